@@ -40,6 +40,8 @@ type (
 
 	// EdgeStackConfig represent an Edge stack config
 	EdgeStackConfig struct {
+		// Version is the version of the stack the configuration belongs to, zero when the server does not send it
+		Version             int
 		Name                string
 		FileContent         string
 		RegistryCredentials []RegistryCredentials
@@ -47,6 +49,94 @@ type (
 		Namespace    string
 		PrePullImage bool
 		RePullImage  bool
+		// AdoptProjectName is the name of an existing compose project or swarm stack that
+		// should be taken over instead of deploying a new one. Keep empty to disable adoption.
+		AdoptProjectName string
+		// EngineType is the engine the stack is deployed to (docker-standalone, docker-swarm, kubernetes, nomad or helm).
+		// Keep empty to use the engine of the agent.
+		EngineType string
+		// NoPullOnDeploy deploys the stack without pulling its images again once they have been pre-pulled
+		NoPullOnDeploy bool
+		// EnvFiles holds the content of the files referenced by the env_file entries of a compose file,
+		// keyed by their path relative to the compose file
+		EnvFiles map[string]string
+		// NodeSelector holds the labels a device must have for the stack to be deployed on it
+		NodeSelector map[string]string
+		// SecretFiles holds the content of the files backing the file secrets of a compose file,
+		// keyed by their path relative to the compose file
+		SecretFiles map[string]string
+		// RetryPolicy overrides the retry backoff policy of the agent for the stack when it is set
+		RetryPolicy *EdgeStackRetryPolicy
+		// OverrideFiles holds the compose files applied on top of the stack file, in order,
+		// like with docker compose -f docker-compose.yml -f override.yml
+		OverrideFiles []EdgeStackFile
+		// EnvVars holds the variables interpolated in the stack file, which lets a stack shared by several
+		// devices be configured per device
+		EnvVars map[string]string
+		// Profiles holds the compose profiles enabled on the device, which lets a stack shared by several
+		// devices deploy different subsets of its services
+		Profiles []string
+		// RemoveOrphans removes the containers of the services removed from the stack file when the stack is updated
+		RemoveOrphans bool
+		// ReconcilePolicy defines how the drift of the deployed stack is handled when its resources are removed
+		// from the environment: ignored when empty, reported ("report") or repaired by a deployment ("redeploy")
+		ReconcilePolicy string
+		// ImagePrune overrides the image prune policy of the agent for the deployments of the stack: disabled,
+		// dangling, unused or dry-run, the policy of the agent applies when it is empty
+		ImagePrune string
+		// HelmChart is the chart installed by a stack deployed with the helm engine, the stack file then holds
+		// the values of the release
+		HelmChart *HelmChart
+		// Kustomization is set when the stack file of a Kubernetes stack is a kustomization.yaml, the resources and
+		// the overlays it references are provided by the archive of the stack folder
+		Kustomization bool
+		// RegistryMirrors maps a source registry host to the mirror host the images of the stack are pulled
+		// from, e.g. docker.io=mirror.local:5000. The mappings are applied over the image mirrors of the agent
+		// so that the air-gapped devices deploy the same stack files as the connected ones.
+		RegistryMirrors map[string]string
+		// HasArchive is set when the stack comes with a tar.gz archive of its folder, holding the files referenced
+		// relatively by the stack file such as the configs, the build contexts or the bind mounted assets
+		HasArchive bool
+		// DeploymentWindows holds the periods during which the updates of the stack are deployed,
+		// keep empty to deploy them at any time
+		DeploymentWindows []EdgeStackDeploymentWindow
+	}
+
+	// EdgeStackDeploymentWindow represents a recurring period during which the updates of an Edge stack are deployed
+	EdgeStackDeploymentWindow struct {
+		// Cron is the cron expression of the opening of the window, e.g. "0 2 * * *" for every day at 2am,
+		// evaluated in the time zone of the device
+		Cron string
+		// Duration is the duration of the window in minutes
+		Duration int
+	}
+
+	// HelmChart represents the Helm chart of an Edge stack
+	HelmChart struct {
+		// Chart is the chart reference, e.g. nginx with a Repository, bitnami/nginx for a local repository
+		// or oci://registry.example.com/charts/nginx
+		Chart string
+		// Repository is the URL of the chart repository, keep empty when Chart is a complete reference
+		Repository string
+		// Version is the version of the chart, keep empty for the latest version
+		Version string
+	}
+
+	// EdgeStackFile represents a file provided with an Edge stack
+	EdgeStackFile struct {
+		// Name is the path of the file relative to the stack file
+		Name    string
+		Content string
+	}
+
+	// EdgeStackRetryPolicy represents the backoff applied between the failed pull attempts of an Edge stack
+	EdgeStackRetryPolicy struct {
+		// InitialInterval is the delay before the first retry in seconds, it doubles with each retry
+		InitialInterval int
+		// MaxInterval caps the delay between two retries in seconds
+		MaxInterval int
+		// MaxRetries is the number of retries after which the stack is reported in error
+		MaxRetries int
 	}
 
 	// EdgeJobStatus represents an Edge job status
@@ -92,6 +182,8 @@ type (
 		EdgeInactivityTimeout string
 		EdgeInsecurePoll      bool
 		EdgeTunnel            bool
+		EdgeClientConcurrency int
+		EdgeRegistrySocket    string
 		LogLevel              string
 		LogMode               string
 		HealthCheck           bool
@@ -100,6 +192,97 @@ type (
 		SSLCACert             string
 		UpdateID              int
 		CertRetryInterval     time.Duration
+		// EdgeStackImageMirrors maps a source registry host to the mirror host used to pull its images
+		EdgeStackImageMirrors             map[string]string
+		EdgeStackImageMirrorFallback      bool
+		EdgeStackMQTTBrokerURL            string
+		EdgeStackMQTTTopic                string
+		EdgeStackFolderCleanup            string
+		EdgeStackFolderCleanupAllow       []string
+		EdgeStackFolderCleanupDeny        []string
+		EdgeStackSharedFilesPath          string
+		EdgeStackMinDeployerVersions      map[string]string
+		EdgeStackOTLPEndpoint             string
+		EdgeStackDeleteConcurrency        int
+		EdgeStackStripComposeVersion      bool
+		EdgeStackHealthMonitorInterval    time.Duration
+		EdgeStackPostReconcileHook        string
+		EdgeStackPostReconcileHookTimeout time.Duration
+		EdgeStackCheckImageDiskSpace      bool
+		EdgeStackImageStorePath           string
+		EdgeStackEventHistoryPerStack     int
+		EdgeStackEventHistoryTotal        int
+		EdgeStackEventHistoryFile         string
+		EdgeStackEventHistoryFileMaxSize  int64
+		EdgeStackAdmissionEndpoint        string
+		EdgeStackAdmissionTimeout         time.Duration
+		EdgeStackAdmissionFailOpen        bool
+		EdgeStackNormalizeLineEndings     bool
+		EdgeStackNetworkDriver            string
+		EdgeStackNetworkDriverOpts        map[string]string
+		EdgeStackDeployAfterDelete        string
+		EdgeStackKubernetesResourcePrefix string
+		EdgeStackKubernetesResourceLabels map[string]string
+		EdgeStackLazyPull                 bool
+		EdgeStackRemoveUnknownStacks      bool
+		EdgeStackOperationConcurrency     int
+		EdgeStackFilesPath                string
+		EdgeStackCoalesceVersions         bool
+		EdgeStackMapResourceLimits        bool
+		EdgeStackDeployDiff               string
+		EdgeStackImagePrune               string
+		EdgeStackRemoveRenamedStacks      bool
+		EdgeStackTransformConcurrency     int
+		EdgeStackCredentialHelperFallback bool
+		EdgeStackAtomicWrites             bool
+		EdgeStackCheckBindMounts          bool
+		EdgeStackRetryStatusInterval      time.Duration
+		EdgeStackEnvFiles                 string
+		EdgeStackEmptyStack               string
+		EdgeStackEngineAssetsPaths        map[string]string
+		EdgeStackNodeLabels               map[string]string
+		EdgeStackReconcileTimeout         time.Duration
+		EdgeStackAnonymousPullFirst       bool
+		EdgeStackRemovePreviousNamespace  bool
+		EdgeStackWarmupImages             []string
+		EdgeStackWarmupKnownStacks        bool
+		EdgeStackQueuePositionInterval    time.Duration
+		EdgeStackSecretFiles              string
+		EdgeStackEngineWorkers            bool
+		EdgeStackVersionMismatch          string
+		EdgeStackNoEngine                 string
+		EdgeStackIndex                    bool
+		EdgeStackOutputLimit              int
+		EdgeStackPartialPoll              int
+		EdgeStackWorkers                  int
+		EdgeStackRetryBackoff             time.Duration
+		EdgeStackRetryBackoffMax          time.Duration
+		EdgeStackRetryMaxRetries          int
+		EdgeStackValidate                 bool
+		EdgeStackRollback                 bool
+		EdgeStackHealthCheckTimeout       time.Duration
+		EdgeStackDeployLogs               int
+		EdgeStackArchiveMaxSize           int64
+		EdgeStackRedeployWebhook          bool
+		EdgeStackWindowBypass             bool
+		EdgeStackProgress                 bool
+		EdgeStackDiskQuota                int64
+		EdgeStackPullBandwidthLimit       int64
+		EdgeStackPrePullWorkers           int
+		EdgeStackDriftCheckInterval       time.Duration
+		EdgeStackRemovePurge              bool
+		EdgeStackRolloutTimeout           time.Duration
+		EdgeStackRegistryCredentialsTTL   time.Duration
+		EdgeStackImageVerifyKeys          []string
+		// OptionSources holds the source of each option (default, env or flag), indexed by environment variable
+		OptionSources                   map[string]string
+		NomadProxyDialTimeout           time.Duration
+		NomadProxyTLSHandshakeTimeout   time.Duration
+		NomadProxyResponseHeaderTimeout time.Duration
+		NomadProxyIdleConnTimeout       time.Duration
+		NomadProxyMaxIdleConns          int
+		NomadProxyRetries               int
+		NomadProxyUnreachableCache      time.Duration
 	}
 
 	NomadConfig struct {
@@ -109,6 +292,21 @@ type (
 		NomadCACert     string
 		NomadClientCert string
 		NomadClientKey  string
+		// NomadDialTimeout is the maximum duration of the connection to the Nomad API
+		NomadDialTimeout time.Duration
+		// NomadTLSHandshakeTimeout is the maximum duration of the TLS handshake with the Nomad API
+		NomadTLSHandshakeTimeout time.Duration
+		// NomadResponseHeaderTimeout is the maximum duration to wait for the response headers of the Nomad API
+		NomadResponseHeaderTimeout time.Duration
+		// NomadIdleConnTimeout is the duration after which an idle connection to the Nomad API is closed
+		NomadIdleConnTimeout time.Duration
+		// NomadMaxIdleConns is the maximum number of idle connections kept to the Nomad API
+		NomadMaxIdleConns int
+		// NomadRetries is the number of times an idempotent request is retried when the Nomad API cannot be reached
+		NomadRetries int
+		// NomadUnreachableCache is the duration the Nomad server is reported unreachable without being dialed
+		// again after a connection failure
+		NomadUnreachableCache time.Duration
 	}
 
 	// PciDevice is the representation of a physical pci device on a host
@@ -180,20 +378,111 @@ type (
 		Deploy(ctx context.Context, name string, filePaths []string, options DeployOptions) error
 		Remove(ctx context.Context, name string, filePaths []string, options RemoveOptions) error
 		Pull(ctx context.Context, name string, filePaths []string) error
+		// Version returns the version of the tool used by the deployer
+		Version(ctx context.Context) (string, error)
+		// Status returns the state of the containers, tasks or pods of a deployed stack
+		Status(ctx context.Context, name string, filePaths []string, options StatusOptions) (ServiceStates, error)
+		// Validate verifies the files of a stack without deploying it, the returned error holds the parser error
+		Validate(ctx context.Context, name string, filePaths []string, options DeployOptions) error
+	}
+
+	// DiffDeployer is implemented by the deployers able to compute the changes a deployment would apply
+	DiffDeployer interface {
+		// Diff returns a human readable description of the changes the deployment of a stack would apply,
+		// it is empty when the deployment would not change anything
+		Diff(ctx context.Context, name string, filePaths []string, options DeployOptions) (string, error)
+	}
+
+	// BuildDeployer is implemented by the deployers able to build the images of the services declaring a build section
+	BuildDeployer interface {
+		// Build builds the images of the services of a stack from their build context
+		Build(ctx context.Context, name string, filePaths []string, options BuildOptions) error
+	}
+
+	// RestartDeployer is implemented by the deployers able to restart a single service of a deployed stack
+	RestartDeployer interface {
+		// Restart restarts the replicas of a service of a stack, without deploying the stack again
+		Restart(ctx context.Context, name string, filePaths []string, options RestartOptions) error
+	}
+
+	// ImageVerifier verifies the signatures of the images of the stacks before they are pulled
+	ImageVerifier interface {
+		// Verify returns an error when the image is not signed or when none of its signatures is valid
+		Verify(ctx context.Context, image string) error
+	}
+
+	// ServiceStates summarizes the state of the containers, tasks or pods of a deployed stack
+	ServiceStates struct {
+		// Total is the number of containers, tasks or pods of the stack
+		Total int `json:"total"`
+		// Running is the number of them that are running
+		Running int `json:"running"`
+		// Exited is the number of them that have exited or failed
+		Exited int `json:"exited"`
+		// Services holds the state of each service, task group or workload of the stack, when the deployer reports it
+		Services []ServiceState `json:"services,omitempty"`
+	}
+
+	// ServiceState represents the state of a service of a deployed stack: a compose service, a swarm service,
+	// a Kubernetes workload, a Nomad task group or a Helm release
+	ServiceState struct {
+		Name string `json:"name"`
+		// Desired is the number of replicas the service should run
+		Desired int `json:"desired"`
+		// Running is the number of replicas that are running, or ready for Kubernetes
+		Running int `json:"running"`
+		// Error is the last error reported for the replicas of the service, empty when none failed
+		Error string `json:"error,omitempty"`
 	}
 
 	DeployerBaseOptions struct {
 		// Namespace to use for kubernetes stack. Keep empty to use the manifest namespace.
 		Namespace string
+		// EnvVars holds the variables interpolated in the stack file, the deployers reading them from the
+		// environment or passing them as job variables use them
+		EnvVars map[string]string
 	}
 
 	DeployOptions struct {
 		DeployerBaseOptions
 		Prune bool
+		// ForceRecreate recreates the containers even if their configuration and image haven't changed
+		ForceRecreate bool
+		// NoPull deploys the stack using the local images only, without pulling them
+		NoPull bool
+		// Profiles holds the compose profiles enabled for the deployment, the other deployers ignore them
+		Profiles []string
+		// RemoveOrphans removes the containers or the services of the stack that are no longer defined by its files
+		RemoveOrphans bool
+		// RolloutTimeout is the maximum duration the Kubernetes deployer waits for the workloads of the manifest to
+		// roll out, the deployment fails once it is exceeded. Zero returns right after the apply.
+		RolloutTimeout time.Duration
+		// HelmChart is the chart installed by the Helm deployer, the other deployers ignore it
+		HelmChart *HelmChart
+	}
+
+	BuildOptions struct {
+		// Pull pulls the base images again even when they are available locally
+		Pull bool
+		// Profiles holds the compose profiles whose services are built
+		Profiles []string
+	}
+
+	RestartOptions struct {
+		DeployerBaseOptions
+		// Service is the restarted service: the compose or swarm service, the Kubernetes workload in the kind/name
+		// form, a Deployment when the kind is omitted, or the Nomad task group
+		Service string
+	}
+
+	StatusOptions struct {
+		DeployerBaseOptions
 	}
 
 	RemoveOptions struct {
 		DeployerBaseOptions
+		// Purge removes the stack along with its history, the Nomad jobs are purged instead of only being stopped
+		Purge bool
 	}
 
 	// KubernetesInfoService is used to retrieve information from a Kubernetes environment.
@@ -247,6 +536,8 @@ const (
 	DefaultAgentSecurityShutdown = "72h"
 	// DefaultEdgeSecurityShutdown is the default time after which the Edge server will shut down if no key is specified
 	DefaultEdgeSecurityShutdown = 15
+	// DefaultRegistryServerAddr is the address the registry credential server listens on when no Unix socket is configured
+	DefaultRegistryServerAddr = "127.0.0.1:9005"
 	// DefaultEdgeServerAddr is the default address used by the Edge server.
 	DefaultEdgeServerAddr = "0.0.0.0"
 	// DefaultEdgeServerPort is the default port exposed by the Edge server.
@@ -268,6 +559,9 @@ const (
 	// HTTPEdgeIdentifierHeaderName is the name of the header used to specify the Docker identifier associated to
 	// an Edge agent.
 	HTTPEdgeIdentifierHeaderName = "X-PortainerAgent-EdgeID"
+	// HTTPEdgeKeyHeaderName is the name of the header containing the Edge key, it authenticates the requests
+	// that are not signed by a Portainer instance such as the Edge stack redeployment webhook.
+	HTTPEdgeKeyHeaderName = "X-PortainerAgent-EdgeKey"
 	// HTTPManagerOperationHeaderName is the name of the header used to specify that
 	// a request must target a manager node.
 	HTTPManagerOperationHeaderName = "X-PortainerAgent-ManagerOperation"
@@ -304,6 +598,14 @@ const (
 	NomadClientCertContentEnvVarName = "NOMAD_CLIENT_CERT_CONTENT"
 	// NomadClientKeyContentEnvVarName represent the name of environment variable of the Nomad client key content
 	NomadClientKeyContentEnvVarName = "NOMAD_CLIENT_KEY_CONTENT"
+	// RegistrySocketEnvVarName represent the name of environment variable of the Unix socket of the registry
+	// credential server, it is read by the credential helper
+	RegistrySocketEnvVarName = "PORTAINER_CREDENTIAL_SOCKET"
+	// RegistryTokenEnvVarName represent the name of environment variable of the token required by the registry
+	// credential server, it is read by the credential helper
+	RegistryTokenEnvVarName = "PORTAINER_CREDENTIAL_TOKEN"
+	// HTTPRegistryTokenHeaderName represent the name of the header containing the token of the registry credential server
+	HTTPRegistryTokenHeaderName = "X-Portainer-Credential-Token"
 	// HTTPResponseAgentApiVersion is the name of the header that will have the
 	// Portainer Agent API Version.
 	HTTPResponseAgentApiVersion = "Portainer-Agent-API-Version"
@@ -339,6 +641,32 @@ const (
 	EdgeStackFilesPath = "/tmp/edge_stacks"
 	// EdgeStackQueueSleepInterval is the interval used to check if there's an Edge stack to deploy
 	EdgeStackQueueSleepInterval = "5s"
+	// DefaultEdgeStackMQTTTopic is the default MQTT topic the Edge stack status transitions are published to
+	DefaultEdgeStackMQTTTopic = "edge/{device}/stack/{id}/status"
+	// DefaultEdgeStackPostReconcileHookTimeout is the default maximum duration of the Edge stack post-reconcile hook
+	DefaultEdgeStackPostReconcileHookTimeout = "30s"
+	// DefaultEdgeStackEventHistoryPerStack is the default number of status transitions retained for each Edge stack
+	DefaultEdgeStackEventHistoryPerStack = "50"
+	// DefaultEdgeStackEventHistoryTotal is the default number of status transitions retained across all the Edge stacks
+	DefaultEdgeStackEventHistoryTotal = "1000"
+	// DefaultEdgeStackEventHistoryFileMaxSize is the default size in bytes after which the Edge stack events log is rotated
+	DefaultEdgeStackEventHistoryFileMaxSize = "1048576"
+	// DefaultEdgeStackAdmissionTimeout is the default maximum duration of an Edge stack admission check
+	DefaultEdgeStackAdmissionTimeout = "10s"
+	// DefaultNomadProxyDialTimeout is the default maximum duration of the connection to the Nomad API
+	DefaultNomadProxyDialTimeout = "10s"
+	// DefaultNomadProxyTLSHandshakeTimeout is the default maximum duration of the TLS handshake with the Nomad API
+	DefaultNomadProxyTLSHandshakeTimeout = "10s"
+	// DefaultNomadProxyResponseHeaderTimeout is the default maximum duration to wait for the response headers of the Nomad API
+	DefaultNomadProxyResponseHeaderTimeout = "30s"
+	// DefaultNomadProxyIdleConnTimeout is the default duration after which an idle connection to the Nomad API is closed
+	DefaultNomadProxyIdleConnTimeout = "90s"
+	// DefaultNomadProxyMaxIdleConns is the default maximum number of idle connections kept to the Nomad API
+	DefaultNomadProxyMaxIdleConns = "10"
+	// DefaultNomadProxyRetries is the default number of retries of the idempotent requests proxied to the Nomad API
+	DefaultNomadProxyRetries = "2"
+	// DefaultNomadProxyUnreachableCache is the default duration the Nomad server is reported unreachable after a connection failure
+	DefaultNomadProxyUnreachableCache = "5s"
 	// KubernetesServiceHost is the environment variable name of the kubernetes API server host
 	KubernetesServiceHost = "KUBERNETES_SERVICE_HOST"
 	// KubernetesServicePortHttps is the environment variable of the kubernetes API server https port
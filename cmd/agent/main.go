@@ -275,6 +275,14 @@ func main() {
 
 		nomadConfig.NomadToken = goos.Getenv(agent.NomadTokenEnvVarName)
 
+		nomadConfig.NomadDialTimeout = options.NomadProxyDialTimeout
+		nomadConfig.NomadTLSHandshakeTimeout = options.NomadProxyTLSHandshakeTimeout
+		nomadConfig.NomadResponseHeaderTimeout = options.NomadProxyResponseHeaderTimeout
+		nomadConfig.NomadIdleConnTimeout = options.NomadProxyIdleConnTimeout
+		nomadConfig.NomadMaxIdleConns = options.NomadProxyMaxIdleConns
+		nomadConfig.NomadRetries = options.NomadProxyRetries
+		nomadConfig.NomadUnreachableCache = options.NomadProxyUnreachableCache
+
 		log.Debug().
 			Str("agent_port", options.AgentServerPort).
 			Str("advertise_address", advertiseAddr).
@@ -362,7 +370,7 @@ func main() {
 	if options.EdgeMode {
 		config.Addr = advertiseAddr
 	}
-	err = registry.StartRegistryServer(edgeManager)
+	err = registry.StartRegistryServer(edgeManager, options.EdgeRegistrySocket)
 	if err != nil {
 		log.Fatal().Err(err).Msg("unable to start registry server")
 	}
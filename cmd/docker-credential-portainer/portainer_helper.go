@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	credentials "github.com/docker/docker-credential-helpers/credentials"
 )
 
+const (
+	// serverURL is the URL of the registry credential server of the agent when it listens on TCP
+	serverURL = "http://localhost:9005"
+	// socketEnvVarName is the name of the environment variable holding the Unix socket of the server, set by the agent
+	socketEnvVarName = "PORTAINER_CREDENTIAL_SOCKET"
+	// tokenEnvVarName is the name of the environment variable holding the token of the server, set by the agent
+	tokenEnvVarName = "PORTAINER_CREDENTIAL_TOKEN"
+	// tokenHeaderName is the name of the header holding the token of the server
+	tokenHeaderName = "X-Portainer-Credential-Token"
+)
+
 type portainerHelper struct {
 }
 
@@ -21,7 +36,7 @@ func (h *portainerHelper) Delete(serverURL string) error {
 }
 
 func (h *portainerHelper) Get(serverURL string) (string, string, error) {
-	f, err := os.OpenFile("/tmp/portainer-credential-helper.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	f, err := os.OpenFile("/tmp/portainer-credential-helper.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
 	}
@@ -34,11 +49,27 @@ func (h *portainerHelper) Get(serverURL string) (string, string, error) {
 
 	log.Printf("GET ServerURL=%s", serverURL)
 
-	resp, err := http.Get("http://localhost:9005/lookup?serverurl=" + serverURL)
+	client, baseURL := lookupClient()
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/lookup?serverurl="+url.QueryEscape(serverURL), nil)
+	if err != nil {
+		log.Printf("Error creating the request: %v", err)
+		return "", "", credentials.NewErrCredentialsNotFound()
+	}
+
+	req.Header.Set(tokenHeaderName, os.Getenv(tokenEnvVarName))
+
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Error getting credentials: %v", err)
 		return "", "", credentials.NewErrCredentialsNotFound()
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error getting credentials: unexpected status %s", resp.Status)
+		return "", "", credentials.NewErrCredentialsNotFound()
+	}
 
 	var c credentials.Credentials
 
@@ -58,3 +89,23 @@ func (h *portainerHelper) Get(serverURL string) (string, string, error) {
 func (h *portainerHelper) List() (map[string]string, error) {
 	return nil, nil
 }
+
+// lookupClient returns the client reaching the registry credential server along with its base URL, through the Unix
+// socket set by the agent when there is one
+func lookupClient() (*http.Client, string) {
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	socketPath := os.Getenv(socketEnvVarName)
+	if socketPath == "" {
+		return client, serverURL
+	}
+
+	client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return client, "http://unix"
+}
@@ -2,6 +2,10 @@ package docker
 
 import (
 	"context"
+	"sort"
+	"strings"
+
+	"github.com/portainer/agent"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -36,3 +40,53 @@ func ContainerDelete(name string, opts types.ContainerRemoveOptions) error {
 		return cli.ContainerRemove(context.Background(), name, opts)
 	})
 }
+
+// GetServiceStates counts the running and exited containers of a list of containers, in total and per compose or
+// swarm service. The status of the last container of a service that failed is reported as its error.
+func GetServiceStates(containers []types.Container) agent.ServiceStates {
+	states := agent.ServiceStates{Total: len(containers)}
+	services := map[string]*agent.ServiceState{}
+
+	for _, container := range containers {
+		name := container.Labels["com.docker.compose.service"]
+		if name == "" {
+			name = container.Labels["com.docker.swarm.service.name"]
+		}
+
+		service := services[name]
+		if service == nil && name != "" {
+			service = &agent.ServiceState{Name: name}
+			services[name] = service
+		}
+
+		if service == nil {
+			service = &agent.ServiceState{}
+		}
+
+		service.Desired++
+
+		switch container.State {
+		case "running":
+			states.Running++
+			service.Running++
+		case "exited", "dead":
+			states.Exited++
+		}
+
+		failed := container.State == "dead" || container.State == "restarting" ||
+			(container.State == "exited" && !strings.HasPrefix(container.Status, "Exited (0)"))
+		if failed {
+			service.Error = container.Status
+		}
+	}
+
+	for _, service := range services {
+		states.Services = append(states.Services, *service)
+	}
+
+	sort.Slice(states.Services, func(i, j int) bool {
+		return states.Services[i].Name < states.Services[j].Name
+	})
+
+	return states
+}
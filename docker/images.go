@@ -2,10 +2,18 @@ package docker
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/portainer/agent"
+	"github.com/rs/zerolog/log"
 )
 
 func ImageDelete(name string, opts types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
@@ -17,3 +25,309 @@ func ImageDelete(name string, opts types.ImageRemoveOptions) ([]types.ImageDelet
 
 	return cli.ImageRemove(context.Background(), name, opts)
 }
+
+// ImageExists returns true when the image is present in the local image store
+func ImageExists(name string) (bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	_, _, err = cli.ImageInspectWithRaw(context.Background(), name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ImageID returns the ID of a local image
+func ImageID(name string) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	image, _, err := cli.ImageInspectWithRaw(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+
+	return image.ID, nil
+}
+
+// GetRootDir returns the root directory of the Docker engine, where the images are stored
+func GetRootDir() (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	info, err := cli.Info(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	return info.DockerRootDir, nil
+}
+
+// ImageRepoDigests returns the repository digests of a local image, they identify the registries the image was pulled from
+func ImageRepoDigests(name string) ([]string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	image, _, err := cli.ImageInspectWithRaw(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return image.RepoDigests, nil
+}
+
+// ImageStore describes the storage of the images of the Docker engine
+type ImageStore struct {
+	// Driver is the storage driver, or the snapshotter when the containerd image store is used
+	Driver string
+	// Containerd is true when the images are stored by containerd instead of the classic graph drivers
+	Containerd bool
+}
+
+// GetImageStore returns the image store configured on the Docker engine
+func GetImageStore() (ImageStore, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return ImageStore{}, err
+	}
+	defer cli.Close()
+
+	info, err := cli.Info(context.Background())
+	if err != nil {
+		return ImageStore{}, err
+	}
+
+	store := ImageStore{Driver: info.Driver}
+
+	for _, status := range info.DriverStatus {
+		if status[0] == "driver-type" && status[1] == "io.containerd.snapshotter.v1" {
+			store.Containerd = true
+		}
+	}
+
+	return store, nil
+}
+
+// PruneDanglingImages removes the dangling images and returns the reclaimed space
+func PruneDanglingImages() (uint64, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return 0, err
+	}
+	defer cli.Close()
+
+	report, err := cli.ImagesPrune(context.Background(), filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		return 0, err
+	}
+
+	return report.SpaceReclaimed, nil
+}
+
+// RemoveUnusedImages removes the images that are not used by any container, including the stopped ones, among the
+// images for which prunable returns true. It returns the size of the removed images, which can exceed the reclaimed
+// space when they share layers, along with their tags or their ID when they have none. An image that cannot be
+// removed is skipped. When dryRun is set, the images are returned without being removed.
+func RemoveUnusedImages(prunable func(id string, repoTags []string) bool, dryRun bool) (uint64, []string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cli.Close()
+
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	used := map[string]bool{}
+	for _, container := range containers {
+		used[container.ImageID] = true
+	}
+
+	images, err := cli.ImageList(context.Background(), types.ImageListOptions{})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reclaimed := uint64(0)
+	removed := []string{}
+	for _, image := range images {
+		if used[image.ID] || !prunable(image.ID, image.RepoTags) {
+			continue
+		}
+
+		if !dryRun {
+			_, err := cli.ImageRemove(context.Background(), image.ID, types.ImageRemoveOptions{PruneChildren: true})
+			if err != nil {
+				log.Debug().Err(err).Str("image", image.ID).Msg("unable to remove the unused image")
+
+				continue
+			}
+		}
+
+		reclaimed += uint64(image.Size)
+
+		if len(image.RepoTags) > 0 {
+			removed = append(removed, image.RepoTags...)
+		} else {
+			removed = append(removed, image.ID)
+		}
+	}
+
+	return reclaimed, removed, nil
+}
+
+// PullProgress is the progress of an image pull, summed over the layers of the image
+type PullProgress struct {
+	Layers       int
+	LayersPulled int
+	// Bytes is the size of the layers being downloaded, it grows as the downloads of the layers start
+	Bytes       int64
+	BytesPulled int64
+}
+
+// pullLayer is the download state of a layer of an image pull
+type pullLayer struct {
+	current int64
+	total   int64
+	pulled  bool
+}
+
+// ImagePull pulls an image with the given registry credentials, instead of relying on the credential helper
+// configured on the Docker engine. Empty credentials pull the image anonymously.
+func ImagePull(ctx context.Context, name string, auth types.AuthConfig) error {
+	return ImagePullWithProgress(ctx, name, auth, 0, nil)
+}
+
+// ImagePullWithProgress pulls an image like ImagePull, progress is called, when it is set, each time the Docker
+// engine reports the progress of a layer. When bandwidthLimit is positive, the progress stream is consumed at the pace
+// of bandwidthLimit bytes of layers downloaded per second, which holds the downloads of the engine back to roughly
+// that rate.
+func ImagePullWithProgress(ctx context.Context, name string, auth types.AuthConfig, bandwidthLimit int64, progress func(PullProgress)) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(agent.SupportedDockerAPIVersion))
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	options := types.ImagePullOptions{}
+
+	if auth.Username != "" {
+		encodedAuth, err := json.Marshal(auth)
+		if err != nil {
+			return err
+		}
+
+		options.RegistryAuth = base64.URLEncoding.EncodeToString(encodedAuth)
+	}
+
+	reader, err := cli.ImagePull(ctx, name, options)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	start := time.Now()
+	layers := map[string]*pullLayer{}
+	layerOrder := []string{}
+
+	// the pull errors are reported in the progress stream
+	decoder := json.NewDecoder(reader)
+	for {
+		var message struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+			Error string `json:"error"`
+		}
+
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+
+		// the messages without a layer identifier, or naming the pulled tag, carry no progress
+		if message.ID == "" || strings.HasPrefix(message.Status, "Pulling from") {
+			continue
+		}
+
+		layer, ok := layers[message.ID]
+		if !ok {
+			layer = &pullLayer{}
+			layers[message.ID] = layer
+			layerOrder = append(layerOrder, message.ID)
+		}
+
+		switch message.Status {
+		case "Downloading":
+			layer.current = message.ProgressDetail.Current
+			layer.total = message.ProgressDetail.Total
+		case "Download complete":
+			layer.current = layer.total
+		case "Pull complete", "Already exists":
+			layer.current = layer.total
+			layer.pulled = true
+		}
+
+		current := PullProgress{Layers: len(layerOrder)}
+		for _, id := range layerOrder {
+			current.Bytes += layers[id].total
+			current.BytesPulled += layers[id].current
+
+			if layers[id].pulled {
+				current.LayersPulled++
+			}
+		}
+
+		if progress != nil {
+			progress(current)
+		}
+
+		if bandwidthLimit <= 0 || message.Status != "Downloading" {
+			continue
+		}
+
+		wait := time.Duration(float64(current.BytesPulled)/float64(bandwidthLimit)*float64(time.Second)) - time.Since(start)
+		if wait <= 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"io"
 	"net/http"
 	"time"
 
@@ -13,7 +14,13 @@ type PortainerClient interface {
 	GetEnvironmentID() (portainer.EndpointID, error)
 	GetEnvironmentStatus(flags ...string) (*PollStatusResponse, error)
 	GetEdgeStackConfig(edgeStackID int) (*agent.EdgeStackConfig, error)
-	SetEdgeStackStatus(edgeStackID int, edgeStackStatus portainer.EdgeStackStatusType, error string) error
+	GetEdgeStackArchive(edgeStackID int) (io.ReadCloser, error)
+	// GetEdgeStackRegistryCredentials fetches the registry credentials of a stack again, so that the short-lived
+	// registry tokens are refreshed
+	GetEdgeStackRegistryCredentials(edgeStackID int) ([]agent.RegistryCredentials, error)
+	SetEdgeStackStatus(edgeStackID int, edgeStackStatus portainer.EdgeStackStatusType, error string, services *agent.ServiceStates) error
+	SetEdgeStackStatusWithLogs(edgeStackID int, edgeStackStatus portainer.EdgeStackStatusType, error string, services *agent.ServiceStates, logs string) error
+	SetEdgeStackProgress(edgeStackID int, progress EdgeStackProgress) error
 	DeleteEdgeStackStatus(edgeStackID int) error
 	SetEdgeJobStatus(edgeJobStatus agent.EdgeJobStatus) error
 	SetTimeout(t time.Duration)
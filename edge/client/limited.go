@@ -0,0 +1,121 @@
+package client
+
+import (
+	"io"
+	"sync"
+
+	"github.com/portainer/agent"
+	portainer "github.com/portainer/portainer/api"
+)
+
+// limitedClient bounds the number of calls to the Portainer API running at the same time
+type limitedClient struct {
+	PortainerClient
+	slots chan struct{}
+}
+
+// NewLimitedClient returns a PortainerClient running at most limit calls at the same time,
+// the calls beyond the limit wait for a running one to complete. A zero limit returns the client unchanged.
+func NewLimitedClient(cli PortainerClient, limit int) PortainerClient {
+	if limit <= 0 {
+		return cli
+	}
+
+	return &limitedClient{
+		PortainerClient: cli,
+		slots:           make(chan struct{}, limit),
+	}
+}
+
+func (client *limitedClient) acquire() func() {
+	client.slots <- struct{}{}
+
+	return func() { <-client.slots }
+}
+
+func (client *limitedClient) GetEnvironmentID() (portainer.EndpointID, error) {
+	defer client.acquire()()
+
+	return client.PortainerClient.GetEnvironmentID()
+}
+
+func (client *limitedClient) GetEnvironmentStatus(flags ...string) (*PollStatusResponse, error) {
+	defer client.acquire()()
+
+	return client.PortainerClient.GetEnvironmentStatus(flags...)
+}
+
+func (client *limitedClient) GetEdgeStackConfig(edgeStackID int) (*agent.EdgeStackConfig, error) {
+	defer client.acquire()()
+
+	return client.PortainerClient.GetEdgeStackConfig(edgeStackID)
+}
+
+func (client *limitedClient) GetEdgeStackRegistryCredentials(edgeStackID int) ([]agent.RegistryCredentials, error) {
+	defer client.acquire()()
+
+	return client.PortainerClient.GetEdgeStackRegistryCredentials(edgeStackID)
+}
+
+// GetEdgeStackArchive holds the slot until the archive is closed
+func (client *limitedClient) GetEdgeStackArchive(edgeStackID int) (io.ReadCloser, error) {
+	release := client.acquire()
+
+	archive, err := client.PortainerClient.GetEdgeStackArchive(edgeStackID)
+	if err != nil {
+		release()
+
+		return nil, err
+	}
+
+	return &releasingReadCloser{ReadCloser: archive, release: release}, nil
+}
+
+func (client *limitedClient) SetEdgeStackStatus(edgeStackID int, edgeStackStatus portainer.EdgeStackStatusType, error string, services *agent.ServiceStates) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.SetEdgeStackStatus(edgeStackID, edgeStackStatus, error, services)
+}
+
+func (client *limitedClient) SetEdgeStackStatusWithLogs(edgeStackID int, edgeStackStatus portainer.EdgeStackStatusType, error string, services *agent.ServiceStates, logs string) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.SetEdgeStackStatusWithLogs(edgeStackID, edgeStackStatus, error, services, logs)
+}
+
+func (client *limitedClient) SetEdgeStackProgress(edgeStackID int, progress EdgeStackProgress) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.SetEdgeStackProgress(edgeStackID, progress)
+}
+
+func (client *limitedClient) DeleteEdgeStackStatus(edgeStackID int) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.DeleteEdgeStackStatus(edgeStackID)
+}
+
+func (client *limitedClient) SetEdgeJobStatus(edgeJobStatus agent.EdgeJobStatus) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.SetEdgeJobStatus(edgeJobStatus)
+}
+
+func (client *limitedClient) EnqueueLogCollectionForStack(logCmd LogCommandData) error {
+	defer client.acquire()()
+
+	return client.PortainerClient.EnqueueLogCollectionForStack(logCmd)
+}
+
+// releasingReadCloser releases a slot once it is closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.once.Do(r.release)
+
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/portainer/agent"
+)
+
+// countingClient tracks the calls running at the same time, they complete once release is closed
+type countingClient struct {
+	PortainerClient
+	release     chan struct{}
+	mu          sync.Mutex
+	running     int
+	maxParallel int
+}
+
+func (c *countingClient) GetEdgeStackConfig(edgeStackID int) (*agent.EdgeStackConfig, error) {
+	c.mu.Lock()
+	c.running++
+	if c.running > c.maxParallel {
+		c.maxParallel = c.running
+	}
+	c.mu.Unlock()
+
+	<-c.release
+
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+
+	return &agent.EdgeStackConfig{}, nil
+}
+
+func (c *countingClient) GetEdgeStackArchive(edgeStackID int) (io.ReadCloser, error) {
+	if edgeStackID == 0 {
+		return nil, errors.New("no archive")
+	}
+
+	return io.NopCloser(nil), nil
+}
+
+func (c *countingClient) calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.running
+}
+
+func TestLimitedClient(t *testing.T) {
+	cli := &countingClient{release: make(chan struct{})}
+	limited := NewLimitedClient(cli, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			limited.GetEdgeStackConfig(i)
+		}(i)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cli.calls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the other calls would start meanwhile if they were not bounded
+	time.Sleep(50 * time.Millisecond)
+
+	if n := cli.calls(); n != 2 {
+		t.Errorf("expected 2 calls running at the same time, got %d", n)
+	}
+
+	close(cli.release)
+	wg.Wait()
+
+	if cli.maxParallel != 2 {
+		t.Errorf("expected at most 2 calls running at the same time, got %d", cli.maxParallel)
+	}
+}
+
+func TestLimitedClientArchive(t *testing.T) {
+	limited := NewLimitedClient(&countingClient{}, 1).(*limitedClient)
+
+	archive, err := limited.GetEdgeStackArchive(1)
+	if err != nil {
+		t.Fatalf("unable to retrieve the archive: %s", err)
+	}
+
+	if len(limited.slots) != 1 {
+		t.Fatal("expected the slot to be held until the archive is closed")
+	}
+
+	archive.Close()
+	archive.Close()
+
+	if len(limited.slots) != 0 {
+		t.Fatal("expected the slot to be released once the archive is closed")
+	}
+
+	if _, err := limited.GetEdgeStackArchive(0); err == nil || len(limited.slots) != 0 {
+		t.Errorf("expected the slot to be released when the archive retrieval fails, got %v", err)
+	}
+}
+
+func TestLimitedClientUnbounded(t *testing.T) {
+	cli := &countingClient{}
+
+	if limited := NewLimitedClient(cli, 0); limited != cli {
+		t.Error("expected the client to be left unchanged without a limit")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"net/http"
 	"sort"
 	"strconv"
@@ -90,7 +91,15 @@ type snapshot struct {
 
 	StackLogs   []EdgeStackLog                                      `json:"stackLogs,omitempty"`
 	StackStatus map[portainer.EdgeStackID]portainer.EdgeStackStatus `json:"stackStatus,omitempty"`
-	JobsStatus  map[portainer.EdgeJobID]agent.EdgeJobStatus         `json:"jobsStatus:,omitempty"`
+	// StackStatusSequence holds the sequence number of the latest status update of each stack of StackStatus
+	StackStatusSequence map[portainer.EdgeStackID]uint64 `json:"stackStatusSequence,omitempty"`
+	// StackServices holds the state of the containers of the stacks of StackStatus, when known
+	StackServices map[portainer.EdgeStackID]agent.ServiceStates `json:"stackServices,omitempty"`
+	// StackDeploymentLogs holds the tail of the output of the deployments the statuses of StackStatus result from
+	StackDeploymentLogs map[portainer.EdgeStackID]string `json:"stackDeploymentLogs,omitempty"`
+	// StackProgress holds the latest progress of the deployments of the stacks
+	StackProgress map[portainer.EdgeStackID]EdgeStackProgress `json:"stackProgress,omitempty"`
+	JobsStatus    map[portainer.EdgeJobID]agent.EdgeJobStatus `json:"jobsStatus:,omitempty"`
 }
 
 type AsyncResponse struct {
@@ -123,6 +132,44 @@ type EdgeStackData struct {
 	Namespace    string
 	PrePullImage bool
 	RePullImage  bool
+	// AdoptProjectName is the name of an existing compose project or swarm stack to take over
+	AdoptProjectName string
+	// EngineType is the engine the stack is deployed to, keep empty to use the engine of the agent
+	EngineType string
+	// NoPullOnDeploy deploys the stack without pulling its images again once they have been pre-pulled
+	NoPullOnDeploy bool
+	// EnvFiles holds the content of the files referenced by the env_file entries of a compose file
+	EnvFiles map[string]string
+	// NodeSelector holds the labels a device must have for the stack to be deployed on it
+	NodeSelector map[string]string
+	// SecretFiles holds the content of the files backing the file secrets of a compose file
+	SecretFiles map[string]string
+	// RetryPolicy overrides the retry backoff policy of the agent for the stack when it is set
+	RetryPolicy *agent.EdgeStackRetryPolicy
+	// OverrideFiles holds the compose files applied on top of the stack file, in order
+	OverrideFiles []agent.EdgeStackFile
+	// EnvVars holds the variables interpolated in the stack file
+	EnvVars map[string]string
+	// Profiles holds the compose profiles enabled on the device
+	Profiles []string
+	// RemoveOrphans removes the services removed from the stack file when the stack is updated
+	RemoveOrphans bool
+	// ReconcilePolicy defines how the drift of the deployed stack is handled
+	ReconcilePolicy string
+	// ImagePrune overrides the image prune policy of the agent for the deployments of the stack
+	ImagePrune string
+	// HelmChart is the chart installed by a stack deployed with the helm engine
+	HelmChart *agent.HelmChart
+	// Kustomization is set when the stack file of a Kubernetes stack is a kustomization.yaml
+	Kustomization bool
+	// RegistryMirrors maps a source registry host to the mirror host the images of the stack are pulled from
+	RegistryMirrors map[string]string
+	// HasArchive is set when the stack comes with a tar.gz archive of its folder, which holds the files the stack
+	// file references. It is downloaded separately, except in async mode where Archive holds it.
+	HasArchive bool
+	Archive    []byte
+	// DeploymentWindows holds the periods during which the updates of the stack are deployed
+	DeploymentWindows []agent.EdgeStackDeploymentWindow
 }
 
 type EdgeJobData struct {
@@ -281,6 +328,10 @@ func (client *PortainerAsyncClient) GetEnvironmentStatus(flags ...string) (*Poll
 
 		client.nextSnapshotMutex.Lock()
 		payload.Snapshot.StackStatus = client.nextSnapshot.StackStatus
+		payload.Snapshot.StackStatusSequence = client.nextSnapshot.StackStatusSequence
+		payload.Snapshot.StackServices = client.nextSnapshot.StackServices
+		payload.Snapshot.StackDeploymentLogs = client.nextSnapshot.StackDeploymentLogs
+		payload.Snapshot.StackProgress = client.nextSnapshot.StackProgress
 		payload.Snapshot.JobsStatus = client.nextSnapshot.JobsStatus
 		client.nextSnapshotMutex.Unlock()
 	}
@@ -314,6 +365,10 @@ func (client *PortainerAsyncClient) GetEnvironmentStatus(flags ...string) (*Poll
 			client.lastSnapshot.StackStatus[k] = v
 		}
 		client.nextSnapshot.StackStatus = nil
+		client.nextSnapshot.StackStatusSequence = nil
+		client.nextSnapshot.StackServices = nil
+		client.nextSnapshot.StackDeploymentLogs = nil
+		client.nextSnapshot.StackProgress = nil
 
 		client.nextSnapshot.JobsStatus = nil
 
@@ -422,7 +477,22 @@ func (client *PortainerAsyncClient) SetEdgeStackStatus(
 	edgeStackID int,
 	edgeStackStatus portainer.EdgeStackStatusType,
 	error string,
+	services *agent.ServiceStates,
 ) error {
+	return client.SetEdgeStackStatusWithLogs(edgeStackID, edgeStackStatus, error, services, "")
+}
+
+// SetEdgeStackStatusWithLogs updates the status of an Edge stack on the Portainer server
+// along with the logs of the deployment it results from
+func (client *PortainerAsyncClient) SetEdgeStackStatusWithLogs(
+	edgeStackID int,
+	edgeStackStatus portainer.EdgeStackStatusType,
+	error string,
+	services *agent.ServiceStates,
+	logs string,
+) error {
+	reportedStatus, error := portainerStatus(edgeStackStatus, error)
+
 	client.nextSnapshotMutex.Lock()
 	defer client.nextSnapshotMutex.Unlock()
 
@@ -436,11 +506,16 @@ func (client *PortainerAsyncClient) SetEdgeStackStatus(
 	}
 
 	details := &status.Details
-	switch edgeStackStatus {
+	switch reportedStatus {
 	case portainer.EdgeStackStatusOk:
 		details.Ok = true
 	case portainer.EdgeStackStatusError:
 		details.Error = true
+
+		// the statuses of the agent reported as errors, e.g. degraded, describe a stack that is no longer ok
+		if reportedStatus != edgeStackStatus {
+			details.Ok = false
+		}
 	case portainer.EdgeStackStatusAcknowledged:
 		*details = portainer.EdgeStackStatusDetails{
 			Acknowledged: true,
@@ -456,6 +531,39 @@ func (client *PortainerAsyncClient) SetEdgeStackStatus(
 
 	client.nextSnapshot.StackStatus[portainer.EdgeStackID(edgeStackID)] = status
 
+	if client.nextSnapshot.StackStatusSequence == nil {
+		client.nextSnapshot.StackStatusSequence = make(map[portainer.EdgeStackID]uint64)
+	}
+	client.nextSnapshot.StackStatusSequence[portainer.EdgeStackID(edgeStackID)] = stackStatusSequences.next(edgeStackID)
+
+	if services != nil {
+		if client.nextSnapshot.StackServices == nil {
+			client.nextSnapshot.StackServices = make(map[portainer.EdgeStackID]agent.ServiceStates)
+		}
+		client.nextSnapshot.StackServices[portainer.EdgeStackID(edgeStackID)] = *services
+	}
+
+	if logs != "" {
+		if client.nextSnapshot.StackDeploymentLogs == nil {
+			client.nextSnapshot.StackDeploymentLogs = make(map[portainer.EdgeStackID]string)
+		}
+		client.nextSnapshot.StackDeploymentLogs[portainer.EdgeStackID(edgeStackID)] = logs
+	}
+
+	return nil
+}
+
+// SetEdgeStackProgress updates the progress of the deployment of an Edge stack on the Portainer server, only the
+// latest progress of each stack is sent with the next snapshot
+func (client *PortainerAsyncClient) SetEdgeStackProgress(edgeStackID int, progress EdgeStackProgress) error {
+	client.nextSnapshotMutex.Lock()
+	defer client.nextSnapshotMutex.Unlock()
+
+	if client.nextSnapshot.StackProgress == nil {
+		client.nextSnapshot.StackProgress = make(map[portainer.EdgeStackID]EdgeStackProgress)
+	}
+	client.nextSnapshot.StackProgress[portainer.EdgeStackID(edgeStackID)] = progress
+
 	return nil
 }
 
@@ -489,6 +597,16 @@ func (client *PortainerAsyncClient) GetEdgeStackConfig(edgeStackID int) (*agent.
 	return nil, nil // unused in async mode
 }
 
+// GetEdgeStackRegistryCredentials is unused in async mode, the credentials are sent with the stack commands
+func (client *PortainerAsyncClient) GetEdgeStackRegistryCredentials(edgeStackID int) ([]agent.RegistryCredentials, error) {
+	return nil, errors.New("the registry credentials are not refreshed in async mode")
+}
+
+// GetEdgeStackArchive is unused in async mode, the archives are sent with the stack commands
+func (client *PortainerAsyncClient) GetEdgeStackArchive(edgeStackID int) (io.ReadCloser, error) {
+	return nil, errors.New("the Edge stack archives are not downloaded in async mode")
+}
+
 func (client *PortainerAsyncClient) EnqueueLogCollectionForStack(logCmd LogCommandData) error {
 	client.nextSnapshotMutex.Lock()
 	defer client.nextSnapshotMutex.Unlock()
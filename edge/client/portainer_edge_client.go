@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -174,19 +175,82 @@ func (client *PortainerEdgeClient) GetEdgeStackConfig(edgeStackID int) (*agent.E
 	}
 
 	return &agent.EdgeStackConfig{
+		Version:             data.Version,
 		Name:                data.Name,
 		FileContent:         data.StackFileContent,
 		RegistryCredentials: data.RegistryCredentials,
 		Namespace:           data.Namespace,
 		PrePullImage:        data.PrePullImage,
 		RePullImage:         data.RePullImage,
+		AdoptProjectName:    data.AdoptProjectName,
+		EngineType:          data.EngineType,
+		NoPullOnDeploy:      data.NoPullOnDeploy,
+		EnvFiles:            data.EnvFiles,
+		NodeSelector:        data.NodeSelector,
+		SecretFiles:         data.SecretFiles,
+		RetryPolicy:         data.RetryPolicy,
+		OverrideFiles:       data.OverrideFiles,
+		EnvVars:             data.EnvVars,
+		Profiles:            data.Profiles,
+		RemoveOrphans:       data.RemoveOrphans,
+		ReconcilePolicy:     data.ReconcilePolicy,
+		ImagePrune:          data.ImagePrune,
+		HelmChart:           data.HelmChart,
+		Kustomization:       data.Kustomization,
+		RegistryMirrors:     data.RegistryMirrors,
+		HasArchive:          data.HasArchive,
+		DeploymentWindows:   data.DeploymentWindows,
 	}, nil
 }
 
+// GetEdgeStackRegistryCredentials fetches the configuration of an Edge stack again and returns its registry
+// credentials, Portainer issues new tokens for the registries using short-lived ones
+func (client *PortainerEdgeClient) GetEdgeStackRegistryCredentials(edgeStackID int) ([]agent.RegistryCredentials, error) {
+	config, err := client.GetEdgeStackConfig(edgeStackID)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.RegistryCredentials, nil
+}
+
+// GetEdgeStackArchive downloads the tar.gz archive of the folder of an Edge stack, the caller closes it
+func (client *PortainerEdgeClient) GetEdgeStackArchive(edgeStackID int) (io.ReadCloser, error) {
+	requestURL := fmt.Sprintf("%s/api/endpoints/%d/edge/stacks/%d/archive", client.serverAddress, client.getEndpointIDFn(), edgeStackID)
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(agent.HTTPEdgeIdentifierHeaderName, client.edgeID)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		log.Error().Int("response_code", resp.StatusCode).Msg("GetEdgeStackArchive operation failed")
+
+		return nil, errors.New("GetEdgeStackArchive operation failed")
+	}
+
+	return resp.Body, nil
+}
+
 type setEdgeStackStatusPayload struct {
 	Error      string
 	Status     portainer.EdgeStackStatusType
 	EndpointID portainer.EndpointID
+	// Sequence increases with each status update of the stack, it is used to discard the updates received out of order
+	Sequence uint64
+	// Services summarizes the state of the containers of the stack, when known
+	Services *agent.ServiceStates `json:",omitempty"`
+	// Logs holds the tail of the output of the deployment the status results from, when captured
+	Logs string `json:",omitempty"`
 }
 
 // SetEdgeStackStatus updates the status of an Edge stack on the Portainer server
@@ -194,11 +258,29 @@ func (client *PortainerEdgeClient) SetEdgeStackStatus(
 	edgeStackID int,
 	edgeStackStatus portainer.EdgeStackStatusType,
 	error string,
+	services *agent.ServiceStates,
 ) error {
+	return client.SetEdgeStackStatusWithLogs(edgeStackID, edgeStackStatus, error, services, "")
+}
+
+// SetEdgeStackStatusWithLogs updates the status of an Edge stack on the Portainer server
+// along with the logs of the deployment it results from
+func (client *PortainerEdgeClient) SetEdgeStackStatusWithLogs(
+	edgeStackID int,
+	edgeStackStatus portainer.EdgeStackStatusType,
+	error string,
+	services *agent.ServiceStates,
+	logs string,
+) error {
+	edgeStackStatus, error = portainerStatus(edgeStackStatus, error)
+
 	payload := setEdgeStackStatusPayload{
 		Error:      error,
 		Status:     edgeStackStatus,
 		EndpointID: client.getEndpointIDFn(),
+		Sequence:   stackStatusSequences.next(edgeStackID),
+		Services:   services,
+		Logs:       logs,
 	}
 
 	data, err := json.Marshal(payload)
@@ -222,6 +304,10 @@ func (client *PortainerEdgeClient) SetEdgeStackStatus(
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrEdgeStackNotFound
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		log.Error().Int("response_code", resp.StatusCode).Msg("SetEdgeStackStatus operation failed")
 
@@ -231,6 +317,55 @@ func (client *PortainerEdgeClient) SetEdgeStackStatus(
 	return nil
 }
 
+type setEdgeStackProgressPayload struct {
+	EdgeStackProgress
+	EndpointID portainer.EndpointID
+	// Sequence orders the progress updates along with the status updates of the stack
+	Sequence uint64
+}
+
+// SetEdgeStackProgress updates the progress of the deployment of an Edge stack on the Portainer server
+func (client *PortainerEdgeClient) SetEdgeStackProgress(edgeStackID int, progress EdgeStackProgress) error {
+	payload := setEdgeStackProgressPayload{
+		EdgeStackProgress: progress,
+		EndpointID:        client.getEndpointIDFn(),
+		Sequence:          stackStatusSequences.next(edgeStackID),
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	requestURL := fmt.Sprintf("%s/api/edge_stacks/%d/progress", client.serverAddress, edgeStackID)
+
+	req, err := http.NewRequest(http.MethodPut, requestURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(agent.HTTPEdgeIdentifierHeaderName, client.edgeID)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrEdgeStackNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Int("response_code", resp.StatusCode).Msg("SetEdgeStackProgress operation failed")
+
+		return errors.New("SetEdgeStackProgress operation failed")
+	}
+
+	return nil
+}
+
 // DeleteEdgeStackStatus deletes the status of an Edge stack on the Portainer server
 func (client *PortainerEdgeClient) DeleteEdgeStackStatus(edgeStackID int) error {
 	requestURL := fmt.Sprintf("%s/api/edge_stacks/%d/status/%d", client.serverAddress, edgeStackID, client.getEndpointIDFn())
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+)
+
+// Edge stack statuses reported by the agent in addition to the ones defined by Portainer
+const (
+	// EdgeStackStatusDegraded represents a deployed edge stack whose workloads became unhealthy
+	EdgeStackStatusDegraded portainer.EdgeStackStatusType = portainer.EdgeStackStatusImagesPulled + 1 + iota
+	// EdgeStackStatusDeniedByPolicy represents an edge stack whose deployment was denied by the admission policy
+	EdgeStackStatusDeniedByPolicy
+	// EdgeStackStatusDiffReported represents an edge stack whose deployment was not applied, the changes it
+	// would apply are reported instead
+	EdgeStackStatusDiffReported
+	// EdgeStackStatusRetrying represents an edge stack whose images pull failed and is retried, the
+	// status message holds the reason of the retry
+	EdgeStackStatusRetrying
+	// EdgeStackStatusSkipped represents an edge stack that is not deployed because the device does not match
+	// its node selector, the status message holds the labels that did not match
+	EdgeStackStatusSkipped
+	// EdgeStackStatusValidationFailed represents an edge stack that is not deployed because its files were rejected
+	// by the deployer validation, the status message holds the validation error
+	EdgeStackStatusValidationFailed
+	// EdgeStackStatusRolledBack represents an edge stack whose update failed and that was deployed again with its
+	// last version deployed successfully, the status message holds both versions and the deployment error
+	EdgeStackStatusRolledBack
+	// EdgeStackStatusUnhealthy represents an edge stack that was deployed but whose workloads did not become healthy
+	// within the health check timeout, the status message holds the unhealthy workloads
+	EdgeStackStatusUnhealthy
+	// EdgeStackStatusScheduled represents an edge stack whose deployment is deferred until its next deployment
+	// window, the status message holds the opening of that window
+	EdgeStackStatusScheduled
+	// EdgeStackStatusDrifted represents a deployed edge stack whose resources no longer exist on the environment,
+	// e.g. after its containers were removed manually
+	EdgeStackStatusDrifted
+	// EdgeStackStatusImageVerificationFailed represents an edge stack that is not deployed because one of its images
+	// is not signed or has no valid signature, the status message holds the rejected images
+	EdgeStackStatusImageVerificationFailed
+)
+
+// portainerStatus maps the statuses defined by the agent onto the statuses defined by Portainer, which is the only
+// ones the server handles. The agent status is described at the start of the message so that it is not lost.
+func portainerStatus(status portainer.EdgeStackStatusType, message string) (portainer.EdgeStackStatusType, string) {
+	var mapped portainer.EdgeStackStatusType
+	var name string
+
+	switch status {
+	case EdgeStackStatusDegraded:
+		mapped, name = portainer.EdgeStackStatusError, "degraded"
+	case EdgeStackStatusDeniedByPolicy:
+		mapped, name = portainer.EdgeStackStatusError, "denied by policy"
+	case EdgeStackStatusValidationFailed:
+		mapped, name = portainer.EdgeStackStatusError, "validation failed"
+	case EdgeStackStatusRolledBack:
+		mapped, name = portainer.EdgeStackStatusError, "rolled back"
+	case EdgeStackStatusUnhealthy:
+		mapped, name = portainer.EdgeStackStatusError, "deployed but unhealthy"
+	case EdgeStackStatusDrifted:
+		mapped, name = portainer.EdgeStackStatusError, "drifted"
+	case EdgeStackStatusImageVerificationFailed:
+		mapped, name = portainer.EdgeStackStatusError, "image verification failed"
+	case EdgeStackStatusRetrying:
+		mapped, name = portainer.EdgeStackStatusPending, "retrying"
+	case EdgeStackStatusScheduled:
+		mapped, name = portainer.EdgeStackStatusPending, "scheduled"
+	case EdgeStackStatusDiffReported:
+		mapped, name = portainer.EdgeStackStatusOk, "not applied, diff reported"
+	case EdgeStackStatusSkipped:
+		mapped, name = portainer.EdgeStackStatusOk, "skipped"
+	default:
+		return status, message
+	}
+
+	if message == "" {
+		return mapped, name
+	}
+
+	return mapped, name + ": " + message
+}
+
+// ErrEdgeStackNotFound is returned when the status of an edge stack that no longer exists on the Portainer server is updated
+var ErrEdgeStackNotFound = errors.New("edge stack not found")
+
+// statusSequencer assigns a monotonically increasing sequence number to each status update of an edge stack,
+// so that the updates received out of order can be discarded. The sequence numbers are based on the clock
+// so that they keep increasing across restarts of the agent.
+type statusSequencer struct {
+	sequences map[int]uint64
+	mu        sync.Mutex
+}
+
+// stackStatusSequences is shared by the clients so that the sequence numbers keep increasing when the client changes
+var stackStatusSequences = &statusSequencer{sequences: map[int]uint64{}}
+
+// next returns the sequence number of the next status update of a stack
+func (sequencer *statusSequencer) next(edgeStackID int) uint64 {
+	sequencer.mu.Lock()
+	defer sequencer.mu.Unlock()
+
+	sequence := sequencer.sequences[edgeStackID] + 1
+	if now := uint64(time.Now().UnixNano()); now > sequence {
+		sequence = now
+	}
+
+	sequencer.sequences[edgeStackID] = sequence
+
+	return sequence
+}
+
+// EdgeStackProgressPhase is a phase of the deployment of an Edge stack
+type EdgeStackProgressPhase string
+
+// Phases of the deployment of an Edge stack, in the order they happen
+const (
+	// EdgeStackProgressFilesWritten represents a stack whose files were written in its folder
+	EdgeStackProgressFilesWritten EdgeStackProgressPhase = "files_written"
+	// EdgeStackProgressPulling represents a stack whose images are being pulled
+	EdgeStackProgressPulling EdgeStackProgressPhase = "pulling"
+	// EdgeStackProgressBuilding represents a stack whose images are being built from their build context
+	EdgeStackProgressBuilding EdgeStackProgressPhase = "building"
+	// EdgeStackProgressDeploying represents a stack being deployed by its deployer
+	EdgeStackProgressDeploying EdgeStackProgressPhase = "deploying"
+	// EdgeStackProgressHealthChecking represents a deployed stack whose workloads are checked to become healthy
+	EdgeStackProgressHealthChecking EdgeStackProgressPhase = "health_checking"
+)
+
+// EdgeStackProgress represents the progress of the deployment of an Edge stack, between its acknowledgement and
+// its final status
+type EdgeStackProgress struct {
+	// Version is the version of the stack being deployed
+	Version int
+	Phase   EdgeStackProgressPhase
+	// Percent is the completion of the phase, from 0 to 100, it is nil when it is unknown
+	Percent *int `json:",omitempty"`
+	// Pull is the progress of the image being pulled, when the pulling phase reports it
+	Pull *EdgeStackPullProgress `json:",omitempty"`
+}
+
+// EdgeStackPullProgress represents the progress of the pull of an image of an Edge stack
+type EdgeStackPullProgress struct {
+	Image string
+	// ImageIndex is the position of the image among the Images pulled for the stack, starting from 1
+	ImageIndex   int
+	Images       int
+	Layers       int
+	LayersPulled int
+	Bytes        int64
+	BytesPulled  int64
+}
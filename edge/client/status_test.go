@@ -0,0 +1,66 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusSequenceMonotonic(t *testing.T) {
+	sequencer := &statusSequencer{sequences: map[int]uint64{}}
+
+	previous := sequencer.next(1)
+	for i := 0; i < 1000; i++ {
+		sequence := sequencer.next(1)
+		if sequence <= previous {
+			t.Fatalf("expected the sequence to increase, got %d after %d", sequence, previous)
+		}
+
+		previous = sequence
+	}
+
+	// a clock set back, e.g. by a time synchronization, does not make the sequence decrease
+	ahead := uint64(time.Now().Add(time.Hour).UnixNano())
+	sequencer.sequences[2] = ahead
+
+	if sequence := sequencer.next(2); sequence != ahead+1 {
+		t.Errorf("expected the sequence to keep increasing from %d, got %d", ahead, sequence)
+	}
+
+	if sequence := sequencer.next(3); sequence >= ahead {
+		t.Errorf("expected the sequences of the stacks to be independent, got %d", sequence)
+	}
+}
+
+func TestStatusSequenceConcurrent(t *testing.T) {
+	sequencer := &statusSequencer{sequences: map[int]uint64{}}
+
+	const updates = 100
+
+	var wg sync.WaitGroup
+	results := make(chan uint64, 4*updates)
+
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < updates; i++ {
+				results <- sequencer.next(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	seen := map[uint64]bool{}
+	for sequence := range results {
+		if seen[sequence] {
+			t.Fatalf("expected each status update to get its own sequence number, got %d twice", sequence)
+		}
+
+		seen[sequence] = true
+	}
+}
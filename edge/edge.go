@@ -10,6 +10,7 @@ import (
 	"github.com/portainer/agent/edge/client"
 	"github.com/portainer/agent/edge/scheduler"
 	"github.com/portainer/agent/edge/stack"
+	"github.com/portainer/agent/exec"
 	portainer "github.com/portainer/portainer/api"
 
 	"github.com/rs/zerolog/log"
@@ -101,10 +102,98 @@ func (manager *Manager) Start() error {
 		manager.agentOptions.UpdateID,
 		client.BuildHTTPClient(10, manager.agentOptions),
 	)
+	portainerClient = client.NewLimitedClient(portainerClient, manager.agentOptions.EdgeClientConcurrency)
+
+	exec.SetOutputLimit(manager.agentOptions.EdgeStackOutputLimit)
 
 	manager.stackManager = stack.NewStackManager(
 		portainerClient,
 		manager.agentOptions.AssetsPath,
+		stack.StackManagerConfig{
+			ImageMirrors:             manager.agentOptions.EdgeStackImageMirrors,
+			ImageMirrorFallback:      manager.agentOptions.EdgeStackImageMirrorFallback,
+			EdgeID:                   manager.agentOptions.EdgeID,
+			MQTTBrokerURL:            manager.agentOptions.EdgeStackMQTTBrokerURL,
+			MQTTTopicTemplate:        manager.agentOptions.EdgeStackMQTTTopic,
+			FolderCleanupMode:        manager.agentOptions.EdgeStackFolderCleanup,
+			FolderCleanupAllow:       manager.agentOptions.EdgeStackFolderCleanupAllow,
+			FolderCleanupDeny:        manager.agentOptions.EdgeStackFolderCleanupDeny,
+			SharedFilesPath:          manager.agentOptions.EdgeStackSharedFilesPath,
+			MinDeployerVersions:      manager.agentOptions.EdgeStackMinDeployerVersions,
+			OTLPEndpoint:             manager.agentOptions.EdgeStackOTLPEndpoint,
+			DeleteConcurrency:        manager.agentOptions.EdgeStackDeleteConcurrency,
+			StripComposeVersion:      manager.agentOptions.EdgeStackStripComposeVersion,
+			HealthMonitorInterval:    manager.agentOptions.EdgeStackHealthMonitorInterval,
+			PostReconcileHook:        manager.agentOptions.EdgeStackPostReconcileHook,
+			PostReconcileHookTimeout: manager.agentOptions.EdgeStackPostReconcileHookTimeout,
+			CheckImageDiskSpace:      manager.agentOptions.EdgeStackCheckImageDiskSpace,
+			ImageStorePath:           manager.agentOptions.EdgeStackImageStorePath,
+			EventHistoryPerStack:     manager.agentOptions.EdgeStackEventHistoryPerStack,
+			EventHistoryTotal:        manager.agentOptions.EdgeStackEventHistoryTotal,
+			EventHistoryFile:         manager.agentOptions.EdgeStackEventHistoryFile,
+			EventHistoryFileMaxSize:  manager.agentOptions.EdgeStackEventHistoryFileMaxSize,
+			AdmissionEndpoint:        manager.agentOptions.EdgeStackAdmissionEndpoint,
+			AdmissionTimeout:         manager.agentOptions.EdgeStackAdmissionTimeout,
+			AdmissionFailOpen:        manager.agentOptions.EdgeStackAdmissionFailOpen,
+			NormalizeLineEndings:     manager.agentOptions.EdgeStackNormalizeLineEndings,
+			NetworkDriver:            manager.agentOptions.EdgeStackNetworkDriver,
+			NetworkDriverOpts:        manager.agentOptions.EdgeStackNetworkDriverOpts,
+			DeployAfterDelete:        manager.agentOptions.EdgeStackDeployAfterDelete,
+			KubernetesResourcePrefix: manager.agentOptions.EdgeStackKubernetesResourcePrefix,
+			KubernetesResourceLabels: manager.agentOptions.EdgeStackKubernetesResourceLabels,
+			LazyPull:                 manager.agentOptions.EdgeStackLazyPull,
+			RemoveUnknownStacks:      manager.agentOptions.EdgeStackRemoveUnknownStacks,
+			OperationConcurrency:     manager.agentOptions.EdgeStackOperationConcurrency,
+			StackFilesPath:           manager.agentOptions.EdgeStackFilesPath,
+			CoalesceVersions:         manager.agentOptions.EdgeStackCoalesceVersions,
+			MapResourceLimits:        manager.agentOptions.EdgeStackMapResourceLimits,
+			DeployDiff:               manager.agentOptions.EdgeStackDeployDiff,
+			ImagePrune:               manager.agentOptions.EdgeStackImagePrune,
+			RemoveRenamedStacks:      manager.agentOptions.EdgeStackRemoveRenamedStacks,
+			TransformConcurrency:     manager.agentOptions.EdgeStackTransformConcurrency,
+			CredentialHelperFallback: manager.agentOptions.EdgeStackCredentialHelperFallback,
+			AtomicWrites:             manager.agentOptions.EdgeStackAtomicWrites,
+			CheckBindMounts:          manager.agentOptions.EdgeStackCheckBindMounts,
+			RetryStatusInterval:      manager.agentOptions.EdgeStackRetryStatusInterval,
+			EnvFiles:                 manager.agentOptions.EdgeStackEnvFiles,
+			EmptyStack:               manager.agentOptions.EdgeStackEmptyStack,
+			EngineAssetsPaths:        manager.agentOptions.EdgeStackEngineAssetsPaths,
+			NodeLabels:               manager.agentOptions.EdgeStackNodeLabels,
+			ReconcileTimeout:         manager.agentOptions.EdgeStackReconcileTimeout,
+			AnonymousPullFirst:       manager.agentOptions.EdgeStackAnonymousPullFirst,
+			RemovePreviousNamespace:  manager.agentOptions.EdgeStackRemovePreviousNamespace,
+			WarmupImages:             manager.agentOptions.EdgeStackWarmupImages,
+			WarmupKnownStacks:        manager.agentOptions.EdgeStackWarmupKnownStacks,
+			QueuePositionInterval:    manager.agentOptions.EdgeStackQueuePositionInterval,
+			SecretFiles:              manager.agentOptions.EdgeStackSecretFiles,
+			EngineWorkers:            manager.agentOptions.EdgeStackEngineWorkers,
+			VersionMismatch:          manager.agentOptions.EdgeStackVersionMismatch,
+			NoEngine:                 manager.agentOptions.EdgeStackNoEngine,
+			StackIndex:               manager.agentOptions.EdgeStackIndex,
+			OutputLimit:              manager.agentOptions.EdgeStackOutputLimit,
+			PartialPollThreshold:     manager.agentOptions.EdgeStackPartialPoll,
+			Workers:                  manager.agentOptions.EdgeStackWorkers,
+			RetryBackoffInitial:      manager.agentOptions.EdgeStackRetryBackoff,
+			RetryBackoffMax:          manager.agentOptions.EdgeStackRetryBackoffMax,
+			RetryBackoffMaxRetries:   manager.agentOptions.EdgeStackRetryMaxRetries,
+			ValidateStacks:           manager.agentOptions.EdgeStackValidate,
+			Rollback:                 manager.agentOptions.EdgeStackRollback,
+			HealthCheckTimeout:       manager.agentOptions.EdgeStackHealthCheckTimeout,
+			DeployLogs:               manager.agentOptions.EdgeStackDeployLogs,
+			ArchiveMaxSize:           manager.agentOptions.EdgeStackArchiveMaxSize,
+			RedeployWebhook:          manager.agentOptions.EdgeStackRedeployWebhook,
+			DeploymentWindowBypass:   manager.agentOptions.EdgeStackWindowBypass,
+			ReportProgress:           manager.agentOptions.EdgeStackProgress,
+			DiskQuota:                manager.agentOptions.EdgeStackDiskQuota,
+			PullBandwidthLimit:       manager.agentOptions.EdgeStackPullBandwidthLimit,
+			PrePullWorkers:           manager.agentOptions.EdgeStackPrePullWorkers,
+			DriftCheckInterval:       manager.agentOptions.EdgeStackDriftCheckInterval,
+			RemovePurge:              manager.agentOptions.EdgeStackRemovePurge,
+			RolloutTimeout:           manager.agentOptions.EdgeStackRolloutTimeout,
+			RegistryCredentialsTTL:   manager.agentOptions.EdgeStackRegistryCredentialsTTL,
+			ImageVerifyKeys:          manager.agentOptions.EdgeStackImageVerifyKeys,
+			OptionSources:            manager.agentOptions.OptionSources,
+		},
 	)
 
 	manager.logsManager = scheduler.NewLogsManager(portainerClient)
@@ -0,0 +1,302 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	dockerHubDomain        = "docker.io"
+	dockerHubRegistryHost  = "registry-1.docker.io"
+	defaultRequestTimeout  = 30 * time.Second
+	maxManifestSize        = 4 << 20
+	manifestAcceptedHeader = mediaTypeManifestList + ", " + mediaTypeOCIIndex + ", " + mediaTypeManifest + ", " + mediaTypeOCIManifest
+)
+
+// Credentials are the credentials used to authenticate against a registry, keep empty for anonymous access
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// Client retrieves image manifests from registries implementing the Docker Registry HTTP API V2
+type Client struct {
+	httpClient *http.Client
+	// AnonymousFirst requests an anonymous token from the registries using token authentication, the credentials
+	// are only exchanged for a token when the anonymous one is refused
+	AnonymousFirst bool
+}
+
+// NewClient returns a pointer to a new Client
+func NewClient() *Client {
+	return &Client{
+		httpClient: &http.Client{Timeout: defaultRequestTimeout},
+	}
+}
+
+// ImageSize returns the sum of the compressed layer sizes of an image for the platform of the agent.
+// It is an approximation of the space required to pull the image.
+func (client *Client) ImageSize(ctx context.Context, image string, credentials Credentials) (int64, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid image reference")
+	}
+	named = reference.TagNameOnly(named)
+
+	host := reference.Domain(named)
+	if host == dockerHubDomain {
+		host = dockerHubRegistryHost
+	}
+
+	ref := ""
+	if canonical, ok := named.(reference.Canonical); ok {
+		ref = canonical.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+
+	repository := reference.Path(named)
+
+	m, err := client.getManifest(ctx, host, repository, ref, credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.MediaType == mediaTypeManifestList || m.MediaType == mediaTypeOCIIndex || len(m.Manifests) > 0 {
+		platformDigest := ""
+		for _, candidate := range m.Manifests {
+			if candidate.Platform != nil && candidate.Platform.OS == "linux" && candidate.Platform.Architecture == runtime.GOARCH {
+				platformDigest = candidate.Digest
+				break
+			}
+		}
+
+		if platformDigest == "" {
+			return 0, fmt.Errorf("no manifest found for the linux/%s platform", runtime.GOARCH)
+		}
+
+		m, err = client.getManifest(ctx, host, repository, platformDigest, credentials)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	size := m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+
+	return size, nil
+}
+
+func (client *Client) getManifest(ctx context.Context, host, repository, ref string, credentials Credentials) (*manifest, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repository, ref)
+
+	resp, err := client.get(ctx, manifestURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		resp, err = client.getAuthorized(ctx, manifestURL, challenge, credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry %s responded with status %d for %s:%s", host, resp.StatusCode, repository, ref)
+	}
+
+	var m manifest
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&m)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode the image manifest")
+	}
+
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return &m, nil
+}
+
+func (client *Client) get(ctx context.Context, url, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", manifestAcceptedHeader)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return client.httpClient.Do(req)
+}
+
+// getAuthorized executes a request answering the authentication challenge of the registry
+func (client *Client) getAuthorized(ctx context.Context, url, challenge string, credentials Credentials) (*http.Response, error) {
+	scheme, _ := parseChallenge(challenge)
+
+	if client.AnonymousFirst && credentials.Username != "" && strings.EqualFold(scheme, "bearer") {
+		authorization, err := client.authorize(ctx, challenge, Credentials{})
+		if err == nil {
+			resp, err := client.get(ctx, url, authorization)
+			if err != nil {
+				return nil, err
+			}
+
+			if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+				return resp, nil
+			}
+
+			resp.Body.Close()
+		}
+	}
+
+	authorization, err := client.authorize(ctx, challenge, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.get(ctx, url, authorization)
+}
+
+// authorize returns the authorization header answering a registry authentication challenge.
+// Both the basic and the bearer token authentication schemes are supported.
+func (client *Client) authorize(ctx context.Context, challenge string, credentials Credentials) (string, error) {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if credentials.Username == "" {
+			return "", errors.New("the registry requires credentials")
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return "", errors.New("invalid registry authentication realm")
+		}
+
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		if params["scope"] != "" {
+			query.Set("scope", params["scope"])
+		}
+		realm.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if credentials.Username != "" {
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+
+		resp, err := client.httpClient.Do(req)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to retrieve the registry token")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry token endpoint responded with status %d", resp.StatusCode)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&token)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to decode the registry token")
+		}
+
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+
+		return "Bearer " + token.Token, nil
+	}
+
+	return "", fmt.Errorf("unsupported registry authentication scheme %q", scheme)
+}
+
+// parseChallenge parses a WWW-Authenticate header such as Bearer realm="...",service="...",scope="..."
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+
+	for rest != "" {
+		var pair string
+
+		rest = strings.TrimLeft(rest, " ,")
+
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+
+			pair = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			pair, rest, _ = strings.Cut(value, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = pair
+	}
+
+	return scheme, params
+}
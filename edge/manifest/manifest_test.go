@@ -0,0 +1,129 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// newTestRegistry returns a registry serving a manifest list for the app:1.0 image, the token and
+// manifest requests are only accepted with the credentials of the user
+func newTestRegistry(t *testing.T) (*httptest.Server, *Client) {
+	var server *httptest.Server
+
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "user" || password != "secret" || r.URL.Query().Get("scope") != "repository:app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+		case r.Header.Get("Authorization") != "Bearer token":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/app/manifests/1.0":
+			w.Header().Set("Content-Type", mediaTypeManifestList)
+			w.Write([]byte(`{"manifests": [
+				{"digest": "sha256:other", "platform": {"os": "windows", "architecture": "` + runtime.GOARCH + `"}},
+				{"digest": "sha256:linux", "platform": {"os": "linux", "architecture": "` + runtime.GOARCH + `"}}
+			]}`))
+		case r.URL.Path == "/v2/app/manifests/sha256:linux":
+			w.Header().Set("Content-Type", mediaTypeManifest)
+			w.Write([]byte(`{"config": {"size": 100}, "layers": [{"size": 1000}, {"size": 2000}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient()
+	client.httpClient = server.Client()
+
+	return server, client
+}
+
+func TestImageSize(t *testing.T) {
+	server, client := newTestRegistry(t)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	size, err := client.ImageSize(context.Background(), host+"/app:1.0", Credentials{Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unable to retrieve the image size: %s", err)
+	}
+
+	if size != 3100 {
+		t.Errorf("expected the size of the config and the layers of the platform manifest, got %d", size)
+	}
+
+	_, err = client.ImageSize(context.Background(), host+"/app:1.0", Credentials{Username: "user", Password: "wrong"})
+	if err == nil {
+		t.Error("expected the size retrieval to fail with invalid credentials")
+	}
+
+	_, err = client.ImageSize(context.Background(), host+"/app:2.0", Credentials{Username: "user", Password: "secret"})
+	if err == nil {
+		t.Error("expected the size retrieval of an unknown tag to fail")
+	}
+}
+
+func TestAuthorizeBasic(t *testing.T) {
+	client := NewClient()
+
+	authorization, err := client.authorize(context.Background(), `Basic realm="registry"`, Credentials{Username: "user", Password: "secret"})
+	if err != nil || authorization != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("unexpected basic authorization %q: %v", authorization, err)
+	}
+
+	if _, err := client.authorize(context.Background(), `Basic realm="registry"`, Credentials{}); err == nil {
+		t.Error("expected the basic authentication to require credentials")
+	}
+
+	if _, err := client.authorize(context.Background(), `Digest realm="registry"`, Credentials{}); err == nil {
+		t.Error("expected an unsupported scheme to be refused")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		scheme    string
+		params    map[string]string
+	}{
+		{
+			challenge: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/nginx:pull"},
+		},
+		{
+			challenge: `Bearer realm="https://auth/token", scope="repository:a:pull,push"`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "https://auth/token", "scope": "repository:a:pull,push"},
+		},
+		{
+			challenge: `Basic realm=registry,charset=UTF-8`,
+			scheme:    "Basic",
+			params:    map[string]string{"realm": "registry", "charset": "UTF-8"},
+		},
+		{
+			challenge: `Bearer realm="unterminated`,
+			scheme:    "Bearer",
+			params:    map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		scheme, params := parseChallenge(test.challenge)
+
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("unexpected parsing of %s: %s %v", test.challenge, scheme, params)
+		}
+	}
+}
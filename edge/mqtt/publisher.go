@@ -0,0 +1,269 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	packetConnect    = 0x10
+	packetConnack    = 0x20
+	packetPublish    = 0x30
+	packetDisconnect = 0xE0
+
+	protocolLevel = 4 // MQTT 3.1.1
+
+	flagCleanSession = 0x02
+	flagPassword     = 0x40
+	flagUsername     = 0x80
+
+	defaultTimeout = 5 * time.Second
+
+	// disconnectCheckTimeout is how long a publish waits for the broker to report a closed connection
+	disconnectCheckTimeout = time.Millisecond
+)
+
+// Publisher is a minimal MQTT 3.1.1 client that publishes messages with QoS 0.
+// The connection to the broker is established lazily and re-established after a failure.
+type Publisher struct {
+	address  string
+	useTLS   bool
+	clientID string
+	username string
+	password string
+	timeout  time.Duration
+	conn     net.Conn
+	mu       sync.Mutex
+}
+
+// NewPublisher returns a pointer to a new Publisher for the specified broker URL.
+// Supported schemes are tcp:// and mqtt:// for plain connections, ssl://, tls:// and mqtts:// for TLS connections.
+// Credentials can be specified in the user information of the URL.
+func NewPublisher(brokerURL, clientID string) (*Publisher, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid MQTT broker URL")
+	}
+
+	publisher := &Publisher{
+		address:  u.Host,
+		clientID: clientID,
+		timeout:  defaultTimeout,
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			publisher.address = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "ssl", "tls", "mqtts":
+		publisher.useTLS = true
+		if u.Port() == "" {
+			publisher.address = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker URL scheme %q", u.Scheme)
+	}
+
+	if u.User != nil {
+		publisher.username = u.User.Username()
+		publisher.password, _ = u.User.Password()
+	}
+
+	return publisher, nil
+}
+
+// Publish sends the payload to the specified topic. The message is sent again once over a new connection when
+// it cannot be written to the current one, e.g. after the broker dropped it.
+func (publisher *Publisher) Publish(topic string, payload []byte) error {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	if publisher.conn != nil && publisher.brokerDisconnected() {
+		publisher.closeConnection()
+	}
+
+	var body bytes.Buffer
+	writeString(&body, topic)
+	body.Write(payload)
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if publisher.conn == nil {
+			err = publisher.connect()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = publisher.writePacket(packetPublish, body.Bytes())
+		if err == nil {
+			return nil
+		}
+
+		publisher.closeConnection()
+	}
+
+	return errors.Wrap(err, "unable to publish MQTT message")
+}
+
+// Close disconnects from the broker
+func (publisher *Publisher) Close() error {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	if publisher.conn == nil {
+		return nil
+	}
+
+	publisher.writePacket(packetDisconnect, nil)
+
+	return publisher.closeConnection()
+}
+
+func (publisher *Publisher) connect() error {
+	dialer := &net.Dialer{Timeout: publisher.timeout}
+
+	var conn net.Conn
+	var err error
+	if publisher.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", publisher.address, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", publisher.address)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to the MQTT broker")
+	}
+
+	publisher.conn = conn
+
+	var body bytes.Buffer
+	writeString(&body, "MQTT")
+	body.WriteByte(protocolLevel)
+
+	flags := byte(flagCleanSession)
+	if publisher.username != "" {
+		flags |= flagUsername
+	}
+	if publisher.password != "" {
+		flags |= flagPassword
+	}
+	body.WriteByte(flags)
+
+	// keep alive disabled, the connection is re-established when the broker closed it or a write fails
+	binary.Write(&body, binary.BigEndian, uint16(0))
+
+	writeString(&body, publisher.clientID)
+	if publisher.username != "" {
+		writeString(&body, publisher.username)
+	}
+	if publisher.password != "" {
+		writeString(&body, publisher.password)
+	}
+
+	err = publisher.writePacket(packetConnect, body.Bytes())
+	if err != nil {
+		publisher.closeConnection()
+
+		return errors.Wrap(err, "unable to send MQTT connect packet")
+	}
+
+	err = publisher.readConnack()
+	if err != nil {
+		publisher.closeConnection()
+
+		return err
+	}
+
+	return nil
+}
+
+// brokerDisconnected returns true when the broker closed the connection. The broker never sends anything once the
+// connection is acknowledged with QoS 0 messages, so a read returning anything else than a timeout means that the
+// connection is gone and that a message written to it would be lost. The deadline must be in the future, a read
+// past its deadline times out without reporting the closed connection.
+func (publisher *Publisher) brokerDisconnected() bool {
+	publisher.conn.SetReadDeadline(time.Now().Add(disconnectCheckTimeout))
+	defer publisher.conn.SetReadDeadline(time.Time{})
+
+	_, err := publisher.conn.Read(make([]byte, 1))
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+
+	return true
+}
+
+func (publisher *Publisher) readConnack() error {
+	publisher.conn.SetReadDeadline(time.Now().Add(publisher.timeout))
+	defer publisher.conn.SetReadDeadline(time.Time{})
+
+	response := make([]byte, 4)
+	_, err := io.ReadFull(bufio.NewReader(publisher.conn), response)
+	if err != nil {
+		return errors.Wrap(err, "unable to read MQTT connect acknowledgement")
+	}
+
+	if response[0] != packetConnack {
+		return fmt.Errorf("unexpected MQTT packet type 0x%x", response[0])
+	}
+
+	if response[3] != 0 {
+		return fmt.Errorf("MQTT connection refused by the broker (return code %d)", response[3])
+	}
+
+	return nil
+}
+
+func (publisher *Publisher) writePacket(packetType byte, body []byte) error {
+	var packet bytes.Buffer
+	packet.WriteByte(packetType)
+	writeRemainingLength(&packet, len(body))
+	packet.Write(body)
+
+	publisher.conn.SetWriteDeadline(time.Now().Add(publisher.timeout))
+
+	_, err := publisher.conn.Write(packet.Bytes())
+
+	return err
+}
+
+func (publisher *Publisher) closeConnection() error {
+	err := publisher.conn.Close()
+	publisher.conn = nil
+
+	return err
+}
+
+func writeString(buf *bytes.Buffer, value string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+func writeRemainingLength(buf *bytes.Buffer, length int) {
+	for {
+		encoded := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			encoded |= 0x80
+		}
+
+		buf.WriteByte(encoded)
+
+		if length == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testBroker accepts MQTT connections on the loopback interface, acknowledges them and reports the packets it reads
+type testBroker struct {
+	listener net.Listener
+	packets  chan []byte
+	closed   chan struct{}
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	broker := &testBroker{listener: listener, packets: make(chan []byte, 10), closed: make(chan struct{}, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	return broker
+}
+
+// serve handles the next connection, it is closed once publishes PUBLISH packets were read
+func (broker *testBroker) serve(t *testing.T, publishes int) {
+	go func() {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			conn.Close()
+			broker.closed <- struct{}{}
+		}()
+
+		connect, err := readPacket(conn)
+		if err != nil {
+			t.Errorf("unable to read the connect packet: %s", err)
+			return
+		}
+		broker.packets <- connect
+
+		conn.Write([]byte{packetConnack, 2, 0, 0})
+
+		for i := 0; i < publishes; i++ {
+			publish, err := readPacket(conn)
+			if err != nil {
+				return
+			}
+			broker.packets <- publish
+		}
+	}()
+}
+
+func (broker *testBroker) next(t *testing.T) []byte {
+	select {
+	case packet := <-broker.packets:
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet received by the broker")
+	}
+
+	return nil
+}
+
+// readPacket reads a packet with a remaining length below 128 bytes
+func readPacket(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, header[1])
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, body...), nil
+}
+
+func TestPublisherPackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		connect []byte
+	}{
+		{
+			name:    "anonymous",
+			url:     "tcp://%s",
+			connect: []byte{packetConnect, 16, 0, 4, 'M', 'Q', 'T', 'T', protocolLevel, flagCleanSession, 0, 0, 0, 4, 'e', 'd', 'g', 'e'},
+		},
+		{
+			name: "username and password",
+			url:  "mqtt://user:pass@%s",
+			connect: []byte{packetConnect, 28, 0, 4, 'M', 'Q', 'T', 'T', protocolLevel, flagCleanSession | flagUsername | flagPassword, 0, 0,
+				0, 4, 'e', 'd', 'g', 'e', 0, 4, 'u', 's', 'e', 'r', 0, 4, 'p', 'a', 's', 's'},
+		},
+		{
+			name:    "username only",
+			url:     "tcp://user@%s",
+			connect: []byte{packetConnect, 22, 0, 4, 'M', 'Q', 'T', 'T', protocolLevel, flagCleanSession | flagUsername, 0, 0, 0, 4, 'e', 'd', 'g', 'e', 0, 4, 'u', 's', 'e', 'r'},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newTestBroker(t)
+			broker.serve(t, 1)
+
+			publisher, err := NewPublisher(fmt.Sprintf(test.url, broker.listener.Addr().String()), "edge")
+			if err != nil {
+				t.Fatalf("unable to create the publisher: %s", err)
+			}
+			defer publisher.Close()
+
+			err = publisher.Publish("stacks/1", []byte("ok"))
+			if err != nil {
+				t.Fatalf("unable to publish: %s", err)
+			}
+
+			if connect := broker.next(t); !bytes.Equal(connect, test.connect) {
+				t.Errorf("unexpected connect packet\n got: %v\nwant: %v", connect, test.connect)
+			}
+
+			expected := []byte{packetPublish, 12, 0, 8, 's', 't', 'a', 'c', 'k', 's', '/', '1', 'o', 'k'}
+			if publish := broker.next(t); !bytes.Equal(publish, expected) {
+				t.Errorf("unexpected publish packet\n got: %v\nwant: %v", publish, expected)
+			}
+		})
+	}
+}
+
+func TestPublisherReconnect(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.serve(t, 1)
+
+	publisher, err := NewPublisher("tcp://"+broker.listener.Addr().String(), "edge")
+	if err != nil {
+		t.Fatalf("unable to create the publisher: %s", err)
+	}
+	defer publisher.Close()
+
+	err = publisher.Publish("stacks/1", []byte("first"))
+	if err != nil {
+		t.Fatalf("unable to publish: %s", err)
+	}
+
+	broker.next(t)
+	broker.next(t)
+
+	select {
+	case <-broker.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the broker did not drop the connection")
+	}
+
+	broker.serve(t, 1)
+
+	err = publisher.Publish("stacks/1", []byte("second"))
+	if err != nil {
+		t.Fatalf("unable to publish after the broker dropped the connection: %s", err)
+	}
+
+	if connect := broker.next(t); connect[0] != packetConnect {
+		t.Errorf("expected the publisher to connect again, got the packet type 0x%x", connect[0])
+	}
+
+	if publish := broker.next(t); !bytes.HasSuffix(publish, []byte("second")) {
+		t.Errorf("expected the message to be published over the new connection, got %v", publish)
+	}
+}
+
+func TestPublisherRetriesFailedWrite(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.serve(t, 1)
+
+	publisher, err := NewPublisher("tcp://"+broker.listener.Addr().String(), "edge")
+	if err != nil {
+		t.Fatalf("unable to create the publisher: %s", err)
+	}
+	defer publisher.Close()
+
+	client, server := net.Pipe()
+	server.Close()
+	publisher.conn = &writeFailingConn{Conn: client}
+
+	err = publisher.Publish("stacks/1", []byte("retried"))
+	if err != nil {
+		t.Fatalf("expected the message to be published again over a new connection, got %s", err)
+	}
+
+	broker.next(t)
+
+	if publish := broker.next(t); !bytes.HasSuffix(publish, []byte("retried")) {
+		t.Errorf("expected the message to be published over the new connection, got %v", publish)
+	}
+}
+
+// writeFailingConn looks connected to the broker but fails every write
+type writeFailingConn struct {
+	net.Conn
+}
+
+func (conn *writeFailingConn) Read(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+
+	return 0, timeoutError{}
+}
+
+func (conn *writeFailingConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *writeFailingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
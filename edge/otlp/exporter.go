@@ -0,0 +1,199 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tracesPath     = "/v1/traces"
+	defaultTimeout = 10 * time.Second
+
+	spanKindInternal = 1
+
+	statusCodeOk    = 1
+	statusCodeError = 2
+)
+
+// Span represents a finished OpenTelemetry span
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	// Error is the error message of a failed span, a span without error is reported with an Ok status
+	Error string
+}
+
+// Exporter sends spans to an OpenTelemetry collector using the OTLP/HTTP protocol with JSON encoding
+type Exporter struct {
+	url         string
+	serviceName string
+	scopeName   string
+	client      *http.Client
+}
+
+// NewExporter returns a pointer to a new Exporter for the specified collector endpoint (e.g. http://collector:4318).
+// The /v1/traces path is appended to the endpoint when missing.
+func NewExporter(endpoint, serviceName, scopeName string) (*Exporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("unsupported OTLP endpoint %q, expected an http:// or https:// URL", endpoint)
+	}
+
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, tracesPath) {
+		url += tracesPath
+	}
+
+	return &Exporter{
+		url:         url,
+		serviceName: serviceName,
+		scopeName:   scopeName,
+		client:      &http.Client{Timeout: defaultTimeout},
+	}, nil
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type spanStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            spanStatus `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource struct {
+		Attributes []keyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type scopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+// Export sends the spans to the collector
+func (exporter *Exporter) Export(spans []Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	scope := scopeSpans{}
+	scope.Scope.Name = exporter.scopeName
+
+	for _, span := range spans {
+		scope.Spans = append(scope.Spans, encodeSpan(span))
+	}
+
+	resource := resourceSpans{ScopeSpans: []scopeSpans{scope}}
+	resource.Resource.Attributes = encodeAttributes(map[string]interface{}{"service.name": exporter.serviceName})
+
+	payload, err := json.Marshal(exportRequest{ResourceSpans: []resourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := exporter.client.Post(exporter.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "unable to send the spans to the OTLP endpoint")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func encodeSpan(span Span) jsonSpan {
+	encoded := jsonSpan{
+		TraceID:           hex.EncodeToString(span.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.SpanID[:]),
+		Name:              span.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        encodeAttributes(span.Attributes),
+		Status:            spanStatus{Code: statusCodeOk},
+	}
+
+	if span.ParentSpanID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+	}
+
+	if span.Error != "" {
+		encoded.Status = spanStatus{Code: statusCodeError, Message: span.Error}
+	}
+
+	return encoded
+}
+
+func encodeAttributes(attributes map[string]interface{}) []keyValue {
+	encoded := []keyValue{}
+
+	for key, value := range attributes {
+		attribute := keyValue{Key: key}
+
+		switch v := value.(type) {
+		case string:
+			attribute.Value.StringValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			attribute.Value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			attribute.Value.IntValue = &s
+		case bool:
+			attribute.Value.BoolValue = &v
+		case float64:
+			attribute.Value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			attribute.Value.StringValue = &s
+		}
+
+		encoded = append(encoded, attribute)
+	}
+
+	return encoded
+}
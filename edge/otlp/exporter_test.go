@@ -0,0 +1,149 @@
+package otlp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	var request map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tracesPath {
+			t.Errorf("expected the spans to be sent to %s, got %s", tracesPath, r.URL.Path)
+		}
+
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("expected a JSON payload, got %s", contentType)
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			t.Errorf("unable to decode the payload: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	exporter, err := NewExporter(server.URL+"/", "portainer-agent", "edge-stacks")
+	if err != nil {
+		t.Fatalf("unable to create the exporter: %s", err)
+	}
+
+	start := time.Unix(1700000000, 123456789)
+
+	err = exporter.Export([]Span{
+		{
+			TraceID:    [16]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+			SpanID:     [8]byte{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8},
+			Name:       "deploy",
+			Start:      start,
+			End:        start.Add(1500 * time.Millisecond),
+			Attributes: map[string]interface{}{"stack.name": "web", "stack.version": 3, "stack.size": int64(42), "stack.prune": true, "stack.ratio": 0.5},
+		},
+		{
+			TraceID:      [16]byte{0x01},
+			SpanID:       [8]byte{0xb1},
+			ParentSpanID: [8]byte{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8},
+			Name:         "pull",
+			Start:        start,
+			End:          start,
+			Error:        "unable to pull the image",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to export the spans: %s", err)
+	}
+
+	resource := request["resourceSpans"].([]interface{})[0].(map[string]interface{})
+
+	expectedResource := []interface{}{map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "portainer-agent"}}}
+	if attributes := resource["resource"].(map[string]interface{})["attributes"]; !reflect.DeepEqual(attributes, expectedResource) {
+		t.Errorf("unexpected resource attributes %v", attributes)
+	}
+
+	scope := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	if name := scope["scope"].(map[string]interface{})["name"]; name != "edge-stacks" {
+		t.Errorf("expected the edge-stacks scope, got %v", name)
+	}
+
+	spans := scope["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	deploy := spans[0].(map[string]interface{})
+
+	for key, expected := range map[string]interface{}{
+		"traceId":           "0102030405060708090a0b0c0d0e0f10",
+		"spanId":            "a1a2a3a4a5a6a7a8",
+		"name":              "deploy",
+		"kind":              float64(spanKindInternal),
+		"startTimeUnixNano": "1700000000123456789",
+		"endTimeUnixNano":   "1700000001623456789",
+		"status":            map[string]interface{}{"code": float64(statusCodeOk)},
+	} {
+		if !reflect.DeepEqual(deploy[key], expected) {
+			t.Errorf("expected the %s of the span to be %v, got %v", key, expected, deploy[key])
+		}
+	}
+
+	if _, ok := deploy["parentSpanId"]; ok {
+		t.Error("expected no parent for a root span")
+	}
+
+	attributes := map[string]interface{}{}
+	for _, attribute := range deploy["attributes"].([]interface{}) {
+		attribute := attribute.(map[string]interface{})
+		attributes[attribute["key"].(string)] = attribute["value"]
+	}
+
+	expectedAttributes := map[string]interface{}{
+		"stack.name":    map[string]interface{}{"stringValue": "web"},
+		"stack.version": map[string]interface{}{"intValue": "3"},
+		"stack.size":    map[string]interface{}{"intValue": "42"},
+		"stack.prune":   map[string]interface{}{"boolValue": true},
+		"stack.ratio":   map[string]interface{}{"doubleValue": 0.5},
+	}
+	if !reflect.DeepEqual(attributes, expectedAttributes) {
+		t.Errorf("unexpected span attributes\n got: %v\nwant: %v", attributes, expectedAttributes)
+	}
+
+	pull := spans[1].(map[string]interface{})
+
+	if pull["parentSpanId"] != "a1a2a3a4a5a6a7a8" {
+		t.Errorf("expected the parent of the span to be reported, got %v", pull["parentSpanId"])
+	}
+
+	expectedStatus := map[string]interface{}{"code": float64(statusCodeError), "message": "unable to pull the image"}
+	if !reflect.DeepEqual(pull["status"], expectedStatus) {
+		t.Errorf("expected an error status, got %v", pull["status"])
+	}
+}
+
+func TestExportErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter, err := NewExporter(server.URL, "portainer-agent", "edge-stacks")
+	if err != nil {
+		t.Fatalf("unable to create the exporter: %s", err)
+	}
+
+	err = exporter.Export([]Span{{Name: "deploy"}})
+	if err == nil {
+		t.Error("expected an error when the collector rejects the spans")
+	}
+}
+
+func TestNewExporterScheme(t *testing.T) {
+	_, err := NewExporter("grpc://collector:4317", "portainer-agent", "edge-stacks")
+	if err == nil {
+		t.Error("expected an error for an endpoint that is not an HTTP URL")
+	}
+}
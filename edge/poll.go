@@ -1,6 +1,7 @@
 package edge
 
 import (
+	"context"
 	"encoding/base64"
 	"math/rand"
 	"strconv"
@@ -321,7 +322,7 @@ func (service *PollService) processStacks(pollResponseStacks []client.StackStatu
 		stacks[s.ID] = s.Version
 	}
 
-	err := service.edgeStackManager.UpdateStacksStatus(stacks)
+	err := service.edgeStackManager.UpdateStacksStatus(context.Background(), stacks)
 	if err != nil {
 		log.Error().Err(err).Msg("an error occurred during stack management")
 
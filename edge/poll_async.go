@@ -255,7 +255,7 @@ func (service *PollService) processStackCommand(ctx context.Context, command cli
 		return newOperationError("schedule", command.Operation, errors.New("operation not supported"))
 	}
 
-	return service.portainerClient.SetEdgeStackStatus(stackData.ID, responseStatus, errorMessage)
+	return service.portainerClient.SetEdgeStackStatus(stackData.ID, responseStatus, errorMessage, nil)
 }
 
 func (service *PollService) processScheduleCommand(command client.AsyncCommand) error {
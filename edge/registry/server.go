@@ -1,10 +1,15 @@
 package registry
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -21,18 +26,37 @@ import (
 type Handler struct {
 	*mux.Router
 	EdgeManager *edge.Manager
+	token       string
 }
 
-func NewEdgeRegistryHandler(edgeManager *edge.Manager) *Handler {
+// NewEdgeRegistryHandler returns the handler of the registry credential server, the requests must hold the token
+// in the HTTPRegistryTokenHeaderName header
+func NewEdgeRegistryHandler(edgeManager *edge.Manager, token string) *Handler {
 	h := &Handler{
 		Router:      mux.NewRouter(),
 		EdgeManager: edgeManager,
+		token:       token,
 	}
 
-	h.Handle("/lookup", httperror.LoggerHandler(h.LookupHandler)).Methods(http.MethodGet)
+	h.Handle("/lookup", h.authenticated(httperror.LoggerHandler(h.LookupHandler))).Methods(http.MethodGet)
 	return h
 }
 
+// authenticated rejects the requests that do not hold the token of the server
+func (handler *Handler) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(agent.HTTPRegistryTokenHeaderName)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(handler.token)) != 1 {
+			log.Warn().Str("remote_addr", r.RemoteAddr).Msg("rejecting registry credentials lookup with an invalid token")
+
+			httperror.WriteError(rw, http.StatusUnauthorized, "Invalid credential token", errors.New("the token of the request does not match the token of the server"))
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
 func (handler *Handler) LookupHandler(rw http.ResponseWriter, r *http.Request) *httperror.HandlerError {
 	stackManager := handler.EdgeManager.GetStackManager()
 	if stackManager == nil {
@@ -47,29 +71,25 @@ func (handler *Handler) LookupHandler(rw http.ResponseWriter, r *http.Request) *
 		return response.Empty(rw)
 	}
 
-	credentials := stackManager.GetEdgeRegistryCredentials()
-	if len(credentials) > 0 {
-		var key string
-		if strings.HasPrefix(serverUrl, "http") {
-			u, err := url.Parse(serverUrl)
-			if err != nil {
-				return &httperror.HandlerError{http.StatusBadRequest, "Invalid server URL", err}
-			}
-
-			if strings.HasSuffix(u.Hostname(), "docker.io") {
-				key = "docker.io"
-			} else {
-				key = u.Hostname()
-			}
-		} else {
-			key = serverUrl
+	var key string
+	if strings.HasPrefix(serverUrl, "http") {
+		u, err := url.Parse(serverUrl)
+		if err != nil {
+			return &httperror.HandlerError{http.StatusBadRequest, "Invalid server URL", err}
 		}
 
-		for _, c := range credentials {
-			if key == c.ServerURL {
-				return response.JSON(rw, c)
-			}
+		if strings.HasSuffix(u.Hostname(), "docker.io") {
+			key = "docker.io"
+		} else {
+			key = u.Hostname()
 		}
+	} else {
+		key = serverUrl
+	}
+
+	credentials, ok := stackManager.GetEdgeRegistryCredentials(key)
+	if ok {
+		return response.JSON(rw, credentials)
 	}
 
 	return response.Empty(rw)
@@ -97,13 +117,31 @@ func LookupCredentials(credentials []agent.RegistryCredentials, serverUrl string
 	return nil, fmt.Errorf("No credentials found for %s", serverUrl)
 }
 
-func StartRegistryServer(edgeManager *edge.Manager) (err error) {
-	log.Info().Msg("starting registry credential server")
+// StartRegistryServer starts the registry credential server used by the credential helper. It listens on the Unix
+// socket at socketPath when it is set, readable by the user running the agent only, and on 127.0.0.1:9005 otherwise.
+// A token is generated on each start and required in the requests, it is exported along with the socket path in the
+// environment of the agent so that the credential helpers run by the deployments inherit them.
+func StartRegistryServer(edgeManager *edge.Manager, socketPath string) error {
+	log.Info().Str("socket", socketPath).Msg("starting registry credential server")
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	listener, err := listen(socketPath)
+	if err != nil {
+		return err
+	}
 
-	h := NewEdgeRegistryHandler(edgeManager)
+	os.Setenv(agent.RegistryTokenEnvVarName, token)
+	if socketPath != "" {
+		os.Setenv(agent.RegistrySocketEnvVarName, socketPath)
+	}
+
+	h := NewEdgeRegistryHandler(edgeManager, token)
 
 	server := &http.Server{
-		Addr:         "127.0.0.1:9005",
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
@@ -112,8 +150,50 @@ func StartRegistryServer(edgeManager *edge.Manager) (err error) {
 
 	// run in a goroutine so it doesn't block
 	go func() {
-		err = server.ListenAndServe()
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("registry credential server stopped")
+		}
 	}()
 
-	return err
+	return nil
+}
+
+// listen listens on the Unix socket at socketPath when it is set, replacing the socket left by a previous run, and
+// on agent.DefaultRegistryServerAddr otherwise
+func listen(socketPath string) (net.Listener, error) {
+	if socketPath == "" {
+		return net.Listen("tcp", agent.DefaultRegistryServerAddr)
+	}
+
+	err := os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to remove the previous registry credential socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+
+		return nil, fmt.Errorf("unable to restrict the permissions of the registry credential socket: %w", err)
+	}
+
+	return listener, nil
+}
+
+// generateToken returns the random token required by the registry credential server
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate the registry credential token: %w", err)
+	}
+
+	return hex.EncodeToString(token), nil
 }
@@ -0,0 +1,144 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// admissionRequest is the payload sent to the admission policy endpoint before a stack is deployed
+type admissionRequest struct {
+	EdgeID    string   `json:"edgeId,omitempty"`
+	StackID   int      `json:"stackId"`
+	StackName string   `json:"stackName"`
+	Version   int      `json:"version"`
+	Images    []string `json:"images"`
+	// Diff holds the changes the deployment would apply, when StackManagerConfig.DeployDiff is enabled
+	Diff string `json:"diff,omitempty"`
+}
+
+// admissionResponse is the decision returned by the admission policy endpoint
+type admissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// checkAdmission asks the admission policy endpoint whether a stack can be deployed. A stack that is denied,
+// or whose admission cannot be checked while AdmissionFailOpen is disabled, is reported as denied by policy
+// and is not deployed.
+func (manager *StackManager) checkAdmission(ctx context.Context, stack *edgeStack, stackFileLocation string) error {
+	if manager.config.AdmissionEndpoint == "" {
+		return nil
+	}
+
+	manager.mu.Lock()
+	payload := admissionRequest{
+		EdgeID:    manager.config.EdgeID,
+		StackID:   int(stack.ID),
+		StackName: stack.Name,
+		Version:   stack.Version,
+		Images:    []string{},
+		Diff:      stack.Diff,
+	}
+	manager.mu.Unlock()
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+		payload.Images = append(payload.Images, match[3])
+	}
+
+	decision, err := manager.requestAdmission(ctx, payload)
+	if err != nil {
+		if manager.config.AdmissionFailOpen {
+			log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to check the stack admission, deploying the stack")
+
+			return nil
+		}
+
+		decision = &admissionResponse{Reason: fmt.Sprintf("unable to check the stack admission: %s", err)}
+	}
+
+	if decision.Allowed {
+		return nil
+	}
+
+	reason := decision.Reason
+	if reason == "" {
+		reason = "stack deployment denied by policy"
+	}
+
+	log.Error().Int("stack_identifier", int(stack.ID)).Str("reason", reason).Msg("stack deployment denied by policy")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	err = manager.setEdgeStackStatus(stack, client.EdgeStackStatusDeniedByPolicy, reason)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return fmt.Errorf("stack deployment denied by policy: %s", reason)
+}
+
+// requestAdmission posts the stack metadata to the admission policy endpoint. A 2xx response carries the
+// decision, a 403 response denies the deployment and any other response is considered a failure.
+func (manager *StackManager) requestAdmission(ctx context.Context, payload admissionRequest) (*admissionResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, manager.config.AdmissionTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, manager.config.AdmissionEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	decision := &admissionResponse{}
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		json.Unmarshal(respBody, decision)
+		decision.Allowed = false
+
+		return decision, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("unexpected response status from the admission policy endpoint: %s", resp.Status)
+	}
+
+	err = json.Unmarshal(respBody, decision)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from the admission policy endpoint: %w", err)
+	}
+
+	return decision, nil
+}
@@ -0,0 +1,86 @@
+package stack
+
+import (
+	"fmt"
+
+	"github.com/portainer/agent/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	swarmStackLabel     = "com.docker.stack.namespace"
+)
+
+// projectLabel returns the label identifying the containers of a stack deployed to a Docker engine
+func projectLabel(engine engineType) (string, bool) {
+	switch engine {
+	case EngineTypeDockerStandalone:
+		return composeProjectLabel, true
+	case EngineTypeDockerSwarm:
+		return swarmStackLabel, true
+	}
+
+	return "", false
+}
+
+// projectName returns the name of the compose project or swarm stack used to deploy the stack,
+// the adopted name once adoptProject took over an existing deployment. It must be called with manager.mu held.
+func (manager *StackManager) projectName(stack *edgeStack) string {
+	if stack.ProjectName != "" {
+		return stack.ProjectName
+	}
+
+	return fmt.Sprintf("edge_%s", stack.Name)
+}
+
+// adoptProject takes over the deployment with the adopted name when the stack opted in for adoption and that
+// deployment already exists on the engine, instead of creating a parallel one. The engine is looked up outside
+// of manager.mu, which must not be held.
+func (manager *StackManager) adoptProject(stack *edgeStack) {
+	manager.mu.Lock()
+	stackID := stack.ID
+	stackName := stack.Name
+	adoptName := stack.AdoptProjectName
+	label, ok := projectLabel(manager.stackEngine(stack))
+	// Kubernetes and Nomad resources are identified by their manifest, they are adopted as is
+	adopt := ok && stack.ProjectName == "" && adoptName != "" && stack.Action == actionDeploy
+	manager.mu.Unlock()
+
+	if !adopt {
+		return
+	}
+
+	containers, err := docker.GetContainersWithLabel(fmt.Sprintf("%s=%s", label, adoptName))
+	if err != nil {
+		log.Warn().Err(err).
+			Int("stack_identifier", int(stackID)).
+			Str("adopt_project_name", adoptName).
+			Msg("unable to look for the deployment to adopt, deploying the stack under its default name")
+
+		return
+	}
+
+	if len(containers) == 0 {
+		log.Info().
+			Int("stack_identifier", int(stackID)).
+			Str("adopt_project_name", adoptName).
+			Msg("no existing deployment found to adopt, deploying the stack under its default name")
+
+		return
+	}
+
+	log.Info().
+		Int("stack_identifier", int(stackID)).
+		Str("stack_name", stackName).
+		Str("adopt_project_name", adoptName).
+		Int("container_count", len(containers)).
+		Msg("adopting externally-created deployment")
+
+	manager.mu.Lock()
+	if stack.ProjectName == "" && stack.AdoptProjectName == adoptName {
+		stack.ProjectName = adoptName
+	}
+	manager.mu.Unlock()
+}
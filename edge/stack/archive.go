@@ -0,0 +1,83 @@
+package stack
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/portainer/agent/filesystem"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// fetchStackArchive downloads the archive of the folder of a stack from Portainer. It is called without holding
+// manager.mu, so that the download over the uplink does not block the manager.
+func (manager *StackManager) fetchStackArchive(stackID int) ([]byte, error) {
+	archive, err := manager.portainerClient.GetEdgeStackArchive(stackID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "unable to download the stack archive")
+	}
+	defer archive.Close()
+
+	var reader io.Reader = archive
+	if manager.config.ArchiveMaxSize > 0 {
+		reader = io.LimitReader(archive, manager.config.ArchiveMaxSize+1)
+	}
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "unable to download the stack archive")
+	}
+
+	if manager.config.ArchiveMaxSize > 0 && int64(len(content)) > manager.config.ArchiveMaxSize {
+		return nil, errors.WithMessage(filesystem.ErrArchiveTooLarge, "unable to download the stack archive")
+	}
+
+	return content, nil
+}
+
+// writeStackArchive extracts the archive of the folder of a stack inside it, so that the files referenced
+// relatively by the stack file are available at deploy time. The archive content is downloaded beforehand with
+// fetchStackArchive. The files extracted from the previous archive that are no longer part of it are removed,
+// the returned files are the extracted ones. The stack file and the files provided with the stack are written
+// afterwards, on top of the archive.
+func (manager *StackManager) writeStackArchive(folder string, hasArchive bool, content []byte, previous []string) ([]string, error) {
+	var extracted []string
+
+	if hasArchive || len(content) > 0 {
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			return previous, manager.readOnlyError(err)
+		}
+
+		extracted, err = filesystem.ExtractTarGz(bytes.NewReader(content), folder, manager.config.ArchiveMaxSize)
+		if err != nil {
+			// the files extracted so far are removed along with the previous ones once a next archive is extracted
+			return append(previous, extracted...), errors.WithMessage(manager.readOnlyError(err), "unable to extract the stack archive")
+		}
+	}
+
+	kept := map[string]bool{}
+	for _, name := range extracted {
+		kept[name] = true
+	}
+
+	for _, name := range previous {
+		if kept[name] {
+			continue
+		}
+
+		path, err := folderFilePath(folder, name)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", name).Msg("unable to remove the stack archive file that is no longer provided")
+		}
+	}
+
+	return extracted, nil
+}
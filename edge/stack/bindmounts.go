@@ -0,0 +1,124 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/portainer/agent"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// composeVolumes holds the volumes of the services of a compose file, using either the short or the long syntax
+type composeVolumes struct {
+	Services map[string]struct {
+		Volumes []interface{} `yaml:"volumes"`
+	} `yaml:"services"`
+}
+
+// checkBindMounts verifies that the host paths bind mounted by the services of a Docker standalone stack exist,
+// instead of letting the engine create them as empty directories. A stack with missing paths is not deployed.
+func (manager *StackManager) checkBindMounts(stack *edgeStack, stackFileLocation string) error {
+	manager.mu.Lock()
+	engine := manager.stackEngine(stack)
+	manager.mu.Unlock()
+
+	if !manager.config.CheckBindMounts || engine != EngineTypeDockerStandalone {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	missing := missingBindMounts(string(content))
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("the bind mounted host paths do not exist: %s", strings.Join(missing, ", "))
+
+	log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack deployment refused")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
+}
+
+// missingBindMounts returns the absolute host paths bind mounted by the services of a compose file that do not exist.
+// The paths are looked up under agent.HostRoot when the host filesystem is mounted inside the agent container.
+func missingBindMounts(fileContent string) []string {
+	var volumes composeVolumes
+
+	err := yaml.Unmarshal([]byte(fileContent), &volumes)
+	if err != nil {
+		// invalid files are reported by the deployer
+		return nil
+	}
+
+	root := ""
+	if _, err := os.Stat(agent.HostRoot); err == nil {
+		root = agent.HostRoot
+	}
+
+	missing := map[string]bool{}
+	for _, service := range volumes.Services {
+		for _, volume := range service.Volumes {
+			source := bindMountSource(volume)
+			if source == "" || !filepath.IsAbs(source) {
+				continue
+			}
+
+			_, err := os.Stat(filepath.Join(root, source))
+			if os.IsNotExist(err) {
+				missing[source] = true
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(missing))
+	for path := range missing {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// bindMountSource returns the host path of a bind mount volume entry, or an empty string for the other volumes
+func bindMountSource(volume interface{}) string {
+	switch entry := volume.(type) {
+	case string:
+		source, _, found := strings.Cut(entry, ":")
+		if !found {
+			return ""
+		}
+
+		return source
+	case map[string]interface{}:
+		if entry["type"] != "bind" {
+			return ""
+		}
+
+		source, _ := entry["source"].(string)
+
+		return source
+	}
+
+	return ""
+}
@@ -0,0 +1,100 @@
+package stack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// inFlightOperation is the deployment or the removal of a stack being processed
+type inFlightOperation struct {
+	cancel     context.CancelFunc
+	deployment bool
+}
+
+// inFlightOperations holds the cancel functions of the contexts of the operations being processed. It has its own
+// lock so that an operation can be cancelled while manager.mu is held during the deployer calls.
+type inFlightOperations struct {
+	mu         sync.Mutex
+	operations map[edgeStackID]*inFlightOperation
+}
+
+func newInFlightOperations() *inFlightOperations {
+	return &inFlightOperations{operations: map[edgeStackID]*inFlightOperation{}}
+}
+
+// begin returns the context of an operation of a stack, the returned function ends the operation
+func (inFlight *inFlightOperations) begin(stackID edgeStackID, deployment bool) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	operation := &inFlightOperation{cancel: cancel, deployment: deployment}
+
+	inFlight.mu.Lock()
+	inFlight.operations[stackID] = operation
+	inFlight.mu.Unlock()
+
+	return ctx, func() {
+		inFlight.mu.Lock()
+		// a removal may have started for the stack while its cancelled deployment was returning
+		if inFlight.operations[stackID] == operation {
+			delete(inFlight.operations, stackID)
+		}
+		inFlight.mu.Unlock()
+
+		cancel()
+	}
+}
+
+// cancelDeployment cancels the deployment of a stack being processed, if any
+func (inFlight *inFlightOperations) cancelDeployment(stackID edgeStackID) {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	operation, ok := inFlight.operations[stackID]
+	if !ok || !operation.deployment {
+		return
+	}
+
+	log.Info().Int("stack_identifier", int(stackID)).Msg("cancelling the deployment of the stack")
+
+	operation.cancel()
+}
+
+// cancelRemovedDeployments cancels the deployments being processed of the stacks missing from a poll response, before
+// their removal is queued. The removal may be skipped for a partial poll response, the cancelled deployments are
+// then processed again.
+func (inFlight *inFlightOperations) cancelRemovedDeployments(pollResponseStacks map[int]int) {
+	inFlight.mu.Lock()
+	removed := []edgeStackID{}
+	for stackID := range inFlight.operations {
+		if _, ok := pollResponseStacks[int(stackID)]; !ok {
+			removed = append(removed, stackID)
+		}
+	}
+	inFlight.mu.Unlock()
+
+	for _, stackID := range removed {
+		inFlight.cancelDeployment(stackID)
+	}
+}
+
+// cancelAll cancels all the operations being processed
+func (inFlight *inFlightOperations) cancelAll() {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	for _, operation := range inFlight.operations {
+		operation.cancel()
+	}
+}
+
+// running returns whether an operation of a stack is being processed
+func (inFlight *inFlightOperations) running(stackID edgeStackID) bool {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	_, ok := inFlight.operations[stackID]
+
+	return ok
+}
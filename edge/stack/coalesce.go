@@ -0,0 +1,35 @@
+package stack
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errSupersededDeployment = errors.New("deployment superseded by a newer version")
+
+// checkSuperseded skips the deployment of a stack when a newer version of the stack was received since the
+// deployment started, the stack is still pending and the latest version is deployed by the next iteration.
+func (manager *StackManager) checkSuperseded(stack *edgeStack) error {
+	if !manager.config.CoalesceVersions {
+		return nil
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if stack.Version == stack.DeployingVersion {
+		return nil
+	}
+
+	log.Debug().
+		Int("stack_identifier", int(stack.ID)).
+		Int("stack_version", stack.DeployingVersion).
+		Int("latest_version", stack.Version).
+		Msg("newer stack version pending, skipping the deployment of the previous version")
+
+	// the images pulled for the previous version may not be the ones of the latest version
+	stack.ImagesPulled = false
+
+	return errSupersededDeployment
+}
@@ -0,0 +1,54 @@
+package stack
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// composeVersionRegexp matches the obsolete top-level version key of a compose file
+var composeVersionRegexp = regexp.MustCompile(`(?m)^["']?version["']?[ \t]*:[^\n]*(?:\n|$)`)
+
+// composeBuilds returns true when a service of the compose files declares a build section. The files that cannot be
+// parsed are left to the deployer, which reports them.
+func composeBuilds(filePaths []string) bool {
+	for _, filePath := range filePaths {
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+
+		var compose struct {
+			Services map[string]struct {
+				Build interface{} `yaml:"build"`
+			} `yaml:"services"`
+		}
+
+		if yaml.Unmarshal(content, &compose) != nil {
+			continue
+		}
+
+		for _, service := range compose.Services {
+			if service.Build != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stripComposeVersion removes the obsolete top-level version key of a compose file,
+// the rest of the content is left untouched
+func stripComposeVersion(content string) (string, bool) {
+	location := composeVersionRegexp.FindStringIndex(content)
+	if location == nil {
+		return content, false
+	}
+
+	log.Debug().Msg("removing the obsolete version key of the compose file")
+
+	return content[:location[0]] + content[location[1]:], true
+}
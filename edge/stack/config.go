@@ -0,0 +1,334 @@
+package stack
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// OptionSourceDefault is the source of an option using its default value
+	OptionSourceDefault = "default"
+	// OptionSourceEnv is the source of an option set through its environment variable
+	OptionSourceEnv = "env"
+	// OptionSourceFlag is the source of an option set through its command line flag
+	OptionSourceFlag = "flag"
+
+	redactedValue = "********"
+)
+
+// ConfigEntry represents a resolved value of the StackManager configuration
+type ConfigEntry struct {
+	Name   string      `json:"name"`
+	Option string      `json:"option,omitempty"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// StackManagerConfig represents the configuration used to create a StackManager.
+// The option tag holds the environment variable used to set a field, the redact tag
+// marks the fields whose value must be redacted when the configuration is displayed:
+// url hides the password of a URL and command the arguments of a command.
+type StackManagerConfig struct {
+	// ImageMirrors maps a source registry host to the mirror host used to pull its images
+	ImageMirrors map[string]string `option:"EDGE_STACK_IMAGE_MIRRORS"`
+	// ImageMirrorFallback enables pulling from the original registry when an image cannot be pulled from its mirror,
+	// the failures unrelated to the registries do not fall back
+	ImageMirrorFallback bool `option:"EDGE_STACK_IMAGE_MIRROR_FALLBACK"`
+	// EdgeID is the Edge identifier of the agent, used to identify the device in the published events
+	EdgeID string `option:"EDGE_ID"`
+	// MQTTBrokerURL is the URL of the MQTT broker the stack status transitions are published to. Keep empty to disable.
+	MQTTBrokerURL string `option:"EDGE_STACK_MQTT_BROKER_URL" redact:"url"`
+	// MQTTTopicTemplate is the topic the status transitions are published to,
+	// {device}, {id} and {name} are replaced by the Edge ID, the stack identifier and the stack name
+	MQTTTopicTemplate string `option:"EDGE_STACK_MQTT_TOPIC"`
+	// FolderCleanupMode defines how the orphaned stack folders are handled once the stacks are known
+	// (FolderCleanupDisabled, FolderCleanupDryRun or FolderCleanupEnabled)
+	FolderCleanupMode string `option:"EDGE_STACK_FOLDER_CLEANUP"`
+	// FolderCleanupAllow restricts the cleanup to the stack folders matching one of these patterns
+	FolderCleanupAllow []string `option:"EDGE_STACK_FOLDER_CLEANUP_ALLOW"`
+	// FolderCleanupDeny excludes the stack folders matching one of these patterns from the cleanup
+	FolderCleanupDeny []string `option:"EDGE_STACK_FOLDER_CLEANUP_DENY"`
+	// SharedFilesPath is a directory linked inside each stack folder so that compose files can
+	// include or extend shared compose files. Compose file references are restricted to the stack
+	// folder and this directory.
+	SharedFilesPath string `option:"EDGE_STACK_SHARED_FILES_PATH"`
+	// MinDeployerVersions overrides the minimum supported version of the deployer tools,
+	// indexed by tool name (docker-compose, docker, kubectl, nomad)
+	MinDeployerVersions map[string]string `option:"EDGE_STACK_MIN_DEPLOYER_VERSIONS"`
+	// OTLPEndpoint is the OpenTelemetry collector endpoint (OTLP/HTTP) the deployment traces are exported to
+	OTLPEndpoint string `option:"EDGE_STACK_OTLP_ENDPOINT" redact:"url"`
+	// DeleteConcurrency is the maximum number of stacks removed at the same time by the dedicated delete
+	// workers. When zero, the stacks are removed one at a time by the deployment loop.
+	DeleteConcurrency int `option:"EDGE_STACK_DELETE_CONCURRENCY"`
+	// StripComposeVersion removes the obsolete top-level version key of the compose files before they are written
+	StripComposeVersion bool `option:"EDGE_STACK_STRIP_COMPOSE_VERSION"`
+	// HealthMonitorInterval is the interval used to check the health of the deployed stacks. Keep zero to disable.
+	HealthMonitorInterval time.Duration `option:"EDGE_STACK_HEALTH_MONITOR_INTERVAL"`
+	// PostReconcileHook is a command executed once the pending stacks of a reconcile cycle have been processed,
+	// it receives the JSON encoded stack inventory on its standard input. The command is split on white spaces into
+	// the executable and its arguments, without any shell quoting. Keep empty to disable.
+	PostReconcileHook string `option:"EDGE_STACK_POST_RECONCILE_HOOK" redact:"command"`
+	// PostReconcileHookTimeout is the maximum duration of the post-reconcile hook
+	PostReconcileHookTimeout time.Duration `option:"EDGE_STACK_POST_RECONCILE_HOOK_TIMEOUT"`
+	// CheckImageDiskSpace verifies that the image store has enough space before pulling the images of a stack
+	CheckImageDiskSpace bool `option:"EDGE_STACK_CHECK_IMAGE_DISK_SPACE"`
+	// ImageStorePath is the path of the image store used to check the available space,
+	// keep empty to use the root directory of the Docker engine
+	ImageStorePath string `option:"EDGE_STACK_IMAGE_STORE_PATH"`
+	// EventHistoryPerStack is the number of status transitions retained for each stack, zero means unbounded
+	EventHistoryPerStack int `option:"EDGE_STACK_EVENT_HISTORY_PER_STACK"`
+	// EventHistoryTotal is the number of status transitions retained across all the stacks, zero means unbounded
+	EventHistoryTotal int `option:"EDGE_STACK_EVENT_HISTORY_TOTAL"`
+	// EventHistoryFile is the path of the log the status transitions are persisted to. Keep empty to disable.
+	EventHistoryFile string `option:"EDGE_STACK_EVENT_HISTORY_FILE"`
+	// EventHistoryFileMaxSize is the size in bytes after which the events log is rotated
+	EventHistoryFileMaxSize int64 `option:"EDGE_STACK_EVENT_HISTORY_FILE_MAX_SIZE"`
+	// AdmissionEndpoint is the URL of the policy endpoint approving each stack deployment. Keep empty to disable.
+	AdmissionEndpoint string `option:"EDGE_STACK_ADMISSION_ENDPOINT" redact:"url"`
+	// AdmissionTimeout is the maximum duration of an admission check
+	AdmissionTimeout time.Duration `option:"EDGE_STACK_ADMISSION_TIMEOUT"`
+	// AdmissionFailOpen deploys the stacks whose admission cannot be checked instead of denying them
+	AdmissionFailOpen bool `option:"EDGE_STACK_ADMISSION_FAIL_OPEN"`
+	// NormalizeLineEndings converts the CRLF line endings of the stack files to LF before they are written
+	NormalizeLineEndings bool `option:"EDGE_STACK_NORMALIZE_LINE_ENDINGS"`
+	// NetworkDriver is the driver of the default network injected in the compose files that do not define it.
+	// Keep empty to disable.
+	NetworkDriver string `option:"EDGE_STACK_NETWORK_DRIVER"`
+	// NetworkDriverOpts are the driver options of the injected default network
+	NetworkDriverOpts map[string]string `option:"EDGE_STACK_NETWORK_DRIVER_OPTS"`
+	// DeployAfterDelete defines how a new deployment of a stack whose deletion is pending is handled
+	// (DeployAfterDeleteSupersede or DeployAfterDeleteWait). A deletion in progress is always completed first.
+	DeployAfterDelete string `option:"EDGE_STACK_DEPLOY_AFTER_DELETE"`
+	// KubernetesResourcePrefix is prepended to the name of the Kubernetes resources created by the agent,
+	// such as the image pull secrets
+	KubernetesResourcePrefix string `option:"EDGE_STACK_KUBERNETES_RESOURCE_PREFIX"`
+	// KubernetesResourceLabels are set on the Kubernetes resources created by the agent, in addition to
+	// the app.kubernetes.io/managed-by ownership label
+	KubernetesResourceLabels map[string]string `option:"EDGE_STACK_KUBERNETES_RESOURCE_LABELS"`
+	// LazyPull skips pulling the images before the deployment when the Docker engine uses the containerd image store
+	// with a lazy pulling snapshotter, the images are then fetched on demand. It is a no-op on the classic image store.
+	LazyPull bool `option:"EDGE_STACK_LAZY_PULL"`
+	// RemoveUnknownStacks removes the stacks whose status update is rejected because they no longer exist
+	// on the Portainer server, as if they were absent from the poll response
+	RemoveUnknownStacks bool `option:"EDGE_STACK_REMOVE_UNKNOWN"`
+	// OperationConcurrency is the maximum number of deployer operations (pulls, deployments and removals) running
+	// at the same time, on top of the limits specific to each operation. When zero, they are not limited.
+	OperationConcurrency int `option:"EDGE_STACK_OPERATION_CONCURRENCY"`
+	// StackFilesPath is the directory the stack files are written to, keep empty to use agent.EdgeStackFilesPath.
+	// It must be writable, e.g. a tmpfs mount when the file system of the device is read-only.
+	StackFilesPath string `option:"EDGE_STACK_FILES_PATH"`
+	// CoalesceVersions skips the deployment of a stack version that was superseded by a newer version received
+	// before it was deployed, only the latest version is then deployed
+	CoalesceVersions bool `option:"EDGE_STACK_COALESCE_VERSIONS"`
+	// MapResourceLimits translates the deploy.resources limits and reservations of the compose services to the
+	// equivalent container settings (mem_limit, cpus, pids_limit, mem_reservation) on Docker standalone
+	MapResourceLimits bool `option:"EDGE_STACK_MAP_RESOURCE_LIMITS"`
+	// DeployDiff defines whether the changes of the stack deployments are computed and reported: DeployDiffDisabled,
+	// DeployDiffReport to report them before deploying the stacks, or DeployDiffOnly to report them without deploying
+	DeployDiff string `option:"EDGE_STACK_DEPLOY_DIFF"`
+	// ImagePrune defines the images removed after a successful deployment on a Docker engine: ImagePruneDisabled,
+	// ImagePruneDangling, ImagePruneUnused or ImagePruneDryRun. Only the images pulled for the stacks are removed,
+	// and never the ones used by a container or referenced by a stack. The stacks can override it.
+	ImagePrune string `option:"EDGE_STACK_IMAGE_PRUNE"`
+	// RemoveRenamedStacks removes the deployment of a renamed stack under its previous project name before the stack
+	// is deployed under its new name, so that the previous deployment is not orphaned
+	RemoveRenamedStacks bool `option:"EDGE_STACK_REMOVE_RENAMED"`
+	// TransformConcurrency is the number of documents of a Kubernetes manifest transformed at the same time
+	// when adding the image pull secrets of the registry credentials
+	TransformConcurrency int `option:"EDGE_STACK_TRANSFORM_CONCURRENCY"`
+	// CredentialHelperFallback pulls the images with the registry credentials passed directly to the Docker engine
+	// when the pull relying on the credential helper fails
+	CredentialHelperFallback bool `option:"EDGE_STACK_CREDENTIAL_HELPER_FALLBACK"`
+	// AtomicWrites writes the stack files to a temporary file which is then renamed into place
+	AtomicWrites bool `option:"EDGE_STACK_ATOMIC_WRITES"`
+	// CheckBindMounts refuses to deploy a Docker standalone stack when a bind mounted host path does not exist
+	CheckBindMounts bool `option:"EDGE_STACK_CHECK_BIND_MOUNTS"`
+	// RetryStatusInterval is the minimum interval between two reports of the retries of a stack, zero disables the reports
+	RetryStatusInterval time.Duration `option:"EDGE_STACK_RETRY_STATUS_INTERVAL"`
+	// EnvFiles defines the handling of the env files provided with the stacks, one of EnvFilesDisabled,
+	// EnvFilesWrite or EnvFilesStrict
+	EnvFiles string `option:"EDGE_STACK_ENV_FILES"`
+	// EmptyStack defines the handling of the stacks that define no services, one of EmptyStackIgnore,
+	// EmptyStackWarn or EmptyStackError
+	EmptyStack string `option:"EDGE_STACK_EMPTY_STACK"`
+	// EngineAssetsPaths overrides the assets path holding the deployment binaries of an engine, keyed by engine name.
+	// The engines without a path use the assets path of the agent.
+	EngineAssetsPaths map[string]string `option:"EDGE_STACK_ENGINE_ASSETS_PATHS"`
+	// NodeLabels holds the labels of the device, matched against the node selector of the stacks
+	NodeLabels map[string]string `option:"EDGE_STACK_NODE_LABELS"`
+	// ReconcileTimeout bounds the duration of the reconciliation of the stacks returned by a poll,
+	// the stacks not processed in time are left to the next pass. Zero does not bound it.
+	ReconcileTimeout time.Duration `option:"EDGE_STACK_RECONCILE_TIMEOUT"`
+	// AnonymousPullFirst accesses the registries anonymously first when the agent provides the registry credentials
+	// itself (direct pulls and manifest lookups), the credentials are only used when the anonymous access is refused
+	AnonymousPullFirst bool `option:"EDGE_STACK_ANONYMOUS_PULL_FIRST"`
+	// RemovePreviousNamespace removes the resources of a Kubernetes stack from its previous namespace when its namespace changes
+	RemovePreviousNamespace bool `option:"EDGE_STACK_REMOVE_PREVIOUS_NAMESPACE"`
+	// WarmupImages are pulled when the agent starts, so that the first deployments using them do not wait for their pull
+	WarmupImages []string `option:"EDGE_STACK_WARMUP_IMAGES"`
+	// WarmupKnownStacks pulls the images of the stack files found in the stack files path when the agent starts
+	WarmupKnownStacks bool `option:"EDGE_STACK_WARMUP_KNOWN_STACKS"`
+	// QueuePositionInterval is the minimum interval between two reports of the position of a pending stack
+	// in the deployment queue, zero disables the reports
+	QueuePositionInterval time.Duration `option:"EDGE_STACK_QUEUE_POSITION_INTERVAL"`
+	// SecretFiles defines the handling of the secret files provided with the stacks, one of SecretFilesDisabled,
+	// SecretFilesWrite or SecretFilesStrict
+	SecretFiles string `option:"EDGE_STACK_SECRET_FILES"`
+	// EngineWorkers runs the deployments of each engine on a dedicated worker, so that a slow engine does not
+	// hold back the deployments to the other engines
+	EngineWorkers bool `option:"EDGE_STACK_ENGINE_WORKERS"`
+	// VersionMismatch is the handling of a stack configuration whose version differs from the version being
+	// processed, see VersionMismatchDefer and VersionMismatchDeploy
+	VersionMismatch string `option:"EDGE_STACK_VERSION_MISMATCH"`
+	// NoEngine is the handling of the stacks received before the engine of the agent is set,
+	// see NoEngineWait and NoEngineFail
+	NoEngine string `option:"EDGE_STACK_NO_ENGINE"`
+	// StackIndex indexes the pending and deploying stacks, so that the deployment loop does not iterate
+	// over all the stacks on agents managing many stacks
+	StackIndex bool `option:"EDGE_STACK_INDEX"`
+	// OutputLimit is the maximum size in bytes of the deployer output reported with the stack statuses, the output
+	// beyond it is elided from its middle. Zero leaves it unbounded.
+	OutputLimit int `option:"EDGE_STACK_OUTPUT_LIMIT"`
+	// PartialPollThreshold is the percentage of the managed stacks missing from a poll response from which the
+	// response is deemed partial, the removals then wait for the next poll to confirm them. Zero disables the check.
+	PartialPollThreshold int `option:"EDGE_STACK_PARTIAL_POLL_THRESHOLD"`
+	// Workers is the number of stacks pulled and deployed in parallel, per engine when EngineWorkers is enabled.
+	// A stack is never processed by two workers at the same time.
+	Workers int `option:"EDGE_STACK_WORKERS"`
+	// RetryBackoffInitial is the delay before the first retry of a failed images pull, it doubles with each retry.
+	// Zero retries the pulls on the following iterations, throttled by RetryInterval.
+	RetryBackoffInitial time.Duration `option:"EDGE_STACK_RETRY_BACKOFF"`
+	// RetryBackoffMax caps the delay between two retries of a failed images pull
+	RetryBackoffMax time.Duration `option:"EDGE_STACK_RETRY_BACKOFF_MAX"`
+	// RetryBackoffMaxRetries is the number of retries of a failed images pull after which the stack is reported
+	// in error, when the backoff is enabled
+	RetryBackoffMaxRetries int `option:"EDGE_STACK_RETRY_MAX_RETRIES"`
+	// ValidateStacks validates the files of the stacks with their deployer before deploying them,
+	// the stacks rejected by the validation are reported and not deployed
+	ValidateStacks bool `option:"EDGE_STACK_VALIDATE"`
+	// Rollback keeps the files of the last version of each stack deployed successfully and deploys it again
+	// when the deployment of another version fails
+	Rollback bool `option:"EDGE_STACK_ROLLBACK"`
+	// HealthCheckTimeout is the maximum duration to wait for the workloads of a deployed stack to be healthy
+	// before reporting it, the stacks still unhealthy are reported as such. Zero disables the check.
+	HealthCheckTimeout time.Duration `option:"EDGE_STACK_HEALTH_CHECK_TIMEOUT"`
+	// DeployLogs is the maximum size in bytes of the tail of the deployer output sent to Portainer with the status
+	// of each deployment, so that a failure can be diagnosed without accessing the device. Zero disables it.
+	DeployLogs int `option:"EDGE_STACK_DEPLOY_LOGS"`
+	// ArchiveMaxSize is the maximum size in bytes of the content extracted from the archive of a stack folder, the
+	// extraction of a larger archive fails. Zero leaves it unbounded.
+	ArchiveMaxSize int64 `option:"EDGE_STACK_ARCHIVE_MAX_SIZE"`
+	// RedeployWebhook enables the redeployment of the stacks on request through Redeploy, their images pulled again,
+	// e.g. by a CI pipeline once new images are pushed under the same tags.
+	RedeployWebhook bool `option:"EDGE_STACK_REDEPLOY_WEBHOOK"`
+	// DeploymentWindowBypass deploys the new stacks outside of their deployment windows, which then only defer
+	// their updates.
+	DeploymentWindowBypass bool `option:"EDGE_STACK_WINDOW_BYPASS"`
+	// ReportProgress reports the phases of the deployments to Portainer between the acknowledgement and the final
+	// status of the stacks: files written, images pulling, deploying and health checking.
+	ReportProgress bool `option:"EDGE_STACK_PROGRESS"`
+	// DiskQuota is the maximum size in bytes of the stack files path. When it is exceeded once the stacks are known, the
+	// orphaned stack folders and the versioned folders kept for the rollbacks are pruned, the least recently deployed first.
+	// The files of the deployed stacks are never removed. Keep zero to disable the quota.
+	DiskQuota int64 `option:"EDGE_STACK_DISK_QUOTA"`
+	// PullBandwidthLimit is the approximate maximum rate in bytes per second of the image pulls of the stacks deployed
+	// to a Docker engine. When it is set, the agent pulls the images itself, one at a time, with the registry credentials
+	// of the stacks instead of the credential helper. Keep zero to leave the pulls to the deployers.
+	PullBandwidthLimit int64 `option:"EDGE_STACK_PULL_BANDWIDTH_LIMIT"`
+	// PrePullWorkers is the number of stacks whose images are pre-pulled at the same time, ahead of their deployment by
+	// the deployment workers. The pending stacks to pre-pull are deployed once their images are local. Keep zero to pull
+	// the images during the deployment.
+	PrePullWorkers int `option:"EDGE_STACK_PRE_PULL_WORKERS"`
+	// DriftCheckInterval is the interval used to check that the resources of the deployed stacks with a reconcile policy
+	// still exist. Keep zero to disable.
+	DriftCheckInterval time.Duration `option:"EDGE_STACK_DRIFT_CHECK_INTERVAL"`
+	// RemovePurge purges the Nomad jobs of the removed stacks, like nomad job stop -purge, instead of only stopping them
+	RemovePurge bool `option:"EDGE_STACK_REMOVE_PURGE"`
+	// RolloutTimeout is the maximum duration the deployment of a Kubernetes stack waits for its Deployments, StatefulSets
+	// and DaemonSets to roll out, the deployment fails once it is exceeded. Keep zero to not wait.
+	RolloutTimeout time.Duration `option:"EDGE_STACK_ROLLOUT_TIMEOUT"`
+	// RegistryCredentialsTTL is the duration after which the registry credentials of a stack are fetched again from
+	// Portainer before they are used, so that the short-lived registry tokens do not expire during long pulls. While
+	// the refresh fails, the cached credentials are used until they are twice as old as the TTL. Keep zero to use the
+	// credentials received with the stack.
+	RegistryCredentialsTTL time.Duration `option:"EDGE_STACK_REGISTRY_CREDENTIALS_TTL"`
+	// ImageVerifyKeys are the cosign public keys the images of the stacks must be signed with, the signatures
+	// are verified before the images are pulled when it is set
+	ImageVerifyKeys []string `option:"EDGE_STACK_IMAGE_VERIFY_KEYS"`
+	// OptionSources holds the source of each option (default, env or flag), indexed by environment variable
+	OptionSources map[string]string `option:"-"`
+}
+
+// EffectiveConfig returns the resolved configuration of the StackManager along with the source of each value.
+// Secrets are redacted.
+func (manager *StackManager) EffectiveConfig() []ConfigEntry {
+	return manager.config.entries()
+}
+
+func (config StackManagerConfig) entries() []ConfigEntry {
+	entries := []ConfigEntry{}
+
+	value := reflect.ValueOf(config)
+	configType := value.Type()
+
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+
+		option := field.Tag.Get("option")
+		if option == "-" {
+			continue
+		}
+
+		entry := ConfigEntry{
+			Name:   field.Name,
+			Option: option,
+			Value:  value.Field(i).Interface(),
+			Source: OptionSourceDefault,
+		}
+
+		if source, ok := config.OptionSources[option]; ok {
+			entry.Source = source
+		}
+
+		switch field.Tag.Get("redact") {
+		case "url":
+			entry.Value = redactURL(value.Field(i).String())
+		case "command":
+			entry.Value = redactCommand(value.Field(i).String())
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// redactCommand hides the arguments of a command, which may hold tokens, and keeps its executable
+func redactCommand(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) <= 1 {
+		return command
+	}
+
+	return fields[0] + " " + redactedValue
+}
+
+// redactURL hides the password of a URL, an invalid URL is entirely redacted
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+
+	return u.String()
+}
@@ -0,0 +1,38 @@
+package stack
+
+import (
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// VersionMismatchDefer leaves a stack unchanged when its configuration belongs to another version than the one
+	// being processed, the configuration is requested again on the next poll
+	VersionMismatchDefer = "defer"
+	// VersionMismatchDeploy deploys the configuration of a stack even when it belongs to another version
+	VersionMismatchDeploy = "deploy"
+)
+
+// deferMismatchedConfig returns whether the configuration of a stack is set aside because it belongs to another
+// version than the one being processed. The configurations that do not carry their version are always used.
+func (manager *StackManager) deferMismatchedConfig(stackID, version int, stackConfig *agent.EdgeStackConfig) bool {
+	if stackConfig.Version == 0 || stackConfig.Version == version {
+		return false
+	}
+
+	logger := log.Warn().
+		Int("stack_identifier", stackID).
+		Int("stack_version", version).
+		Int("config_version", stackConfig.Version)
+
+	if manager.config.VersionMismatch == VersionMismatchDeploy {
+		logger.Msg("the stack configuration belongs to another version, deploying it anyway")
+
+		return false
+	}
+
+	logger.Msg("the stack configuration belongs to another version, waiting for the next poll")
+
+	return true
+}
@@ -0,0 +1,169 @@
+package stack
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/docker"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	credentialsSourceHelper = "credential_helper"
+	credentialsSourceDirect = "direct"
+)
+
+// canPullWithCredentials returns true when the images of a stack can be pulled by passing its registry
+// credentials directly to the Docker engine, after a pull relying on the credential helper failed
+func (manager *StackManager) canPullWithCredentials(stack *edgeStack) bool {
+	return manager.config.CredentialHelperFallback &&
+		len(stack.RegistryCredentials) > 0 &&
+		isDockerEngine(manager.stackEngine(stack))
+}
+
+// pullWithCredentials pulls each image of the stack file with the matching registry credentials, it bypasses
+// the credential helper. The pulls are bounded by StackManagerConfig.PullBandwidthLimit and their progress is
+// reported. It must be called with manager.mu held, it is released during the pulls like the deployer operations.
+func (manager *StackManager) pullWithCredentials(ctx context.Context, stack *edgeStack, stackFileLocation string) error {
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	// the progress is reported through a copy of the stack, which is not modified by the other workers while
+	// manager.mu is released
+	pulled := &edgeStack{ID: stack.ID, Version: stack.Version}
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	matches := imageLineRegexp.FindAllStringSubmatch(string(content), -1)
+	defer manager.reportPullProgress(pulled, len(matches), len(matches))
+
+	for i, match := range matches {
+		image := match[3]
+
+		manager.reportPullProgress(pulled, i, len(matches))
+
+		pullImage := func(auth types.AuthConfig) error {
+			return docker.ImagePullWithProgress(ctx, image, auth, manager.config.PullBandwidthLimit, func(progress docker.PullProgress) {
+				manager.reportImagePullProgress(pulled, image, i+1, len(matches), progress)
+			})
+		}
+
+		credentials, ok := manager.registryCredentials(pulled, image)
+		if !ok {
+			err := pullImage(types.AuthConfig{})
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if manager.config.AnonymousPullFirst {
+			err := pullImage(types.AuthConfig{})
+			if err == nil {
+				continue
+			}
+
+			if !isUnauthorizedPull(err) {
+				return err
+			}
+
+			log.Debug().Str("image", image).Msg("anonymous pull refused, pulling the image with the registry credentials")
+		}
+
+		err := pullImage(types.AuthConfig{
+			Username:      credentials.Username,
+			Password:      credentials.Secret,
+			ServerAddress: credentials.ServerURL,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pullsThroughAgent returns true when the agent pulls the images of a stack itself instead of its deployer,
+// so that the pulls are bounded by StackManagerConfig.PullBandwidthLimit
+func (manager *StackManager) pullsThroughAgent(stack *edgeStack) bool {
+	return manager.config.PullBandwidthLimit > 0 && isDockerEngine(manager.stackEngine(stack))
+}
+
+// isUnauthorizedPull returns true when a pull failed because the registry requires credentials
+func isUnauthorizedPull(err error) bool {
+	if errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+
+	return strings.Contains(message, "unauthorized") ||
+		strings.Contains(message, "authentication required") ||
+		strings.Contains(message, "access denied") ||
+		strings.Contains(message, "denied: requested access")
+}
+
+// registryCredentials returns the stack registry credentials matching the registry of an image
+func (manager *StackManager) registryCredentials(stack *edgeStack, image string) (agent.RegistryCredentials, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return agent.RegistryCredentials{}, false
+	}
+
+	domain := reference.Domain(named)
+
+	for _, credentials := range manager.credentials.get(stack.ID, manager.portainerClient) {
+		if credentials.ServerURL == domain {
+			return credentials, true
+		}
+	}
+
+	return agent.RegistryCredentials{}, false
+}
+
+// credentialHelperAvailable returns true when the registry credential server queried by the credential helper accepts
+// connections, on the Unix socket the server exported in the environment of the agent when it listens on one
+func credentialHelperAvailable() bool {
+	network, address := "tcp", agent.DefaultRegistryServerAddr
+	if socketPath := os.Getenv(agent.RegistrySocketEnvVarName); socketPath != "" {
+		network, address = "unix", socketPath
+	}
+
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+// logCredentialsSource logs which path provided the registry credentials of a stack images pull
+func logCredentialsSource(stack *edgeStack, source string) {
+	if len(stack.RegistryCredentials) == 0 {
+		return
+	}
+
+	log.Info().
+		Int("stack_identifier", int(stack.ID)).
+		Str("credentials_source", source).
+		Msg("registry credentials provided to the stack images pull")
+}
@@ -0,0 +1,134 @@
+package stack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DeployAfterDeleteSupersede replaces a pending deletion of a stack by a new deployment of the stack
+	DeployAfterDeleteSupersede = "supersede"
+	// DeployAfterDeleteWait processes a new deployment of a stack once its pending deletion has completed
+	DeployAfterDeleteWait = "wait"
+)
+
+// markStackForDeletion queues the removal of a stack, it must be called with manager.mu held
+func (manager *StackManager) markStackForDeletion(stack *edgeStack) {
+	manager.inFlight.cancelDeployment(stack.ID)
+
+	stack.Action = actionDelete
+	manager.setStatus(stack, StatusPending)
+	stack.PendingSince = time.Now()
+}
+
+// removeUnknownStack queues the removal of a stack that no longer exists on the Portainer server, so that
+// its deployment is not retried. It must be called with manager.mu held.
+func (manager *StackManager) removeUnknownStack(stack *edgeStack) {
+	if stack.Deleting || stack.Action == actionDelete || manager.stacks[stack.ID] != stack {
+		return
+	}
+
+	log.Warn().Int("stack_identifier", int(stack.ID)).Msg("stack not found on the Portainer server, marking stack for deletion")
+
+	manager.markStackForDeletion(stack)
+}
+
+// deleteWorkersEnabled returns true when the stack deletions are processed by the dedicated delete workers
+// instead of the deployment loop
+func (manager *StackManager) deleteWorkersEnabled() bool {
+	return manager.config.DeleteConcurrency > 0
+}
+
+// startDeleteWorkers drains the pending deletions with at most StackManagerConfig.DeleteConcurrency
+// deletions running at the same time, until the stop signal is closed
+func (manager *StackManager) startDeleteWorkers(stopSignal chan struct{}, sleepInterval time.Duration) {
+	workers := make(chan struct{}, manager.config.DeleteConcurrency)
+
+	go func() {
+		for {
+			select {
+			case <-stopSignal:
+				log.Debug().Msg("shutting down Edge stack delete workers")
+				return
+			case workers <- struct{}{}:
+			}
+
+			stack := manager.nextPendingDelete()
+			if stack == nil {
+				<-workers
+
+				timer := time.NewTimer(sleepInterval)
+				select {
+				case <-stopSignal:
+					timer.Stop()
+				case <-timer.C:
+				}
+
+				continue
+			}
+
+			go func() {
+				defer func() { <-workers }()
+
+				manager.runDelete(stack)
+			}()
+		}
+	}()
+}
+
+// nextPendingDelete returns the next stack waiting for deletion and marks it as being deleted
+func (manager *StackManager) nextPendingDelete() *edgeStack {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, stack := range manager.stacksWithStatus(StatusPending) {
+		if stack.Action == actionDelete {
+			manager.setStatus(stack, StatusDeleting)
+			stack.Deleting = true
+
+			return stack
+		}
+	}
+
+	return nil
+}
+
+func (manager *StackManager) runDelete(stack *edgeStack) {
+	ctx, end := manager.inFlight.begin(stack.ID, false)
+	defer end()
+
+	manager.mu.Lock()
+	stackName := manager.projectName(stack)
+	stackFileLocation := fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName)
+	manager.mu.Unlock()
+
+	manager.deleteStack(ctx, stack, stackName, stackFileLocation)
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	failed := manager.stacks[stack.ID] == stack
+	if failed && stack.Status == StatusDeleting {
+		// the deletion is attempted again by a later iteration
+		manager.setStatus(stack, StatusPending)
+	}
+
+	if !failed {
+		manager.metrics.deleted()
+	}
+
+	remaining := 0
+	for _, s := range manager.stacks {
+		if s.Action == actionDelete {
+			remaining++
+		}
+	}
+
+	log.Info().
+		Int("stack_identifier", int(stack.ID)).
+		Bool("deleted", !failed).
+		Int("remaining", remaining).
+		Msg("stack deletion progress")
+}
@@ -0,0 +1,55 @@
+package stack
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/portainer/agent/exec"
+)
+
+// deploymentLogs keeps the tail of the output of the deployer commands run by a deployment, the output of the
+// commands is written from several goroutines
+type deploymentLogs struct {
+	mu    sync.Mutex
+	limit int
+	tail  []byte
+}
+
+func (logs *deploymentLogs) Write(p []byte) (int, error) {
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+
+	logs.tail = append(logs.tail, p...)
+	if excess := len(logs.tail) - logs.limit; excess > 0 {
+		logs.tail = append(logs.tail[:0], logs.tail[excess:]...)
+	}
+
+	return len(p), nil
+}
+
+// String returns the tail of the output, it is empty when the logs are not captured
+func (logs *deploymentLogs) String() string {
+	if logs == nil {
+		return ""
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+
+	// the cut may split a multi-byte character
+	return strings.TrimSpace(strings.ToValidUTF8(string(logs.tail), ""))
+}
+
+// captureDeploymentLogs returns a context making the deployer write the output of its commands to the returned
+// logs, bounded to StackManagerConfig.DeployLogs. The context is returned unchanged and the logs are nil when
+// the capture is disabled.
+func (manager *StackManager) captureDeploymentLogs(ctx context.Context) (context.Context, *deploymentLogs) {
+	if manager.config.DeployLogs <= 0 {
+		return ctx, nil
+	}
+
+	logs := &deploymentLogs{limit: manager.config.DeployLogs}
+
+	return exec.WithOutput(ctx, logs), logs
+}
@@ -0,0 +1,93 @@
+package stack
+
+import (
+	"context"
+	"errors"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DeployDiffDisabled deploys the stacks without computing the changes of their deployment
+	DeployDiffDisabled = "disabled"
+	// DeployDiffReport computes and reports the changes of the deployment of a stack before deploying it
+	DeployDiffReport = "report"
+	// DeployDiffOnly computes and reports the changes of the deployment of a stack without deploying it
+	DeployDiffOnly = "only"
+)
+
+var errDiffOnly = errors.New("deployment skipped, only its changes are reported")
+
+// diffStack computes the changes the deployment of a stack would apply, when the deployer supports it.
+// The changes are reported along with the status of the deployment and sent to the admission policy
+// endpoint. When DeployDiff is DeployDiffOnly the stack is not deployed, the changes are reported instead.
+func (manager *StackManager) diffStack(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	stack.Diff = ""
+
+	if manager.config.DeployDiff == "" || manager.config.DeployDiff == DeployDiffDisabled {
+		return nil
+	}
+
+	diffDeployer, ok := manager.deployerFor(stack).(agent.DiffDeployer)
+	if !ok {
+		log.Debug().Int("stack_identifier", int(stack.ID)).Msg("the deployer of the stack engine does not compute the deployment changes")
+
+		if manager.config.DeployDiff == DeployDiffOnly {
+			return manager.reportDiff(stack, "the deployer of the stack engine does not compute the deployment changes")
+		}
+
+		return nil
+	}
+
+	diff, err := manager.diff(ctx, diffDeployer, stack, stackName, stackFileLocation, agent.DeployOptions{
+		DeployerBaseOptions: agent.DeployerBaseOptions{
+			Namespace: stack.Namespace,
+			EnvVars:   stack.EnvVars,
+		},
+		ForceRecreate: stackPullPolicy(stack) == pullPolicyAlways,
+		Profiles:      stack.Profiles,
+	})
+
+	if manager.requeuedDuringOperation(ctx, stack) {
+		return errSupersededDeployment
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to compute the changes of the stack deployment")
+
+		if manager.config.DeployDiff == DeployDiffOnly {
+			return manager.reportDiff(stack, err.Error())
+		}
+
+		return nil
+	}
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Str("diff", diff).Msg("stack deployment changes")
+
+	stack.Diff = diff
+
+	if manager.config.DeployDiff == DeployDiffOnly {
+		return manager.reportDiff(stack, diff)
+	}
+
+	return nil
+}
+
+// reportDiff reports the changes of a stack deployment that is not applied, it must be called with manager.mu held
+func (manager *StackManager) reportDiff(stack *edgeStack, message string) error {
+	manager.setStatus(stack, StatusDiffed)
+	stack.Action = actionIdle
+
+	err := manager.setEdgeStackStatus(stack, client.EdgeStackStatusDiffReported, message)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return errDiffOnly
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package stack
+
+import "syscall"
+
+// availableDiskSpace returns the number of bytes available to unprivileged users on the filesystem of a path
+func availableDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
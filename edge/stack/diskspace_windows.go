@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package stack
+
+import "errors"
+
+// availableDiskSpace returns the number of bytes available to unprivileged users on the filesystem of a path
+func availableDiskSpace(path string) (int64, error) {
+	return 0, errors.New("Platform not supported")
+}
@@ -0,0 +1,136 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ReconcilePolicyReport reports the deployed stacks whose resources were removed as drifted
+	ReconcilePolicyReport = "report"
+	// ReconcilePolicyRedeploy deploys again the deployed stacks whose resources were removed
+	ReconcilePolicyRedeploy = "redeploy"
+)
+
+// driftCheckTimeout bounds the time the deployer takes to return the state of the resources of a stack
+const driftCheckTimeout = time.Minute
+
+type driftedStack struct {
+	stack             *edgeStack
+	deployer          agent.Deployer
+	projectName       string
+	stackFileLocation string
+	options           agent.StatusOptions
+}
+
+// startDriftMonitor periodically checks that the resources of the deployed stacks still exist until the stop
+// signal is closed. The drift of a stack is handled according to its reconcile policy.
+func (manager *StackManager) startDriftMonitor(stopSignal chan struct{}, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopSignal:
+				log.Debug().Msg("shutting down Edge stack drift monitor")
+				return
+			case <-ticker.C:
+				manager.checkStacksDrift()
+			}
+		}
+	}()
+}
+
+func (manager *StackManager) checkStacksDrift() {
+	manager.mu.Lock()
+	stacks := []driftedStack{}
+	for _, stack := range manager.stacks {
+		if stack.Status != StatusDone || (stack.ReconcilePolicy != ReconcilePolicyReport && stack.ReconcilePolicy != ReconcilePolicyRedeploy) {
+			continue
+		}
+
+		stacks = append(stacks, driftedStack{
+			stack:             stack,
+			deployer:          manager.deployerFor(stack),
+			projectName:       manager.projectName(stack),
+			stackFileLocation: fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName),
+			options:           statusOptions(stack),
+		})
+	}
+	manager.mu.Unlock()
+
+	for _, checked := range stacks {
+		ctx, cancel := context.WithTimeout(context.Background(), driftCheckTimeout)
+		states, err := checked.deployer.Status(ctx, checked.projectName, []string{checked.stackFileLocation}, checked.options)
+		cancel()
+
+		if err != nil && !resourcesNotFound(err) {
+			log.Warn().Err(err).Int("stack_identifier", int(checked.stack.ID)).Msg("unable to check the drift of the stack")
+
+			continue
+		}
+
+		manager.updateStackDrift(checked.stack, err != nil || states.Total == 0)
+	}
+}
+
+func (manager *StackManager) updateStackDrift(stack *edgeStack, drifted bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	// the stack was redeployed or removed while its resources were checked
+	if stack.Status != StatusDone || drifted == stack.Drifted {
+		return
+	}
+
+	if !drifted {
+		log.Info().Int("stack_identifier", int(stack.ID)).Msg("the resources of the stack exist again")
+
+		stack.Drifted = false
+
+		err := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusOk, "")
+		if err != nil {
+			log.Error().Err(err).Msg("unable to update Edge stack status")
+		}
+
+		return
+	}
+
+	if stack.ReconcilePolicy == ReconcilePolicyRedeploy {
+		log.Warn().Int("stack_identifier", int(stack.ID)).Msg("the resources of the stack were removed, deploying the stack again")
+
+		stack.Action = actionUpdate
+		stack.Retries = 0
+		stack.NextRetryAt = time.Time{}
+		manager.setStatus(stack, StatusPending)
+		stack.PendingSince = time.Now()
+
+		return
+	}
+
+	log.Warn().Int("stack_identifier", int(stack.ID)).Msg("the resources of the stack were removed, reporting the stack as drifted")
+
+	stack.Drifted = true
+
+	err := manager.setEdgeStackStatus(stack, client.EdgeStackStatusDrifted, "the resources of the stack no longer exist on the environment")
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+}
+
+// resourcesNotFound returns true when the deployer failed to return the state of the resources of a stack
+// because they no longer exist, e.g. kubectl get on deleted resources
+func resourcesNotFound(err error) bool {
+	message := strings.ToLower(err.Error())
+
+	return strings.Contains(message, "notfound") || strings.Contains(message, "not found")
+}
@@ -0,0 +1,121 @@
+package stack
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EmptyStackIgnore deploys the stacks that define no services
+	EmptyStackIgnore = "ignore"
+	// EmptyStackWarn deploys the stacks that define no services and logs a warning
+	EmptyStackWarn = "warn"
+	// EmptyStackError refuses to deploy the stacks that define no services
+	EmptyStackError = "error"
+)
+
+// kubernetesWorkloadKinds are the kinds of the Kubernetes resources running containers
+var kubernetesWorkloadKinds = map[string]bool{
+	"Pod":                   true,
+	"Deployment":            true,
+	"StatefulSet":           true,
+	"DaemonSet":             true,
+	"ReplicaSet":            true,
+	"ReplicationController": true,
+	"Job":                   true,
+	"CronJob":               true,
+}
+
+var nomadGroupRegexp = regexp.MustCompile(`(?m)^\s*group\s+"`)
+
+// checkEmptyStack detects the stacks that define no services, no workloads for Kubernetes and no task groups
+// for Nomad, whose deployment would succeed without running anything. Depending on StackManagerConfig.EmptyStack,
+// the deployment goes on, with a warning or not, or is refused.
+func (manager *StackManager) checkEmptyStack(stack *edgeStack, stackFileLocation string) error {
+	if manager.config.EmptyStack == "" || manager.config.EmptyStack == EmptyStackIgnore {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	manager.mu.Lock()
+	engine := manager.stackEngine(stack)
+	kustomization := stack.Kustomization
+	manager.mu.Unlock()
+
+	// the resources of a kustomization are defined by the files it references
+	if kustomization || !isEmptyStack(engine, string(content)) {
+		return nil
+	}
+
+	if manager.config.EmptyStack == EmptyStackWarn {
+		log.Warn().Int("stack_identifier", int(stack.ID)).Msg("the stack defines no services, its deployment will not run anything")
+
+		return nil
+	}
+
+	err = errors.New("the stack defines no services")
+
+	log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack deployment refused")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
+}
+
+// isEmptyStack returns true when the stack file of an engine defines no services. A file that cannot be
+// parsed is not considered empty, it is reported by the deployer.
+func isEmptyStack(engine engineType, content string) bool {
+	switch engine {
+	case EngineTypeDockerStandalone, EngineTypeDockerSwarm:
+		var compose struct {
+			Services map[string]interface{} `yaml:"services"`
+		}
+
+		err := yaml.Unmarshal([]byte(content), &compose)
+
+		return err == nil && len(compose.Services) == 0
+	case EngineTypeKubernetes:
+		decoder := yaml.NewDecoder(strings.NewReader(content))
+
+		for {
+			var resource struct {
+				Kind string `yaml:"kind"`
+			}
+
+			err := decoder.Decode(&resource)
+			if err != nil {
+				// the end of the manifest, or a document that cannot be parsed
+				return errors.Is(err, io.EOF)
+			}
+
+			if kubernetesWorkloadKinds[resource.Kind] {
+				return false
+			}
+		}
+	case EngineTypeNomad:
+		return !nomadGroupRegexp.MatchString(content)
+	}
+
+	return false
+}
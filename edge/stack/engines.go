@@ -0,0 +1,203 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/portainer/agent"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// NoEngineWait holds the stacks back until the engine of the agent is set
+	NoEngineWait = "wait"
+	// NoEngineFail processes the stacks received before the engine of the agent is set, they fail to deploy
+	NoEngineFail = "fail"
+)
+
+// engineWaitLogInterval is the interval between the logs of a deployment loop waiting for the engine of the agent
+const engineWaitLogInterval = time.Minute
+
+// parseEngineType returns the engine declared in the configuration of a stack.
+// An empty value returns zero, the stack is then deployed to the engine of the agent.
+func parseEngineType(value string) (engineType, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "docker-standalone", "docker", "compose":
+		return EngineTypeDockerStandalone, nil
+	case "docker-swarm", "swarm":
+		return EngineTypeDockerSwarm, nil
+	case "kubernetes", "k8s":
+		return EngineTypeKubernetes, nil
+	case "nomad":
+		return EngineTypeNomad, nil
+	case "helm":
+		return EngineTypeHelm, nil
+	}
+
+	return 0, fmt.Errorf("unsupported engine type %q", value)
+}
+
+// engineName returns the name of an engine, as accepted by parseEngineType
+func engineName(engine engineType) string {
+	switch engine {
+	case EngineTypeDockerStandalone:
+		return "docker-standalone"
+	case EngineTypeDockerSwarm:
+		return "docker-swarm"
+	case EngineTypeKubernetes:
+		return "kubernetes"
+	case EngineTypeNomad:
+		return "nomad"
+	case EngineTypeHelm:
+		return "helm"
+	}
+
+	return ""
+}
+
+// engineAssetsPath returns the assets path holding the deployment binaries of an engine
+func (manager *StackManager) engineAssetsPath(engine engineType) string {
+	if path, ok := manager.config.EngineAssetsPaths[engineName(engine)]; ok && path != "" {
+		return path
+	}
+
+	return manager.assetsPath
+}
+
+func isDockerEngine(engine engineType) bool {
+	return engine == EngineTypeDockerStandalone || engine == EngineTypeDockerSwarm
+}
+
+// stackEngine returns the engine a stack is deployed to, it must be called with manager.mu held
+func (manager *StackManager) stackEngine(stack *edgeStack) engineType {
+	if stack.EngineType != 0 {
+		return stack.EngineType
+	}
+
+	return manager.engineType
+}
+
+// deployerFor returns the deployer of the engine a stack is deployed to.
+// The deployers of the engines other than the one of the agent are built on first use.
+// It must be called with manager.mu held.
+func (manager *StackManager) deployerFor(stack *edgeStack) agent.Deployer {
+	engine := manager.stackEngine(stack)
+	if engine == manager.engineType {
+		return manager.deployer
+	}
+
+	manager.deployersMu.Lock()
+	defer manager.deployersMu.Unlock()
+
+	if deployer, ok := manager.deployers[engine]; ok {
+		return deployer
+	}
+
+	deployer, err := manager.buildDeployer(manager.engineAssetsPath(engine), engine)
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to build the deployer of the stack engine")
+
+		// the deployer is built again for the next stack using this engine
+		return unavailableDeployer{err: err}
+	}
+
+	manager.deployers[engine] = deployer
+
+	return deployer
+}
+
+// checkDeployer refuses to process a stack when no deployer is configured for its engine,
+// e.g. when the engine of the agent could not be set, instead of invoking a nil deployer
+func (manager *StackManager) checkDeployer(stack *edgeStack) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.deployerFor(stack) != nil {
+		return nil
+	}
+
+	deployerErr := fmt.Errorf("no deployer configured for engine %d", manager.stackEngine(stack))
+
+	log.Error().Err(deployerErr).Int("stack_identifier", int(stack.ID)).Msg("unable to process the stack")
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	err := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, deployerErr.Error())
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return deployerErr
+}
+
+// unavailableDeployer is used when the deployer of an engine cannot be built,
+// every operation fails with the build error
+type unavailableDeployer struct {
+	err error
+}
+
+func (d unavailableDeployer) Deploy(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	return d.err
+}
+
+func (d unavailableDeployer) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
+	return d.err
+}
+
+func (d unavailableDeployer) Pull(ctx context.Context, name string, filePaths []string) error {
+	return d.err
+}
+
+func (d unavailableDeployer) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	return d.err
+}
+
+func (d unavailableDeployer) Version(ctx context.Context) (string, error) {
+	return "", d.err
+}
+
+func (d unavailableDeployer) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	return agent.ServiceStates{}, d.err
+}
+
+// waitingForEngine returns whether the stacks wait for the engine of the agent to be set before being processed,
+// it must be called with manager.mu held
+func (manager *StackManager) waitingForEngine() bool {
+	return manager.config.NoEngine != NoEngineFail && manager.deployer == nil
+}
+
+// waitForEngine waits for the engine of the agent to be set before the stacks are processed, the wait is logged
+// every engineWaitLogInterval. It returns false when the stop signal is closed first.
+func (manager *StackManager) waitForEngine(stopSignal chan struct{}, interval time.Duration) bool {
+	var loggedAt time.Time
+
+	for {
+		manager.mu.Lock()
+		waiting := manager.waitingForEngine()
+		manager.mu.Unlock()
+
+		if !waiting {
+			return true
+		}
+
+		if time.Since(loggedAt) >= engineWaitLogInterval {
+			log.Info().Msg("waiting for the engine of the agent to be set before processing the Edge stacks")
+
+			loggedAt = time.Now()
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-stopSignal:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvFilesDisabled ignores the env files provided with the stacks
+	EnvFilesDisabled = "disabled"
+	// EnvFilesWrite writes the env files provided with the stacks next to their compose file
+	EnvFilesWrite = "write"
+	// EnvFilesStrict writes the env files and refuses to deploy a stack referencing an env file that is neither
+	// provided nor present in the stack folder
+	EnvFilesStrict = "strict"
+)
+
+// composeEnvFiles holds the env_file entries of the services of a compose file
+type composeEnvFiles struct {
+	Services map[string]struct {
+		EnvFile interface{} `yaml:"env_file"`
+	} `yaml:"services"`
+}
+
+// writeEnvFiles writes the env files provided with a Docker stack inside the stack folder, so that the relative
+// env_file references of the compose file resolve
+func (manager *StackManager) writeEnvFiles(engine engineType, folder string, envFiles map[string]string) error {
+	if manager.config.EnvFiles == EnvFilesDisabled || !isDockerEngine(engine) {
+		return nil
+	}
+
+	for name, content := range envFiles {
+		path, err := folderFilePath(folder, name)
+		if err != nil {
+			return err
+		}
+
+		err = manager.writeFile(filepath.Dir(path), filepath.Base(path), content)
+		if err != nil {
+			return manager.readOnlyError(err)
+		}
+	}
+
+	return nil
+}
+
+// folderFilePath resolves the path of a file provided with a stack inside the stack folder
+func folderFilePath(folder, name string) (string, error) {
+	path := filepath.Join(folder, name)
+
+	if filepath.IsAbs(name) || !isWithin(filepath.Clean(folder), path) {
+		return "", errors.Errorf("the file %q is outside of the stack folder", name)
+	}
+
+	return path, nil
+}
+
+// checkEnvFiles verifies that the required env files referenced by a Docker stack are present in the stack folder,
+// a stack referencing a missing env file is not deployed
+func (manager *StackManager) checkEnvFiles(stack *edgeStack, stackFileLocation string) error {
+	manager.mu.Lock()
+	engine := manager.stackEngine(stack)
+	manager.mu.Unlock()
+
+	if manager.config.EnvFiles != EnvFilesStrict || !isDockerEngine(engine) {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	missing := missingEnvFiles(filepath.Dir(stackFileLocation), string(content))
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("the env files referenced by the stack were not provided: %s", strings.Join(missing, ", "))
+
+	log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack deployment refused")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
+}
+
+// missingEnvFiles returns the relative env files required by the services of a compose file that are not present in its folder
+func missingEnvFiles(folder, fileContent string) []string {
+	var envFiles composeEnvFiles
+
+	err := yaml.Unmarshal([]byte(fileContent), &envFiles)
+	if err != nil {
+		// invalid files are reported by the deployer
+		return nil
+	}
+
+	missing := map[string]bool{}
+	for _, service := range envFiles.Services {
+		for _, name := range requiredEnvFiles(service.EnvFile) {
+			if filepath.IsAbs(name) {
+				continue
+			}
+
+			_, err := os.Stat(filepath.Join(folder, name))
+			if os.IsNotExist(err) {
+				missing[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// requiredEnvFiles returns the required files of an env_file entry, which is either a path,
+// a list of paths or a list of path and required mappings
+func requiredEnvFiles(envFile interface{}) []string {
+	switch entry := envFile.(type) {
+	case string:
+		return []string{entry}
+	case []interface{}:
+		names := []string{}
+
+		for _, item := range entry {
+			switch file := item.(type) {
+			case string:
+				names = append(names, file)
+			case map[string]interface{}:
+				path, _ := file["path"].(string)
+				if required, ok := file["required"].(bool); path == "" || (ok && !required) {
+					continue
+				}
+
+				names = append(names, path)
+			}
+		}
+
+		return names
+	}
+
+	return nil
+}
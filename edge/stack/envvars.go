@@ -0,0 +1,74 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/portainer/agent/exec"
+)
+
+// envVarReference matches the ${NAME} references to the variables of a stack in its stack file
+var envVarReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// writeStackEnvFile writes the variables of a Docker stack to the env file read by the deployer next to the stack
+// file, the env file is removed when the stack has no variables
+func (manager *StackManager) writeStackEnvFile(engine engineType, folder string, envVars map[string]string) error {
+	if !isDockerEngine(engine) {
+		return nil
+	}
+
+	if len(envVars) == 0 {
+		err := os.Remove(filepath.Join(folder, exec.StackEnvFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	err := manager.writeFile(folder, exec.StackEnvFileName, formatEnvFile(envVars))
+	if err != nil {
+		return manager.readOnlyError(err)
+	}
+
+	return nil
+}
+
+// formatEnvFile formats variables in the env file format, the values are double quoted so that they are
+// taken literally
+func formatEnvFile(envVars map[string]string) string {
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", `\$`)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key + `="` + escape.Replace(envVars[key]) + "\"\n")
+	}
+
+	return b.String()
+}
+
+// expandEnvVars replaces the ${NAME} references to the variables of a Kubernetes stack in its manifest, the
+// references to the variables the stack does not define are left untouched
+func expandEnvVars(content string, envVars map[string]string) string {
+	if len(envVars) == 0 {
+		return content
+	}
+
+	return envVarReference.ReplaceAllStringFunc(content, func(reference string) string {
+		value, ok := envVars[reference[2:len(reference)-1]]
+		if !ok {
+			return reference
+		}
+
+		return value
+	})
+}
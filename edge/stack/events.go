@@ -0,0 +1,185 @@
+package stack
+
+import (
+	"errors"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+	"github.com/portainer/agent/exec"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+const eventQueueSize = 256
+
+// StackEvent represents a status transition of an Edge stack
+type StackEvent struct {
+	StackID   int                           `json:"stackId"`
+	StackName string                        `json:"stackName"`
+	Version   int                           `json:"version"`
+	Status    portainer.EdgeStackStatusType `json:"status"`
+	Message   string                        `json:"message,omitempty"`
+	// Images holds the registry each image was pulled from, it is only set once the stack is deployed
+	Images []ImageSource `json:"images,omitempty"`
+	// ReclaimedSpace is the space reclaimed by the image prune that followed the deployment of the stack
+	ReclaimedSpace uint64 `json:"reclaimedSpace,omitempty"`
+	// PrunableImages holds the images the dry-run image prune that followed the deployment would have removed
+	PrunableImages []string `json:"prunableImages,omitempty"`
+	// Diff holds the changes the deployment of the stack applies, or would apply when it is not deployed
+	Diff string `json:"diff,omitempty"`
+	// Services summarizes the state of the containers of the stack, it is only set once the stack is deployed
+	Services *agent.ServiceStates `json:"services,omitempty"`
+	Time     time.Time            `json:"time"`
+}
+
+// EventSink is used to publish the status transitions of the Edge stacks outside of Portainer
+type EventSink interface {
+	Publish(event StackEvent) error
+}
+
+// eventDispatcher forwards the stack events to the sinks from a dedicated goroutine
+// so that a slow or failing sink never blocks the deployment loop
+type eventDispatcher struct {
+	sinks  []EventSink
+	events chan StackEvent
+}
+
+func newEventDispatcher(sinks []EventSink) *eventDispatcher {
+	dispatcher := &eventDispatcher{
+		sinks:  sinks,
+		events: make(chan StackEvent, eventQueueSize),
+	}
+
+	if len(sinks) > 0 {
+		go dispatcher.run()
+	}
+
+	return dispatcher
+}
+
+func (dispatcher *eventDispatcher) dispatch(event StackEvent) {
+	if len(dispatcher.sinks) == 0 {
+		return
+	}
+
+	select {
+	case dispatcher.events <- event:
+	default:
+		log.Warn().Int("stack_identifier", event.StackID).Msg("stack event queue is full, dropping event")
+	}
+}
+
+func (dispatcher *eventDispatcher) run() {
+	for event := range dispatcher.events {
+		for _, sink := range dispatcher.sinks {
+			err := sink.Publish(event)
+			if err != nil {
+				log.Warn().Err(err).Int("stack_identifier", event.StackID).Msg("unable to publish stack event")
+			}
+		}
+	}
+}
+
+// setEdgeStackStatus reports the status of a stack to Portainer and publishes the transition to the event sinks
+func (manager *StackManager) setEdgeStackStatus(stack *edgeStack, status portainer.EdgeStackStatusType, message string) error {
+	message = exec.ElideOutput(message, manager.config.OutputLimit)
+
+	event := StackEvent{
+		StackID:   int(stack.ID),
+		StackName: stack.Name,
+		Version:   stack.Version,
+		Status:    status,
+		Message:   message,
+		Time:      time.Now(),
+	}
+
+	if status == portainer.EdgeStackStatusOk {
+		event.Images = stack.ImageSources
+		event.ReclaimedSpace = stack.ReclaimedSpace
+		event.PrunableImages = stack.PrunableImages
+	}
+
+	if status == portainer.EdgeStackStatusOk || status == client.EdgeStackStatusDiffReported {
+		event.Diff = stack.Diff
+	}
+
+	var services *agent.ServiceStates
+	if status == portainer.EdgeStackStatusOk || status == client.EdgeStackStatusDegraded || status == client.EdgeStackStatusUnhealthy {
+		services = stack.Services
+		event.Services = services
+	}
+
+	manager.events.dispatch(event)
+
+	manager.tracer.observe(stack, status, message)
+
+	// the deployment logs are only sent with the first status following the deployment
+	logs := stack.DeploymentLogs
+	stack.DeploymentLogs = ""
+
+	err := manager.portainerClient.SetEdgeStackStatusWithLogs(int(stack.ID), status, message, services, logs)
+	if errors.Is(err, client.ErrEdgeStackNotFound) && manager.config.RemoveUnknownStacks {
+		manager.removeUnknownStack(stack)
+	}
+
+	return err
+}
+
+// deleteEdgeStackStatus removes the status of a stack from Portainer and publishes the removal to the event sinks
+func (manager *StackManager) deleteEdgeStackStatus(stack *edgeStack) error {
+	manager.events.dispatch(StackEvent{
+		StackID:   int(stack.ID),
+		StackName: stack.Name,
+		Version:   stack.Version,
+		Status:    portainer.EdgeStackStatusRemove,
+		Time:      time.Now(),
+	})
+
+	return manager.portainerClient.DeleteEdgeStackStatus(int(stack.ID))
+}
+
+// statusName returns a human readable name of an Edge stack status
+func statusName(status portainer.EdgeStackStatusType) string {
+	switch status {
+	case portainer.EdgeStackStatusPending:
+		return "pending"
+	case portainer.EdgeStackStatusOk:
+		return "ok"
+	case portainer.EdgeStackStatusError:
+		return "error"
+	case portainer.EdgeStackStatusAcknowledged:
+		return "acknowledged"
+	case portainer.EdgeStackStatusRemove:
+		return "removed"
+	case portainer.EdgeStackStatusRemoteUpdateSuccess:
+		return "remote_update_success"
+	case portainer.EdgeStackStatusImagesPulled:
+		return "images_pulled"
+	case client.EdgeStackStatusDiffReported:
+		return "diff_reported"
+	case client.EdgeStackStatusDegraded:
+		return "degraded"
+	case client.EdgeStackStatusDeniedByPolicy:
+		return "denied_by_policy"
+	case client.EdgeStackStatusRetrying:
+		return "retrying"
+	case client.EdgeStackStatusSkipped:
+		return "skipped"
+	case client.EdgeStackStatusValidationFailed:
+		return "validation_failed"
+	case client.EdgeStackStatusRolledBack:
+		return "rolled_back"
+	case client.EdgeStackStatusUnhealthy:
+		return "unhealthy"
+	case client.EdgeStackStatusScheduled:
+		return "scheduled"
+	case client.EdgeStackStatusDrifted:
+		return "drifted"
+	case client.EdgeStackStatusImageVerificationFailed:
+		return "image_verification_failed"
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,67 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// stackFilesPath returns the directory the stack files are written to
+func (manager *StackManager) stackFilesPath() string {
+	if manager.config.StackFilesPath != "" {
+		return manager.config.StackFilesPath
+	}
+
+	return agent.EdgeStackFilesPath
+}
+
+// stackFolder returns the directory the files of a stack are written to
+func (manager *StackManager) stackFolder(stackID int) string {
+	return fmt.Sprintf("%s/%d", manager.stackFilesPath(), stackID)
+}
+
+// isStackFolder returns true when folder is a folder inside the stack files path, the only folders the removal
+// of a stack deletes
+func (manager *StackManager) isStackFolder(folder string) bool {
+	root := filepath.Clean(manager.stackFilesPath())
+	folder = filepath.Clean(folder)
+
+	return folder != root && strings.HasPrefix(folder, root+string(filepath.Separator))
+}
+
+// readOnlyError explains how to fix the write of the stack files on a read-only file system
+func (manager *StackManager) readOnlyError(err error) error {
+	if !errors.Is(err, syscall.EROFS) {
+		return err
+	}
+
+	return fmt.Errorf("the Edge stack files path %s is on a read-only file system, set EDGE_STACK_FILES_PATH to a writable location such as a tmpfs mount: %w", manager.stackFilesPath(), err)
+}
+
+// checkStackFilesPath warns when the stack files cannot be written to the stack files path,
+// so that the misconfiguration is detected before the first deployment
+func (manager *StackManager) checkStackFilesPath() {
+	path := manager.stackFilesPath()
+
+	err := os.MkdirAll(path, 0755)
+	if err == nil {
+		var file *os.File
+
+		file, err = os.CreateTemp(path, ".write-check-")
+		if err == nil {
+			file.Close()
+			os.Remove(file.Name())
+
+			return
+		}
+	}
+
+	log.Warn().Err(manager.readOnlyError(err)).Str("path", path).Msg("the Edge stack files path is not writable")
+}
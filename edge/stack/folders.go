@@ -0,0 +1,105 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// FolderCleanupDisabled disables the removal of orphaned stack folders
+	FolderCleanupDisabled = "disabled"
+	// FolderCleanupDryRun only logs the orphaned stack folders that would be removed
+	FolderCleanupDryRun = "dry-run"
+	// FolderCleanupEnabled removes the orphaned stack folders
+	FolderCleanupEnabled = "enabled"
+)
+
+// ReconcileFolders removes the folders of the stack files path that belong to stacks which are
+// no longer managed by the agent, and returns the folders that were (or would be, when dryRun is set) removed.
+// Only folders named after a stack identifier are considered, anything else stored under
+// the stack files path is never touched. The allow and deny patterns of the configuration
+// further restrict the folders that can be removed.
+func (manager *StackManager) ReconcileFolders(dryRun bool) ([]string, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return manager.reconcileFolders(dryRun)
+}
+
+func (manager *StackManager) reconcileFolders(dryRun bool) ([]string, error) {
+	entries, err := os.ReadDir(manager.stackFilesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	removed := []string{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+
+		stackID, err := strconv.Atoi(name)
+		if err != nil || stackID <= 0 || strconv.Itoa(stackID) != name {
+			continue
+		}
+
+		if _, ok := manager.stacks[edgeStackID(stackID)]; ok {
+			continue
+		}
+
+		if !manager.folderCleanupAllowed(name) {
+			log.Debug().Str("folder", name).Msg("orphaned stack folder excluded from cleanup")
+
+			continue
+		}
+
+		folder := filepath.Join(manager.stackFilesPath(), name)
+
+		if dryRun {
+			log.Info().Str("folder", folder).Msg("orphaned stack folder would be removed (dry-run)")
+		} else {
+			err = os.RemoveAll(folder)
+			if err != nil {
+				return removed, err
+			}
+
+			log.Info().Str("folder", folder).Msg("orphaned stack folder removed")
+		}
+
+		removed = append(removed, folder)
+	}
+
+	return removed, nil
+}
+
+// folderCleanupAllowed checks the name of a folder against the allow and deny patterns.
+// Deny patterns take precedence, an empty allow list allows every folder.
+func (manager *StackManager) folderCleanupAllowed(name string) bool {
+	for _, pattern := range manager.config.FolderCleanupDeny {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	if len(manager.config.FolderCleanupAllow) == 0 {
+		return true
+	}
+
+	for _, pattern := range manager.config.FolderCleanupAllow {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
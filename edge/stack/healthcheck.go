@@ -0,0 +1,122 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/docker"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultHealthCheckInterval is the interval between two checks of the workloads of a stack after its deployment
+const defaultHealthCheckInterval = 2 * time.Second
+
+// waitHealthy waits for the workloads of a deployed stack to be healthy, for at most
+// StackManagerConfig.HealthCheckTimeout. It returns the details of the unhealthy workloads once the timeout is
+// reached, they are empty when the stack is healthy or the check is disabled. manager.mu is released while
+// waiting, false is returned when the stack was queued again meanwhile. It must be called with manager.mu held.
+func (manager *StackManager) waitHealthy(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) (string, bool) {
+	if manager.config.HealthCheckTimeout <= 0 {
+		return "", true
+	}
+
+	manager.reportProgress(stack, client.EdgeStackProgressHealthChecking, nil)
+
+	deployer := manager.deployerFor(stack)
+	files := stackFiles(stack, stackFileLocation)
+	options := statusOptions(stack)
+	label, dockerEngine := projectLabel(manager.stackEngine(stack))
+
+	manager.mu.Unlock()
+
+	deadline := time.Now().Add(manager.config.HealthCheckTimeout)
+
+	details := unhealthyDetails(ctx, deployer, stackName, files, options, label, dockerEngine)
+	for details != "" && time.Now().Add(manager.healthCheckInterval).Before(deadline) && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			continue
+		case <-time.After(manager.healthCheckInterval):
+		}
+
+		details = unhealthyDetails(ctx, deployer, stackName, files, options, label, dockerEngine)
+	}
+
+	manager.mu.Lock()
+
+	if stack.Status == StatusPending {
+		return "", false
+	}
+
+	if details != "" {
+		log.Warn().Int("stack_identifier", int(stack.ID)).Str("details", details).Msg("stack deployed but unhealthy")
+	}
+
+	return details, true
+}
+
+// unhealthyServices describes the services of a stack that do not run all their replicas, along with their error
+func unhealthyServices(states agent.ServiceStates) []string {
+	unhealthy := []string{}
+
+	for _, service := range states.Services {
+		if service.Running >= service.Desired && service.Error == "" {
+			continue
+		}
+
+		description := fmt.Sprintf("%s (%d/%d)", service.Name, service.Running, service.Desired)
+		if service.Error != "" {
+			description = fmt.Sprintf("%s (%d/%d: %s)", service.Name, service.Running, service.Desired, service.Error)
+		}
+
+		unhealthy = append(unhealthy, description)
+	}
+
+	return unhealthy
+}
+
+// unhealthyDetails returns the details of the workloads of a stack that are not healthy, empty when all of them are.
+// The containers of the stacks deployed to a Docker engine are checked individually, so that their names are
+// reported and their health checks are taken into account.
+func unhealthyDetails(ctx context.Context, deployer agent.Deployer, stackName string, files []string, options agent.StatusOptions, label string, dockerEngine bool) string {
+	states, err := deployer.Status(ctx, stackName, files, options)
+	if err != nil {
+		return fmt.Sprintf("unable to retrieve the state of the stack: %s", err)
+	}
+
+	if !dockerEngine {
+		if states.Total > 0 && states.Exited == 0 && states.Running == states.Total {
+			return ""
+		}
+
+		details := fmt.Sprintf("%d/%d running, %d exited", states.Running, states.Total, states.Exited)
+		if unhealthy := unhealthyServices(states); len(unhealthy) > 0 {
+			details += ", unhealthy services: " + strings.Join(unhealthy, ", ")
+		}
+
+		return details
+	}
+
+	containers, err := docker.GetContainersWithLabel(fmt.Sprintf("%s=%s", label, stackName))
+	if err != nil {
+		return fmt.Sprintf("unable to retrieve the containers of the stack: %s", err)
+	}
+
+	unhealthy := unhealthyContainers(containers)
+	for _, container := range containers {
+		if strings.Contains(container.Status, "(health: starting)") && len(container.Names) > 0 {
+			unhealthy = append(unhealthy, strings.TrimPrefix(container.Names[0], "/")+" (starting)")
+		}
+	}
+
+	if len(containers) > 0 && len(unhealthy) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d/%d running, unhealthy containers: %s", states.Running, states.Total, strings.Join(unhealthy, ", "))
+}
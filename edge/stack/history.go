@@ -0,0 +1,199 @@
+package stack
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// eventHistory is an EventSink retaining the latest events of each stack in memory, and optionally on disk.
+// At most perStack events are retained for a stack and total events across all stacks, the oldest events
+// being evicted first. The on-disk log is rotated once it reaches maxFileSize, the previous log is kept
+// with the .1 suffix so that at most twice maxFileSize bytes are used on disk.
+type eventHistory struct {
+	perStack    int
+	total       int
+	path        string
+	maxFileSize int64
+	events      []StackEvent
+	counts      map[int]int
+	file        *os.File
+	fileSize    int64
+	mu          sync.Mutex
+}
+
+func newEventHistory(perStack, total int, path string, maxFileSize int64) *eventHistory {
+	history := &eventHistory{
+		perStack:    perStack,
+		total:       total,
+		path:        path,
+		maxFileSize: maxFileSize,
+		counts:      map[int]int{},
+	}
+
+	if path != "" {
+		history.load(path + ".1")
+		history.load(path)
+	}
+
+	return history
+}
+
+// Publish records an event
+func (history *eventHistory) Publish(event StackEvent) error {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	history.add(event)
+
+	if history.path == "" {
+		return nil
+	}
+
+	return history.persist(event)
+}
+
+func (history *eventHistory) add(event StackEvent) {
+	history.events = append(history.events, event)
+	history.counts[event.StackID]++
+
+	if history.perStack > 0 && history.counts[event.StackID] > history.perStack {
+		for i, e := range history.events {
+			if e.StackID == event.StackID {
+				history.remove(i)
+				break
+			}
+		}
+	}
+
+	if history.total > 0 && len(history.events) > history.total {
+		history.remove(0)
+	}
+}
+
+func (history *eventHistory) remove(index int) {
+	stackID := history.events[index].StackID
+
+	history.events = append(history.events[:index], history.events[index+1:]...)
+
+	history.counts[stackID]--
+	if history.counts[stackID] <= 0 {
+		delete(history.counts, stackID)
+	}
+}
+
+func (history *eventHistory) persist(event StackEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if history.file == nil {
+		err = history.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the log left by a previous run is rotated as well once it is full
+	if history.maxFileSize > 0 && history.fileSize > 0 && history.fileSize+int64(len(line)) > history.maxFileSize {
+		history.file.Close()
+		history.file = nil
+
+		err = os.Rename(history.path, history.path+".1")
+		if err != nil {
+			return err
+		}
+
+		err = history.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := history.file.Write(line)
+	history.fileSize += int64(n)
+
+	return err
+}
+
+// open opens the on-disk log for appending
+func (history *eventHistory) open() error {
+	file, err := os.OpenFile(history.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	history.file = file
+	history.fileSize = info.Size()
+
+	return nil
+}
+
+// load replays the events of an on-disk log
+func (history *eventHistory) load(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", path).Msg("unable to read the stack events history")
+		}
+
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event StackEvent
+
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			continue
+		}
+
+		history.add(event)
+	}
+}
+
+// stackEvents returns the retained events of a stack, oldest first
+func (history *eventHistory) stackEvents(stackID int) []StackEvent {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	events := []StackEvent{}
+	for _, event := range history.events {
+		if event.StackID == stackID {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// count returns the number of retained events across all stacks
+func (history *eventHistory) count() int {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	return len(history.events)
+}
+
+// StackEvents returns the retained status transitions of a stack, oldest first
+func (manager *StackManager) StackEvents(stackID int) []StackEvent {
+	return manager.history.stackEvents(stackID)
+}
+
+// EventCount returns the number of status transitions retained across all stacks
+func (manager *StackManager) EventCount() int {
+	return manager.history.count()
+}
@@ -0,0 +1,96 @@
+package stack
+
+import (
+	"os"
+
+	"github.com/portainer/agent/docker"
+
+	"github.com/docker/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+// ImageSource describes the registry an image of a stack was pulled from
+type ImageSource struct {
+	Image string `json:"image"`
+	// Registry is the host of the registry that served the image
+	Registry string `json:"registry"`
+	// OriginalImage is the image reference declared in the stack file, when it was rewritten to use a mirror
+	OriginalImage string `json:"originalImage,omitempty"`
+	// Digest is the repository digest of the local image, when it could be retrieved from the engine
+	Digest string `json:"digest,omitempty"`
+}
+
+// resolveImageSources returns the effective registry of each image of a deployed stack. The registry is
+// read from the written stack file, so that the images rewritten to use a mirror report the mirror, and
+// is confirmed by the repository digests of the local images for the Docker engines. It must be called with
+// manager.mu held, it is released while the digests are retrieved from the engine.
+func (manager *StackManager) resolveImageSources(stack *edgeStack, stackFileLocation string) []ImageSource {
+	stackID := stack.ID
+	fallbackFileContent := stack.FallbackFileContent
+	dockerEngine := isDockerEngine(manager.stackEngine(stack))
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stackID)).Msg("unable to read the stack file to resolve the image sources")
+
+		return nil
+	}
+
+	originalImages := []string{}
+	if fallbackFileContent != "" {
+		for _, match := range imageLineRegexp.FindAllStringSubmatch(fallbackFileContent, -1) {
+			originalImages = append(originalImages, match[3])
+		}
+	}
+
+	sources := []ImageSource{}
+
+	for i, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+		named, err := reference.ParseNormalizedNamed(match[3])
+		if err != nil {
+			continue
+		}
+
+		source := ImageSource{
+			Image:    match[3],
+			Registry: reference.Domain(named),
+		}
+
+		if i < len(originalImages) && originalImages[i] != source.Image {
+			source.OriginalImage = originalImages[i]
+		}
+
+		if dockerEngine {
+			source.Digest = imageRepoDigest(named)
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources
+}
+
+// imageRepoDigest returns the repository digest of a local image matching its repository
+func imageRepoDigest(named reference.Named) string {
+	digests, err := docker.ImageRepoDigests(named.String())
+	if err != nil {
+		return ""
+	}
+
+	for _, digest := range digests {
+		digestNamed, err := reference.ParseNormalizedNamed(digest)
+		if err != nil {
+			continue
+		}
+
+		canonical, ok := digestNamed.(reference.Canonical)
+		if ok && canonical.Name() == named.Name() {
+			return canonical.Digest().String()
+		}
+	}
+
+	return ""
+}
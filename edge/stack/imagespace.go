@@ -0,0 +1,109 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/portainer/agent/docker"
+	"github.com/portainer/agent/edge/manifest"
+	"github.com/rs/zerolog/log"
+)
+
+// checkImageDiskSpace verifies that the image store has enough space to pull the images of a stack
+// that are not present yet. The required space is estimated from the layer sizes of the image manifests.
+// The check is skipped when the required or the available space cannot be determined. It must be called with
+// manager.mu held, it is released while the registries and the engine are queried like the deployer operations.
+func (manager *StackManager) checkImageDiskSpace(ctx context.Context, stack *edgeStack, stackFileLocation string) error {
+	if !manager.config.CheckImageDiskSpace || !isDockerEngine(manager.stackEngine(stack)) {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	// the credentials are looked up through a copy of the stack while manager.mu is released
+	checked := &edgeStack{ID: stack.ID}
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	storePath := manager.config.ImageStorePath
+	if storePath == "" {
+		storePath, err = docker.GetRootDir()
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to retrieve the image store location, skipping the disk space check")
+
+			return nil
+		}
+	}
+
+	available, err := availableDiskSpace(storePath)
+	if err != nil {
+		log.Warn().Err(err).Str("path", storePath).Msg("unable to retrieve the available image store space, skipping the disk space check")
+
+		return nil
+	}
+
+	client := manifest.NewClient()
+	client.AnonymousFirst = manager.config.AnonymousPullFirst
+	required := int64(0)
+
+	for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+		image := match[3]
+
+		exists, err := docker.ImageExists(image)
+		if err == nil && exists {
+			continue
+		}
+
+		size, err := client.ImageSize(ctx, image, manager.imageCredentials(checked, image))
+		if err != nil {
+			log.Warn().Err(err).Str("image", image).Msg("unable to estimate the image size, skipping the disk space check")
+
+			return nil
+		}
+
+		required += size
+	}
+
+	log.Debug().
+		Int("stack_identifier", int(checked.ID)).
+		Int64("required_bytes", required).
+		Int64("available_bytes", available).
+		Msg("image store space estimated")
+
+	if required > available {
+		return fmt.Errorf("insufficient image store space to pull the stack images: %s required, %s available in %s", formatBytes(required), formatBytes(available), storePath)
+	}
+
+	return nil
+}
+
+// imageCredentials returns the stack registry credentials matching the registry of an image
+func (manager *StackManager) imageCredentials(stack *edgeStack, image string) manifest.Credentials {
+	credentials, ok := manager.registryCredentials(stack, image)
+	if !ok {
+		return manifest.Credentials{}
+	}
+
+	return manifest.Credentials{Username: credentials.Username, Password: credentials.Secret}
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
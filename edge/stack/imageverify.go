@@ -0,0 +1,85 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/docker/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+// checkImageSignatures verifies the signatures of the images of a stack before they are pulled, when
+// StackManagerConfig.ImageVerifyKeys is set. A stack holding an image that is not signed, whose signatures are
+// not valid or whose reference cannot be resolved is reported as failing the image verification and is not
+// deployed.
+func (manager *StackManager) checkImageSignatures(ctx context.Context, stack *edgeStack, stackFileLocation string) error {
+	if manager.imageVerifier == nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	verified := map[string]bool{}
+	rejected := []string{}
+
+	for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+		image := match[3]
+		if verified[image] {
+			continue
+		}
+
+		verified[image] = true
+
+		// the references defined through variables are interpolated by the deployment, they cannot be verified
+		if _, err := reference.ParseNormalizedNamed(image); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: unresolved image reference", image))
+
+			continue
+		}
+
+		err := manager.imageVerifier.Verify(ctx, image)
+		if ctx.Err() != nil {
+			manager.mu.Lock()
+			defer manager.mu.Unlock()
+
+			// the cancelled verification queues the stack again, it is not reported as failed
+			manager.requeuedDuringOperation(ctx, stack)
+
+			return errSupersededDeployment
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Str("image", image).Msg("image signature verification failed")
+
+			rejected = append(rejected, fmt.Sprintf("%s: %s", image, err))
+		}
+	}
+
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	reason := fmt.Sprintf("image signature verification failed: %s", strings.Join(rejected, ", "))
+
+	log.Error().Int("stack_identifier", int(stack.ID)).Str("reason", reason).Msg("stack deployment refused")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	err = manager.setEdgeStackStatus(stack, client.EdgeStackStatusImageVerificationFailed, reason)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return fmt.Errorf("stack deployment refused: %s", reason)
+}
@@ -0,0 +1,102 @@
+package stack
+
+import "sync"
+
+// indexedStatuses are the statuses looked up by the deployment loop
+var indexedStatuses = []edgeStackStatus{StatusPending, StatusRetry}
+
+// stackIndex holds the stacks of the indexed statuses, so that they are found without iterating over all the
+// managed stacks. Its entries are checked when read: the stacks that have since changed status or have been
+// removed are dropped then, only the stacks entering an indexed status must be recorded.
+type stackIndex struct {
+	byStatus map[edgeStackStatus]map[edgeStackID]*edgeStack
+	// mu guards byStatus, which is also read by the registry credentials lookup without manager.mu held
+	mu sync.Mutex
+}
+
+func newStackIndex() *stackIndex {
+	index := &stackIndex{
+		byStatus: map[edgeStackStatus]map[edgeStackID]*edgeStack{},
+	}
+
+	for _, status := range indexedStatuses {
+		index.byStatus[status] = map[edgeStackID]*edgeStack{}
+	}
+
+	return index
+}
+
+// record adds a stack to the entries of its current status, a nil index records nothing
+func (index *stackIndex) record(stack *edgeStack) {
+	if index == nil {
+		return
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if stacks, ok := index.byStatus[stack.Status]; ok {
+		stacks[stack.ID] = stack
+	}
+}
+
+// withStatus returns the indexed stacks having a status and drops the stale entries, managed holds the stacks
+// of the manager when the removed stacks must be dropped as well
+func (index *stackIndex) withStatus(status edgeStackStatus, managed map[edgeStackID]*edgeStack) []*edgeStack {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	stacks := []*edgeStack{}
+	for stackID, stack := range index.byStatus[status] {
+		if stack.Status != status || (managed != nil && managed[stackID] != stack) {
+			delete(index.byStatus[status], stackID)
+
+			continue
+		}
+
+		stacks = append(stacks, stack)
+	}
+
+	return stacks
+}
+
+// indexes returns whether the stacks of a status are looked up in the index, a nil index indexes nothing
+func (index *stackIndex) indexes(status edgeStackStatus) bool {
+	if index == nil {
+		return false
+	}
+
+	_, ok := index.byStatus[status]
+
+	return ok
+}
+
+// setStatus sets the status of a stack and records it in the stack index, it must be called with manager.mu held
+func (manager *StackManager) setStatus(stack *edgeStack, status edgeStackStatus) {
+	stack.Status = status
+	manager.index.record(stack)
+}
+
+// storeStack adds a stack to the managed stacks, it must be called with manager.mu held
+func (manager *StackManager) storeStack(stack *edgeStack) {
+	manager.stacks[stack.ID] = stack
+	manager.index.record(stack)
+}
+
+// stacksWithStatus returns the managed stacks having a status. The stacks are looked up in the stack index when
+// it is enabled and indexes the status, otherwise all the managed stacks are iterated over.
+// It must be called with manager.mu held.
+func (manager *StackManager) stacksWithStatus(status edgeStackStatus) []*edgeStack {
+	if manager.index.indexes(status) {
+		return manager.index.withStatus(status, manager.stacks)
+	}
+
+	stacks := []*edgeStack{}
+	for _, stack := range manager.stacks {
+		if stack.Status == status {
+			stacks = append(stacks, stack)
+		}
+	}
+
+	return stacks
+}
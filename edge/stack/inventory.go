@@ -0,0 +1,159 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StackInventoryItem represents a stack managed by the agent
+type StackInventoryItem struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Version     int    `json:"version"`
+	Status      string `json:"status"`
+	ProjectName string `json:"projectName"`
+	// Services summarizes the state of the containers of the deployed stack, when known
+	Services *agent.ServiceStates `json:"services,omitempty"`
+}
+
+// PostReconcileHook is called once the pending stacks of a reconcile cycle have been processed,
+// with the inventory of the stacks managed by the agent
+type PostReconcileHook func(ctx context.Context, inventory []StackInventoryItem) error
+
+// SetPostReconcileHook defines the hook called after each reconcile cycle, it replaces the configured command.
+func (manager *StackManager) SetPostReconcileHook(hook PostReconcileHook) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.postReconcileHook = hook
+}
+
+// Inventory returns the stacks managed by the agent, sorted by identifier
+func (manager *StackManager) Inventory() []StackInventoryItem {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return manager.inventory()
+}
+
+func (manager *StackManager) inventory() []StackInventoryItem {
+	inventory := make([]StackInventoryItem, 0, len(manager.stacks))
+
+	for _, stack := range manager.stacks {
+		projectName := stack.ProjectName
+		if projectName == "" {
+			projectName = fmt.Sprintf("edge_%s", stack.Name)
+		}
+
+		inventory = append(inventory, StackInventoryItem{
+			ID:          int(stack.ID),
+			Name:        stack.Name,
+			Version:     stack.Version,
+			Status:      stackStatusName(stack),
+			ProjectName: projectName,
+			Services:    stack.Services,
+		})
+	}
+
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventory[i].ID < inventory[j].ID
+	})
+
+	return inventory
+}
+
+// runPostReconcileHook calls the post-reconcile hook when the inventory changed since the last call.
+// It is called by the deployment loop once the pending queue is drained.
+func (manager *StackManager) runPostReconcileHook() {
+	manager.mu.Lock()
+	hook := manager.postReconcileHook
+	inventory := manager.inventory()
+	manager.mu.Unlock()
+
+	if hook == nil || reflect.DeepEqual(inventory, manager.lastReconciledInventory) {
+		return
+	}
+
+	manager.lastReconciledInventory = inventory
+
+	ctx, cancel := context.WithTimeout(context.Background(), manager.config.PostReconcileHookTimeout)
+	defer cancel()
+
+	err := hook(ctx, inventory)
+	if err != nil {
+		log.Error().Err(err).Msg("post-reconcile hook failed")
+	}
+}
+
+// commandHook returns a hook running a command with the JSON encoded inventory on its standard input. The command
+// is split on white spaces into the executable and its arguments, without any shell quoting.
+func commandHook(command string) PostReconcileHook {
+	args := strings.Fields(command)
+
+	return func(ctx context.Context, inventory []StackInventoryItem) error {
+		if len(args) == 0 {
+			return errors.New("empty post-reconcile hook command")
+		}
+
+		payload, err := json.Marshal(inventory)
+		if err != nil {
+			return err
+		}
+
+		var stderr bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stderr = &stderr
+
+		start := time.Now()
+
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, stderr.String())
+		}
+
+		log.Debug().Str("command", command).Dur("duration", time.Since(start)).Msg("post-reconcile hook executed")
+
+		return nil
+	}
+}
+
+func stackStatusName(stack *edgeStack) string {
+	switch stack.Status {
+	case StatusPending:
+		return "pending"
+	case StatusDone:
+		if stack.Degraded {
+			return "degraded"
+		}
+
+		return "deployed"
+	case StatusError:
+		return "error"
+	case StatusDeploying:
+		return "deploying"
+	case StatusRetry:
+		return "retrying"
+	case StatusDeleting:
+		return "deleting"
+	case StatusDiffed:
+		return "diffed"
+	case StatusSkipped:
+		return "skipped"
+	}
+
+	return "unknown"
+}
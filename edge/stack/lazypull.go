@@ -0,0 +1,38 @@
+package stack
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// lazyPullSnapshotters are the containerd snapshotters fetching the image content on demand
+var lazyPullSnapshotters = map[string]bool{
+	"stargz": true,
+	"soci":   true,
+	"nydus":  true,
+}
+
+// lazyPullAvailable returns whether the images of a stack are pulled lazily by the engine, which is the case
+// when the Docker engine uses the containerd image store with a lazy pulling snapshotter. The image store is
+// only detected once, it must be called with manager.mu held.
+func (manager *StackManager) lazyPullAvailable(stack *edgeStack) bool {
+	if !manager.config.LazyPull || !isDockerEngine(manager.stackEngine(stack)) {
+		return false
+	}
+
+	if manager.lazyPull == nil {
+		available := false
+
+		store, err := manager.imageStore()
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to retrieve the image store, images are pulled eagerly")
+		} else {
+			available = store.Containerd && lazyPullSnapshotters[store.Driver]
+
+			log.Debug().Str("driver", store.Driver).Bool("containerd", store.Containerd).Bool("lazy_pull", available).Msg("image store detected")
+		}
+
+		manager.lazyPull = &available
+	}
+
+	return *manager.lazyPull
+}
@@ -0,0 +1,147 @@
+package stack
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StackManagerMetrics represents the deployment queue metrics of a StackManager
+type StackManagerMetrics struct {
+	// InFlightDeploys is the number of stacks currently processed by a worker
+	InFlightDeploys int `json:"inFlightDeploys"`
+	// QueueDepth is the number of stacks waiting for a worker
+	QueueDepth int `json:"queueDepth"`
+	// DispatchedTotal is the number of stacks picked up by a worker since the agent started
+	DispatchedTotal int `json:"dispatchedTotal"`
+	// QueueWaitSecondsTotal is the sum of the time spent in the queue by the dispatched stacks
+	QueueWaitSecondsTotal float64 `json:"queueWaitSecondsTotal"`
+	// QueueWaitSecondsMax is the longest time spent in the queue by a dispatched stack
+	QueueWaitSecondsMax float64 `json:"queueWaitSecondsMax"`
+	// InFlightDeletes is the number of stacks currently removed by the delete workers
+	InFlightDeletes int `json:"inFlightDeletes"`
+	// PendingDeletes is the number of stacks waiting for a delete worker
+	PendingDeletes int `json:"pendingDeletes"`
+	// DeletedTotal is the number of stacks removed by the delete workers since the agent started
+	DeletedTotal int `json:"deletedTotal"`
+	// Stacks holds the queue metrics of each stack
+	Stacks []StackQueueMetrics `json:"stacks"`
+}
+
+// StackQueueMetrics represents the queue metrics of a single stack
+type StackQueueMetrics struct {
+	StackID int `json:"stackId"`
+	// LastQueueWaitSeconds is the time the stack spent in the queue before its last dispatch
+	LastQueueWaitSeconds float64 `json:"lastQueueWaitSeconds"`
+}
+
+// deployMetrics tracks the dispatch of the stacks to the deployment workers
+type deployMetrics struct {
+	inFlight        int
+	dispatchedTotal int
+	queueWaitTotal  time.Duration
+	queueWaitMax    time.Duration
+	deletedTotal    int
+	lastQueueWait   map[edgeStackID]time.Duration
+	mu              sync.Mutex
+}
+
+func newDeployMetrics() *deployMetrics {
+	return &deployMetrics{
+		lastQueueWait: map[edgeStackID]time.Duration{},
+	}
+}
+
+// dispatched records that a stack that was queued since pendingSince has been picked up by a worker
+func (metrics *deployMetrics) dispatched(stackID edgeStackID, pendingSince time.Time) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	wait := time.Duration(0)
+	if !pendingSince.IsZero() {
+		wait = time.Since(pendingSince)
+	}
+
+	metrics.inFlight++
+	metrics.dispatchedTotal++
+	metrics.queueWaitTotal += wait
+	if wait > metrics.queueWaitMax {
+		metrics.queueWaitMax = wait
+	}
+	metrics.lastQueueWait[stackID] = wait
+}
+
+// done records that a worker has finished processing a stack
+func (metrics *deployMetrics) done() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.inFlight > 0 {
+		metrics.inFlight--
+	}
+}
+
+// deleted records that a delete worker has removed a stack
+func (metrics *deployMetrics) deleted() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.deletedTotal++
+}
+
+// forget drops the metrics associated to a removed stack
+func (metrics *deployMetrics) forget(stackID edgeStackID) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	delete(metrics.lastQueueWait, stackID)
+}
+
+func (metrics *deployMetrics) snapshot(queueDepth, pendingDeletes, inFlightDeletes int) StackManagerMetrics {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	snapshot := StackManagerMetrics{
+		InFlightDeploys:       metrics.inFlight,
+		QueueDepth:            queueDepth,
+		DispatchedTotal:       metrics.dispatchedTotal,
+		QueueWaitSecondsTotal: metrics.queueWaitTotal.Seconds(),
+		QueueWaitSecondsMax:   metrics.queueWaitMax.Seconds(),
+		InFlightDeletes:       inFlightDeletes,
+		PendingDeletes:        pendingDeletes,
+		DeletedTotal:          metrics.deletedTotal,
+		Stacks:                make([]StackQueueMetrics, 0, len(metrics.lastQueueWait)),
+	}
+
+	for stackID, wait := range metrics.lastQueueWait {
+		snapshot.Stacks = append(snapshot.Stacks, StackQueueMetrics{
+			StackID:              int(stackID),
+			LastQueueWaitSeconds: wait.Seconds(),
+		})
+	}
+
+	sort.Slice(snapshot.Stacks, func(i, j int) bool {
+		return snapshot.Stacks[i].StackID < snapshot.Stacks[j].StackID
+	})
+
+	return snapshot
+}
+
+// Metrics returns the current deployment queue metrics
+func (manager *StackManager) Metrics() StackManagerMetrics {
+	manager.mu.Lock()
+	queueDepth, pendingDeletes, inFlightDeletes := 0, 0, 0
+	for _, stack := range manager.stacks {
+		switch {
+		case stack.Status == StatusDeleting:
+			inFlightDeletes++
+		case stack.Action == actionDelete && stack.Status == StatusPending && manager.deleteWorkersEnabled():
+			pendingDeletes++
+		case stack.Status == StatusPending || stack.Status == StatusRetry:
+			queueDepth++
+		}
+	}
+	manager.mu.Unlock()
+
+	return manager.metrics.snapshot(queueDepth, pendingDeletes, inFlightDeletes)
+}
@@ -0,0 +1,125 @@
+package stack
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+// imageLineRegexp matches the image field of a compose service or of a Kubernetes container
+var imageLineRegexp = regexp.MustCompile(`(?m)^(\s*(?:-\s+)?image:\s*)(["']?)([^"'\s#]+)(["']?)`)
+
+// registryErrorMarkers are the messages of the deployer and engine errors caused by pulling an image from a registry
+var registryErrorMarkers = []string{
+	"pull access denied",
+	"manifest unknown",
+	"not found: manifest",
+	"failed to resolve reference",
+	"error pulling image",
+	"failed to pull image",
+	"errimagepull",
+	"imagepullbackoff",
+	"toomanyrequests",
+	"unauthorized: ",
+	"no such host",
+	"i/o timeout",
+	"tls: ",
+	"x509: ",
+	"/v2/",
+}
+
+// isRegistryError returns true when a pull or a deployment failed because of the registry an image is pulled
+// from, the other errors such as an invalid stack file are not solved by pulling from another registry
+func isRegistryError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, marker := range registryErrorMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageMirror rewrites the image references of a stack file so that they are pulled from a local mirror
+type imageMirror struct {
+	rules map[string]string
+}
+
+func newImageMirror(rules map[string]string) *imageMirror {
+	return &imageMirror{
+		rules: rules,
+	}
+}
+
+// withRules returns a mirror applying rules over the rules of m, the rules of m are kept for the registries
+// missing from rules
+func (m *imageMirror) withRules(rules map[string]string) *imageMirror {
+	if len(rules) == 0 {
+		return m
+	}
+
+	merged := map[string]string{}
+	if m != nil {
+		for registry, mirror := range m.rules {
+			merged[registry] = mirror
+		}
+	}
+
+	for registry, mirror := range rules {
+		merged[registry] = mirror
+	}
+
+	return newImageMirror(merged)
+}
+
+// rewrite returns the content with every image hosted on a mirrored registry pointing at its mirror.
+// The second return value reports whether at least one image reference was rewritten.
+func (m *imageMirror) rewrite(content string) (string, bool) {
+	if m == nil || len(m.rules) == 0 {
+		return content, false
+	}
+
+	rewritten := false
+
+	content = imageLineRegexp.ReplaceAllStringFunc(content, func(line string) string {
+		parts := imageLineRegexp.FindStringSubmatch(line)
+
+		image, ok := m.mirrorImage(parts[3])
+		if !ok {
+			return line
+		}
+
+		log.Debug().Str("image", parts[3]).Str("mirror_image", image).Msg("rewriting image reference to use a registry mirror")
+
+		rewritten = true
+
+		return parts[1] + parts[2] + image + parts[4]
+	})
+
+	return content, rewritten
+}
+
+// mirrorImage returns the reference of the image on its mirror, if a mirror is defined for the image registry
+func (m *imageMirror) mirrorImage(image string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		// images defined through variables or invalid references are left untouched
+		return "", false
+	}
+
+	domain := reference.Domain(named)
+
+	mirror, ok := m.rules[domain]
+	if !ok {
+		return "", false
+	}
+
+	return strings.TrimSuffix(mirror, "/") + strings.TrimPrefix(named.String(), domain), true
+}
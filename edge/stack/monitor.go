@@ -0,0 +1,201 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/docker"
+	"github.com/portainer/agent/edge/client"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+// degradedReportInterval is the minimum interval between two health status updates of the same stack,
+// it prevents a flapping stack from flooding Portainer with status updates
+const degradedReportInterval = 5 * time.Minute
+
+type monitoredStack struct {
+	stack       *edgeStack
+	projectName string
+	label       string
+}
+
+// startHealthMonitor periodically checks the health of the deployed stacks until the stop signal is closed.
+// A deployed stack whose containers become unhealthy is reported as degraded, and reported as
+// deployed again once it recovers.
+func (manager *StackManager) startHealthMonitor(stopSignal chan struct{}, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopSignal:
+				log.Debug().Msg("shutting down Edge stack health monitor")
+				return
+			case <-ticker.C:
+				manager.checkStacksHealth()
+			}
+		}
+	}()
+}
+
+func (manager *StackManager) checkStacksHealth() {
+	manager.mu.Lock()
+	stacks := []monitoredStack{}
+	for _, stack := range manager.stacks {
+		if stack.Status != StatusDone {
+			continue
+		}
+
+		// only the health of the stacks deployed to a Docker engine is monitored
+		label, ok := projectLabel(manager.stackEngine(stack))
+		if !ok {
+			continue
+		}
+
+		stacks = append(stacks, monitoredStack{stack: stack, projectName: manager.projectName(stack), label: label})
+	}
+	manager.mu.Unlock()
+
+	for _, monitored := range stacks {
+		containers, err := docker.GetContainersWithLabel(fmt.Sprintf("%s=%s", monitored.label, monitored.projectName))
+		if err != nil {
+			log.Warn().Err(err).Int("stack_identifier", int(monitored.stack.ID)).Msg("unable to check the health of the stack")
+
+			continue
+		}
+
+		manager.updateStackHealth(monitored.stack, unhealthyContainers(containers), docker.GetServiceStates(containers))
+	}
+}
+
+func (manager *StackManager) updateStackHealth(stack *edgeStack, unhealthy []string, services agent.ServiceStates) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	// the stack was redeployed or removed while its health was checked
+	if stack.Status != StatusDone {
+		return
+	}
+
+	stack.Services = &services
+
+	degraded := len(unhealthy) > 0
+	if degraded == stack.Degraded {
+		return
+	}
+
+	if time.Since(stack.HealthReportedAt) < degradedReportInterval {
+		return
+	}
+
+	stack.Degraded = degraded
+	stack.HealthReportedAt = time.Now()
+
+	status := portainer.EdgeStackStatusOk
+	message := ""
+
+	if degraded {
+		status = client.EdgeStackStatusDegraded
+		message = fmt.Sprintf("%d/%d running, unhealthy containers: %s", services.Running, services.Total, strings.Join(unhealthy, ", "))
+
+		log.Warn().Int("stack_identifier", int(stack.ID)).Strs("containers", unhealthy).Msg("stack is degraded")
+	} else {
+		log.Info().Int("stack_identifier", int(stack.ID)).Msg("stack recovered")
+	}
+
+	err := manager.setEdgeStackStatus(stack, status, message)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+}
+
+// serviceStates returns the state of the containers of a deployed stack, or nil when it cannot be retrieved.
+// It must be called with manager.mu held, it is released while the deployer retrieves the state.
+func (manager *StackManager) serviceStates(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) *agent.ServiceStates {
+	stackID := stack.ID
+	deployer := manager.deployerFor(stack)
+	options := statusOptions(stack)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	states, err := deployer.Status(ctx, stackName, []string{stackFileLocation}, options)
+	if err != nil {
+		log.Debug().Err(err).Int("stack_identifier", int(stackID)).Msg("unable to retrieve the state of the stack containers")
+
+		return nil
+	}
+
+	return &states
+}
+
+// StackState returns the runtime state of the services of a stack, as reported by the deployer of its engine.
+// ErrUnknownStack is returned when the stack is not managed by the agent or was not deployed yet.
+func (manager *StackManager) StackState(ctx context.Context, stackID int) (agent.ServiceStates, error) {
+	manager.mu.Lock()
+	stack, ok := manager.stacks[edgeStackID(stackID)]
+	if !ok || stack.FileName == "" {
+		manager.mu.Unlock()
+
+		return agent.ServiceStates{}, ErrUnknownStack
+	}
+
+	deployer := manager.deployerFor(stack)
+	stackName := manager.projectName(stack)
+	files := stackFiles(stack, fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName))
+	options := statusOptions(stack)
+	manager.mu.Unlock()
+
+	if deployer == nil {
+		return agent.ServiceStates{}, fmt.Errorf("no deployer configured for the stack %d", stackID)
+	}
+
+	return deployer.Status(ctx, stackName, files, options)
+}
+
+// statusOptions returns the options retrieving the state of the workloads of a stack from its deployer
+func statusOptions(stack *edgeStack) agent.StatusOptions {
+	return agent.StatusOptions{
+		DeployerBaseOptions: agent.DeployerBaseOptions{
+			Namespace: stack.Namespace,
+			EnvVars:   stack.EnvVars,
+		},
+	}
+}
+
+// unhealthyContainers returns the names of the containers that are restarting, dead,
+// exited with an error or reported as unhealthy by their health check
+func unhealthyContainers(containers []types.Container) []string {
+	unhealthy := []string{}
+
+	for _, container := range containers {
+		healthy := true
+
+		switch container.State {
+		case "restarting", "dead":
+			healthy = false
+		case "exited":
+			healthy = strings.HasPrefix(container.Status, "Exited (0)")
+		default:
+			healthy = !strings.Contains(container.Status, "(unhealthy)")
+		}
+
+		if !healthy {
+			name := container.ID
+			if len(container.Names) > 0 {
+				name = strings.TrimPrefix(container.Names[0], "/")
+			}
+
+			unhealthy = append(unhealthy, name)
+		}
+	}
+
+	return unhealthy
+}
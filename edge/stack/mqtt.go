@@ -0,0 +1,61 @@
+package stack
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/mqtt"
+)
+
+// mqttSink publishes the stack events to an MQTT broker
+type mqttSink struct {
+	publisher     *mqtt.Publisher
+	topicTemplate string
+	deviceID      string
+}
+
+type mqttStatusMessage struct {
+	StackEvent
+	StatusName string `json:"statusName"`
+	DeviceID   string `json:"deviceId"`
+}
+
+func newMQTTSink(brokerURL, topicTemplate, deviceID string) (*mqttSink, error) {
+	publisher, err := mqtt.NewPublisher(brokerURL, "portainer-agent-"+deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if topicTemplate == "" {
+		topicTemplate = agent.DefaultEdgeStackMQTTTopic
+	}
+
+	return &mqttSink{
+		publisher:     publisher,
+		topicTemplate: topicTemplate,
+		deviceID:      deviceID,
+	}, nil
+}
+
+func (sink *mqttSink) Publish(event StackEvent) error {
+	payload, err := json.Marshal(mqttStatusMessage{
+		StackEvent: event,
+		StatusName: statusName(event.Status),
+		DeviceID:   sink.deviceID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return sink.publisher.Publish(sink.topic(event), payload)
+}
+
+func (sink *mqttSink) topic(event StackEvent) string {
+	return strings.NewReplacer(
+		"{device}", sink.deviceID,
+		"{id}", strconv.Itoa(event.StackID),
+		"{name}", event.StackName,
+	).Replace(sink.topicTemplate)
+}
@@ -0,0 +1,80 @@
+package stack
+
+import (
+	"context"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// trackNamespaceChange records the previous namespace of a Kubernetes stack whose namespace changes, so that the
+// resources deployed to the previous namespace are removed before the stack is applied to its new namespace.
+// It must be called with manager.mu held, before the namespace of the stack is updated.
+func (manager *StackManager) trackNamespaceChange(stack *edgeStack, namespace string) {
+	// the stack was not deployed yet when its file was never written
+	if !manager.config.RemovePreviousNamespace || stack.FileName == "" {
+		return
+	}
+
+	if stack.NamespaceChanged && stack.PreviousNamespace == namespace {
+		// the namespace was changed back before the new namespace was deployed
+		stack.NamespaceChanged = false
+		stack.PreviousNamespace = ""
+
+		return
+	}
+
+	if stack.Namespace == namespace || stack.NamespaceChanged {
+		return
+	}
+
+	log.Debug().
+		Int("stack_identifier", int(stack.ID)).
+		Str("previous_namespace", stack.Namespace).
+		Str("namespace", namespace).
+		Msg("stack namespace changed")
+
+	stack.NamespaceChanged = true
+	stack.PreviousNamespace = stack.Namespace
+}
+
+// removePreviousNamespace removes the resources of a Kubernetes stack from its previous namespace, so that they are
+// not orphaned by the deployment to the new namespace. The resources are identified from the current manifest.
+// A failed removal is logged and retried by the next update.
+func (manager *StackManager) removePreviousNamespace(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) {
+	manager.mu.Lock()
+	changed, previousNamespace := stack.NamespaceChanged, stack.PreviousNamespace
+	engine := manager.stackEngine(stack)
+	deployer := manager.deployerFor(stack)
+	manager.mu.Unlock()
+
+	if !changed || (engine != EngineTypeKubernetes && engine != EngineTypeHelm) {
+		return
+	}
+
+	log.Info().Int("stack_identifier", int(stack.ID)).Str("namespace", previousNamespace).Msg("removing the stack resources from its previous namespace")
+
+	release, err := manager.acquireOperation(ctx)
+	if err == nil {
+		err = deployer.Remove(ctx, stackName, []string{stackFileLocation}, agent.RemoveOptions{
+			DeployerBaseOptions: agent.DeployerBaseOptions{
+				Namespace: previousNamespace,
+			},
+		})
+		release()
+	}
+
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Str("namespace", previousNamespace).Msg("unable to remove the stack resources from its previous namespace")
+
+		return
+	}
+
+	manager.mu.Lock()
+	if stack.NamespaceChanged && stack.PreviousNamespace == previousNamespace {
+		stack.NamespaceChanged = false
+		stack.PreviousNamespace = ""
+	}
+	manager.mu.Unlock()
+}
@@ -0,0 +1,104 @@
+package stack
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// injectDefaultNetwork defines the driver of the default network of a compose file so that the services
+// without explicit networks are attached to a network using the driver of the site. A compose file that
+// already defines its default network is left untouched, the rest of the content is never modified.
+func injectDefaultNetwork(content, driver string, driverOpts map[string]string) (string, error) {
+	var document yaml.Node
+
+	err := yaml.Unmarshal([]byte(content), &document)
+	if err != nil {
+		return content, err
+	}
+
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return content, errors.New("the compose file is not a mapping")
+	}
+
+	root := document.Content[0]
+
+	var networksKey, networks *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "networks" {
+			networksKey, networks = root.Content[i], root.Content[i+1]
+		}
+	}
+
+	lines := strings.Split(content, "\n")
+
+	switch {
+	case networks == nil:
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+
+		lines = append(lines, "networks:")
+		lines = append(lines, defaultNetworkLines(2, driver, driverOpts)...)
+		lines = append(lines, "")
+	case networks.Kind == yaml.ScalarNode && networks.Tag == "!!null":
+		lines = insertLines(lines, networksKey.Line, defaultNetworkLines(2, driver, driverOpts))
+	case networks.Kind == yaml.MappingNode && networks.Style&yaml.FlowStyle == 0 && len(networks.Content) > 0:
+		for i := 0; i < len(networks.Content); i += 2 {
+			if networks.Content[i].Value == "default" {
+				log.Debug().Msg("the compose file defines its default network, skipping the network driver injection")
+
+				return content, nil
+			}
+		}
+
+		first := networks.Content[0]
+		lines = insertLines(lines, first.Line-1, defaultNetworkLines(first.Column-1, driver, driverOpts))
+	default:
+		return content, errors.New("unsupported definition of the compose file networks")
+	}
+
+	log.Debug().Str("driver", driver).Msg("injecting the default network driver in the compose file")
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// defaultNetworkLines returns the definition of the default network, indented by indent spaces
+func defaultNetworkLines(indent int, driver string, driverOpts map[string]string) []string {
+	pad := strings.Repeat(" ", indent)
+
+	lines := []string{
+		pad + "default:",
+		pad + pad + "driver: " + strconv.Quote(driver),
+	}
+
+	if len(driverOpts) == 0 {
+		return lines
+	}
+
+	keys := make([]string, 0, len(driverOpts))
+	for key := range driverOpts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines = append(lines, pad+pad+"driver_opts:")
+	for _, key := range keys {
+		lines = append(lines, pad+pad+pad+strconv.Quote(key)+": "+strconv.Quote(driverOpts[key]))
+	}
+
+	return lines
+}
+
+// insertLines inserts lines before the line at index position
+func insertLines(lines []string, position int, inserted []string) []string {
+	result := make([]string, 0, len(lines)+len(inserted))
+	result = append(result, lines[:position]...)
+	result = append(result, inserted...)
+
+	return append(result, lines[position:]...)
+}
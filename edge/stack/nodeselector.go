@@ -0,0 +1,59 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errNodeSelectorMismatch = errors.New("the device does not match the node selector of the stack")
+
+// checkNodeSelector skips the deployment of a stack whose node selector does not match the labels of the device,
+// the stack is reported as skipped along with the labels that did not match
+func (manager *StackManager) checkNodeSelector(stack *edgeStack) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	mismatches := nodeSelectorMismatches(stack.NodeSelector, manager.config.NodeLabels)
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	reason := fmt.Sprintf("not applicable to this device, node selector mismatch: %s", strings.Join(mismatches, ", "))
+
+	log.Info().Int("stack_identifier", int(stack.ID)).Str("reason", reason).Msg("skipping the stack deployment")
+
+	manager.setStatus(stack, StatusSkipped)
+	stack.Action = actionIdle
+
+	err := manager.setEdgeStackStatus(stack, client.EdgeStackStatusSkipped, reason)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return errNodeSelectorMismatch
+}
+
+// nodeSelectorMismatches returns the labels of a node selector that the device labels do not match, sorted by key
+func nodeSelectorMismatches(selector, labels map[string]string) []string {
+	mismatches := []string{}
+
+	for key, value := range selector {
+		actual, ok := labels[key]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s=%s (label not set)", key, value))
+		case actual != value:
+			mismatches = append(mismatches, fmt.Sprintf("%s=%s (device has %s=%s)", key, value, key, actual))
+		}
+	}
+
+	sort.Strings(mismatches)
+
+	return mismatches
+}
@@ -0,0 +1,136 @@
+package stack
+
+import (
+	"context"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// newOperationSlots returns the slots bounding the number of deployer operations running at the same time,
+// a zero limit returns nil which leaves them unbounded
+func newOperationSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+
+	return make(chan struct{}, limit)
+}
+
+// pull pulls the images of a stack once a deployer operation slot is available,
+// it must be called with manager.mu held
+func (manager *StackManager) pull(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) error {
+	deployer := manager.deployerFor(stack)
+	files := stackFiles(stack, stackFileLocation)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return deployer.Pull(ctx, stackName, files)
+}
+
+// deploy deploys a stack once a deployer operation slot is available, it must be called with manager.mu held
+func (manager *StackManager) deploy(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string, options agent.DeployOptions) error {
+	deployer := manager.deployerFor(stack)
+	files := stackFiles(stack, stackFileLocation)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return deployer.Deploy(ctx, stackName, files, options)
+}
+
+// build builds the images of a stack whose services declare a build section once a deployer operation slot is
+// available, nothing is done for the other stacks and the deployers that do not build images. It must be called
+// with manager.mu held.
+func (manager *StackManager) build(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string, options agent.BuildOptions) error {
+	buildDeployer, ok := manager.deployerFor(stack).(agent.BuildDeployer)
+	if !ok {
+		return nil
+	}
+
+	files := stackFiles(stack, stackFileLocation)
+	if !composeBuilds(files) {
+		return nil
+	}
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Msg("building the stack images")
+
+	manager.reportProgress(stack, client.EdgeStackProgressBuilding, nil)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return buildDeployer.Build(ctx, stackName, files, options)
+}
+
+// validate validates the files of a stack once a deployer operation slot is available,
+// it must be called with manager.mu held
+func (manager *StackManager) validate(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string, options agent.DeployOptions) error {
+	deployer := manager.deployerFor(stack)
+	files := stackFiles(stack, stackFileLocation)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return deployer.Validate(ctx, stackName, files, options)
+}
+
+// diff computes the changes the deployment of a stack would apply once a deployer operation slot is available,
+// it must be called with manager.mu held
+func (manager *StackManager) diff(ctx context.Context, diffDeployer agent.DiffDeployer, stack *edgeStack, stackName, stackFileLocation string, options agent.DeployOptions) (string, error) {
+	files := stackFiles(stack, stackFileLocation)
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	return diffDeployer.Diff(ctx, stackName, files, options)
+}
+
+// acquireOperation waits for a free slot before invoking the deployer, whether to pull, deploy or remove a stack.
+// It bounds the total deployer activity on top of the limits specific to each operation, the returned function
+// releases the slot. The context error is returned when ctx is done before a slot is free.
+func (manager *StackManager) acquireOperation(ctx context.Context) (func(), error) {
+	if manager.operations == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case manager.operations <- struct{}{}:
+		return func() { <-manager.operations }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// writeOverrideFiles writes the override files provided with a Docker stack inside the stack folder, the previously
+// written override files that are no longer provided are removed. It returns the names of the written files in the
+// order they are applied on top of the stack file.
+func (manager *StackManager) writeOverrideFiles(engine engineType, folder string, overrideFiles []agent.EdgeStackFile, previous []string) ([]string, error) {
+	if !isDockerEngine(engine) {
+		return nil, nil
+	}
+
+	written := make([]string, 0, len(overrideFiles))
+	provided := map[string]bool{}
+
+	for _, file := range overrideFiles {
+		path, err := folderFilePath(folder, file.Name)
+		if err != nil {
+			return previous, err
+		}
+
+		err = manager.writeFile(filepath.Dir(path), filepath.Base(path), file.Content)
+		if err != nil {
+			return previous, manager.readOnlyError(err)
+		}
+
+		written = append(written, file.Name)
+		provided[file.Name] = true
+	}
+
+	for _, name := range previous {
+		if provided[name] {
+			continue
+		}
+
+		path, err := folderFilePath(folder, name)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", name).Msg("unable to remove the override file that is no longer provided")
+		}
+	}
+
+	return written, nil
+}
+
+// stackFiles returns the files a stack is deployed from: the stack file followed by its override files, in the
+// order they are applied. It must be called with manager.mu held.
+func stackFiles(stack *edgeStack, stackFileLocation string) []string {
+	files := []string{stackFileLocation}
+
+	for _, name := range stack.OverrideFiles {
+		files = append(files, filepath.Join(stack.FileFolder, name))
+	}
+
+	return files
+}
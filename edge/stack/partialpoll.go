@@ -0,0 +1,44 @@
+package stack
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// partialPoll returns whether a poll response is likely partial, in which case the stacks missing from it are not
+// removed. A response is suspicious when it misses at least StackManagerConfig.PartialPollThreshold percent of the
+// managed stacks, the removals are then applied once the next poll response confirms them.
+// It must be called with manager.mu held.
+func (manager *StackManager) partialPoll(pollResponseStacks map[int]int) bool {
+	if manager.config.PartialPollThreshold <= 0 {
+		return false
+	}
+
+	managed, missing := 0, 0
+	for stackID, stack := range manager.stacks {
+		if stack.Deleting || stack.Action == actionDelete {
+			continue
+		}
+
+		managed++
+
+		if _, ok := pollResponseStacks[int(stackID)]; !ok {
+			missing++
+		}
+	}
+
+	if missing == 0 || missing*100 < managed*manager.config.PartialPollThreshold || manager.partialPollSkipped {
+		manager.partialPollSkipped = false
+
+		return false
+	}
+
+	manager.partialPollSkipped = true
+
+	log.Warn().
+		Int("managed_stacks", managed).
+		Int("missing_stacks", missing).
+		Int("poll_response_stacks", len(pollResponseStacks)).
+		Msg("the poll response is likely partial, skipping the removal of the missing stacks until the next poll confirms it")
+
+	return true
+}
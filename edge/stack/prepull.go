@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"fmt"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startPrePullWorkers pulls the images of the pending stacks with at most StackManagerConfig.PrePullWorkers
+// pulls running at the same time, until the stop signal is closed
+func (manager *StackManager) startPrePullWorkers(stopSignal chan struct{}, sleepInterval time.Duration) {
+	workers := make(chan struct{}, manager.config.PrePullWorkers)
+
+	go func() {
+		for {
+			select {
+			case <-stopSignal:
+				log.Debug().Msg("shutting down Edge stack pre-pull workers")
+				return
+			case workers <- struct{}{}:
+			}
+
+			stack := manager.nextPrePull()
+			if stack == nil {
+				<-workers
+
+				timer := time.NewTimer(sleepInterval)
+				select {
+				case <-stopSignal:
+					timer.Stop()
+				case <-timer.C:
+				}
+
+				continue
+			}
+
+			go func() {
+				defer func() { <-workers }()
+
+				manager.runPrePull(stack)
+			}()
+		}
+	}()
+}
+
+// prePullPending returns whether the images of a pending stack are left to pull by the pre-pull workers for its
+// current version. The stacks being retried, and the ones whose images the agent pulls itself, are pulled by their
+// deployment. It must be called with manager.mu held.
+func (manager *StackManager) prePullPending(stack *edgeStack) bool {
+	if manager.config.PrePullWorkers <= 0 || stack.Status != StatusPending || stack.Dispatched || stack.PrePulling {
+		return false
+	}
+
+	if stack.Action != actionDeploy && stack.Action != actionUpdate {
+		return false
+	}
+
+	if stack.PrePulledVersion == stack.Version || stack.Retries > 0 {
+		return false
+	}
+
+	policy := stackPullPolicy(stack)
+	if policy == pullPolicyNone || (policy == pullPolicyBeforeDeploy && manager.lazyPullAvailable(stack)) {
+		return false
+	}
+
+	return !manager.pullsThroughAgent(stack)
+}
+
+// awaitingPrePull returns whether the deployment of a pending stack waits for the pre-pull of its images,
+// it must be called with manager.mu held
+func (manager *StackManager) awaitingPrePull(stack *edgeStack) bool {
+	return stack.PrePulling || manager.prePullPending(stack)
+}
+
+// prePulled returns whether the images of the current version of a stack were pulled by the pre-pull workers,
+// it must be called with manager.mu held
+func (manager *StackManager) prePulled(stack *edgeStack) bool {
+	return manager.config.PrePullWorkers > 0 && stack.ImagesPulled && stack.PrePulledVersion == stack.Version
+}
+
+// nextPrePull returns the next pending stack whose images are left to pre-pull and marks it as being pre-pulled
+func (manager *StackManager) nextPrePull() *edgeStack {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, stack := range manager.stacksWithStatus(StatusPending) {
+		if manager.prePullPending(stack) {
+			stack.PrePulling = true
+
+			return stack
+		}
+	}
+
+	return nil
+}
+
+// runPrePull pulls the images of a stack without holding manager.mu. A failed pre-pull is not retried, the
+// deployment of the stack pulls the images again and handles the failure.
+func (manager *StackManager) runPrePull(stack *edgeStack) {
+	ctx, end := manager.inFlight.begin(stack.ID, true)
+	defer end()
+
+	manager.mu.Lock()
+	version := stack.Version
+	stackName := manager.projectName(stack)
+	deployer := manager.deployerFor(stack)
+	files := stackFiles(stack, fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName))
+	manager.mu.Unlock()
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Int("stack_version", version).Msg("stack pre-pulling images")
+
+	release, err := manager.acquireOperation(ctx)
+	if err == nil {
+		err = deployer.Pull(ctx, stackName, files)
+		release()
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	stack.PrePulling = false
+	stack.PrePulledVersion = version
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack images pre-pull failed, the deployment pulls them again")
+
+		return
+	}
+
+	// the files of a newer version may have been written during the pull
+	if stack.Version != version {
+		return
+	}
+
+	stack.ImagesPulled = true
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Int("stack_version", version).Msg("stack images pre-pulled")
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusImagesPulled, "")
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+}
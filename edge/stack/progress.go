@@ -0,0 +1,76 @@
+package stack
+
+import (
+	"time"
+
+	"github.com/portainer/agent/docker"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// pullProgressInterval is the minimum interval between two reports of the progress of an image pull
+const pullProgressInterval = 5 * time.Second
+
+// reportProgress reports the phase a deployment of a stack entered when StackManagerConfig.ReportProgress is set,
+// percent is the completion of the phase, nil when it is unknown. It must be called with manager.mu held.
+func (manager *StackManager) reportProgress(stack *edgeStack, phase client.EdgeStackProgressPhase, percent *int) {
+	if !manager.config.ReportProgress {
+		return
+	}
+
+	manager.sendProgress(stack, client.EdgeStackProgress{
+		Version: stack.Version,
+		Phase:   phase,
+		Percent: percent,
+	})
+}
+
+func (manager *StackManager) sendProgress(stack *edgeStack, progress client.EdgeStackProgress) {
+	err := manager.portainerClient.SetEdgeStackProgress(int(stack.ID), progress)
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Str("phase", string(progress.Phase)).Msg("unable to update Edge stack progress")
+	}
+}
+
+// reportPullProgress reports the share of the images of a stack pulled so far
+func (manager *StackManager) reportPullProgress(stack *edgeStack, pulled, total int) {
+	if total == 0 {
+		return
+	}
+
+	percent := pulled * 100 / total
+	manager.reportProgress(stack, client.EdgeStackProgressPulling, &percent)
+}
+
+// reportImagePullProgress reports the layers and bytes pulled of the image at the position index among the total
+// images of a stack, at most once per pullProgressInterval
+func (manager *StackManager) reportImagePullProgress(stack *edgeStack, image string, index, total int, progress docker.PullProgress) {
+	if !manager.config.ReportProgress || time.Since(stack.PullProgressReportedAt) < pullProgressInterval {
+		return
+	}
+
+	stack.PullProgressReportedAt = time.Now()
+
+	imagePercent := 0
+	if progress.Bytes > 0 {
+		imagePercent = int(progress.BytesPulled * 100 / progress.Bytes)
+	}
+
+	percent := ((index-1)*100 + imagePercent) / total
+
+	manager.sendProgress(stack, client.EdgeStackProgress{
+		Version: stack.Version,
+		Phase:   client.EdgeStackProgressPulling,
+		Percent: &percent,
+		Pull: &client.EdgeStackPullProgress{
+			Image:        image,
+			ImageIndex:   index,
+			Images:       total,
+			Layers:       progress.Layers,
+			LayersPulled: progress.LayersPulled,
+			Bytes:        progress.Bytes,
+			BytesPulled:  progress.BytesPulled,
+		},
+	})
+}
@@ -0,0 +1,215 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/portainer/agent/docker"
+
+	"github.com/docker/distribution/reference"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ImagePruneDisabled keeps the images after the deployments
+	ImagePruneDisabled = "disabled"
+	// ImagePruneDangling removes the dangling images after a successful deployment
+	ImagePruneDangling = "dangling"
+	// ImagePruneUnused removes the images that are not used by any container nor referenced by a managed stack
+	// after a successful deployment
+	ImagePruneUnused = "unused"
+	// ImagePruneDryRun reports the images ImagePruneUnused would remove after a successful deployment, without
+	// removing them
+	ImagePruneDryRun = "dry-run"
+)
+
+// stackImagePrune returns the image prune policy of a stack, the policy of the stack overrides
+// StackManagerConfig.ImagePrune when it is valid
+func (manager *StackManager) stackImagePrune(stack *edgeStack) string {
+	switch stack.ImagePrune {
+	case ImagePruneDisabled, ImagePruneDangling, ImagePruneUnused, ImagePruneDryRun:
+		return stack.ImagePrune
+	case "":
+	default:
+		log.Warn().Int("stack_identifier", int(stack.ID)).Str("image_prune", stack.ImagePrune).Msg("unknown image prune policy of the stack, using the policy of the agent")
+	}
+
+	return manager.config.ImagePrune
+}
+
+// pruneImages removes the images left unused by a successful deployment according to the image prune policy of
+// the stack and returns the reclaimed space. Only the images pulled for the stacks are removed, and never the ones
+// still referenced by a managed stack, so that the images pre-pulled for a pending deployment are kept. With
+// ImagePruneDryRun, nothing is removed: the images that would be removed are returned instead, along with a report
+// of them to send to Portainer in the status message. It must be called with manager.mu held, the filter is computed
+// under the lock and the images are removed with the lock released.
+func (manager *StackManager) pruneImages(stack *edgeStack, stackFileLocation string) (uint64, []string, string) {
+	if !isDockerEngine(manager.stackEngine(stack)) {
+		return 0, nil, ""
+	}
+
+	policy := manager.stackImagePrune(stack)
+	if policy != ImagePruneDangling && policy != ImagePruneUnused && policy != ImagePruneDryRun {
+		return 0, nil, ""
+	}
+
+	stackID := stack.ID
+
+	var pulled *pulledImages
+	var filter *imagesFilter
+	if policy != ImagePruneDangling {
+		pulled = manager.loadPulledImages()
+		filter = manager.prunableImagesFilter(pulled)
+	}
+
+	relock := manager.unlockDuringOperation()
+	defer relock()
+
+	var reclaimed uint64
+	var removed []string
+	var err error
+
+	if policy == ImagePruneDangling {
+		reclaimed, err = docker.PruneDanglingImages()
+	} else {
+		pulled.add(stackFileImages(stackFileLocation))
+
+		reclaimed, removed, err = docker.RemoveUnusedImages(filter.prunable, policy == ImagePruneDryRun)
+		if err == nil && policy == ImagePruneUnused {
+			pulled.forget(filter.identifiers(removed))
+		}
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stackID)).Msg("unable to prune the unused images")
+
+		return 0, nil, ""
+	}
+
+	if policy == ImagePruneDryRun {
+		log.Info().Int("stack_identifier", int(stackID)).Strs("images", removed).Uint64("reclaimable_space", reclaimed).Msg("unused images found by the dry-run image prune")
+
+		return 0, removed, imagePruneReport(removed, reclaimed)
+	}
+
+	log.Debug().Int("stack_identifier", int(stackID)).Uint64("reclaimed_space", reclaimed).Msg("unused images pruned")
+
+	return reclaimed, nil, ""
+}
+
+// imagePruneReport describes the images a dry-run image prune would remove, it is sent in the status message
+func imagePruneReport(images []string, size uint64) string {
+	if len(images) == 0 {
+		return "image prune dry-run: no unused image"
+	}
+
+	return fmt.Sprintf("image prune dry-run: %d unused images (%d bytes) would be removed: %s", len(images), size, strings.Join(images, ", "))
+}
+
+// loadPulledImages returns the images pulled for the stacks, loading them on first use.
+// It must be called with manager.mu held.
+func (manager *StackManager) loadPulledImages() *pulledImages {
+	if manager.pulledImages == nil {
+		manager.pulledImages = loadPulledImages(manager.stackFilesPath())
+	}
+
+	return manager.pulledImages
+}
+
+// stackFileImages returns the images referenced by a stack file
+func stackFileImages(stackFileLocation string) []string {
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return nil
+	}
+
+	var images []string
+	for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+		images = append(images, match[3])
+	}
+
+	return images
+}
+
+// imagesFilter selects the images an unused image prune may remove
+type imagesFilter struct {
+	pulled     *pulledImages
+	referenced func(repoTags []string) bool
+	// candidates holds the ID and the tags of the selected images by the name the prune reports them under
+	candidates map[string][]string
+}
+
+// prunableImagesFilter returns a filter selecting the images pulled for the stacks that are no longer referenced by
+// the files of the managed stacks, it must be called with manager.mu held
+func (manager *StackManager) prunableImagesFilter(pulled *pulledImages) *imagesFilter {
+	return &imagesFilter{
+		pulled:     pulled,
+		referenced: manager.stackImagesFilter(),
+		candidates: map[string][]string{},
+	}
+}
+
+func (filter *imagesFilter) prunable(id string, repoTags []string) bool {
+	if !filter.pulled.contains(id, repoTags) || filter.referenced(repoTags) {
+		return false
+	}
+
+	identifiers := append([]string{id}, repoTags...)
+	if len(repoTags) == 0 {
+		filter.candidates[id] = identifiers
+	}
+
+	for _, tag := range repoTags {
+		filter.candidates[tag] = identifiers
+	}
+
+	return true
+}
+
+// identifiers returns the IDs and the tags of the removed images
+func (filter *imagesFilter) identifiers(removed []string) []string {
+	var identifiers []string
+	for _, name := range removed {
+		identifiers = append(identifiers, filter.candidates[name]...)
+	}
+
+	return identifiers
+}
+
+// stackImagesFilter returns a filter matching the images referenced by the files of the managed stacks,
+// it must be called with manager.mu held
+func (manager *StackManager) stackImagesFilter() func(repoTags []string) bool {
+	referenced := map[string]bool{}
+
+	for _, stack := range manager.stacks {
+		content, err := os.ReadFile(stack.FileFolder + "/" + stack.FileName)
+		if err != nil {
+			continue
+		}
+
+		for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+			referenced[normalizeImageName(match[3])] = true
+		}
+	}
+
+	return func(repoTags []string) bool {
+		for _, tag := range repoTags {
+			if referenced[normalizeImageName(tag)] {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// normalizeImageName returns the fully qualified name of an image, with the latest tag when it has none
+func normalizeImageName(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+
+	return reference.TagNameOnly(named).String()
+}
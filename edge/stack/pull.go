@@ -0,0 +1,34 @@
+package stack
+
+import "errors"
+
+// pullPolicy defines how the images of a stack are pulled before it is deployed
+type pullPolicy int
+
+const (
+	// pullPolicyNone does not pull the images before the deployment, the engine pulls the missing images when deploying
+	pullPolicyNone pullPolicy = iota
+	// pullPolicyBeforeDeploy pulls the images before the deployment, the stack is only deployed once every image is available
+	pullPolicyBeforeDeploy
+	// pullPolicyAlways pulls the images again before every deployment, even when they are already present,
+	// and recreates the containers so that updated images published under the same tag (e.g. latest) are used
+	pullPolicyAlways
+)
+
+var errSkipPull = errors.New("skip pulling")
+
+// stackPullPolicy returns the pull policy of a stack:
+//   - PrePullImage only: pullPolicyBeforeDeploy
+//   - RePullImage, with or without PrePullImage: pullPolicyAlways, re-pulling implies pulling before the deployment,
+//     a requested redeployment (ForceRedeploy) re-pulls as well
+//   - neither: pullPolicyNone
+func stackPullPolicy(stack *edgeStack) pullPolicy {
+	switch {
+	case stack.RePullImage, stack.ForceRedeploy:
+		return pullPolicyAlways
+	case stack.PrePullImage:
+		return pullPolicyBeforeDeploy
+	}
+
+	return pullPolicyNone
+}
@@ -0,0 +1,144 @@
+package stack
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/portainer/agent/docker"
+	"github.com/portainer/agent/filesystem"
+
+	"github.com/rs/zerolog/log"
+)
+
+// pulledImagesFileName is the file of the stack files path holding the images pulled for the stacks
+const pulledImagesFileName = ".pulled-images.json"
+
+// pulledImages holds the normalized names and the IDs of the images pulled for the Docker stacks, so that the
+// unused image prune never removes the images of the host that the stacks did not pull. It is safe for concurrent
+// use, the images are recorded and removed with manager.mu released.
+type pulledImages struct {
+	path   string
+	images map[string]bool
+	mu     sync.Mutex
+}
+
+// loadPulledImages returns the images pulled for the stacks saved in the stack files path
+func loadPulledImages(folder string) *pulledImages {
+	pulled := &pulledImages{
+		path:   filepath.Join(folder, pulledImagesFileName),
+		images: map[string]bool{},
+	}
+
+	content, err := os.ReadFile(pulled.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", pulled.path).Msg("unable to read the images pulled for the stacks")
+		}
+
+		return pulled
+	}
+
+	var images []string
+
+	err = json.Unmarshal(content, &images)
+	if err != nil {
+		log.Warn().Err(err).Str("path", pulled.path).Msg("unable to parse the images pulled for the stacks")
+
+		return pulled
+	}
+
+	for _, image := range images {
+		pulled.images[image] = true
+	}
+
+	return pulled
+}
+
+// add records the images of a stack file along with their local IDs
+func (pulled *pulledImages) add(images []string) {
+	identifiers := []string{}
+
+	for _, image := range images {
+		name := normalizeImageName(image)
+		identifiers = append(identifiers, name)
+
+		id, err := docker.ImageID(name)
+		if err == nil {
+			identifiers = append(identifiers, id)
+		}
+	}
+
+	pulled.mu.Lock()
+	defer pulled.mu.Unlock()
+
+	changed := false
+
+	for _, identifier := range identifiers {
+		if !pulled.images[identifier] {
+			pulled.images[identifier] = true
+			changed = true
+		}
+	}
+
+	if changed {
+		pulled.save()
+	}
+}
+
+// contains returns true when an image was pulled for a stack, either under its ID or one of its tags
+func (pulled *pulledImages) contains(id string, repoTags []string) bool {
+	pulled.mu.Lock()
+	defer pulled.mu.Unlock()
+
+	if pulled.images[id] {
+		return true
+	}
+
+	for _, tag := range repoTags {
+		if pulled.images[normalizeImageName(tag)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forget removes the images that are no longer on the host
+func (pulled *pulledImages) forget(images []string) {
+	if len(images) == 0 {
+		return
+	}
+
+	pulled.mu.Lock()
+	defer pulled.mu.Unlock()
+
+	for _, image := range images {
+		delete(pulled.images, image)
+		delete(pulled.images, normalizeImageName(image))
+	}
+
+	pulled.save()
+}
+
+// save writes the images to the stack files path, it must be called with pulled.mu held
+func (pulled *pulledImages) save() {
+	images := make([]string, 0, len(pulled.images))
+	for image := range pulled.images {
+		images = append(images, image)
+	}
+
+	sort.Strings(images)
+
+	content, err := json.Marshal(images)
+	if err != nil {
+		return
+	}
+
+	err = filesystem.WriteFileAtomic(filepath.Dir(pulled.path), filepath.Base(pulled.path), content, 0600)
+	if err != nil {
+		log.Warn().Err(err).Str("path", pulled.path).Msg("unable to save the images pulled for the stacks")
+	}
+}
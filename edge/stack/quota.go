@@ -0,0 +1,152 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/portainer/agent/filesystem"
+
+	"github.com/rs/zerolog/log"
+)
+
+const versionsFolderSuffix = ".versions"
+
+// prunableFolder is a folder of the stack files path that can be removed to enforce the disk quota
+type prunableFolder struct {
+	path     string
+	orphaned bool
+	modTime  time.Time
+	// stack is set for the versioned folder of a known stack, which can no longer be rolled back once it is removed
+	stack *edgeStack
+}
+
+// enforceDiskQuota prunes the folders of the stack files path while its size exceeds StackManagerConfig.DiskQuota.
+// The orphaned folders are removed first, then the versioned folders of the known stacks, least recently deployed
+// first. It must be called with manager.mu held.
+func (manager *StackManager) enforceDiskQuota() {
+	quota := manager.config.DiskQuota
+	if quota <= 0 {
+		return
+	}
+
+	size, err := filesystem.DirSize(manager.stackFilesPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("unable to compute the size of the Edge stack files path")
+		}
+
+		return
+	}
+
+	if size <= quota {
+		return
+	}
+
+	folders, err := manager.prunableFolders()
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to list the Edge stack folders to prune")
+
+		return
+	}
+
+	for _, folder := range folders {
+		if size <= quota {
+			break
+		}
+
+		freed, err := filesystem.DirSize(folder.path)
+		if err == nil {
+			err = os.RemoveAll(folder.path)
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Str("folder", folder.path).Msg("unable to prune the stack folder")
+
+			continue
+		}
+
+		if folder.stack != nil {
+			folder.stack.GoodVersion = 0
+		}
+
+		size -= freed
+
+		log.Info().
+			Str("folder", folder.path).
+			Bool("orphaned", folder.orphaned).
+			Int64("freed_bytes", freed).
+			Msg("stack folder pruned to enforce the disk quota")
+	}
+
+	if size > quota {
+		log.Warn().
+			Int64("size", size).
+			Int64("quota", quota).
+			Msg("the Edge stack files still exceed the disk quota, the files of the deployed stacks are kept")
+	}
+}
+
+// prunableFolders returns the folders that can be removed to enforce the disk quota, in the order they are removed.
+// The folders of the stacks being processed and the folders excluded by the cleanup patterns are left out.
+func (manager *StackManager) prunableFolders() ([]prunableFolder, error) {
+	entries, err := os.ReadDir(manager.stackFilesPath())
+	if err != nil {
+		return nil, err
+	}
+
+	folders := []prunableFolder{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), versionsFolderSuffix)
+		versioned := name != entry.Name()
+
+		stackID, err := strconv.Atoi(name)
+		if err != nil || stackID <= 0 || strconv.Itoa(stackID) != name {
+			continue
+		}
+
+		stack, known := manager.stacks[edgeStackID(stackID)]
+		if known && (!versioned || manager.inFlight.running(stack.ID)) {
+			continue
+		}
+
+		if !known && !manager.folderCleanupAllowed(name) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		folder := prunableFolder{
+			path:     filepath.Join(manager.stackFilesPath(), entry.Name()),
+			orphaned: !known,
+			modTime:  info.ModTime(),
+		}
+
+		if known {
+			folder.stack = stack
+		}
+
+		folders = append(folders, folder)
+	}
+
+	sort.SliceStable(folders, func(i, j int) bool {
+		if folders[i].orphaned != folders[j].orphaned {
+			return folders[i].orphaned
+		}
+
+		return folders[i].modTime.Before(folders[j].modTime)
+	})
+
+	return folders, nil
+}
@@ -0,0 +1,52 @@
+package stack
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrRedeployDisabled is returned when a stack redeployment is requested while StackManagerConfig.RedeployWebhook
+	// is not set
+	ErrRedeployDisabled = errors.New("the redeployment of the stacks on request is disabled")
+	// ErrUnknownStack is returned when the requested stack is not managed by the agent
+	ErrUnknownStack = errors.New("unknown stack")
+	// ErrRestartUnsupported is returned when the deployer of the engine of a stack cannot restart its services
+	ErrRestartUnsupported = errors.New("the engine of the stack does not support the restart of its services")
+)
+
+// Redeploy queues the deployment of a stack without waiting for the next poll, its images are pulled again and
+// its containers recreated, e.g. after new images were pushed under the same tags. A deployment in progress is
+// not interrupted, it is followed by the requested one.
+func (manager *StackManager) Redeploy(stackID int) error {
+	if !manager.config.RedeployWebhook {
+		return ErrRedeployDisabled
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	stack, ok := manager.stacks[edgeStackID(stackID)]
+	if !ok || stack.Action == actionDelete || stack.FileName == "" {
+		return ErrUnknownStack
+	}
+
+	log.Info().Int("stack_identifier", stackID).Msg("stack redeployment requested")
+
+	if stack.Action == actionIdle {
+		stack.Action = actionUpdate
+	}
+
+	stack.ForceRedeploy = true
+	stack.Retries = 0
+	stack.NextRetryAt = time.Time{}
+
+	if stack.Status != StatusPending {
+		manager.setStatus(stack, StatusPending)
+		stack.PendingSince = time.Now()
+	}
+
+	return nil
+}
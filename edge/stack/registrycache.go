@@ -0,0 +1,143 @@
+package stack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// credentialRefreshBackoff is the delay before a failed refresh of the registry credentials of a stack is attempted
+// again, the cached credentials are returned meanwhile
+const credentialRefreshBackoff = 30 * time.Second
+
+// credentialCache keeps the registry credentials of the stacks along with the time they were fetched, so that
+// they are read without manager.mu by the credential helper and refreshed once StackManagerConfig.RegistryCredentialsTTL
+// is exceeded, e.g. for the short-lived ECR or GCR tokens expiring during a long pull
+type credentialCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[edgeStackID]cachedCredentials
+}
+
+type cachedCredentials struct {
+	credentials []agent.RegistryCredentials
+	fetchedAt   time.Time
+	// retryAt is the time the credentials are refreshed again after a failed refresh
+	retryAt time.Time
+}
+
+func newCredentialCache(ttl time.Duration) *credentialCache {
+	return &credentialCache{
+		ttl:     ttl,
+		entries: map[edgeStackID]cachedCredentials{},
+	}
+}
+
+// store keeps the credentials of a stack received from Portainer
+func (cache *credentialCache) store(stackID edgeStackID, credentials []agent.RegistryCredentials) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(credentials) == 0 {
+		delete(cache.entries, stackID)
+
+		return
+	}
+
+	cache.entries[stackID] = cachedCredentials{credentials: credentials, fetchedAt: time.Now()}
+}
+
+// remove forgets the credentials of a removed stack
+func (cache *credentialCache) remove(stackID edgeStackID) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.entries, stackID)
+}
+
+// lookup returns the credentials of a registry, scoped by its server URL instead of by the stack being deployed so
+// that the stacks deploying at the same time from different registries each get theirs. When several stacks hold
+// credentials for the registry, the most recently fetched ones are used, they are refreshed like with get.
+func (cache *credentialCache) lookup(serverURL string, portainerClient client.PortainerClient) (agent.RegistryCredentials, bool) {
+	cache.mu.Lock()
+
+	var (
+		found     bool
+		stackID   edgeStackID
+		fetchedAt time.Time
+	)
+
+	for id, entry := range cache.entries {
+		for _, credentials := range entry.credentials {
+			if credentials.ServerURL == serverURL && (!found || entry.fetchedAt.After(fetchedAt)) {
+				found, stackID, fetchedAt = true, id, entry.fetchedAt
+			}
+		}
+	}
+
+	cache.mu.Unlock()
+
+	if !found {
+		return agent.RegistryCredentials{}, false
+	}
+
+	for _, credentials := range cache.get(stackID, portainerClient) {
+		if credentials.ServerURL == serverURL {
+			return credentials, true
+		}
+	}
+
+	return agent.RegistryCredentials{}, false
+}
+
+// get returns the credentials of a stack, they are fetched again from Portainer when they are older than the TTL.
+// When the refresh fails, it is attempted again after credentialRefreshBackoff and the cached credentials are
+// returned meanwhile, the registry then reports them if they expired. The credentials are dropped once they are older
+// than twice the TTL, so that expired credentials are not served indefinitely while Portainer cannot be reached.
+func (cache *credentialCache) get(stackID edgeStackID, portainerClient client.PortainerClient) []agent.RegistryCredentials {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[stackID]
+	if !ok {
+		return nil
+	}
+
+	if cache.ttl <= 0 || time.Since(entry.fetchedAt) < cache.ttl {
+		return entry.credentials
+	}
+
+	if time.Now().Before(entry.retryAt) {
+		return entry.validCredentials(cache.ttl)
+	}
+
+	// the concurrent lookups wait for the refresh instead of fetching the credentials again
+	credentials, err := portainerClient.GetEdgeStackRegistryCredentials(int(stackID))
+	if err != nil || len(credentials) == 0 {
+		log.Warn().Err(err).Int("stack_identifier", int(stackID)).Dur("retry_in", credentialRefreshBackoff).Msg("unable to refresh the registry credentials of the stack, using the cached ones")
+
+		entry.retryAt = time.Now().Add(credentialRefreshBackoff)
+		cache.entries[stackID] = entry
+
+		return entry.validCredentials(cache.ttl)
+	}
+
+	log.Debug().Int("stack_identifier", int(stackID)).Msg("registry credentials of the stack refreshed")
+
+	cache.entries[stackID] = cachedCredentials{credentials: credentials, fetchedAt: time.Now()}
+
+	return credentials
+}
+
+// validCredentials returns the cached credentials unless they are older than twice the TTL
+func (entry cachedCredentials) validCredentials(ttl time.Duration) []agent.RegistryCredentials {
+	if time.Since(entry.fetchedAt) >= 2*ttl {
+		return nil
+	}
+
+	return entry.credentials
+}
@@ -0,0 +1,70 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// trackRename records the previous name of a stack deployed to a Docker engine whose name changes, the project
+// is named after the stack so the deployment under the previous name is removed before the stack is deployed
+// under its new name. It must be called with manager.mu held, before the name of the stack is updated.
+func (manager *StackManager) trackRename(stack *edgeStack, name string) {
+	if !manager.config.RemoveRenamedStacks || stack.Name == "" || stack.ProjectName != "" {
+		return
+	}
+
+	if stack.PreviousName == name {
+		// the stack was renamed back before the new name was deployed
+		stack.PreviousName = ""
+
+		return
+	}
+
+	if stack.Name == name || stack.PreviousName != "" {
+		return
+	}
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Str("previous_name", stack.Name).Str("stack_name", name).Msg("stack renamed")
+
+	stack.PreviousName = stack.Name
+}
+
+// removeRenamedStack removes the deployment of a renamed stack under its previous name, so that it is not
+// orphaned by the deployment under the new name. A failed removal is logged and retried by the next update.
+func (manager *StackManager) removeRenamedStack(ctx context.Context, stack *edgeStack, stackFileLocation string) {
+	manager.mu.Lock()
+	previousName := stack.PreviousName
+	_, dockerEngine := projectLabel(manager.stackEngine(stack))
+	deployer := manager.deployerFor(stack)
+	manager.mu.Unlock()
+
+	if previousName == "" || !dockerEngine {
+		return
+	}
+
+	projectName := fmt.Sprintf("edge_%s", previousName)
+
+	log.Info().Int("stack_identifier", int(stack.ID)).Str("project_name", projectName).Msg("removing the deployment of the renamed stack")
+
+	release, err := manager.acquireOperation(ctx)
+	if err == nil {
+		err = deployer.Remove(ctx, projectName, []string{stackFileLocation}, agent.RemoveOptions{})
+		release()
+	}
+
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Str("project_name", projectName).Msg("unable to remove the deployment of the renamed stack")
+
+		return
+	}
+
+	manager.mu.Lock()
+	if stack.PreviousName == previousName {
+		stack.PreviousName = ""
+	}
+	manager.mu.Unlock()
+}
@@ -0,0 +1,155 @@
+package stack
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// resourceLimitKeys maps the deploy.resources settings of a compose service to the equivalent container setting
+var resourceLimitKeys = map[string]map[string]string{
+	"limits": {
+		"memory": "mem_limit",
+		"cpus":   "cpus",
+		"pids":   "pids_limit",
+	},
+	"reservations": {
+		"memory": "mem_reservation",
+	},
+}
+
+// mapResourceLimits translates the deploy.resources limits and reservations of the compose services, which are
+// only enforced by swarm, to the equivalent container settings so that they are also enforced on a standalone
+// Docker engine. The settings already defined on a service are left untouched, the settings without a
+// container equivalent are reported and ignored. The rest of the content is never modified.
+func mapResourceLimits(content string) (string, error) {
+	var document yaml.Node
+
+	err := yaml.Unmarshal([]byte(content), &document)
+	if err != nil {
+		return content, err
+	}
+
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return content, errors.New("the compose file is not a mapping")
+	}
+
+	services := mappingValue(document.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return content, nil
+	}
+
+	type insertion struct {
+		position int
+		lines    []string
+	}
+
+	insertions := []insertion{}
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, service := services.Content[i].Value, services.Content[i+1]
+
+		resources := mappingValue(mappingValue(service, "deploy"), "resources")
+		if resources == nil {
+			continue
+		}
+
+		settings := serviceResourceSettings(name, service, resources)
+		if len(settings) == 0 {
+			continue
+		}
+
+		if service.Style&yaml.FlowStyle != 0 {
+			log.Warn().Str("service", name).Msg("unable to map the resource limits of a service defined in flow style")
+
+			continue
+		}
+
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		first := service.Content[0]
+		pad := strings.Repeat(" ", first.Column-1)
+
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			lines = append(lines, pad+key+": "+strconv.Quote(settings[key]))
+		}
+
+		insertions = append(insertions, insertion{position: first.Line - 1, lines: lines})
+
+		log.Debug().Str("service", name).Strs("settings", keys).Msg("mapping the service resource limits to container settings")
+	}
+
+	if len(insertions) == 0 {
+		return content, nil
+	}
+
+	// the lines are inserted from the bottom so that the positions of the previous services are preserved
+	sort.Slice(insertions, func(i, j int) bool {
+		return insertions[i].position > insertions[j].position
+	})
+
+	lines := strings.Split(content, "\n")
+	for _, insertion := range insertions {
+		lines = insertLines(lines, insertion.position, insertion.lines)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// serviceResourceSettings returns the container settings equivalent to the deploy.resources of a service,
+// except the ones already defined on the service
+func serviceResourceSettings(name string, service, resources *yaml.Node) map[string]string {
+	settings := map[string]string{}
+
+	for i := 0; i+1 < len(resources.Content); i += 2 {
+		kind, values := resources.Content[i].Value, resources.Content[i+1]
+
+		keys, ok := resourceLimitKeys[kind]
+		if !ok || values.Kind != yaml.MappingNode {
+			continue
+		}
+
+		for j := 0; j+1 < len(values.Content); j += 2 {
+			resource, value := values.Content[j].Value, values.Content[j+1]
+
+			key, ok := keys[resource]
+			if !ok || value.Kind != yaml.ScalarNode {
+				log.Warn().Str("service", name).Str("resource", kind+"."+resource).Msg("the resource setting has no container equivalent, it is not enforced on a standalone Docker engine")
+
+				continue
+			}
+
+			if mappingValue(service, key) != nil {
+				continue
+			}
+
+			settings[key] = value.Value
+		}
+	}
+
+	return settings
+}
+
+// mappingValue returns the value of a key of a mapping node, or nil when the key or the mapping does not exist
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/portainer/agent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RestartService restarts a single service of a deployed stack without deploying the stack again, e.g. to reload
+// a configuration mounted from the host. ErrUnknownStack is returned when the stack is not deployed and
+// ErrRestartUnsupported when its deployer cannot restart a service.
+func (manager *StackManager) RestartService(ctx context.Context, stackID int, service string) error {
+	if service == "" {
+		return errors.New("missing service")
+	}
+
+	manager.mu.Lock()
+	stack, ok := manager.stacks[edgeStackID(stackID)]
+	if !ok || stack.Action == actionDelete || stack.FileName == "" {
+		manager.mu.Unlock()
+
+		return ErrUnknownStack
+	}
+
+	restartDeployer, ok := manager.deployerFor(stack).(agent.RestartDeployer)
+	if !ok {
+		manager.mu.Unlock()
+
+		return ErrRestartUnsupported
+	}
+
+	stackName := manager.projectName(stack)
+	files := stackFiles(stack, fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName))
+	namespace := stack.Namespace
+	envVars := stack.EnvVars
+	manager.mu.Unlock()
+
+	log.Info().Int("stack_identifier", stackID).Str("service", service).Msg("stack service restart requested")
+
+	release, err := manager.acquireOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = restartDeployer.Restart(ctx, stackName, files, agent.RestartOptions{
+		DeployerBaseOptions: agent.DeployerBaseOptions{
+			Namespace: namespace,
+			EnvVars:   envVars,
+		},
+		Service: service,
+	})
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", stackID).Str("service", service).Msg("unable to restart the stack service")
+	}
+
+	return err
+}
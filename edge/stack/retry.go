@@ -0,0 +1,91 @@
+package stack
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// reportRetry reports to Portainer that a stack is retried and why, at most once every
+// StackManagerConfig.RetryStatusInterval. It must be called with manager.mu held.
+func (manager *StackManager) reportRetry(stack *edgeStack, operation string, cause error) {
+	if manager.config.RetryStatusInterval <= 0 || time.Since(stack.RetryReportedAt) < manager.config.RetryStatusInterval {
+		return
+	}
+
+	stack.RetryReportedAt = time.Now()
+
+	message := fmt.Sprintf("%s: %s, retry %d/%d", operation, cause, stack.Retries, manager.maxRetries(stack))
+	if _, backoff := manager.stackRetryPolicy(stack); backoff {
+		message += fmt.Sprintf(", next attempt at %s", stack.NextRetryAt.UTC().Format(time.RFC3339))
+	}
+
+	err := manager.setEdgeStackStatus(stack, client.EdgeStackStatusRetrying, message)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+}
+
+// retryPolicy is the backoff applied between the failed pull attempts of a stack
+type retryPolicy struct {
+	initial    time.Duration
+	max        time.Duration
+	maxRetries int
+}
+
+// stackRetryPolicy returns the retry backoff policy of a stack, the policy sent by the server overrides the
+// configured one. It returns false when no backoff applies, the attempts are then throttled by RetryInterval.
+func (manager *StackManager) stackRetryPolicy(stack *edgeStack) (retryPolicy, bool) {
+	policy := retryPolicy{
+		initial:    manager.config.RetryBackoffInitial,
+		max:        manager.config.RetryBackoffMax,
+		maxRetries: manager.config.RetryBackoffMaxRetries,
+	}
+
+	if override := stack.RetryPolicy; override != nil {
+		if override.InitialInterval > 0 {
+			policy.initial = time.Duration(override.InitialInterval) * time.Second
+		}
+
+		if override.MaxInterval > 0 {
+			policy.max = time.Duration(override.MaxInterval) * time.Second
+		}
+
+		if override.MaxRetries > 0 {
+			policy.maxRetries = override.MaxRetries
+		}
+	}
+
+	return policy, policy.initial > 0
+}
+
+// maxRetries returns the number of failed pull attempts after which a stack is reported in error
+func (manager *StackManager) maxRetries(stack *edgeStack) int {
+	policy, backoff := manager.stackRetryPolicy(stack)
+	if !backoff || policy.maxRetries <= 0 {
+		return MaxRetries
+	}
+
+	return policy.maxRetries
+}
+
+// delay returns the delay before a retry. It doubles with each retry from the initial interval up to the
+// maximum interval, a random jitter of up to half of it spreads the retries of the stacks failing together.
+func (policy retryPolicy) delay(retry int) time.Duration {
+	delay := policy.initial
+	for i := 1; i < retry && (policy.max <= 0 || delay < policy.max); i++ {
+		delay *= 2
+	}
+
+	if policy.max > 0 && delay > policy.max {
+		delay = policy.max
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,100 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+	"github.com/portainer/agent/filesystem"
+
+	"github.com/rs/zerolog/log"
+)
+
+// versionsFolder returns the folder holding the files of the last version of a stack deployed successfully,
+// next to the folder of the stack
+func (manager *StackManager) versionsFolder(stackID edgeStackID) string {
+	return fmt.Sprintf("%s/%d%s", manager.stackFilesPath(), stackID, versionsFolderSuffix)
+}
+
+// keepDeployedVersion keeps the files of a stack version that was deployed successfully, in place of the files
+// of the version deployed before, so that a failed update can be rolled back. It must be called with manager.mu held.
+func (manager *StackManager) keepDeployedVersion(stack *edgeStack) {
+	if !manager.config.Rollback {
+		return
+	}
+
+	versions := manager.versionsFolder(stack.ID)
+
+	err := os.RemoveAll(versions)
+	if err == nil {
+		err = filesystem.CopyDir(stack.FileFolder, filepath.Join(versions, strconv.Itoa(stack.DeployingVersion)))
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to keep the files of the deployed stack version, it cannot be rolled back to")
+
+		stack.GoodVersion = 0
+
+		return
+	}
+
+	stack.GoodVersion = stack.DeployingVersion
+	stack.GoodOverrideFiles = stack.OverrideFiles
+	stack.GoodSecretFiles = stack.SecretFiles
+}
+
+// rollback deploys again the last version of a stack deployed successfully once the deployment of another version
+// failed, and reports the rollback along with both versions. It returns false when the stack was not rolled back.
+// It must be called with manager.mu held.
+func (manager *StackManager) rollback(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string, options agent.DeployOptions, cause error) bool {
+	if !manager.config.Rollback || stack.GoodVersion == 0 || stack.GoodVersion == stack.DeployingVersion {
+		return false
+	}
+
+	logger := log.With().
+		Int("stack_identifier", int(stack.ID)).
+		Int("stack_version", stack.DeployingVersion).
+		Int("rollback_version", stack.GoodVersion).
+		Logger()
+
+	err := os.RemoveAll(stack.FileFolder)
+	if err == nil {
+		err = filesystem.CopyDir(filepath.Join(manager.versionsFolder(stack.ID), strconv.Itoa(stack.GoodVersion)), stack.FileFolder)
+	}
+
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to restore the files of the stack version to roll back to")
+
+		return false
+	}
+
+	stack.OverrideFiles = stack.GoodOverrideFiles
+	stack.SecretFiles = stack.GoodSecretFiles
+
+	// the images of the restored version may not be present anymore
+	options.NoPull = false
+
+	err = manager.deploy(ctx, stack, stackName, stackFileLocation, options)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to roll back the stack")
+
+		return false
+	}
+
+	logger.Warn().Err(cause).Msg("stack deployment failed, rolled back to the last version deployed successfully")
+
+	manager.setStatus(stack, StatusError)
+
+	message := fmt.Sprintf("deployment of version %d failed, rolled back to version %d: %s", stack.DeployingVersion, stack.GoodVersion, cause)
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, client.EdgeStackStatusRolledBack, message)
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return true
+}
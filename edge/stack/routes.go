@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	httperror "github.com/portainer/libhttp/error"
+	"github.com/portainer/libhttp/request"
+	"github.com/portainer/libhttp/response"
+)
+
+// StackManagerStatus reports the readiness of the stack manager
+type StackManagerStatus struct {
+	// Enabled is true once the manager processes the stacks
+	Enabled bool `json:"enabled"`
+	// Engine is the engine of the agent the stacks are deployed to
+	Engine string `json:"engine"`
+	// WaitingForEngine is true while the manager waits for the engine of the agent to be set
+	WaitingForEngine bool `json:"waitingForEngine"`
+	// Stacks is the number of stacks managed by the agent
+	Stacks int `json:"stacks"`
+	// PendingStacks is the number of stacks waiting to be deployed or removed
+	PendingStacks int `json:"pendingStacks"`
+}
+
+type restartPayload struct {
+	// Service is the name of the restarted service, see agent.RestartOptions
+	Service string
+}
+
+func (payload *restartPayload) Validate(r *http.Request) error {
+	if payload.Service == "" {
+		return errors.New("invalid service")
+	}
+
+	return nil
+}
+
+type debugResponse struct {
+	Config     []ConfigEntry `json:"config"`
+	EventCount int           `json:"eventCount"`
+}
+
+// RegisterRoutes registers the routes exposing the state of the stack manager on a router, so that they are served
+// along with the other endpoints of the agent. wrap is applied to every route when it is not nil, e.g. to verify
+// the signature of the requests.
+func (manager *StackManager) RegisterRoutes(router *mux.Router, wrap func(http.Handler) http.Handler) {
+	if wrap == nil {
+		wrap = func(handler http.Handler) http.Handler { return handler }
+	}
+
+	router.Handle("/edge/stacks/status", wrap(httperror.LoggerHandler(manager.statusRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/inventory", wrap(httperror.LoggerHandler(manager.inventoryRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/metrics", wrap(httperror.LoggerHandler(manager.metricsRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/debug", wrap(httperror.LoggerHandler(manager.debugRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/{id}/events", wrap(httperror.LoggerHandler(manager.eventsRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/{id}/state", wrap(httperror.LoggerHandler(manager.stateRoute))).Methods(http.MethodGet)
+	router.Handle("/edge/stacks/{id}/restart", wrap(httperror.LoggerHandler(manager.restartRoute))).Methods(http.MethodPost)
+}
+
+// Status returns the readiness of the stack manager
+func (manager *StackManager) Status() StackManagerStatus {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	status := StackManagerStatus{
+		Enabled:          manager.isEnabled,
+		Engine:           engineName(manager.engineType),
+		WaitingForEngine: manager.isEnabled && manager.waitingForEngine(),
+		Stacks:           len(manager.stacks),
+	}
+
+	for _, stack := range manager.stacks {
+		if stack.Status == StatusPending || stack.Status == StatusRetry {
+			status.PendingStacks++
+		}
+	}
+
+	return status
+}
+
+func (manager *StackManager) statusRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	return response.JSON(w, manager.Status())
+}
+
+func (manager *StackManager) inventoryRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	return response.JSON(w, manager.Inventory())
+}
+
+func (manager *StackManager) metricsRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	return response.JSON(w, manager.Metrics())
+}
+
+func (manager *StackManager) debugRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	return response.JSON(w, debugResponse{
+		Config:     manager.EffectiveConfig(),
+		EventCount: manager.EventCount(),
+	})
+}
+
+func (manager *StackManager) eventsRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	stackID, err := request.RetrieveNumericRouteVariableValue(r, "id")
+	if err != nil {
+		return &httperror.HandlerError{StatusCode: http.StatusBadRequest, Message: "Invalid stack identifier route variable", Err: err}
+	}
+
+	return response.JSON(w, manager.StackEvents(stackID))
+}
+
+func (manager *StackManager) stateRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	stackID, err := request.RetrieveNumericRouteVariableValue(r, "id")
+	if err != nil {
+		return &httperror.HandlerError{StatusCode: http.StatusBadRequest, Message: "Invalid stack identifier route variable", Err: err}
+	}
+
+	states, err := manager.StackState(r.Context(), stackID)
+	switch {
+	case errors.Is(err, ErrUnknownStack):
+		return &httperror.HandlerError{StatusCode: http.StatusNotFound, Message: "Unable to find the Edge stack", Err: err}
+	case err != nil:
+		return &httperror.HandlerError{StatusCode: http.StatusInternalServerError, Message: "Unable to retrieve the state of the Edge stack", Err: err}
+	}
+
+	return response.JSON(w, states)
+}
+
+func (manager *StackManager) restartRoute(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	stackID, err := request.RetrieveNumericRouteVariableValue(r, "id")
+	if err != nil {
+		return &httperror.HandlerError{StatusCode: http.StatusBadRequest, Message: "Invalid stack identifier route variable", Err: err}
+	}
+
+	var payload restartPayload
+	err = request.DecodeAndValidateJSONPayload(r, &payload)
+	if err != nil {
+		return &httperror.HandlerError{StatusCode: http.StatusBadRequest, Message: "Invalid request payload", Err: err}
+	}
+
+	err = manager.RestartService(r.Context(), stackID, payload.Service)
+	switch {
+	case errors.Is(err, ErrUnknownStack):
+		return &httperror.HandlerError{StatusCode: http.StatusNotFound, Message: "Unable to find the Edge stack", Err: err}
+	case errors.Is(err, ErrRestartUnsupported):
+		return &httperror.HandlerError{StatusCode: http.StatusNotImplemented, Message: "The Edge stack services cannot be restarted", Err: err}
+	case err != nil:
+		return &httperror.HandlerError{StatusCode: http.StatusInternalServerError, Message: "Unable to restart the Edge stack service", Err: err}
+	}
+
+	return response.Empty(w)
+}
@@ -0,0 +1,156 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/portainer/agent/edge/client"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+// queuePosition is a position in the deployment queue to report to a stack waiting to be dispatched
+type queuePosition struct {
+	stackID   edgeStackID
+	stackName string
+	version   int
+	message   string
+}
+
+// selectPendingStack picks the next stack to process among the pending ones. The namespaces take turns:
+// the namespace dispatched the longest time ago goes first, so that a namespace holding many stacks
+// cannot delay the stacks of the other namespaces. Within a namespace, the stack that has been waiting
+// the longest goes first. It also returns the queue positions to report with reportQueuePositions once
+// manager.mu is released. It must be called with manager.mu held.
+func (manager *StackManager) selectPendingStack(pending []*edgeStack) (*edgeStack, []queuePosition) {
+	queue := manager.queueOrder(pending)
+	if len(queue) == 0 {
+		return nil, nil
+	}
+
+	selected := queue[0]
+	selected.QueuePosition = 0
+	manager.namespaceDispatches[selected.Namespace] = time.Now()
+
+	return selected, manager.queuePositions(queue[1:])
+}
+
+// queueOrder returns the pending stacks in the order they are dispatched, as long as no other stack becomes pending.
+// It must be called with manager.mu held.
+func (manager *StackManager) queueOrder(pending []*edgeStack) []*edgeStack {
+	namespaces := map[string][]*edgeStack{}
+	for _, stack := range pending {
+		namespaces[stack.Namespace] = append(namespaces[stack.Namespace], stack)
+	}
+
+	turns := make([][]*edgeStack, 0, len(namespaces))
+	for _, stacks := range namespaces {
+		sort.Slice(stacks, func(i, j int) bool {
+			return pendingBefore(stacks[i], stacks[j])
+		})
+
+		turns = append(turns, stacks)
+	}
+
+	// a simulated dispatch happens after all the dispatches of the namespaces, so once a namespace got its
+	// turn it goes after all the others: the namespaces take turns in the order of their first turn
+	sort.Slice(turns, func(i, j int) bool {
+		last, otherLast := manager.namespaceDispatches[turns[i][0].Namespace], manager.namespaceDispatches[turns[j][0].Namespace]
+		if !last.Equal(otherLast) {
+			return last.Before(otherLast)
+		}
+
+		return pendingBefore(turns[i][0], turns[j][0])
+	})
+
+	queue := make([]*edgeStack, 0, len(pending))
+
+	for len(turns) > 0 {
+		next := turns[:0]
+
+		for _, stacks := range turns {
+			queue = append(queue, stacks[0])
+
+			if len(stacks) > 1 {
+				next = append(next, stacks[1:])
+			}
+		}
+
+		turns = next
+	}
+
+	return queue
+}
+
+// pendingBefore returns true when the stack has been waiting longer than the other one
+func pendingBefore(stack, other *edgeStack) bool {
+	if !stack.PendingSince.Equal(other.PendingSince) {
+		return stack.PendingSince.Before(other.PendingSince)
+	}
+
+	return stack.ID < other.ID
+}
+
+// queuePositions returns the positions in the queue to report to the stacks still waiting to be dispatched, a
+// position is reported when it changed and at most once every StackManagerConfig.QueuePositionInterval for each
+// stack. It must be called with manager.mu held.
+func (manager *StackManager) queuePositions(queue []*edgeStack) []queuePosition {
+	if manager.config.QueuePositionInterval <= 0 {
+		return nil
+	}
+
+	var positions []queuePosition
+
+	for i, stack := range queue {
+		position := i + 1
+
+		if stack.QueuePosition == position || time.Since(stack.QueuePositionReportedAt) < manager.config.QueuePositionInterval {
+			continue
+		}
+
+		stack.QueuePosition = position
+		stack.QueuePositionReportedAt = time.Now()
+
+		positions = append(positions, queuePosition{
+			stackID:   stack.ID,
+			stackName: stack.Name,
+			version:   stack.Version,
+			message:   fmt.Sprintf("queued for deployment, position %d of %d", position, len(queue)),
+		})
+	}
+
+	return positions
+}
+
+// reportQueuePositions reports their position in the queue to the stacks waiting to be dispatched,
+// manager.mu must not be held
+func (manager *StackManager) reportQueuePositions(positions []queuePosition) {
+	for _, position := range positions {
+		manager.events.dispatch(StackEvent{
+			StackID:   int(position.stackID),
+			StackName: position.stackName,
+			Version:   position.version,
+			Status:    portainer.EdgeStackStatusPending,
+			Message:   position.message,
+			Time:      time.Now(),
+		})
+
+		err := manager.portainerClient.SetEdgeStackStatusWithLogs(int(position.stackID), portainer.EdgeStackStatusPending, position.message, nil, "")
+		if err == nil {
+			continue
+		}
+
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+
+		if errors.Is(err, client.ErrEdgeStackNotFound) && manager.config.RemoveUnknownStacks {
+			manager.mu.Lock()
+			if stack, ok := manager.stacks[position.stackID]; ok {
+				manager.removeUnknownStack(stack)
+			}
+			manager.mu.Unlock()
+		}
+	}
+}
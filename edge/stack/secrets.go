@@ -0,0 +1,147 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/portainer/agent/filesystem"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// SecretFilesDisabled ignores the secret files provided with the stacks
+	SecretFilesDisabled = "disabled"
+	// SecretFilesWrite writes the secret files provided with the stacks next to their compose file
+	SecretFilesWrite = "write"
+	// SecretFilesStrict writes the secret files and refuses to deploy a stack whose file secrets are neither
+	// provided nor present in the stack folder
+	SecretFilesStrict = "strict"
+)
+
+// composeSecrets holds the top level secrets of a compose file
+type composeSecrets struct {
+	Secrets map[string]struct {
+		File string `yaml:"file"`
+	} `yaml:"secrets"`
+}
+
+// writeSecretFiles writes the secret files provided with a Docker stack inside the stack folder, readable by their
+// owner only, so that the file secrets of the compose file resolve. The previously written secret files that are
+// no longer provided are removed. It returns the paths of the written secret files, the secret files are removed
+// along with the stack folder when the stack is deleted. Their content is never logged.
+func (manager *StackManager) writeSecretFiles(engine engineType, folder string, secretFiles map[string]string, previous []string) ([]string, error) {
+	if manager.config.SecretFiles == SecretFilesDisabled || !isDockerEngine(engine) {
+		return previous, nil
+	}
+
+	written := make([]string, 0, len(secretFiles))
+
+	for name, content := range secretFiles {
+		path, err := folderFilePath(folder, name)
+		if err != nil {
+			return previous, err
+		}
+
+		if manager.config.AtomicWrites {
+			err = filesystem.WriteFileAtomic(filepath.Dir(path), filepath.Base(path), []byte(content), 0600)
+		} else {
+			err = filesystem.WriteFile(filepath.Dir(path), filepath.Base(path), []byte(content), 0600)
+		}
+		if err != nil {
+			return previous, manager.readOnlyError(err)
+		}
+
+		written = append(written, name)
+	}
+
+	for _, name := range previous {
+		if _, ok := secretFiles[name]; ok {
+			continue
+		}
+
+		path, err := folderFilePath(folder, name)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", name).Msg("unable to remove the secret file that is no longer provided")
+		}
+	}
+
+	sort.Strings(written)
+
+	return written, nil
+}
+
+// checkSecretFiles verifies that the files backing the file secrets of a Docker stack are present in the stack folder,
+// a stack missing a secret file is not deployed
+func (manager *StackManager) checkSecretFiles(stack *edgeStack, stackFileLocation string) error {
+	manager.mu.Lock()
+	engine := manager.stackEngine(stack)
+	manager.mu.Unlock()
+
+	if manager.config.SecretFiles != SecretFilesStrict || !isDockerEngine(engine) {
+		return nil
+	}
+
+	content, err := os.ReadFile(stackFileLocation)
+	if err != nil {
+		return err
+	}
+
+	missing := missingSecretFiles(filepath.Dir(stackFileLocation), string(content))
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("the secret files referenced by the stack were not provided: %s", strings.Join(missing, ", "))
+
+	log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack deployment refused")
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
+}
+
+// missingSecretFiles returns the relative files backing the secrets of a compose file that are not present in its folder
+func missingSecretFiles(folder, fileContent string) []string {
+	var secrets composeSecrets
+
+	err := yaml.Unmarshal([]byte(fileContent), &secrets)
+	if err != nil {
+		// invalid files are reported by the deployer
+		return nil
+	}
+
+	missing := []string{}
+	for _, secret := range secrets.Secrets {
+		if secret.File == "" || filepath.IsAbs(secret.File) {
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(folder, secret.File))
+		if os.IsNotExist(err) {
+			missing = append(missing, secret.File)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
@@ -0,0 +1,187 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/portainer/agent/filesystem"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// sharedFilesLink is the name of the link to the shared files directory created inside each stack folder
+const sharedFilesLink = "shared"
+
+type composeReferences struct {
+	Include  []interface{} `yaml:"include"`
+	Services map[string]struct {
+		Extends interface{} `yaml:"extends"`
+	} `yaml:"services"`
+}
+
+// writeStackFile writes the stack file inside the stack folder. When a shared files directory is configured
+// for a Docker engine, the compose file references are validated and the shared directory is linked inside
+// the stack folder so that include/extends references to shared compose files can be resolved.
+func (manager *StackManager) writeStackFile(engine engineType, folder, fileName, fileContent string) error {
+	if manager.config.SharedFilesPath == "" || !isDockerEngine(engine) {
+		return manager.readOnlyError(manager.writeFile(folder, fileName, fileContent))
+	}
+
+	sharedPath, err := filepath.Abs(manager.config.SharedFilesPath)
+	if err != nil {
+		return err
+	}
+
+	err = validateComposeReferences(folder, sharedPath, fileContent)
+	if err != nil {
+		return err
+	}
+
+	err = manager.writeFile(folder, fileName, fileContent)
+	if err != nil {
+		return manager.readOnlyError(err)
+	}
+
+	return linkSharedFiles(folder, sharedPath)
+}
+
+// writeFile writes a stack file, atomically unless disabled, so that the deployer never reads a partially written file
+func (manager *StackManager) writeFile(folder, fileName, fileContent string) error {
+	if !manager.config.AtomicWrites {
+		return filesystem.WriteFile(folder, fileName, []byte(fileContent), 0644)
+	}
+
+	return filesystem.WriteFileAtomic(folder, fileName, []byte(fileContent), 0644)
+}
+
+// linkSharedFiles creates (or updates) the link to the shared files directory inside the stack folder
+func linkSharedFiles(folder, sharedPath string) error {
+	link := filepath.Join(folder, sharedFilesLink)
+
+	target, err := os.Readlink(link)
+	if err == nil {
+		if target == sharedPath {
+			return nil
+		}
+
+		err = os.Remove(link)
+		if err != nil {
+			return err
+		}
+	} else if _, statErr := os.Lstat(link); statErr == nil {
+		return fmt.Errorf("unable to link the shared files directory, %s already exists in the stack folder", sharedFilesLink)
+	}
+
+	return os.Symlink(sharedPath, link)
+}
+
+// validateComposeReferences ensures that every file referenced through include or extends
+// resolves inside the stack folder or the shared files directory
+func validateComposeReferences(folder, sharedPath, fileContent string) error {
+	var references composeReferences
+
+	err := yaml.Unmarshal([]byte(fileContent), &references)
+	if err != nil {
+		// invalid files are reported by the deployer
+		return nil
+	}
+
+	paths := []string{}
+	for _, include := range references.Include {
+		paths = append(paths, includePaths(include)...)
+	}
+
+	for _, service := range references.Services {
+		if extends, ok := service.Extends.(map[string]interface{}); ok {
+			if file, ok := extends["file"].(string); ok {
+				paths = append(paths, file)
+			}
+		}
+	}
+
+	for _, p := range paths {
+		err := validateReferencePath(folder, sharedPath, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// includePaths returns the files of an include entry, using either the short or the long syntax
+func includePaths(include interface{}) []string {
+	switch entry := include.(type) {
+	case string:
+		return []string{entry}
+	case map[string]interface{}:
+		paths := []string{}
+
+		switch p := entry["path"].(type) {
+		case string:
+			paths = append(paths, p)
+		case []interface{}:
+			for _, item := range p {
+				if s, ok := item.(string); ok {
+					paths = append(paths, s)
+				}
+			}
+		}
+
+		if dir, ok := entry["project_directory"].(string); ok {
+			paths = append(paths, dir)
+		}
+
+		return paths
+	}
+
+	return nil
+}
+
+func validateReferencePath(folder, sharedPath, reference string) error {
+	resolved := reference
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(folder, resolved)
+	}
+	resolved = filepath.Clean(resolved)
+
+	// the link to the shared directory is followed explicitly since it might not exist yet
+	sharedLink := filepath.Join(filepath.Clean(folder), sharedFilesLink)
+	if isWithin(sharedLink, resolved) {
+		relative, _ := filepath.Rel(sharedLink, resolved)
+		resolved = filepath.Join(sharedPath, relative)
+	}
+
+	resolved = realPath(resolved)
+
+	for _, base := range []string{sharedPath, realPath(sharedPath), filepath.Clean(folder), realPath(folder)} {
+		if isWithin(base, resolved) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("the compose file reference %q is outside of the stack folder and the shared files directory", reference)
+}
+
+// realPath resolves the symbolic links of a path when it exists
+func realPath(path string) string {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+
+	return real
+}
+
+// isWithin returns true when path is equal to or located under base
+func isWithin(base, path string) bool {
+	relative, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+
+	return relative == "." || (relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)))
+}
@@ -5,14 +5,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/portainer/agent"
+	"github.com/portainer/agent/docker"
 	"github.com/portainer/agent/edge/client"
 	"github.com/portainer/agent/edge/yaml"
 	"github.com/portainer/agent/exec"
-	"github.com/portainer/agent/filesystem"
 	"github.com/portainer/agent/nomad"
 	portainer "github.com/portainer/portainer/api"
 
@@ -33,7 +34,110 @@ type edgeStack struct {
 	Namespace           string
 	PrePullImage        bool
 	RePullImage         bool
-	Retries             int
+	// NoPullOnDeploy deploys the stack without pulling its images again once they have been pre-pulled
+	NoPullOnDeploy bool
+	// ImagesPulled is set when the images of the stack have been pre-pulled for the pending deployment
+	ImagesPulled bool
+	// PrePulling is set while a pre-pull worker pulls the images of the stack
+	PrePulling bool
+	// PrePulledVersion is the version of the stack whose images the pre-pull workers last attempted to pull
+	PrePulledVersion int
+	Retries          int
+	// FallbackFileContent holds the stack file content using the original registries
+	// when the image references were rewritten to use a registry mirror
+	FallbackFileContent string
+	// QueuePosition is the last position in the deployment queue reported to Portainer, and QueuePositionReportedAt
+	// the time it was reported
+	QueuePosition           int
+	QueuePositionReportedAt time.Time
+	// RetryReportedAt is the last time a retry of the stack was reported to Portainer
+	RetryReportedAt time.Time
+	// PendingSince is the time at which the stack was queued for processing
+	PendingSince time.Time
+	// AdoptProjectName is the name of an externally-created deployment to take over
+	AdoptProjectName string
+	// NodeSelector holds the labels the device must have for the stack to be deployed
+	NodeSelector map[string]string
+	// RetryPolicy is the retry backoff policy sent by the server for the stack, nil when unset
+	RetryPolicy *agent.EdgeStackRetryPolicy
+	// NextRetryAt is the time of the next pull attempt of a stack retried with a backoff
+	NextRetryAt time.Time
+	// SecretFiles holds the paths of the secret files written in the stack folder, their content is never kept
+	SecretFiles []string
+	// OverrideFiles holds the paths of the override files written in the stack folder, in the order they are applied
+	OverrideFiles []string
+	// EnvVars holds the variables interpolated in the stack file
+	EnvVars map[string]string
+	// Profiles holds the compose profiles enabled for the stack
+	Profiles []string
+	// RemoveOrphans removes the services removed from the stack file when the stack is updated
+	RemoveOrphans bool
+	// ReconcilePolicy defines how the drift of the deployed stack is handled (ReconcilePolicyReport or
+	// ReconcilePolicyRedeploy), it is ignored when empty
+	ReconcilePolicy string
+	// ImagePrune overrides StackManagerConfig.ImagePrune for the deployments of the stack when it is set
+	ImagePrune string
+	// HelmChart is the chart of a stack deployed with the helm engine
+	HelmChart *agent.HelmChart
+	// Kustomization is set when the stack file is the kustomization of the stack folder
+	Kustomization bool
+	// Drifted is set when the drift monitor reported the resources of the deployed stack as removed
+	Drifted bool
+	// ArchiveFiles holds the paths of the files extracted from the archive of the stack folder
+	ArchiveFiles []string
+	// ForceRedeploy is set when a redeployment was requested, the next deployment pulls the images again
+	// and recreates the containers
+	ForceRedeploy bool
+	// PullProgressReportedAt is the time the progress of the pull of an image of the stack was last reported
+	PullProgressReportedAt time.Time
+	// DeploymentWindows holds the periods during which the updates of the stack are deployed, Scheduled is set
+	// once the deferral of the pending deployment until the next window has been reported
+	DeploymentWindows []deploymentWindow
+	Scheduled         bool
+	// ProjectName is the name of the compose project or stack used on the engine, once resolved
+	ProjectName string
+	// EngineType is the engine the stack is deployed to, zero when the stack uses the engine of the agent
+	EngineType engineType
+	// Deleting is set while the stack is being removed from the engine
+	Deleting bool
+	// PendingDeploy holds a deployment requested while the stack was being deleted, it is processed once
+	// the deletion completes
+	PendingDeploy *client.EdgeStackData
+	// Degraded is set when the health monitor reported the deployed stack as degraded
+	Degraded bool
+	// ImageSources holds the registry each image of the deployed stack was pulled from
+	ImageSources []ImageSource
+	// ReclaimedSpace is the space reclaimed by the image prune that followed the last deployment of the stack
+	ReclaimedSpace uint64
+	// PrunableImages holds the images the dry-run image prune that followed the last deployment of the stack
+	// would have removed
+	PrunableImages []string
+	// Diff holds the changes the current deployment of the stack applies, when they were computed
+	Diff string
+	// DeploymentLogs holds the tail of the deployer output of the last deployment, until it is sent to Portainer
+	// with the resulting status
+	DeploymentLogs string
+	// PreviousName is the name the stack was deployed under before it was renamed, until that deployment is removed
+	PreviousName string
+	// NamespaceChanged is set when the namespace of a Kubernetes stack changed, until the resources deployed
+	// to PreviousNamespace are removed
+	NamespaceChanged  bool
+	PreviousNamespace string
+	// DeployingVersion is the version being deployed, Version is the latest version received
+	DeployingVersion int
+	// GoodVersion is the last version deployed successfully whose files are kept to roll back to, zero when none,
+	// GoodOverrideFiles and GoodSecretFiles are the override and secret files of that version
+	GoodVersion       int
+	GoodOverrideFiles []string
+	GoodSecretFiles   []string
+	// Dispatched is set while a worker processes the stack
+	Dispatched bool
+	// Services summarizes the state of the containers of the deployed stack, nil when unknown
+	Services *agent.ServiceStates
+	// HealthReportedAt is the time of the last health status update sent by the health monitor
+	HealthReportedAt time.Time
+	// CorrelationID identifies the current deployment of the stack, it is used as the trace ID of the deployment
+	CorrelationID string
 }
 
 type edgeStackStatus int
@@ -45,6 +149,11 @@ const (
 	StatusError
 	StatusDeploying
 	StatusRetry
+	StatusDeleting
+	// StatusDiffed is set once the changes of a deployment that is not applied have been reported
+	StatusDiffed
+	// StatusSkipped is set when the stack is not deployed because the device does not match its node selector
+	StatusSkipped
 )
 
 type edgeStackAction int
@@ -60,6 +169,9 @@ const (
 const RetryInterval = 3600 / 5
 const MaxRetries = RetryInterval * 24 * 7
 
+// kustomizationFileName is the name of the stack file of the Kubernetes stacks deployed from a kustomization
+const kustomizationFileName = "kustomization.yaml"
+
 type engineType int
 
 const (
@@ -70,46 +182,192 @@ const (
 	EngineTypeDockerSwarm
 	EngineTypeKubernetes
 	EngineTypeNomad
+	EngineTypeHelm
 )
 
 // StackManager represents a service for managing Edge stacks
 type StackManager struct {
-	engineType      engineType
-	stacks          map[edgeStackID]*edgeStack
-	stopSignal      chan struct{}
+	engineType engineType
+	stacks     map[edgeStackID]*edgeStack
+	stopSignal chan struct{}
+	// loopDone is closed once the deployment loop has returned after a stop
+	loopDone        chan struct{}
 	deployer        agent.Deployer
 	isEnabled       bool
 	portainerClient client.PortainerClient
 	assetsPath      string
-	mu              sync.Mutex
+	config          StackManagerConfig
+	imageMirror     *imageMirror
+	imageVerifier   agent.ImageVerifier
+	metrics         *deployMetrics
+	events          *eventDispatcher
+	tracer          *tracer
+	// foldersReconciled is set once the orphaned stack folders have been handled
+	foldersReconciled bool
+	// deployers holds the deployers of the engines used by the stacks besides the engine of the agent
+	deployers   map[engineType]agent.Deployer
+	deployersMu sync.Mutex
+	// postReconcileHook is called once the pending queue is drained, lastReconciledInventory is the
+	// inventory it was last called with and is only accessed by the deployment loop
+	postReconcileHook       PostReconcileHook
+	lastReconciledInventory []StackInventoryItem
+	// deployerVersions caches the result of the deployer version check of each engine
+	deployerVersions map[engineType]error
+	// lazyPull caches whether the image store of the Docker engine pulls the images lazily
+	lazyPull *bool
+	// lifecycleMu serializes the starts, the stops and the engine switches of the manager
+	lifecycleMu sync.Mutex
+	// buildDeployer builds the deployer of an engine
+	buildDeployer func(assetsPath string, engine engineType) (agent.Deployer, error)
+	// imageStore returns the image store of the Docker engine
+	imageStore func() (docker.ImageStore, error)
+	// healthCheckInterval is the interval between two checks of the workloads of a stack after its deployment
+	healthCheckInterval time.Duration
+	// operations bounds the number of deployer operations running at the same time, nil when unbounded
+	operations chan struct{}
+	// history retains the latest status transitions of the stacks
+	history *eventHistory
+	// warmedUp is set once the warmup images pull has started
+	warmedUp bool
+	// namespaceDispatches holds the last time a stack of each namespace was dispatched
+	namespaceDispatches map[string]time.Time
+	// index holds the stacks of the statuses looked up by the hot paths, nil when disabled
+	index *stackIndex
+	// credentials holds the registry credentials of the stacks, refreshed once they are older than
+	// StackManagerConfig.RegistryCredentialsTTL
+	credentials *credentialCache
+	// inFlight holds the contexts of the operations being processed, so that they can be cancelled
+	inFlight *inFlightOperations
+	// partialPollSkipped is set when the removals of the last poll response were skipped as likely partial
+	partialPollSkipped bool
+	// pulledImages holds the images pulled for the stacks, nil until the first unused image prune
+	pulledImages *pulledImages
+	mu           sync.Mutex
 }
 
 // NewStackManager returns a pointer to a new instance of StackManager
-func NewStackManager(cli client.PortainerClient, assetsPath string) *StackManager {
+func NewStackManager(cli client.PortainerClient, assetsPath string, config StackManagerConfig) *StackManager {
+	history := newEventHistory(config.EventHistoryPerStack, config.EventHistoryTotal, config.EventHistoryFile, config.EventHistoryFileMaxSize)
+	sinks := []EventSink{history}
+
+	if config.MQTTBrokerURL != "" {
+		sink, err := newMQTTSink(config.MQTTBrokerURL, config.MQTTTopicTemplate, config.EdgeID)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to create the MQTT stack events publisher")
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	var deployTracer *tracer
+	if config.OTLPEndpoint != "" {
+		t, err := newTracer(config.OTLPEndpoint)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to create the stack deployment trace exporter")
+		} else {
+			deployTracer = t
+		}
+	}
+
+	log.Info().Interface("config", config.entries()).Msg("Edge stack manager configuration")
+
+	var postReconcileHook PostReconcileHook
+	if config.PostReconcileHook != "" {
+		postReconcileHook = commandHook(config.PostReconcileHook)
+	}
+
+	var index *stackIndex
+	if config.StackIndex {
+		index = newStackIndex()
+	}
+
+	var imageVerifier agent.ImageVerifier
+	if len(config.ImageVerifyKeys) > 0 {
+		imageVerifier = exec.NewCosignVerifier(assetsPath, config.ImageVerifyKeys)
+	}
+
 	return &StackManager{
-		stacks:          map[edgeStackID]*edgeStack{},
-		stopSignal:      nil,
-		portainerClient: cli,
-		assetsPath:      assetsPath,
+		stacks:                  map[edgeStackID]*edgeStack{},
+		stopSignal:              nil,
+		portainerClient:         cli,
+		assetsPath:              assetsPath,
+		config:                  config,
+		imageMirror:             newImageMirror(config.ImageMirrors),
+		metrics:                 newDeployMetrics(),
+		events:                  newEventDispatcher(sinks),
+		history:                 history,
+		operations:              newOperationSlots(config.OperationConcurrency),
+		tracer:                  deployTracer,
+		deployers:               map[engineType]agent.Deployer{},
+		deployerVersions:        map[engineType]error{},
+		namespaceDispatches:     map[string]time.Time{},
+		index:                   index,
+		imageVerifier:           imageVerifier,
+		credentials:             newCredentialCache(config.RegistryCredentialsTTL),
+		inFlight:                newInFlightOperations(),
+		buildDeployer:           buildDeployerService,
+		imageStore:              docker.GetImageStore,
+		healthCheckInterval:     defaultHealthCheckInterval,
+		postReconcileHook:       postReconcileHook,
+		lastReconciledInventory: []StackInventoryItem{},
 	}
 }
 
-func (manager *StackManager) UpdateStacksStatus(pollResponseStacks map[int]int) error {
+// UpdateStacksStatus reconciles the stacks with the ones returned by the poll. When StackManagerConfig.ReconcileTimeout
+// is set, the stacks that could not be processed before the deadline are left to the next pass.
+func (manager *StackManager) UpdateStacksStatus(ctx context.Context, pollResponseStacks map[int]int) error {
+	// a deployment holds manager.mu, the deployments of the removed stacks are cancelled beforehand
+	manager.inFlight.cancelRemovedDeployments(pollResponseStacks)
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
 	if !manager.isEnabled {
 		return nil
 	}
 
-	manager.mu.Lock()
-	defer manager.mu.Unlock()
+	if manager.config.ReconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, manager.config.ReconcileTimeout)
+		defer cancel()
+	}
 
+	processed := 0
 	for stackID, version := range pollResponseStacks {
+		if ctx.Err() != nil {
+			log.Warn().
+				Int("processed_stacks", processed).
+				Int("deferred_stacks", len(pollResponseStacks)-processed).
+				Msg("reconcile deadline exceeded, deferring the remaining stacks to the next pass")
+
+			break
+		}
+
 		err := manager.processStack(stackID, version)
 		if err != nil {
 			return err
 		}
+
+		processed++
+	}
+
+	if !manager.partialPoll(pollResponseStacks) {
+		manager.processRemovedStacks(pollResponseStacks)
+	}
+
+	if !manager.foldersReconciled && manager.config.FolderCleanupMode != "" && manager.config.FolderCleanupMode != FolderCleanupDisabled {
+		manager.foldersReconciled = true
+
+		_, err := manager.reconcileFolders(manager.config.FolderCleanupMode == FolderCleanupDryRun)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to clean up the orphaned stack folders")
+		}
 	}
 
-	manager.processRemovedStacks(pollResponseStacks)
+	// the folders of the stacks deferred to the next pass would be seen as orphaned
+	if processed == len(pollResponseStacks) {
+		manager.enforceDiskQuota()
+	}
 
 	return nil
 }
@@ -117,60 +375,147 @@ func (manager *StackManager) UpdateStacksStatus(pollResponseStacks map[int]int)
 func (manager *StackManager) processStack(stackID int, version int) error {
 	stack, processedStack := manager.stacks[edgeStackID(stackID)]
 	if processedStack {
-		if stack.Version == version {
+		if manager.deployMustWait(stack) {
+			// the stack is deployed again by the next poll once it has been removed
+			log.Debug().Int("stack_identifier", stackID).Msg("stack deletion in progress, postponing the deployment")
+
+			return nil
+		}
+
+		if stack.Version == version && stack.Action != actionDelete {
 			return nil // stack is unchanged
 		}
+	}
+
+	stackConfig, err := manager.portainerClient.GetEdgeStackConfig(stackID)
+	if err != nil {
+		return err
+	}
+
+	if manager.deferMismatchedConfig(stackID, version, stackConfig) {
+		return nil
+	}
+
+	var archive []byte
+	if stackConfig.HasArchive {
+		// the archive is downloaded with manager.mu released, the stack is handled by the next poll when it
+		// changed meanwhile
+		manager.mu.Unlock()
+		archive, err = manager.fetchStackArchive(stackID)
+		manager.mu.Lock()
+
+		if err != nil {
+			return err
+		}
+
+		current, ok := manager.stacks[edgeStackID(stackID)]
+		if ok != processedStack || current != stack || (ok && (manager.deployMustWait(current) || (current.Version == version && current.Action != actionDelete))) {
+			log.Debug().Int("stack_identifier", stackID).Msg("stack changed while its archive was downloaded, skipping it until the next poll")
 
+			return nil
+		}
+	}
+
+	if processedStack {
 		log.Debug().Int("stack_identifier", stackID).Msg("marking stack for update")
 
 		stack.Action = actionUpdate
 		stack.Version = version
-		stack.Status = StatusPending
+		manager.setStatus(stack, StatusPending)
+		stack.PendingSince = time.Now()
 	} else {
 		log.Debug().Int("stack_identifier", stackID).Msg("marking stack for deployment")
 
 		stack = &edgeStack{
-			ID:      edgeStackID(stackID),
-			Action:  actionDeploy,
-			Status:  StatusPending,
-			Version: version,
+			ID:           edgeStackID(stackID),
+			Action:       actionDeploy,
+			Status:       StatusPending,
+			Version:      version,
+			PendingSince: time.Now(),
 		}
 	}
 
-	stackConfig, err := manager.portainerClient.GetEdgeStackConfig(int(stack.ID))
-	if err != nil {
-		return err
-	}
-
+	manager.trackRename(stack, stackConfig.Name)
 	stack.Name = stackConfig.Name
 	stack.RegistryCredentials = stackConfig.RegistryCredentials
+	manager.credentials.store(stack.ID, stack.RegistryCredentials)
+	manager.trackNamespaceChange(stack, stackConfig.Namespace)
 	stack.Namespace = stackConfig.Namespace
 	stack.PrePullImage = stackConfig.PrePullImage
 	stack.RePullImage = stackConfig.RePullImage
+	stack.NoPullOnDeploy = stackConfig.NoPullOnDeploy
+	stack.AdoptProjectName = stackConfig.AdoptProjectName
+	stack.NodeSelector = stackConfig.NodeSelector
+	stack.RetryPolicy = stackConfig.RetryPolicy
+	stack.EnvVars = stackConfig.EnvVars
+	stack.Profiles = stackConfig.Profiles
+	stack.RemoveOrphans = stackConfig.RemoveOrphans
+	stack.ReconcilePolicy = stackConfig.ReconcilePolicy
+	stack.ImagePrune = stackConfig.ImagePrune
+	stack.HelmChart = stackConfig.HelmChart
+	stack.Kustomization = stackConfig.Kustomization
+	stack.DeploymentWindows = parseDeploymentWindows(stackID, stackConfig.DeploymentWindows)
+	stack.Scheduled = false
+
+	stack.EngineType, err = parseEngineType(stackConfig.EngineType)
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", stackID).Msg("unable to deploy the stack")
 
-	folder := fmt.Sprintf("%s/%d", agent.EdgeStackFilesPath, stackID)
-	fileName := "docker-compose.yml"
-	fileContent := stackConfig.FileContent
-	if manager.engineType == EngineTypeKubernetes {
-		fileName = fmt.Sprintf("%s.yml", stack.Name)
-		if len(stackConfig.RegistryCredentials) > 0 {
-			yml := yaml.NewYAML(fileContent, stackConfig.RegistryCredentials)
-			fileContent, _ = yml.AddImagePullSecrets()
+		manager.setStatus(stack, StatusError)
+		stack.Action = actionIdle
+
+		// the folder of the stack is set so that a later removal of the stack never targets an empty location
+		if stack.FileFolder == "" {
+			stack.FileFolder = manager.stackFolder(stackID)
+			stack.FileName = stackFileName(manager.engineType, stack.Name, stack.Kustomization)
 		}
+
+		manager.storeStack(stack)
+
+		return manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	}
+
+	engine := manager.stackEngine(stack)
+
+	folder := manager.stackFolder(stackID)
+	fileName := stackFileName(engine, stack.Name, stack.Kustomization)
+	fileContent, fallbackFileContent := manager.renderStackFileContent(engine, stackConfig.FileContent, manifestCredentials(stack.Kustomization, stackConfig.RegistryCredentials), stackConfig.EnvVars, stackConfig.RegistryMirrors)
+
+	stack.ArchiveFiles, err = manager.writeStackArchive(folder, stackConfig.HasArchive, archive, stack.ArchiveFiles)
+	if err != nil {
+		return err
+	}
+
+	err = manager.writeStackFile(engine, folder, fileName, fileContent)
+	if err != nil {
+		return err
+	}
+
+	err = manager.writeEnvFiles(engine, folder, stackConfig.EnvFiles)
+	if err != nil {
+		return err
+	}
+
+	err = manager.writeStackEnvFile(engine, folder, stackConfig.EnvVars)
+	if err != nil {
+		return err
 	}
-	if manager.engineType == EngineTypeNomad {
-		fileName = fmt.Sprintf("%s.hcl", stack.Name)
+
+	stack.SecretFiles, err = manager.writeSecretFiles(engine, folder, stackConfig.SecretFiles, stack.SecretFiles)
+	if err != nil {
+		return err
 	}
 
-	err = filesystem.WriteFile(folder, fileName, []byte(fileContent), 0644)
+	stack.OverrideFiles, err = manager.writeOverrideFiles(engine, folder, stackConfig.OverrideFiles, stack.OverrideFiles)
 	if err != nil {
 		return err
 	}
 
 	stack.FileFolder = folder
 	stack.FileName = fileName
+	stack.FallbackFileContent = fallbackFileContent
 
-	manager.stacks[stack.ID] = stack
+	manager.storeStack(stack)
 
 	log.Debug().
 		Int("stack_identifier", int(stack.ID)).
@@ -178,142 +523,426 @@ func (manager *StackManager) processStack(stackID int, version int) error {
 		Str("namespace", stack.Namespace).
 		Msg("stack acknowledged")
 
-	return manager.portainerClient.SetEdgeStackStatus(int(stack.ID), portainer.EdgeStackStatusAcknowledged, "")
+	err = manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusAcknowledged, "")
+
+	manager.reportProgress(stack, client.EdgeStackProgressFilesWritten, nil)
+
+	return err
 }
 
 func (manager *StackManager) processRemovedStacks(pollResponseStacks map[int]int) {
 	for stackID, stack := range manager.stacks {
+		if stack.Deleting || stack.Status == StatusDeleting {
+			continue
+		}
+
 		if _, ok := pollResponseStacks[int(stackID)]; !ok {
 			log.Debug().Int("stack_identifier", int(stackID)).Msg("marking stack for deletion")
 
-			stack.Action = actionDelete
-			stack.Status = StatusPending
-
-			manager.stacks[stackID] = stack
+			manager.markStackForDeletion(stack)
 		}
 	}
 }
 
+// Stop signals the deployment loop to return, stopping a manager that is not running does nothing
 func (manager *StackManager) Stop() error {
-	if manager.stopSignal != nil {
-		close(manager.stopSignal)
-		manager.stopSignal = nil
-		manager.isEnabled = false
-	}
+	manager.lifecycleMu.Lock()
+	defer manager.lifecycleMu.Unlock()
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.stop()
 
 	return nil
 }
 
+// stop signals the deployment loop to return, it must be called with manager.lifecycleMu and manager.mu held.
+// It returns a channel closed once the loop has returned, nil when the loop was not running.
+func (manager *StackManager) stop() chan struct{} {
+	if manager.stopSignal == nil {
+		return nil
+	}
+
+	close(manager.stopSignal)
+	manager.stopSignal = nil
+	manager.isEnabled = false
+
+	manager.inFlight.cancelAll()
+
+	return manager.loopDone
+}
+
+// Start starts the deployment loop, starting a manager that is already running does nothing
 func (manager *StackManager) Start() error {
+	manager.lifecycleMu.Lock()
+	defer manager.lifecycleMu.Unlock()
+
+	return manager.start()
+}
+
+// start starts the deployment loop once the loop of a previous start has returned,
+// so that two loops never run at the same time. It must be called with manager.lifecycleMu held.
+func (manager *StackManager) start() error {
+	queueSleepInterval, err := time.ParseDuration(agent.EdgeStackQueueSleepInterval)
+	if err != nil {
+		return err
+	}
+
+	manager.mu.Lock()
 	if manager.stopSignal != nil {
+		manager.mu.Unlock()
+
 		return nil
 	}
+	previousLoopDone := manager.loopDone
+	manager.mu.Unlock()
+
+	if previousLoopDone != nil {
+		<-previousLoopDone
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
 
 	manager.isEnabled = true
 	manager.stopSignal = make(chan struct{})
+	manager.loopDone = make(chan struct{})
 
-	queueSleepInterval, err := time.ParseDuration(agent.EdgeStackQueueSleepInterval)
-	if err != nil {
-		return err
+	stopSignal := manager.stopSignal
+	loopDone := manager.loopDone
+
+	manager.checkStackFilesPath()
+	manager.startWarmup(stopSignal)
+
+	if manager.deleteWorkersEnabled() {
+		manager.startDeleteWorkers(stopSignal, queueSleepInterval)
+	}
+
+	if manager.config.PrePullWorkers > 0 {
+		manager.startPrePullWorkers(stopSignal, queueSleepInterval)
+	}
+
+	if manager.config.HealthMonitorInterval > 0 {
+		manager.startHealthMonitor(stopSignal, manager.config.HealthMonitorInterval)
+	}
+
+	if manager.config.DriftCheckInterval > 0 {
+		manager.startDriftMonitor(stopSignal, manager.config.DriftCheckInterval)
 	}
 
 	go func() {
-		for {
-			select {
-			case <-manager.stopSignal:
-				log.Debug().Msg("shutting down Edge stack manager")
-				return
-			default:
-				stack := manager.nextPendingStack()
-				if stack == nil {
-					timer1 := time.NewTimer(queueSleepInterval)
-					<-timer1.C
-					continue
-				}
+		defer close(loopDone)
 
-				ctx := context.TODO()
+		if !manager.waitForEngine(stopSignal, queueSleepInterval) {
+			log.Debug().Msg("shutting down Edge stack manager")
+			return
+		}
 
-				manager.mu.Lock()
-				stackName := fmt.Sprintf("edge_%s", stack.Name)
-				stackFileLocation := fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName)
-				manager.mu.Unlock()
+		if manager.config.EngineWorkers {
+			manager.runEngineWorkers(stopSignal, queueSleepInterval)
+			return
+		}
 
-				if stack.Action == actionDeploy || stack.Action == actionUpdate {
-					err = manager.pullImages(ctx, stack, stackName, stackFileLocation)
-					if err == nil {
-						manager.deployStack(ctx, stack, stackName, stackFileLocation)
-					}
-				} else if stack.Action == actionDelete {
-					manager.deleteStack(ctx, stack, stackName, stackFileLocation)
+		manager.runWorkers(stopSignal, queueSleepInterval, 0, true)
+	}()
+
+	return nil
+}
+
+// runDeploymentLoop processes the pending stacks until the stop signal is closed, a zero engine processes
+// the stacks of all the engines. The post-reconcile hook is called once the queue is drained when hook is set.
+func (manager *StackManager) runDeploymentLoop(stopSignal chan struct{}, queueSleepInterval time.Duration, engine engineType, hook bool) {
+	for {
+		select {
+		case <-stopSignal:
+			log.Debug().Msg("shutting down Edge stack manager")
+			return
+		default:
+			stack := manager.nextPendingStack(engine)
+			if stack == nil {
+				if hook && manager.queueDrained() {
+					manager.runPostReconcileHook()
+				}
+
+				timer1 := time.NewTimer(queueSleepInterval)
+				select {
+				case <-stopSignal:
+					timer1.Stop()
+				case <-timer1.C:
 				}
+				continue
 			}
+
+			manager.processPendingStack(stack)
+			manager.dispatchDone(stack)
+			manager.metrics.done()
 		}
-	}()
+	}
+}
 
-	return nil
+// processPendingStack deploys or deletes a stack picked up from the pending queue
+func (manager *StackManager) processPendingStack(stack *edgeStack) {
+	// the deployments are cancelled when the stack is removed, the operations when the manager stops
+	ctx, end := manager.inFlight.begin(stack.ID, stack.Action != actionDelete)
+	defer end()
+
+	if manager.checkDeployer(stack) != nil {
+		return
+	}
+
+	manager.adoptProject(stack)
+
+	manager.mu.Lock()
+	stackName := manager.projectName(stack)
+	stackFileLocation := fmt.Sprintf("%s/%s", stack.FileFolder, stack.FileName)
+	if stack.Action == actionDelete {
+		stack.Deleting = true
+	}
+	stack.DeployingVersion = stack.Version
+	manager.mu.Unlock()
+
+	if stack.Action == actionDeploy || stack.Action == actionUpdate {
+		err := manager.checkNodeSelector(stack)
+		if err == nil {
+			err = manager.checkDeployerVersion(ctx, stack)
+		}
+		if err == nil {
+			err = manager.diffStack(ctx, stack, stackName, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkEmptyStack(stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkBindMounts(stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkEnvFiles(stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkSecretFiles(stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.validateStack(ctx, stack, stackName, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkAdmission(ctx, stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkSuperseded(stack)
+		}
+		if err == nil {
+			err = manager.checkImageSignatures(ctx, stack, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.pullImages(ctx, stack, stackName, stackFileLocation)
+		}
+		if err == nil {
+			err = manager.checkSuperseded(stack)
+		}
+		if err == nil {
+			manager.removeRenamedStack(ctx, stack, stackFileLocation)
+			manager.removePreviousNamespace(ctx, stack, stackName, stackFileLocation)
+			manager.deployStack(ctx, stack, stackName, stackFileLocation)
+		}
+	} else if stack.Action == actionDelete {
+		manager.deleteStack(ctx, stack, stackName, stackFileLocation)
+	}
 }
 
-func (manager *StackManager) nextPendingStack() *edgeStack {
+// nextPendingStack returns the next stack to process among the pending stacks of an engine,
+// a zero engine returns the next one among the pending stacks of all the engines
+func (manager *StackManager) nextPendingStack(engine engineType) *edgeStack {
 	manager.mu.Lock()
-	defer manager.mu.Unlock()
 
-	for _, stack := range manager.stacks {
-		if stack.Status == StatusPending {
-			return stack
+	pending := []*edgeStack{}
+	for _, stack := range manager.stacksWithStatus(StatusPending) {
+		if stack.Action == actionDelete && manager.deleteWorkersEnabled() {
+			continue
+		}
+
+		if manager.dispatchable(stack, engine) && !manager.awaitingPrePull(stack) && !manager.deferredByWindow(stack) {
+			pending = append(pending, stack)
 		}
 	}
 
-	for _, stack := range manager.stacks {
-		if stack.Status == StatusRetry {
-			stack.Status = StatusPending
+	if stack, positions := manager.selectPendingStack(pending); stack != nil {
+		stack.Dispatched = true
+		manager.metrics.dispatched(stack.ID, stack.PendingSince)
+		manager.mu.Unlock()
+
+		manager.reportQueuePositions(positions)
+
+		return stack
+	}
+
+	for _, stack := range manager.stacksWithStatus(StatusRetry) {
+		if manager.dispatchable(stack, engine) {
+			manager.setStatus(stack, StatusPending)
+			stack.PendingSince = time.Now()
 		}
 	}
+	manager.mu.Unlock()
 
 	return nil
 }
 
+// pullImages pulls the images of a stack before its deployment, according to the pull policy of the stack.
+// A failed pull is retried after a backoff doubling with each attempt when a retry policy applies to the stack,
+// see stackRetryPolicy. Otherwise it is retried on the next iterations: every iteration during the first
+// RetryInterval attempts, then once every RetryInterval iterations, until MaxRetries attempts have failed.
 func (manager *StackManager) pullImages(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) error {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 
-	log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack pulling images")
+	if stackPullPolicy(stack) == pullPolicyNone {
+		return nil
+	}
+
+	// the images are fetched on demand when the containers are started, pulling them
+	// beforehand would transfer their whole content
+	if stackPullPolicy(stack) == pullPolicyBeforeDeploy && manager.lazyPullAvailable(stack) {
+		log.Debug().Int("stack_identifier", int(stack.ID)).Msg("skipping the stack images pull, the image store pulls them lazily")
+
+		return nil
+	}
+
+	if manager.prePulled(stack) {
+		log.Debug().Int("stack_identifier", int(stack.ID)).Msg("skipping the stack images pull, they were pre-pulled")
+
+		return nil
+	}
 
-	if stack.PrePullImage || stack.RePullImage {
+	policy, backoff := manager.stackRetryPolicy(stack)
+
+	if stack.Retries > 0 && backoff && time.Now().Before(stack.NextRetryAt) {
+		manager.setStatus(stack, StatusRetry)
+
+		return errSkipPull
+	}
+
+	if stack.Retries > 0 && !backoff {
 		stack.Retries += 1
-		if stack.Retries <= RetryInterval || stack.Retries%RetryInterval == 0 {
-			stack.Status = StatusDeploying
+		if stack.Retries > RetryInterval && stack.Retries%RetryInterval != 0 {
+			manager.setStatus(stack, StatusRetry)
+
+			return errSkipPull
+		}
+	}
 
-			err := manager.deployer.Pull(ctx, stackName, []string{stackFileLocation})
-			if err == nil {
-				stack.Action = actionIdle
+	log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack pulling images")
 
-				log.Debug().Int("stack_identifier", int(stack.ID)).Int("stack_version", stack.Version).Msg("stack images pulled")
+	err := manager.checkImageDiskSpace(ctx, stack, stackFileLocation)
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack images pull refused")
 
-				statusUpdateErr := manager.portainerClient.SetEdgeStackStatus(int(stack.ID), portainer.EdgeStackStatusImagesPulled, "")
-				if statusUpdateErr != nil {
-					log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
-				}
-			} else {
-				log.Error().Err(err).Int("Retries", stack.Retries).Msg("stack images pull failed")
-				if stack.Retries < MaxRetries {
-					stack.Status = StatusRetry
-				} else {
-					stack.Status = StatusError
-
-					statusUpdateErr := manager.portainerClient.SetEdgeStackStatus(int(stack.ID), portainer.EdgeStackStatusError, err.Error())
-					if statusUpdateErr != nil {
-						log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
-					}
-				}
-			}
+		manager.setStatus(stack, StatusError)
+		stack.Retries = 0
 
-			return err
-		} else {
-			return fmt.Errorf("skip pulling")
+		statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+		if statusUpdateErr != nil {
+			log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
 		}
+
+		return err
 	}
 
-	return nil
+	if manager.requeuedDuringOperation(ctx, stack) {
+		return errSupersededDeployment
+	}
+
+	manager.setStatus(stack, StatusDeploying)
+
+	endPull := manager.tracer.phase(stack, "pull")
+
+	// the deployer pulls the images at once, their individual progress is unknown
+	manager.reportProgress(stack, client.EdgeStackProgressPulling, nil)
+
+	credentialsSource := credentialsSourceHelper
+
+	pull := func() error {
+		return manager.pull(ctx, stack, stackName, stackFileLocation)
+	}
+
+	if manager.pullsThroughAgent(stack) {
+		credentialsSource = credentialsSourceDirect
+		pull = func() error {
+			return manager.pullWithCredentials(ctx, stack, stackFileLocation)
+		}
+	}
+
+	err = pull()
+	if manager.canFallbackToOriginalRegistries(stack, err) {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to pull the stack images from the registry mirrors, falling back to the original registries")
+
+		err = manager.useOriginalRegistries(stack)
+		if err == nil {
+			err = pull()
+		}
+	}
+
+	if err != nil && credentialsSource == credentialsSourceHelper && manager.canPullWithCredentials(stack) {
+		log.Warn().
+			Err(err).
+			Int("stack_identifier", int(stack.ID)).
+			Bool("credential_helper_available", credentialHelperAvailable()).
+			Msg("unable to pull the stack images through the credential helper, passing the registry credentials to the pull")
+
+		credentialsSource = credentialsSourceDirect
+		err = manager.pullWithCredentials(ctx, stack, stackFileLocation)
+	}
+
+	endPull(err)
+
+	if manager.requeuedDuringOperation(ctx, stack) {
+		stack.ImagesPulled = false
+
+		return errSupersededDeployment
+	}
+
+	if err == nil {
+		logCredentialsSource(stack, credentialsSource)
+
+		stack.Action = actionIdle
+		stack.Retries = 0
+		stack.ImagesPulled = true
+
+		log.Debug().Int("stack_identifier", int(stack.ID)).Int("stack_version", stack.Version).Msg("stack images pulled")
+
+		statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusImagesPulled, "")
+		if statusUpdateErr != nil {
+			log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+		}
+
+		return nil
+	}
+
+	if backoff {
+		stack.Retries++
+		stack.NextRetryAt = time.Now().Add(policy.delay(stack.Retries))
+	} else if stack.Retries == 0 {
+		stack.Retries = 1
+	}
+
+	log.Error().Err(err).Int("Retries", stack.Retries).Msg("stack images pull failed")
+
+	if stack.Retries < manager.maxRetries(stack) {
+		manager.setStatus(stack, StatusRetry)
+
+		manager.reportRetry(stack, "pull failed", err)
+
+		return err
+	}
+
+	manager.setStatus(stack, StatusError)
+	stack.Retries = 0
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
 }
 
 func (manager *StackManager) deployStack(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) {
@@ -325,85 +954,273 @@ func (manager *StackManager) deployStack(ctx context.Context, stack *edgeStack,
 		Str("namespace", stack.Namespace).
 		Msg("stack deployment")
 
-	stack.Status = StatusDeploying
+	manager.setStatus(stack, StatusDeploying)
 	stack.Action = actionIdle
 	responseStatus := portainer.EdgeStackStatusOk
 	errorMessage := ""
 
-	err := manager.deployer.Deploy(ctx, stackName, []string{stackFileLocation},
-		agent.DeployOptions{
-			DeployerBaseOptions: agent.DeployerBaseOptions{
-				Namespace: stack.Namespace,
-			},
+	deployOptions := agent.DeployOptions{
+		DeployerBaseOptions: agent.DeployerBaseOptions{
+			Namespace: stack.Namespace,
+			EnvVars:   stack.EnvVars,
 		},
-	)
+		ForceRecreate: stackPullPolicy(stack) == pullPolicyAlways,
+		// the images pulled by the pre-pull are used as is, so that the deployment does not reach the registries
+		NoPull:         stack.NoPullOnDeploy && stack.ImagesPulled,
+		Profiles:       stack.Profiles,
+		RemoveOrphans:  stack.RemoveOrphans,
+		RolloutTimeout: manager.config.RolloutTimeout,
+		HelmChart:      stack.HelmChart,
+	}
+
+	stack.ImagesPulled = false
+	stack.ForceRedeploy = false
+
+	endDeploy := manager.tracer.phase(stack, "deploy")
+
+	ctx, logs := manager.captureDeploymentLogs(ctx)
+
+	// the images built locally are deployed along with the pulled ones, the build logs are captured with the
+	// deployment logs
+	err := manager.build(ctx, stack, stackName, stackFileLocation, agent.BuildOptions{
+		Pull:     deployOptions.ForceRecreate && !deployOptions.NoPull,
+		Profiles: stack.Profiles,
+	})
+
+	buildFailed := err != nil
+	if buildFailed {
+		err = fmt.Errorf("unable to build the stack images: %w", err)
+	} else {
+		manager.reportProgress(stack, client.EdgeStackProgressDeploying, nil)
+
+		err = manager.deploy(ctx, stack, stackName, stackFileLocation, deployOptions)
+	}
+
+	if !buildFailed && manager.canFallbackToOriginalRegistries(stack, err) {
+		log.Warn().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to deploy the stack using the registry mirrors, falling back to the original registries")
+
+		// the images of the original registries have not been pre-pulled
+		deployOptions.NoPull = false
+
+		err = manager.useOriginalRegistries(stack)
+		if err == nil {
+			err = manager.deploy(ctx, stack, stackName, stackFileLocation, deployOptions)
+		}
+	}
+
+	endDeploy(err)
+
+	if manager.requeuedDuringOperation(ctx, stack) {
+		log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack queued again during its deployment, skipping the status update")
+
+		return
+	}
+
+	stack.DeploymentLogs = logs.String()
+
 	if err != nil {
 		log.Error().Err(err).Msg("stack deployment failed")
 
-		stack.Status = StatusError
+		if manager.rollback(ctx, stack, stackName, stackFileLocation, deployOptions, err) {
+			stack.Degraded = false
+
+			manager.storeStack(stack)
+
+			return
+		}
+
+		manager.setStatus(stack, StatusError)
 		responseStatus = portainer.EdgeStackStatusError
 		errorMessage = err.Error()
 	} else {
 		log.Debug().Int("stack_identifier", int(stack.ID)).Int("stack_version", stack.Version).Msg("stack deployed")
 
-		stack.Status = StatusDone
+		unhealthy, ok := manager.waitHealthy(ctx, stack, stackName, stackFileLocation)
+		if !ok {
+			log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack queued again during its health check, skipping the status update")
+
+			return
+		}
+
+		if unhealthy != "" {
+			responseStatus = client.EdgeStackStatusUnhealthy
+			errorMessage = unhealthy
+		}
+
+		manager.setStatus(stack, StatusDone)
+		manager.keepDeployedVersion(stack)
+		stack.ImageSources = manager.resolveImageSources(stack, stackFileLocation)
+		stack.Services = manager.serviceStates(ctx, stack, stackName, stackFileLocation)
+
+		var pruneReport string
+		stack.ReclaimedSpace, stack.PrunableImages, pruneReport = manager.pruneImages(stack, stackFileLocation)
+		if errorMessage == "" {
+			errorMessage = pruneReport
+		}
+
+		if manager.requeuedDuringOperation(ctx, stack) {
+			log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack queued again while retrieving its state, skipping the status update")
+
+			return
+		}
+
+		for _, source := range stack.ImageSources {
+			log.Debug().Int("stack_identifier", int(stack.ID)).
+				Str("image", source.Image).
+				Str("registry", source.Registry).
+				Str("original_image", source.OriginalImage).
+				Msg("stack image source")
+		}
+	}
+
+	// an unhealthy stack is reported as recovered by the health monitor
+	stack.Degraded = responseStatus == client.EdgeStackStatusUnhealthy
+	if stack.Degraded {
+		stack.HealthReportedAt = time.Now()
 	}
 
-	manager.stacks[stack.ID] = stack
+	stack.Drifted = false
+
+	manager.storeStack(stack)
 
-	err = manager.portainerClient.SetEdgeStackStatus(int(stack.ID), responseStatus, errorMessage)
+	err = manager.setEdgeStackStatus(stack, responseStatus, errorMessage)
 	if err != nil {
 		log.Error().Err(err).Msg("unable to update Edge stack status")
 	}
 }
 
+// deleteStack removes a stack from the engine. A deployment requested while the stack was being deleted
+// is processed once the deletion completes. When the deletion failed, the deployment supersedes it unless
+// StackManagerConfig.DeployAfterDelete is DeployAfterDeleteWait, in which case it waits for the next attempt.
 func (manager *StackManager) deleteStack(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) {
 	log.Debug().Int("stack_identifier", int(stack.ID)).Msg("removing stack")
 
-	err := manager.deployer.Remove(ctx, stackName, []string{stackFileLocation}, agent.RemoveOptions{})
+	removed := manager.removeStack(ctx, stack, stackName, stackFileLocation)
+
+	manager.mu.Lock()
+	stack.Deleting = false
+	pendingDeploy := stack.PendingDeploy
+	stack.PendingDeploy = nil
+
+	if removed {
+		delete(manager.stacks, stack.ID)
+		manager.credentials.remove(stack.ID)
+	}
+	manager.mu.Unlock()
+
+	if removed {
+		manager.metrics.forget(stack.ID)
+		manager.tracer.forget(stack.ID)
+	}
+
+	if pendingDeploy == nil {
+		return
+	}
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Msg("processing the deployment requested during the stack deletion")
+
+	err := manager.buildDeployerParams(*pendingDeploy, false)
+	if err != nil {
+		log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("unable to process the deployment requested during the stack deletion")
+	}
+}
+
+func (manager *StackManager) removeStack(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) bool {
+	manager.mu.Lock()
+	deployer := manager.deployerFor(stack)
+	envVars := stack.EnvVars
+	manager.mu.Unlock()
+
+	release, err := manager.acquireOperation(ctx)
+	if err == nil {
+		err = deployer.Remove(ctx, stackName, []string{stackFileLocation}, agent.RemoveOptions{
+			DeployerBaseOptions: agent.DeployerBaseOptions{
+				EnvVars: envVars,
+			},
+			Purge: manager.config.RemovePurge,
+		})
+		release()
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msg("unable to remove stack")
 
-		return
+		return false
 	}
 
 	// Remove stack file folder
-	err = os.RemoveAll(filepath.Dir(stackFileLocation))
-	if err != nil {
-		log.Error().Err(err).Msg("unable to delete Edge stack file")
+	folder := filepath.Dir(stackFileLocation)
+	if manager.isStackFolder(folder) {
+		err = os.RemoveAll(folder)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to delete Edge stack file")
 
-		return
+			return false
+		}
+	} else {
+		log.Warn().Str("folder", folder).Int("stack_identifier", int(stack.ID)).Msg("refusing to delete a folder outside of the Edge stack files path")
 	}
 
-	err = manager.portainerClient.DeleteEdgeStackStatus(int(stack.ID))
+	err = os.RemoveAll(manager.versionsFolder(stack.ID))
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to delete the kept Edge stack versions")
+	}
+
+	err = manager.deleteEdgeStackStatus(stack)
 	if err != nil {
 		log.Error().Err(err).Msg("unable to delete Edge stack status")
 
-		return
+		return false
 	}
 
-	manager.mu.Lock()
-	delete(manager.stacks, stack.ID)
-	manager.mu.Unlock()
+	return true
 }
 
+// deployMustWait returns true when a new deployment of a stack marked for deletion must wait for the
+// deletion to complete. A deletion in progress is always completed first, a pending deletion is
+// superseded by the deployment unless StackManagerConfig.DeployAfterDelete is DeployAfterDeleteWait.
+// It must be called with manager.mu held.
+func (manager *StackManager) deployMustWait(stack *edgeStack) bool {
+	if stack.Action != actionDelete {
+		return false
+	}
+
+	return stack.Deleting || manager.config.DeployAfterDelete == DeployAfterDeleteWait
+}
+
+// SetEngineStatus switches the engine the stacks are deployed to. The deployment loop is stopped and the
+// in-flight deployment is awaited before the deployer is swapped, the loop is then restarted if it was running.
 func (manager *StackManager) SetEngineStatus(engineStatus engineType) error {
+	manager.lifecycleMu.Lock()
+	defer manager.lifecycleMu.Unlock()
+
+	manager.mu.Lock()
 	if engineStatus == manager.engineType {
+		manager.mu.Unlock()
 		return nil
 	}
 
-	manager.engineType = engineStatus
+	loopDone := manager.stop()
+	manager.mu.Unlock()
 
-	err := manager.Stop()
-	if err != nil {
-		return err
+	if loopDone != nil {
+		<-loopDone
 	}
 
-	deployer, err := buildDeployerService(manager.assetsPath, engineStatus)
+	deployer, err := manager.buildDeployer(manager.engineAssetsPath(engineStatus), engineStatus)
 	if err != nil {
 		return err
 	}
+
+	manager.mu.Lock()
+	manager.engineType = engineStatus
 	manager.deployer = deployer
+	delete(manager.deployerVersions, engineStatus)
+	manager.mu.Unlock()
+
+	if loopDone != nil {
+		return manager.start()
+	}
 
 	return nil
 }
@@ -418,6 +1235,8 @@ func buildDeployerService(assetsPath string, engineStatus engineType) (agent.Dep
 		return exec.NewKubernetesDeployer(assetsPath), nil
 	case EngineTypeNomad:
 		return nomad.NewDeployer()
+	case EngineTypeHelm:
+		return exec.NewHelmDeployer(assetsPath), nil
 	}
 
 	return nil, fmt.Errorf("engine status %d not supported", engineStatus)
@@ -432,24 +1251,13 @@ func (manager *StackManager) DeleteStack(ctx context.Context, stackData client.E
 }
 
 func (manager *StackManager) buildDeployerParams(stackData client.EdgeStackData, deleteStack bool) error {
-	folder := fmt.Sprintf("%s/%d", agent.EdgeStackFilesPath, stackData.ID)
-	fileName := "docker-compose.yml"
-	fileContent := stackData.StackFileContent
-
-	if manager.engineType == EngineTypeKubernetes {
-		fileName = fmt.Sprintf("%s.yml", stackData.Name)
-		if len(stackData.RegistryCredentials) > 0 {
-			yml := yaml.NewYAML(fileContent, stackData.RegistryCredentials)
-			fileContent, _ = yml.AddImagePullSecrets()
-		}
-	}
-
-	if manager.engineType == EngineTypeNomad {
-		fileName = fmt.Sprintf("%s.hcl", stackData.Name)
+	stackEngineType, err := parseEngineType(stackData.EngineType)
+	if err != nil {
+		return err
 	}
 
-	if !deleteStack {
-		err := filesystem.WriteFile(folder, fileName, []byte(fileContent), 0644)
+	if !deleteStack && stackData.HasArchive && len(stackData.Archive) == 0 {
+		stackData.Archive, err = manager.fetchStackArchive(stackData.ID)
 		if err != nil {
 			return err
 		}
@@ -460,11 +1268,73 @@ func (manager *StackManager) buildDeployerParams(stackData client.EdgeStackData,
 	defer manager.mu.Unlock()
 
 	stack, processedStack := manager.stacks[edgeStackID(stackData.ID)]
+	if processedStack && stack.Deleting && deleteStack {
+		return nil // the stack is already being deleted
+	}
+
+	if processedStack && !deleteStack && manager.deployMustWait(stack) {
+		log.Debug().Int("stack_identifier", stackData.ID).Msg("stack deletion in progress, postponing the deployment")
+
+		stack.PendingDeploy = &stackData
+
+		return nil
+	}
+
+	engine := stackEngineType
+	if engine == 0 {
+		engine = manager.engineType
+	}
+
+	folder := manager.stackFolder(stackData.ID)
+	fileName := stackFileName(engine, stackData.Name, stackData.Kustomization)
+	fileContent, fallbackFileContent := manager.renderStackFileContent(engine, stackData.StackFileContent, manifestCredentials(stackData.Kustomization, stackData.RegistryCredentials), stackData.EnvVars, stackData.RegistryMirrors)
+
+	var secretFiles, overrideFiles, archiveFiles []string
+	if processedStack {
+		secretFiles = stack.SecretFiles
+		overrideFiles = stack.OverrideFiles
+		archiveFiles = stack.ArchiveFiles
+	}
+
+	if !deleteStack {
+		var err error
+
+		archiveFiles, err = manager.writeStackArchive(folder, stackData.HasArchive, stackData.Archive, archiveFiles)
+		if err != nil {
+			return err
+		}
+
+		err = manager.writeStackFile(engine, folder, fileName, fileContent)
+		if err != nil {
+			return err
+		}
+
+		err = manager.writeEnvFiles(engine, folder, stackData.EnvFiles)
+		if err != nil {
+			return err
+		}
+
+		err = manager.writeStackEnvFile(engine, folder, stackData.EnvVars)
+		if err != nil {
+			return err
+		}
+
+		secretFiles, err = manager.writeSecretFiles(engine, folder, stackData.SecretFiles, secretFiles)
+		if err != nil {
+			return err
+		}
+
+		overrideFiles, err = manager.writeOverrideFiles(engine, folder, stackData.OverrideFiles, overrideFiles)
+		if err != nil {
+			return err
+		}
+	}
+
 	if processedStack {
 		if deleteStack {
 			stack.Action = actionDelete
 		} else {
-			if stack.Version == stackData.Version {
+			if stack.Version == stackData.Version && stack.Action != actionDelete {
 				return nil
 			}
 			log.Debug().Int("stack_identifier", stackData.ID).Msg("marking stack for update")
@@ -480,29 +1350,156 @@ func (manager *StackManager) buildDeployerParams(stackData client.EdgeStackData,
 		}
 	}
 
+	manager.trackRename(stack, stackData.Name)
 	stack.Name = stackData.Name
 	stack.RegistryCredentials = stackData.RegistryCredentials
+	manager.credentials.store(stack.ID, stack.RegistryCredentials)
+	manager.trackNamespaceChange(stack, stackData.Namespace)
+	stack.Namespace = stackData.Namespace
 
-	stack.Status = StatusPending
+	manager.setStatus(stack, StatusPending)
+	stack.PendingSince = time.Now()
 	stack.Version = stackData.Version
 
 	stack.PrePullImage = stackData.PrePullImage
 	stack.RePullImage = stackData.RePullImage
+	stack.NoPullOnDeploy = stackData.NoPullOnDeploy
+	stack.AdoptProjectName = stackData.AdoptProjectName
+	stack.NodeSelector = stackData.NodeSelector
+	stack.RetryPolicy = stackData.RetryPolicy
+	stack.EnvVars = stackData.EnvVars
+	stack.Profiles = stackData.Profiles
+	stack.RemoveOrphans = stackData.RemoveOrphans
+	stack.ReconcilePolicy = stackData.ReconcilePolicy
+	stack.ImagePrune = stackData.ImagePrune
+	stack.HelmChart = stackData.HelmChart
+	stack.Kustomization = stackData.Kustomization
+	stack.DeploymentWindows = parseDeploymentWindows(stackData.ID, stackData.DeploymentWindows)
+	stack.Scheduled = false
+	stack.EngineType = stackEngineType
 
 	stack.FileFolder = folder
 	stack.FileName = fileName
+	stack.SecretFiles = secretFiles
+	stack.OverrideFiles = overrideFiles
+	stack.ArchiveFiles = archiveFiles
+	if !deleteStack {
+		stack.FallbackFileContent = fallbackFileContent
+	}
 
-	manager.stacks[stack.ID] = stack
+	manager.storeStack(stack)
 
 	return nil
 }
 
-func (manager *StackManager) GetEdgeRegistryCredentials() []agent.RegistryCredentials {
-	for _, stack := range manager.stacks {
-		if stack.Status == StatusDeploying {
-			return stack.RegistryCredentials
+// stackFileName returns the name of the file used to deploy a stack on an engine
+func stackFileName(engine engineType, stackName string, kustomization bool) string {
+	switch engine {
+	case EngineTypeKubernetes:
+		if kustomization {
+			return kustomizationFileName
+		}
+
+		return fmt.Sprintf("%s.yml", stackName)
+	case EngineTypeNomad:
+		return fmt.Sprintf("%s.hcl", stackName)
+	case EngineTypeHelm:
+		return fmt.Sprintf("%s-values.yml", stackName)
+	}
+
+	return "docker-compose.yml"
+}
+
+// manifestCredentials returns the registry credentials whose image pull secrets are added to the stack file,
+// none for a kustomization which holds no resources of its own
+func manifestCredentials(kustomization bool, registryCredentials []agent.RegistryCredentials) []agent.RegistryCredentials {
+	if kustomization {
+		return nil
+	}
+
+	return registryCredentials
+}
+
+// renderStackFileContent applies the engine specific transformations to the content of a stack file.
+// When the image references are rewritten to use registry mirrors, the content using the original
+// registries is returned as well so that it can be used as a fallback. The registry mirrors of the stack are
+// applied over the image mirrors of the agent.
+func (manager *StackManager) renderStackFileContent(engine engineType, fileContent string, registryCredentials []agent.RegistryCredentials, envVars map[string]string, registryMirrors map[string]string) (string, string) {
+	// the Kubernetes manifests and the Helm values have no interpolation of their own
+	if engine == EngineTypeKubernetes || engine == EngineTypeHelm {
+		fileContent = expandEnvVars(fileContent, envVars)
+	}
+
+	if engine == EngineTypeKubernetes && len(registryCredentials) > 0 {
+		yml := yaml.NewYAML(fileContent, registryCredentials, yaml.ResourceOptions{
+			NamePrefix: manager.config.KubernetesResourcePrefix,
+			Labels:     manager.config.KubernetesResourceLabels,
+		})
+		fileContent, _ = yml.WithConcurrency(manager.config.TransformConcurrency).AddImagePullSecrets()
+	}
+
+	if manager.config.NormalizeLineEndings {
+		fileContent = normalizeLineEndings(fileContent)
+	}
+
+	if manager.config.StripComposeVersion && isDockerEngine(engine) {
+		fileContent, _ = stripComposeVersion(fileContent)
+	}
+
+	if manager.config.NetworkDriver != "" && isDockerEngine(engine) {
+		content, err := injectDefaultNetwork(fileContent, manager.config.NetworkDriver, manager.config.NetworkDriverOpts)
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to inject the default network driver, the compose file is left untouched")
+		}
+
+		fileContent = content
+	}
+
+	if manager.config.MapResourceLimits && engine == EngineTypeDockerStandalone {
+		content, err := mapResourceLimits(fileContent)
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to map the resource limits of the services, the compose file is left untouched")
 		}
+
+		fileContent = content
 	}
 
+	mirroredFileContent, mirrored := manager.imageMirror.withRules(registryMirrors).rewrite(fileContent)
+	if !mirrored {
+		return fileContent, ""
+	}
+
+	return mirroredFileContent, fileContent
+}
+
+// normalizeLineEndings converts the CRLF and CR line endings of a stack file to LF
+func normalizeLineEndings(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	return strings.ReplaceAll(content, "\r", "\n")
+}
+
+// canFallbackToOriginalRegistries returns true when the images of a stack pulled from the registry mirrors can be
+// pulled from their original registries instead, after a pull or a deployment failed because of a registry
+func (manager *StackManager) canFallbackToOriginalRegistries(stack *edgeStack, err error) bool {
+	return manager.config.ImageMirrorFallback && stack.FallbackFileContent != "" && isRegistryError(err)
+}
+
+// useOriginalRegistries rewrites the stack file so that the images are pulled from their original registries
+func (manager *StackManager) useOriginalRegistries(stack *edgeStack) error {
+	err := manager.writeFile(stack.FileFolder, stack.FileName, stack.FallbackFileContent)
+	if err != nil {
+		return err
+	}
+
+	stack.FallbackFileContent = ""
+
 	return nil
 }
+
+// GetEdgeRegistryCredentials returns the credentials of the registry being authenticated, whichever stack is
+// being deployed. They are refreshed when they are older than StackManagerConfig.RegistryCredentialsTTL.
+// manager.mu is not acquired, it is held by the deployment whose pull requests the credentials.
+func (manager *StackManager) GetEdgeRegistryCredentials(serverURL string) (agent.RegistryCredentials, bool) {
+	return manager.credentials.lookup(serverURL, manager.portainerClient)
+}
@@ -0,0 +1,207 @@
+package stack
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/portainer/agent/edge/otlp"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+const traceQueueSize = 64
+
+// deployTrace holds the spans of a single deployment of a stack, from its acknowledgement to its final status
+type deployTrace struct {
+	root  otlp.Span
+	spans []otlp.Span
+}
+
+// tracer records the deployment lifecycle of the stacks as OpenTelemetry spans.
+// The correlation ID of a deployment is used as the trace ID and every phase is a child span of the deployment.
+// Finished traces are exported from a dedicated goroutine so that the deployment loop is never blocked.
+// A nil tracer records nothing.
+type tracer struct {
+	exporter *otlp.Exporter
+	traces   map[edgeStackID]*deployTrace
+	queue    chan []otlp.Span
+	mu       sync.Mutex
+}
+
+func newTracer(endpoint string) (*tracer, error) {
+	exporter, err := otlp.NewExporter(endpoint, "portainer-agent", "github.com/portainer/agent/edge/stack")
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := &tracer{
+		exporter: exporter,
+		traces:   make(map[edgeStackID]*deployTrace),
+		queue:    make(chan []otlp.Span, traceQueueSize),
+	}
+
+	go tracer.run()
+
+	return tracer, nil
+}
+
+func (tracer *tracer) run() {
+	for spans := range tracer.queue {
+		err := tracer.exporter.Export(spans)
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to export the stack deployment trace")
+		}
+	}
+}
+
+// trace returns the trace of the current deployment of a stack, starting a new one when needed.
+// It must be called with the tracer lock held.
+func (tracer *tracer) trace(stack *edgeStack) *deployTrace {
+	trace, ok := tracer.traces[stack.ID]
+	if ok {
+		return trace
+	}
+
+	start := stack.PendingSince
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	trace = &deployTrace{
+		root: otlp.Span{
+			SpanID: newSpanID(),
+			Name:   "edge_stack.deploy",
+			Start:  start,
+		},
+	}
+
+	traceID, err := hex.DecodeString(stack.CorrelationID)
+	if err != nil || len(traceID) != len(trace.root.TraceID) {
+		stack.CorrelationID = newCorrelationID()
+		traceID, _ = hex.DecodeString(stack.CorrelationID)
+	}
+	copy(trace.root.TraceID[:], traceID)
+
+	tracer.traces[stack.ID] = trace
+
+	return trace
+}
+
+// phase starts a child span of the current deployment of a stack, the returned function ends it
+func (tracer *tracer) phase(stack *edgeStack, name string) func(err error) {
+	if tracer == nil {
+		return func(err error) {}
+	}
+
+	start := time.Now()
+
+	return func(err error) {
+		tracer.addSpan(stack, name, start, err)
+	}
+}
+
+func (tracer *tracer) addSpan(stack *edgeStack, name string, start time.Time, err error) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	trace := tracer.trace(stack)
+
+	span := otlp.Span{
+		TraceID:      trace.root.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: trace.root.SpanID,
+		Name:         "edge_stack." + name,
+		Start:        start,
+		End:          time.Now(),
+		Attributes:   spanAttributes(stack),
+	}
+
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	trace.spans = append(trace.spans, span)
+}
+
+// observe records the status transitions of a stack: the acknowledgement is recorded as a phase
+// and a final status ends the deployment trace, which is then queued for export
+func (tracer *tracer) observe(stack *edgeStack, status portainer.EdgeStackStatusType, message string) {
+	if tracer == nil {
+		return
+	}
+
+	switch status {
+	case portainer.EdgeStackStatusAcknowledged:
+		start := stack.PendingSince
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		tracer.addSpan(stack, "acknowledge", start, nil)
+	case portainer.EdgeStackStatusOk, portainer.EdgeStackStatusError:
+		tracer.finish(stack, message, status == portainer.EdgeStackStatusError)
+	}
+}
+
+func (tracer *tracer) finish(stack *edgeStack, message string, failed bool) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	trace := tracer.trace(stack)
+	delete(tracer.traces, stack.ID)
+
+	trace.root.End = time.Now()
+	trace.root.Attributes = spanAttributes(stack)
+	if failed {
+		trace.root.Error = message
+		if trace.root.Error == "" {
+			trace.root.Error = "deployment failed"
+		}
+	}
+
+	stack.CorrelationID = ""
+
+	select {
+	case tracer.queue <- append([]otlp.Span{trace.root}, trace.spans...):
+	default:
+		log.Warn().Int("stack_identifier", int(stack.ID)).Msg("trace export queue is full, dropping the stack deployment trace")
+	}
+}
+
+// forget discards the trace of a stack that is no longer managed
+func (tracer *tracer) forget(stackID edgeStackID) {
+	if tracer == nil {
+		return
+	}
+
+	tracer.mu.Lock()
+	delete(tracer.traces, stackID)
+	tracer.mu.Unlock()
+}
+
+func spanAttributes(stack *edgeStack) map[string]interface{} {
+	return map[string]interface{}{
+		"edge_stack.id":             int(stack.ID),
+		"edge_stack.name":           stack.Name,
+		"edge_stack.version":        stack.Version,
+		"edge_stack.correlation_id": stack.CorrelationID,
+	}
+}
+
+// newCorrelationID returns a random identifier usable as an OpenTelemetry trace ID
+func newCorrelationID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func newSpanID() [8]byte {
+	id := [8]byte{}
+	_, _ = rand.Read(id[:])
+
+	return id
+}
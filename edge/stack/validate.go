@@ -0,0 +1,50 @@
+package stack
+
+import (
+	"context"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// validateStack validates the files of a stack with its deployer before deploying it, when enabled.
+// A stack rejected by the validation is not deployed, the validation error is reported instead.
+func (manager *StackManager) validateStack(ctx context.Context, stack *edgeStack, stackName, stackFileLocation string) error {
+	if !manager.config.ValidateStacks {
+		return nil
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	err := manager.validate(ctx, stack, stackName, stackFileLocation, agent.DeployOptions{
+		DeployerBaseOptions: agent.DeployerBaseOptions{
+			Namespace: stack.Namespace,
+			EnvVars:   stack.EnvVars,
+		},
+		Profiles:  stack.Profiles,
+		HelmChart: stack.HelmChart,
+	})
+
+	if manager.requeuedDuringOperation(ctx, stack) {
+		return errSupersededDeployment
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	log.Error().Err(err).Int("stack_identifier", int(stack.ID)).Msg("stack validation failed")
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	statusUpdateErr := manager.setEdgeStackStatus(stack, client.EdgeStackStatusValidationFailed, err.Error())
+	if statusUpdateErr != nil {
+		log.Error().Err(statusUpdateErr).Msg("unable to update Edge stack status")
+	}
+
+	return err
+}
@@ -0,0 +1,170 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/portainer/agent"
+	portainer "github.com/portainer/portainer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultMinDeployerVersions are the minimum versions of the deployer tools supported by the agent,
+// they can be overridden through StackManagerConfig.MinDeployerVersions
+var defaultMinDeployerVersions = map[string]string{
+	"docker-compose": "1.27.0",
+	"docker":         "19.03.0",
+	"kubectl":        "1.19.0",
+	"nomad":          "1.0.0",
+	"helm":           "3.8.0",
+}
+
+var versionRegexp = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// deployerTool returns the name of the tool used by the deployer of an engine
+func deployerTool(engine engineType) string {
+	switch engine {
+	case EngineTypeDockerStandalone:
+		return "docker-compose"
+	case EngineTypeDockerSwarm:
+		return "docker"
+	case EngineTypeKubernetes:
+		return "kubectl"
+	case EngineTypeNomad:
+		return "nomad"
+	case EngineTypeHelm:
+		return "helm"
+	}
+
+	return ""
+}
+
+// minDeployerVersion returns the minimum supported version of a deployer tool
+func (manager *StackManager) minDeployerVersion(tool string) string {
+	if version, ok := manager.config.MinDeployerVersions[tool]; ok {
+		return version
+	}
+
+	return defaultMinDeployerVersions[tool]
+}
+
+// checkDeployerVersion refuses to deploy a stack when the version of the deployer tool is lower than
+// the minimum supported version. The version is only retrieved once per engine, outside of manager.mu,
+// a deployer whose version cannot be determined is not blocked.
+func (manager *StackManager) checkDeployerVersion(ctx context.Context, stack *edgeStack) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	engine := manager.stackEngine(stack)
+
+	versionErr, checked := manager.deployerVersions[engine]
+	if !checked {
+		deployer := manager.deployerFor(stack)
+
+		manager.mu.Unlock()
+		versionErr = manager.compareDeployerVersion(ctx, engine, deployer)
+		manager.mu.Lock()
+
+		manager.deployerVersions[engine] = versionErr
+	}
+
+	if versionErr == nil {
+		return nil
+	}
+
+	log.Error().Err(versionErr).Int("stack_identifier", int(stack.ID)).Msg("stack deployment refused")
+
+	manager.setStatus(stack, StatusError)
+	stack.Action = actionIdle
+
+	err := manager.setEdgeStackStatus(stack, portainer.EdgeStackStatusError, versionErr.Error())
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return versionErr
+}
+
+func (manager *StackManager) compareDeployerVersion(ctx context.Context, engine engineType, deployer agent.Deployer) error {
+	tool := deployerTool(engine)
+
+	required := manager.minDeployerVersion(tool)
+	if required == "" {
+		return nil
+	}
+
+	found, err := deployer.Version(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("tool", tool).Msg("unable to retrieve the deployer version, skipping the version check")
+
+		return nil
+	}
+
+	foundVersion, ok := parseVersion(found)
+	if !ok {
+		log.Warn().Str("tool", tool).Str("version", found).Msg("unable to parse the deployer version, skipping the version check")
+
+		return nil
+	}
+
+	requiredVersion, ok := parseVersion(required)
+	if !ok {
+		log.Warn().Str("tool", tool).Str("version", required).Msg("invalid minimum deployer version, skipping the version check")
+
+		return nil
+	}
+
+	if compareVersions(foundVersion, requiredVersion) < 0 {
+		return fmt.Errorf("unsupported %s version: found %s, %s or later is required", tool, versionString(foundVersion), versionString(requiredVersion))
+	}
+
+	log.Debug().Str("tool", tool).Str("version", versionString(foundVersion)).Msg("deployer version is supported")
+
+	return nil
+}
+
+// parseVersion extracts the first major.minor[.patch] version found in a string
+func parseVersion(value string) ([3]int, bool) {
+	version := [3]int{}
+
+	matches := versionRegexp.FindStringSubmatch(value)
+	if matches == nil {
+		return version, false
+	}
+
+	for i, match := range matches[1:] {
+		if match == "" {
+			continue
+		}
+
+		number, err := strconv.Atoi(match)
+		if err != nil {
+			return version, false
+		}
+
+		version[i] = number
+	}
+
+	return version, true
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func versionString(version [3]int) string {
+	return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+}
@@ -0,0 +1,164 @@
+package stack
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/portainer/agent/docker"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/rs/zerolog/log"
+)
+
+// startWarmup pulls the warmup images and, when enabled, the images of the stacks deployed before the agent
+// started, so that the first deployments do not wait for them. The images are pulled once per agent start,
+// one at a time and through the deployer operation slots. It must be called with manager.mu held.
+func (manager *StackManager) startWarmup(stopSignal chan struct{}) {
+	if manager.warmedUp || !isDockerEngine(manager.engineType) {
+		return
+	}
+
+	if len(manager.config.WarmupImages) == 0 && !manager.config.WarmupKnownStacks {
+		return
+	}
+
+	manager.warmedUp = true
+
+	images := append([]string{}, manager.config.WarmupImages...)
+	if manager.config.WarmupKnownStacks {
+		images = append(images, knownStackImages(manager.stackFilesPath())...)
+	}
+
+	go manager.warmup(stopSignal, uniqueImages(images))
+}
+
+// warmup pulls the images one at a time with the registry credentials known to the agent, the pulls are cancelled
+// once stopSignal is closed
+func (manager *StackManager) warmup(stopSignal chan struct{}, images []string) {
+	log.Info().Int("images", len(images)).Msg("pulling the warmup images")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopSignal:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	pulled := 0
+	for _, image := range images {
+		if ctx.Err() != nil {
+			return
+		}
+
+		exists, err := docker.ImageExists(image)
+		if err == nil && exists {
+			continue
+		}
+
+		release, err := manager.acquireOperation(ctx)
+		if err != nil {
+			return
+		}
+
+		err = docker.ImagePullWithProgress(ctx, image, manager.warmupAuth(image), manager.config.PullBandwidthLimit, nil)
+		release()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Str("image", image).Msg("unable to pull the warmup image")
+
+			continue
+		}
+
+		pulled++
+	}
+
+	log.Info().Int("pulled_images", pulled).Msg("warmup images pulled")
+}
+
+// warmupAuth returns the authentication of the pull of a warmup image, from the registry credentials of the stacks
+// cached by the agent. The image is pulled anonymously when no stack holds credentials for its registry.
+func (manager *StackManager) warmupAuth(image string) types.AuthConfig {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return types.AuthConfig{}
+	}
+
+	credentials, ok := manager.GetEdgeRegistryCredentials(reference.Domain(named))
+	if !ok {
+		return types.AuthConfig{}
+	}
+
+	return types.AuthConfig{
+		Username:      credentials.Username,
+		Password:      credentials.Secret,
+		ServerAddress: credentials.ServerURL,
+	}
+}
+
+// knownStackImages returns the images referenced by the stack files found in the stack folders
+func knownStackImages(stackFilesPath string) []string {
+	entries, err := os.ReadDir(stackFilesPath)
+	if err != nil {
+		return nil
+	}
+
+	images := []string{}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(stackFilesPath, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			if file.IsDir() || !(strings.HasSuffix(file.Name(), ".yml") || strings.HasSuffix(file.Name(), ".yaml")) {
+				continue
+			}
+
+			content, err := os.ReadFile(filepath.Join(stackFilesPath, entry.Name(), file.Name()))
+			if err != nil {
+				continue
+			}
+
+			for _, match := range imageLineRegexp.FindAllStringSubmatch(string(content), -1) {
+				images = append(images, match[3])
+			}
+		}
+	}
+
+	return images
+}
+
+func uniqueImages(images []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+
+	for _, image := range images {
+		if image == "" || seen[image] {
+			continue
+		}
+
+		seen[image] = true
+		unique = append(unique, image)
+	}
+
+	sort.Strings(unique)
+
+	return unique
+}
@@ -0,0 +1,121 @@
+package stack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge/client"
+
+	"github.com/hashicorp/cronexpr"
+	"github.com/rs/zerolog/log"
+)
+
+// deploymentWindow is a recurring period during which the updates of a stack are deployed
+type deploymentWindow struct {
+	schedule *cronexpr.Expression
+	duration time.Duration
+}
+
+// parseDeploymentWindows parses the deployment windows of a stack, the invalid windows are ignored
+func parseDeploymentWindows(stackID int, windows []agent.EdgeStackDeploymentWindow) []deploymentWindow {
+	parsed := make([]deploymentWindow, 0, len(windows))
+
+	for _, window := range windows {
+		schedule, err := cronexpr.Parse(window.Cron)
+		if err != nil || window.Duration <= 0 {
+			log.Warn().Err(err).Int("stack_identifier", stackID).
+				Str("cron", window.Cron).
+				Int("duration", window.Duration).
+				Msg("invalid deployment window, ignoring it")
+
+			continue
+		}
+
+		parsed = append(parsed, deploymentWindow{
+			schedule: schedule,
+			duration: time.Duration(window.Duration) * time.Minute,
+		})
+	}
+
+	return parsed
+}
+
+// open returns whether the window is open at a time: the last opening of the window is less than its duration ago
+func (window deploymentWindow) open(now time.Time) bool {
+	opening := window.schedule.Next(now.Add(-window.duration))
+
+	return !opening.IsZero() && !opening.After(now)
+}
+
+// deferredByWindow returns whether the deployment of a pending stack waits for its next deployment window, the
+// deferral is reported once as the scheduled status. The new stacks bypass the windows when
+// StackManagerConfig.DeploymentWindowBypass is set, and so do the requested redeployments. It must be called with
+// manager.mu held.
+func (manager *StackManager) deferredByWindow(stack *edgeStack) bool {
+	if !manager.outsideDeploymentWindows(stack, time.Now()) {
+		stack.Scheduled = false
+
+		return false
+	}
+
+	if stack.Scheduled {
+		return true
+	}
+
+	stack.Scheduled = true
+
+	message := "deployment deferred until the next deployment window"
+	if opening := nextDeploymentWindow(stack.DeploymentWindows, time.Now()); !opening.IsZero() {
+		message = fmt.Sprintf("deployment deferred until the next deployment window, opening at %s", opening.Format(time.RFC3339))
+	}
+
+	log.Debug().Int("stack_identifier", int(stack.ID)).Msg(message)
+
+	err := manager.setEdgeStackStatus(stack, client.EdgeStackStatusScheduled, message)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to update Edge stack status")
+	}
+
+	return true
+}
+
+// outsideDeploymentWindows returns whether a deployment of a stack is outside of all its deployment windows, the
+// deletions are never deferred
+func (manager *StackManager) outsideDeploymentWindows(stack *edgeStack, now time.Time) bool {
+	if len(stack.DeploymentWindows) == 0 || stack.ForceRedeploy {
+		return false
+	}
+
+	switch stack.Action {
+	case actionUpdate:
+	case actionDeploy:
+		if manager.config.DeploymentWindowBypass {
+			return false
+		}
+	default:
+		return false
+	}
+
+	for _, window := range stack.DeploymentWindows {
+		if window.open(now) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nextDeploymentWindow returns the next opening among deployment windows, zero when none opens again
+func nextDeploymentWindow(windows []deploymentWindow, now time.Time) time.Time {
+	next := time.Time{}
+
+	for _, window := range windows {
+		opening := window.schedule.Next(now)
+		if !opening.IsZero() && (next.IsZero() || opening.Before(next)) {
+			next = opening
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,141 @@
+package stack
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// workerEngines are the engines served by a dedicated worker when StackManagerConfig.EngineWorkers is enabled
+var workerEngines = []engineType{
+	EngineTypeDockerStandalone,
+	EngineTypeDockerSwarm,
+	EngineTypeKubernetes,
+	EngineTypeNomad,
+	EngineTypeHelm,
+}
+
+// runEngineWorkers runs the deployment workers of each engine and returns once all of them have returned
+func (manager *StackManager) runEngineWorkers(stopSignal chan struct{}, queueSleepInterval time.Duration) {
+	manager.mu.Lock()
+	agentEngine := manager.engineType
+	manager.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, engine := range workerEngines {
+		wg.Add(1)
+
+		go func(engine engineType) {
+			defer wg.Done()
+
+			log.Debug().Str("engine", engineName(engine)).Msg("starting Edge stack engine workers")
+
+			// the post-reconcile hook is called by a single worker, the one of the agent engine
+			manager.runWorkers(stopSignal, queueSleepInterval, engine, engine == agentEngine)
+		}(engine)
+	}
+
+	wg.Wait()
+}
+
+// runWorkers runs StackManagerConfig.Workers deployment loops processing the stacks of an engine and returns once
+// all of them have returned, a zero engine processes the stacks of all the engines. The first loop calls the
+// post-reconcile hook when hook is set.
+func (manager *StackManager) runWorkers(stopSignal chan struct{}, queueSleepInterval time.Duration, engine engineType, hook bool) {
+	workers := manager.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(hook bool) {
+			defer wg.Done()
+
+			manager.runDeploymentLoop(stopSignal, queueSleepInterval, engine, hook)
+		}(hook && i == 0)
+	}
+
+	wg.Wait()
+}
+
+// concurrentWorkers returns whether several deployment loops process the stacks at the same time,
+// the pre-pull workers pull the images of the pending stacks while a deployment loop processes the others
+func (manager *StackManager) concurrentWorkers() bool {
+	return manager.config.EngineWorkers || manager.config.Workers > 1 || manager.config.PrePullWorkers > 0
+}
+
+// dispatchable returns whether a stack can be picked up by the worker of an engine, a zero engine picks up
+// the stacks of all the engines. It must be called with manager.mu held.
+func (manager *StackManager) dispatchable(stack *edgeStack, engine engineType) bool {
+	// a stack queued again while a worker processes it waits for that worker, even when its engine changed
+	if stack.Dispatched {
+		return false
+	}
+
+	return engine == 0 || manager.stackEngine(stack) == engine
+}
+
+// dispatchDone records that a worker has finished processing a stack
+func (manager *StackManager) dispatchDone(stack *edgeStack) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	stack.Dispatched = false
+}
+
+// queueDrained returns whether the post-reconcile hook can be called by a loop whose queue is drained.
+// With concurrent workers, the other workers may still have stacks pending or being processed.
+func (manager *StackManager) queueDrained() bool {
+	if !manager.concurrentWorkers() {
+		return true
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, stack := range manager.stacks {
+		if stack.Dispatched || stack.Status == StatusPending || stack.Status == StatusRetry {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unlockDuringOperation releases manager.mu while a deployer operation runs when the deployments run on
+// concurrent workers, so that the other workers are not held back. The returned function locks it again.
+// It must be called with manager.mu held.
+func (manager *StackManager) unlockDuringOperation() func() {
+	if !manager.concurrentWorkers() {
+		return func() {}
+	}
+
+	manager.mu.Unlock()
+
+	return manager.mu.Lock
+}
+
+// requeuedDuringOperation returns whether a stack was queued again, for a newer version or its removal, while
+// manager.mu was released during a deployer operation. A cancelled operation queues the stack again, it is processed
+// again unless its removal is queued meanwhile. It must be called with manager.mu held.
+func (manager *StackManager) requeuedDuringOperation(ctx context.Context, stack *edgeStack) bool {
+	if ctx.Err() != nil {
+		log.Debug().Int("stack_identifier", int(stack.ID)).Msg("stack operation cancelled")
+
+		if stack.Status != StatusPending {
+			manager.setStatus(stack, StatusPending)
+			stack.PendingSince = time.Now()
+		}
+
+		return true
+	}
+
+	return manager.concurrentWorkers() && stack.Status == StatusPending
+}
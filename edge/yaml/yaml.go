@@ -2,10 +2,14 @@ package yaml
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/portainer/agent"
 
@@ -20,25 +24,67 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
+const (
+	// ManagedByLabel is the label identifying the Kubernetes resources created by the agent
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel set on the Kubernetes resources created by the agent
+	ManagedByValue = "portainer-agent"
+)
+
+// ResourceOptions defines how the Kubernetes resources created by the agent are named and labeled
+type ResourceOptions struct {
+	// NamePrefix is prepended to the name of the created resources
+	NamePrefix string
+	// Labels are set on the created resources in addition to ManagedByLabel
+	Labels map[string]string
+}
+
 type yaml struct {
 	fileContent         string
 	registryCredentials []agent.RegistryCredentials
+	resourceOptions     ResourceOptions
+	concurrency         int
 }
 
-func NewYAML(fileContent string, credentials []agent.RegistryCredentials) *yaml {
+func NewYAML(fileContent string, credentials []agent.RegistryCredentials, resourceOptions ResourceOptions) *yaml {
 	return &yaml{
 		fileContent:         fileContent,
 		registryCredentials: credentials,
+		resourceOptions:     resourceOptions,
 	}
 }
 
+// WithConcurrency sets the number of documents of the manifest transformed at the same time
+func (y *yaml) WithConcurrency(concurrency int) *yaml {
+	y.concurrency = concurrency
+
+	return y
+}
+
+// resourceName returns the name of a resource created by the agent
+func (y *yaml) resourceName(name string) string {
+	return y.resourceOptions.NamePrefix + name
+}
+
+// resourceLabels returns the labels of a resource created by the agent
+func (y *yaml) resourceLabels() map[string]string {
+	labels := map[string]string{}
+	for key, value := range y.resourceOptions.Labels {
+		labels[key] = value
+	}
+	labels[ManagedByLabel] = ManagedByValue
+
+	return labels
+}
+
 func (y *yaml) getRegistryCredentialsByImageURL(imageURL string) []agent.RegistryCredentials {
+	domain, err := getRegistryDomain(imageURL)
+	if err != nil {
+		return nil
+	}
+
 	credentials := []agent.RegistryCredentials{}
 	for _, r := range y.registryCredentials {
-		domain, err := getRegistryDomain(imageURL)
-		if err != nil {
-			return nil
-		}
 		if strings.Contains(r.ServerURL, domain) {
 			credentials = append(credentials, r)
 		}
@@ -56,6 +102,7 @@ func (y *yaml) generateImagePullSecrets(namespace string, secretName string, cre
 		ObjectMeta: v1AMacTypes.ObjectMeta{
 			Name:      secretName,
 			Namespace: namespace,
+			Labels:    y.resourceLabels(),
 		},
 		Data: map[string][]byte{
 			".dockerconfigjson": []byte(fmt.Sprintf(`{
@@ -84,72 +131,191 @@ func getRegistryDomain(image string) (string, error) {
 	return reference.Domain(ref), nil
 }
 
+// AddImagePullSecrets adds the image pull secrets of the registry credentials to the deployments of the manifest,
+// and appends the secrets to the manifest. The documents are transformed by up to the configured concurrency
+// at the same time, and the transformed manifest is cached so that the same version of a manifest deployed
+// again with the same credentials is not transformed again.
 func (y *yaml) AddImagePullSecrets() (string, error) {
+	key := y.cacheKey()
+	if content, ok := transformedManifests.get(key); ok {
+		return content, nil
+	}
+
 	ymlFiles := strings.Split(y.fileContent, "---\n")
-	log.Info().Int("length", len(ymlFiles)).Msg("yaml")
+	log.Debug().Int("length", len(ymlFiles)).Msg("yaml")
 
-	pullSecrets := make([]v1Types.Secret, 0)
-	for i, f := range ymlFiles {
-		decode := scheme.Codecs.UniversalDeserializer().Decode
+	secrets := make([][]v1Types.Secret, len(ymlFiles))
+	errs := make([]error, len(ymlFiles))
 
-		obj, _, err := decode([]byte(f), nil, nil) // TODO: validate second param
-		if err != nil {
-			return "", errors.Wrap(err, "Error while decoding original YAML")
+	transform := func(i int) {
+		ymlFiles[i], secrets[i], errs[i] = y.addDocumentImagePullSecrets(ymlFiles[i])
+	}
+
+	if y.concurrency <= 1 || len(ymlFiles) == 1 {
+		for i := range ymlFiles {
+			transform(i)
+			if errs[i] != nil {
+				break
+			}
 		}
+	} else {
+		workers := make(chan struct{}, y.concurrency)
+		wg := sync.WaitGroup{}
 
-		switch o := obj.(type) {
-		case *v1.Deployment:
-			yml := obj.(*v1.Deployment)
-			spec := yml.Spec.Template.Spec
-			namespace := yml.GetNamespace()
+		for i := range ymlFiles {
+			workers <- struct{}{}
+			wg.Add(1)
 
-			for _, c := range spec.Containers {
-				creds := y.getRegistryCredentialsByImageURL(c.Image)
-				if len(creds) == 0 {
-					continue
-				}
-				for _, cred := range creds {
-					imagePullSecretName := slug(cred.ServerURL + cred.Username)
-					sec := v1Types.LocalObjectReference{
-						Name: imagePullSecretName,
-					}
-					spec.ImagePullSecrets = append(spec.ImagePullSecrets, sec)
+			go func(i int) {
+				defer func() {
+					<-workers
+					wg.Done()
+				}()
 
-					pullSecret := y.generateImagePullSecrets(namespace, imagePullSecretName, cred)
+				transform(i)
+			}(i)
+		}
 
-					pullSecrets = append(pullSecrets, pullSecret)
-				}
-			}
-			yml.Spec.Template.Spec = spec
+		wg.Wait()
+	}
 
-			ymlStr, err := encodeYAML(yml)
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// All pullSecrets to original YAML file
+	for _, documentSecrets := range secrets {
+		for _, yml := range documentSecrets {
+			y := yml.DeepCopyObject()
+
+			ymlStr, err := encodeYAML(y)
 			if err != nil {
 				log.Error().Msg("error while encoding YAML with imagePullSecrets")
 
 				continue
 			}
-			ymlFiles[i] = ymlStr
-		default:
-			log.Info().Str("type", fmt.Sprintf("%T", obj)).Msg("default case")
-			_ = o
+
+			ymlFiles = append(ymlFiles, ymlStr)
 		}
 	}
 
-	// All pullSecrets to original YAML file
-	for _, yml := range pullSecrets {
-		y := yml.DeepCopyObject()
+	content := strings.Join(ymlFiles, "---\n")
+	transformedManifests.add(key, content)
 
-		ymlStr, err := encodeYAML(y)
-		if err != nil {
-			log.Error().Msg("error while encoding YAML with imagePullSecrets")
+	return content, nil
+}
 
+// addDocumentImagePullSecrets adds the image pull secrets to a deployment document of the manifest,
+// it returns the document and the secrets it references
+func (y *yaml) addDocumentImagePullSecrets(document string) (string, []v1Types.Secret, error) {
+	obj, _, err := deserializer.Decode([]byte(document), nil, nil) // TODO: validate second param
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error while decoding original YAML")
+	}
+
+	yml, ok := obj.(*v1.Deployment)
+	if !ok {
+		log.Debug().Str("type", fmt.Sprintf("%T", obj)).Msg("default case")
+
+		return document, nil, nil
+	}
+
+	pullSecrets := make([]v1Types.Secret, 0)
+	spec := yml.Spec.Template.Spec
+	namespace := yml.GetNamespace()
+
+	for _, c := range spec.Containers {
+		creds := y.getRegistryCredentialsByImageURL(c.Image)
+		if len(creds) == 0 {
 			continue
 		}
+		for _, cred := range creds {
+			imagePullSecretName := y.resourceName(slug(cred.ServerURL + cred.Username))
+			sec := v1Types.LocalObjectReference{
+				Name: imagePullSecretName,
+			}
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, sec)
+
+			pullSecret := y.generateImagePullSecrets(namespace, imagePullSecretName, cred)
 
-		ymlFiles = append(ymlFiles, ymlStr)
+			pullSecrets = append(pullSecrets, pullSecret)
+		}
 	}
+	yml.Spec.Template.Spec = spec
 
-	return strings.Join(ymlFiles, "---\n"), nil
+	ymlStr, err := encodeYAML(yml)
+	if err != nil {
+		log.Error().Msg("error while encoding YAML with imagePullSecrets")
+
+		return document, pullSecrets, nil
+	}
+
+	return ymlStr, pullSecrets, nil
+}
+
+// cacheKey identifies the transformation of the manifest, from its content, the registry credentials
+// and the resource options
+func (y *yaml) cacheKey() string {
+	hash := sha256.New()
+	hash.Write([]byte(y.fileContent))
+
+	for _, cred := range y.registryCredentials {
+		fmt.Fprintf(hash, "\x00%s\x00%s\x00%s", cred.ServerURL, cred.Username, cred.Secret)
+	}
+
+	fmt.Fprintf(hash, "\x00%s", y.resourceOptions.NamePrefix)
+
+	labels := make([]string, 0, len(y.resourceOptions.Labels))
+	for key, value := range y.resourceOptions.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fmt.Fprintf(hash, "\x00%s", label)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// transformCacheSize is the number of transformed manifests kept by the cache
+const transformCacheSize = 16
+
+// transformCache keeps the latest transformed manifests, the oldest one is evicted first
+type transformCache struct {
+	entries map[string]string
+	keys    []string
+	mu      sync.Mutex
+}
+
+var transformedManifests = &transformCache{entries: map[string]string{}}
+
+func (cache *transformCache) get(key string) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	content, ok := cache.entries[key]
+
+	return content, ok
+}
+
+func (cache *transformCache) add(key, content string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, ok := cache.entries[key]; ok {
+		return
+	}
+
+	if len(cache.keys) == transformCacheSize {
+		delete(cache.entries, cache.keys[0])
+		cache.keys = cache.keys[1:]
+	}
+
+	cache.entries[key] = content
+	cache.keys = append(cache.keys, key)
 }
 
 // Utility methods
@@ -159,11 +325,15 @@ func slug(s string) string {
 	return strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
 }
 
+var (
+	deserializer = scheme.Codecs.UniversalDeserializer()
+	serializer   = json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
+)
+
 func encodeYAML(yml runtime.Object) (string, error) {
 	var buf bytes.Buffer
 
-	e := json.NewYAMLSerializer(json.DefaultMetaFactory, nil, nil)
-	err := e.Encode(yml, &buf)
+	err := serializer.Encode(yml, &buf)
 
 	return buf.String(), err
 }
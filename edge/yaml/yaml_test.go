@@ -0,0 +1,131 @@
+package yaml
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/portainer/agent"
+)
+
+const deploymentDocument = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web-%d
+  namespace: default
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: web-%d
+  template:
+    metadata:
+      labels:
+        app: web-%d
+    spec:
+      containers:
+      - name: web
+        image: registry.example.com/web:%d
+`
+
+func largeManifest(documents int) string {
+	ymlFiles := make([]string, documents)
+	for i := range ymlFiles {
+		ymlFiles[i] = fmt.Sprintf(deploymentDocument, i, i, i, i)
+	}
+
+	return strings.Join(ymlFiles, "---\n")
+}
+
+var benchmarkCredentials = []agent.RegistryCredentials{
+	{ServerURL: "registry.example.com", Username: "user", Secret: "secret"},
+}
+
+func TestAddImagePullSecretsConcurrency(t *testing.T) {
+	manifest := largeManifest(20)
+
+	sequential, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{NamePrefix: "edge-"}).AddImagePullSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	concurrent, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{NamePrefix: "edge-"}).WithConcurrency(4).AddImagePullSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformedManifests = &transformCache{entries: map[string]string{}}
+
+	uncached, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{NamePrefix: "edge-"}).WithConcurrency(4).AddImagePullSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sequential != concurrent || sequential != uncached {
+		t.Fatal("the concurrent transformation differs from the sequential one")
+	}
+
+	if strings.Count(sequential, "imagePullSecrets") != 20 {
+		t.Fatalf("expected 20 deployments with image pull secrets, got:\n%s", sequential)
+	}
+}
+
+func TestAddImagePullSecretsResourceOptions(t *testing.T) {
+	manifest := largeManifest(1)
+
+	prefixed, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{NamePrefix: "edge-", Labels: map[string]string{"site": "paris"}}).AddImagePullSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"name: edge-registry-example-comuser\n",
+		"app.kubernetes.io/managed-by: portainer-agent\n",
+		"site: paris\n",
+		"- name: edge-registry-example-comuser\n",
+	} {
+		if !strings.Contains(prefixed, expected) {
+			t.Errorf("expected the manifest to contain %q, got:\n%s", expected, prefixed)
+		}
+	}
+
+	// the resource options are part of the cache key
+	unprefixed, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{}).AddImagePullSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(unprefixed, "edge-") || strings.Contains(unprefixed, "site: paris") {
+		t.Errorf("expected the manifest transformed without resource options not to be prefixed or labeled, got:\n%s", unprefixed)
+	}
+
+	if !strings.Contains(unprefixed, "name: registry-example-comuser\n") || !strings.Contains(unprefixed, "app.kubernetes.io/managed-by: portainer-agent\n") {
+		t.Errorf("expected the image pull secret to be named after the registry and labeled, got:\n%s", unprefixed)
+	}
+}
+
+func BenchmarkAddImagePullSecrets(b *testing.B) {
+	manifest := largeManifest(200)
+
+	for _, concurrency := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				transformedManifests = &transformCache{entries: map[string]string{}}
+
+				_, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{}).WithConcurrency(concurrency).AddImagePullSecrets()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := NewYAML(manifest, benchmarkCredentials, ResourceOptions{}).AddImagePullSecrets()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
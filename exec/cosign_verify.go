@@ -0,0 +1,60 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// CosignVerifier represents a service verifying the cosign signatures of the images against a set of public keys
+type CosignVerifier struct {
+	command string
+	keys    []string
+}
+
+// NewCosignVerifier initializes a new CosignVerifier service, keys holds the paths or the KMS references of the
+// public keys the images can be signed with.
+func NewCosignVerifier(binaryPath string, keys []string) *CosignVerifier {
+	command := path.Join(binaryPath, "cosign")
+	if runtime.GOOS == "windows" {
+		command = path.Join(binaryPath, "cosign.exe")
+	}
+
+	return &CosignVerifier{
+		command: command,
+		keys:    keys,
+	}
+}
+
+// Verify returns nil as soon as a signature of the image is verified with one of the keys. The registry credentials
+// are retrieved through the credential helper, like the pulls. The verification is aborted once ctx is done.
+func (verifier *CosignVerifier) Verify(ctx context.Context, image string) error {
+	if len(verifier.keys) == 0 {
+		return errors.New("missing public keys")
+	}
+
+	failures := []string{}
+
+	for _, key := range verifier.keys {
+		stderr := newLimitedOutput(outputLimit)
+		cmd := exec.CommandContext(ctx, verifier.command, "verify", "--key", key, "--output", "json", image)
+		cmd.Stderr = stderr
+
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %s: %s", key, err, strings.TrimSpace(stderr.String())))
+	}
+
+	return fmt.Errorf("no valid signature found (%s)", strings.Join(failures, "; "))
+}
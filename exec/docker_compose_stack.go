@@ -2,12 +2,29 @@ package exec
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/portainer/agent"
+	"github.com/portainer/agent/docker"
 	libstack "github.com/portainer/docker-compose-wrapper"
 	"github.com/portainer/docker-compose-wrapper/compose"
 )
 
+const (
+	composeProjectLabel    = "com.docker.compose.project"
+	composeServiceLabel    = "com.docker.compose.service"
+	composeConfigHashLabel = "com.docker.compose.config-hash"
+)
+
+// StackEnvFileName is the name of the env file holding the variables of a stack, written next to its stack file
+const StackEnvFileName = "stack.env"
+
 // DockerComposeStackService represents a service for managing stacks by using the Docker binary.
 type DockerComposeStackService struct {
 	deployer   libstack.Deployer
@@ -32,23 +49,232 @@ func NewDockerComposeStackService(binaryPath string) (*DockerComposeStackService
 
 // Deploy executes the docker stack deploy command.
 func (service *DockerComposeStackService) Deploy(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
-	return service.deployer.Deploy(ctx, filePaths, libstack.DeployOptions{
+	if options.NoPull || options.RemoveOrphans || len(options.Profiles) > 0 {
+		return service.deployWithCommand(ctx, name, filePaths, options)
+	}
+
+	err := service.deployer.Deploy(ctx, filePaths, libstack.DeployOptions{
 		Options: libstack.Options{
 			ProjectName: name,
+			EnvFilePath: stackEnvFilePath(filePaths),
 		},
+		ForceRecreate: options.ForceRecreate,
 	})
+
+	// the compose wrapper only surfaces the output of the command through its error
+	if output := OutputFrom(ctx); err != nil && output != nil {
+		fmt.Fprintln(output, err.Error())
+	}
+
+	return err
+}
+
+// deployWithCommand executes the docker compose up command, for the deployments using the local images only
+// or enabling profiles or removing the orphaned containers, which the compose wrapper does not support
+func (service *DockerComposeStackService) deployWithCommand(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
+	args := composeFileArgs(filePaths, options.Profiles)
+	args = append(args, "--project-name", name, "up", "-d")
+
+	if options.NoPull {
+		args = append(args, "--pull", "never")
+	}
+
+	if options.RemoveOrphans {
+		args = append(args, "--remove-orphans")
+	}
+
+	if options.ForceRecreate {
+		args = append(args, "--force-recreate")
+	}
+
+	_, err := runCommandAndCaptureStdErr(service.command(), args, &cmdOpts{WorkingDir: path.Dir(filePaths[0]), Output: OutputFrom(ctx)})
+
+	return err
+}
+
+// Build executes the docker compose build command, which builds the images of the services declaring a build section.
+func (service *DockerComposeStackService) Build(ctx context.Context, name string, filePaths []string, options agent.BuildOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
+	args := composeFileArgs(filePaths, options.Profiles)
+	args = append(args, "--project-name", name, "build")
+
+	if options.Pull {
+		args = append(args, "--pull")
+	}
+
+	_, err := runCommandAndCaptureStdErr(service.command(), args, &cmdOpts{WorkingDir: path.Dir(filePaths[0]), Output: OutputFrom(ctx)})
+
+	return err
+}
+
+// Restart executes the docker compose restart command on a service of the project.
+func (service *DockerComposeStackService) Restart(ctx context.Context, name string, filePaths []string, options agent.RestartOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
+	args := composeFileArgs(filePaths, nil)
+	args = append(args, "--project-name", name, "restart", options.Service)
+
+	_, err := runCommandAndCaptureStdErr(service.command(), args, &cmdOpts{WorkingDir: path.Dir(filePaths[0])})
+
+	return err
 }
 
 // Pull executes the docker pull command.
 func (service *DockerComposeStackService) Pull(ctx context.Context, name string, filePaths []string) error {
 	return service.deployer.Pull(ctx, filePaths, libstack.Options{
 		ProjectName: name,
+		EnvFilePath: stackEnvFilePath(filePaths),
 	})
 }
 
-// Remove executes the docker stack rm command.
+// Validate executes the docker compose config command, which parses and validates the compose files.
+func (service *DockerComposeStackService) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
+	args := composeFileArgs(filePaths, options.Profiles)
+	args = append(args, "--project-name", name, "config", "--quiet")
+
+	_, err := runCommandAndCaptureStdErr(service.command(), args, &cmdOpts{WorkingDir: path.Dir(filePaths[0])})
+
+	return err
+}
+
+// Version returns the version of the Docker Compose binary.
+func (service *DockerComposeStackService) Version(ctx context.Context) (string, error) {
+	output, err := runCommandAndCaptureStdErr(service.command(), []string{"version", "--short"}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Status counts the running and exited containers of the compose project.
+func (service *DockerComposeStackService) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	containers, err := docker.GetContainersWithLabel(composeProjectLabel + "=" + name)
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	return docker.GetServiceStates(containers), nil
+}
+
+// Diff compares the configuration hash of the services of the compose files with the one of the running
+// containers of the project, and returns the services that would be created, recreated or left orphaned.
+func (service *DockerComposeStackService) Diff(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) (string, error) {
+	if len(filePaths) == 0 {
+		return "", errors.New("missing file paths")
+	}
+
+	args := composeFileArgs(filePaths, options.Profiles)
+	args = append(args, "--project-name", name, "config", "--hash", "*")
+
+	output, err := runCommandAndCaptureStdErr(service.command(), args, &cmdOpts{WorkingDir: path.Dir(filePaths[0])})
+	if err != nil {
+		return "", err
+	}
+
+	desired := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			desired[fields[0]] = fields[1]
+		}
+	}
+
+	containers, err := docker.GetContainersWithLabel(composeProjectLabel + "=" + name)
+	if err != nil {
+		return "", err
+	}
+
+	running := map[string]string{}
+	for _, container := range containers {
+		running[container.Labels[composeServiceLabel]] = container.Labels[composeConfigHashLabel]
+	}
+
+	changes := []string{}
+	for serviceName, hash := range desired {
+		runningHash, ok := running[serviceName]
+		switch {
+		case !ok:
+			changes = append(changes, "+ "+serviceName+" (created)")
+		case runningHash != hash || options.ForceRecreate:
+			changes = append(changes, "~ "+serviceName+" (recreated)")
+		}
+	}
+
+	for serviceName := range running {
+		if _, ok := desired[serviceName]; !ok {
+			changes = append(changes, "- "+serviceName+" (orphaned)")
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][2:] < changes[j][2:]
+	})
+
+	return strings.Join(changes, "\n"), nil
+}
+
+// Remove executes the docker stack rm command. The orphaned containers are removed as well,
+// which covers the services of the profiles enabled by the deployment.
 func (service *DockerComposeStackService) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
 	return service.deployer.Remove(ctx, filePaths, libstack.Options{
 		ProjectName: name,
+		EnvFilePath: stackEnvFilePath(filePaths),
 	})
 }
+
+// composeFileArgs returns the arguments selecting the compose files of a project, the env file of the stack
+// and its enabled profiles
+func composeFileArgs(filePaths []string, profiles []string) []string {
+	args := []string{}
+	for _, filePath := range filePaths {
+		args = append(args, "-f", strings.TrimSpace(filePath))
+	}
+
+	for _, profile := range profiles {
+		args = append(args, "--profile", profile)
+	}
+
+	if envFilePath := stackEnvFilePath(filePaths); envFilePath != "" {
+		args = append(args, "--env-file", envFilePath)
+	}
+
+	return args
+}
+
+// stackEnvFilePath returns the path of the env file holding the variables of a stack, written next to its
+// stack file, it is empty when the stack has none
+func stackEnvFilePath(filePaths []string) string {
+	if len(filePaths) == 0 {
+		return ""
+	}
+
+	envFilePath := path.Join(path.Dir(filePaths[0]), StackEnvFileName)
+	if _, err := os.Stat(envFilePath); err != nil {
+		return ""
+	}
+
+	return envFilePath
+}
+
+// command returns the path of the Docker Compose binary
+func (service *DockerComposeStackService) command() string {
+	if runtime.GOOS == "windows" {
+		return path.Join(service.binaryPath, "docker-compose.exe")
+	}
+
+	return path.Join(service.binaryPath, "docker-compose")
+}
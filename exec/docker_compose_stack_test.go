@@ -0,0 +1,106 @@
+package exec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/portainer/agent"
+)
+
+// fakeBinary writes an executable named name in a temporary folder, recording the arguments of each of its calls
+// on a line of the returned file
+func fakeBinary(t *testing.T, name string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	folder := t.TempDir()
+	calls := filepath.Join(folder, "calls")
+
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(folder, name), []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write the fake binary: %s", err)
+	}
+
+	return folder, calls
+}
+
+// recordedCalls returns the arguments of the calls recorded by a fake binary
+func recordedCalls(t *testing.T, calls string) []string {
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("unable to read the recorded calls: %s", err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestComposeDeployWithCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  agent.DeployOptions
+		expected string
+	}{
+		{
+			name:     "profiles",
+			options:  agent.DeployOptions{Profiles: []string{"gpu", "debug"}},
+			expected: "--profile gpu --profile debug --project-name web up -d",
+		},
+		{
+			name:     "local images only",
+			options:  agent.DeployOptions{NoPull: true, ForceRecreate: true},
+			expected: "--project-name web up -d --pull never --force-recreate",
+		},
+		{
+			name:     "orphans removed",
+			options:  agent.DeployOptions{RemoveOrphans: true},
+			expected: "--project-name web up -d --remove-orphans",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binaryPath, calls := fakeBinary(t, "docker-compose")
+			service := &DockerComposeStackService{binaryPath: binaryPath}
+
+			folder := t.TempDir()
+			stackFile := filepath.Join(folder, "docker-compose.yml")
+
+			err := service.Deploy(context.Background(), "web", []string{stackFile}, test.options)
+			if err != nil {
+				t.Fatalf("unable to deploy the stack: %s", err)
+			}
+
+			expected := []string{"-f " + stackFile + " " + test.expected}
+			if args := recordedCalls(t, calls); !reflect.DeepEqual(args, expected) {
+				t.Errorf("unexpected compose command\n got: %v\nwant: %v", args, expected)
+			}
+		})
+	}
+}
+
+func TestComposeFileArgs(t *testing.T) {
+	folder := t.TempDir()
+	stackFile := filepath.Join(folder, "docker-compose.yml")
+	overrideFile := filepath.Join(folder, "docker-compose.site.yml")
+
+	expected := []string{"-f", stackFile, "-f", overrideFile, "--profile", "gpu"}
+	if args := composeFileArgs([]string{stackFile, " " + overrideFile}, []string{"gpu"}); !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected arguments\n got: %v\nwant: %v", args, expected)
+	}
+
+	envFile := filepath.Join(folder, StackEnvFileName)
+	if err := os.WriteFile(envFile, []byte("A=1\n"), 0644); err != nil {
+		t.Fatalf("unable to write the env file: %s", err)
+	}
+
+	expected = []string{"-f", stackFile, "--env-file", envFile}
+	if args := composeFileArgs([]string{stackFile}, nil); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected the env file of the stack to be selected\n got: %v\nwant: %v", args, expected)
+	}
+}
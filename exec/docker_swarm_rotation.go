@@ -0,0 +1,184 @@
+package exec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// rotatedObjectKinds are the top level sections of a compose file defining swarm objects that cannot be updated,
+// along with the docker command managing them
+var rotatedObjectKinds = map[string]string{
+	"configs": "config",
+	"secrets": "secret",
+}
+
+// rotatedNameRegexp matches the names given to the rotated configs and secrets, <stack>_<key>_<hash>
+var rotatedNameRegexp = regexp.MustCompile(`_[0-9a-f]{12}$`)
+
+// rotatedFilePrefix is the prefix of the copies of the compose files naming the configs and secrets after their content
+const rotatedFilePrefix = ".rotated-"
+
+// rotateObjects writes a copy of a compose file in which the configs and secrets read from a file are named after
+// the hash of their content, so that a changed content creates new swarm objects that the services are updated to
+// use instead of failing the deployment. The external objects and the objects already named are left untouched.
+// It returns the path of the file to deploy, the copy when some objects were rotated, along with the rotated names
+// keyed by kind.
+func rotateObjects(stackName, filePath string) (string, map[string][]string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var document yaml.Node
+
+	err = yaml.Unmarshal(content, &document)
+	if err != nil || len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		// the file is reported by the deployment
+		return filePath, nil, nil
+	}
+
+	root := document.Content[0]
+	names := map[string][]string{}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "version" && !namedObjectsSupported(root.Content[i+1].Value) {
+			return filePath, nil, nil
+		}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		kind := root.Content[i].Value
+		objects := root.Content[i+1]
+
+		if _, ok := rotatedObjectKinds[kind]; !ok || objects.Kind != yaml.MappingNode {
+			continue
+		}
+
+		for j := 0; j+1 < len(objects.Content); j += 2 {
+			key, object := objects.Content[j].Value, objects.Content[j+1]
+
+			name, ok := rotatedName(stackName, key, object, filepath.Dir(filePath))
+			if !ok {
+				continue
+			}
+
+			object.Content = append(object.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: "name"},
+				&yaml.Node{Kind: yaml.ScalarNode, Value: name},
+			)
+
+			names[kind] = append(names[kind], name)
+		}
+	}
+
+	if len(names) == 0 {
+		return filePath, nil, nil
+	}
+
+	rotated, err := yaml.Marshal(&document)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the copy is written next to the compose file so that the relative paths it holds are resolved the same way
+	rotatedPath := filepath.Join(filepath.Dir(filePath), rotatedFilePrefix+filepath.Base(filePath))
+
+	err = os.WriteFile(rotatedPath, rotated, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return rotatedPath, names, nil
+}
+
+// namedObjectsSupported returns true when a compose file version lets the configs and secrets be named, which
+// requires the version 3.5 or later
+func namedObjectsSupported(version string) bool {
+	var major, minor int
+
+	_, err := fmt.Sscanf(version, "%d.%d", &major, &minor)
+	if err != nil {
+		_, err = fmt.Sscanf(version, "%d", &major)
+	}
+
+	return err != nil || major > 3 || (major == 3 && minor >= 5)
+}
+
+// rotatedName returns the name of a config or secret read from a file, made of the stack name, its key and the
+// hash of the content of the file
+func rotatedName(stackName, key string, object *yaml.Node, folder string) (string, bool) {
+	if object.Kind != yaml.MappingNode {
+		return "", false
+	}
+
+	file := ""
+	for i := 0; i+1 < len(object.Content); i += 2 {
+		switch object.Content[i].Value {
+		case "external", "name":
+			return "", false
+		case "file":
+			file = object.Content[i+1].Value
+		}
+	}
+
+	// the files whose path is interpolated are left to the deployment
+	if file == "" || strings.Contains(file, "$") {
+		return "", false
+	}
+
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(folder, file)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+
+	hash := sha256.Sum256(content)
+
+	return fmt.Sprintf("%s_%s_%s", stackName, key, hex.EncodeToString(hash[:])[:12]), true
+}
+
+// pruneRotatedObjects removes the rotated configs and secrets of a stack that are no longer used by its compose
+// files. A removal failure is logged, the object is removed by the next deployment.
+func (service *DockerSwarmStackService) pruneRotatedObjects(stackName string, names map[string][]string) {
+	command := service.prepareDockerCommand(service.binaryPath)
+
+	for kind, objectCommand := range rotatedObjectKinds {
+		current := map[string]bool{}
+		for _, name := range names[kind] {
+			current[name] = true
+		}
+
+		output, err := runCommandAndCaptureStdErr(command, []string{objectCommand, "ls", "--filter", "label=com.docker.stack.namespace=" + stackName, "--format", "{{.Name}}"}, nil)
+		if err != nil {
+			log.Warn().Err(err).Str("stack", stackName).Msgf("unable to list the %s of the stack", kind)
+
+			continue
+		}
+
+		for _, name := range strings.Fields(string(output)) {
+			if current[name] || !strings.HasPrefix(name, stackName+"_") || !rotatedNameRegexp.MatchString(name) {
+				continue
+			}
+
+			_, err := runCommandAndCaptureStdErr(command, []string{objectCommand, "rm", name}, nil)
+			if err != nil {
+				log.Warn().Err(err).Str("stack", stackName).Str("name", name).Msgf("unable to remove the superseded %s of the stack", objectCommand)
+
+				continue
+			}
+
+			log.Debug().Str("stack", stackName).Str("name", name).Msgf("superseded %s of the stack removed", objectCommand)
+		}
+	}
+}
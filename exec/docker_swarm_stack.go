@@ -3,8 +3,11 @@ package exec
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"path"
 	"runtime"
+	"strings"
 
 	"github.com/portainer/agent"
 )
@@ -28,7 +31,8 @@ func NewDockerSwarmStackService(binaryPath string) (*DockerSwarmStackService, er
 	return service, nil
 }
 
-// Deploy executes the docker stack deploy command.
+// Deploy executes the docker stack deploy command. The configs and secrets read from a file are named after the hash
+// of their content, the ones superseded by a successful deployment are removed.
 func (service *DockerSwarmStackService) Deploy(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
 	if len(filePaths) == 0 {
 		return errors.New("missing file paths")
@@ -38,15 +42,58 @@ func (service *DockerSwarmStackService) Deploy(ctx context.Context, name string,
 
 	command := service.prepareDockerCommand(service.binaryPath)
 
-	args := []string{}
-	if options.Prune {
-		args = append(args, "stack", "deploy", "--prune", "--with-registry-auth", "--compose-file", stackFilePath, name)
-	} else {
-		args = append(args, "stack", "deploy", "--with-registry-auth", "--compose-file", stackFilePath, name)
+	args := []string{"stack", "deploy"}
+	if options.Prune || options.RemoveOrphans {
+		args = append(args, "--prune")
+	}
+
+	if options.NoPull {
+		// the image digests are not resolved against the registries
+		args = append(args, "--resolve-image", "never")
+	}
+
+	args = append(args, "--with-registry-auth")
+
+	rotatedNames := map[string][]string{}
+
+	// the override files are merged on top of the stack file, in order
+	for _, filePath := range filePaths {
+		deployedPath, names, err := rotateObjects(name, filePath)
+		if err != nil {
+			return fmt.Errorf("unable to name the configs and secrets of %s: %w", path.Base(filePath), err)
+		}
+
+		if deployedPath != filePath {
+			defer os.Remove(deployedPath)
+		}
+
+		for kind, kindNames := range names {
+			rotatedNames[kind] = append(rotatedNames[kind], kindNames...)
+		}
+
+		args = append(args, "--compose-file", deployedPath)
 	}
 
+	args = append(args, name)
+
 	stackFolder := path.Dir(stackFilePath)
-	_, err := runCommandAndCaptureStdErr(command, args, &cmdOpts{WorkingDir: stackFolder})
+	_, err := runCommandAndCaptureStdErr(command, args, &cmdOpts{WorkingDir: stackFolder, Output: OutputFrom(ctx), Env: envList(options.EnvVars)})
+	if err != nil {
+		return err
+	}
+
+	service.pruneRotatedObjects(name, rotatedNames)
+
+	return nil
+}
+
+// Restart executes the docker service update command with --force on a service of the stack, which replaces its
+// tasks with the same configuration.
+func (service *DockerSwarmStackService) Restart(ctx context.Context, name string, filePaths []string, options agent.RestartOptions) error {
+	command := service.prepareDockerCommand(service.binaryPath)
+	args := []string{"service", "update", "--force", "--detach", name + "_" + options.Service}
+
+	_, err := runCommandAndCaptureStdErr(command, args, nil)
 	return err
 }
 
@@ -64,6 +111,93 @@ func (service *DockerSwarmStackService) Remove(ctx context.Context, name string,
 	return err
 }
 
+// Status executes the docker stack ps command and counts the running and exited tasks of the stack, in total and
+// per service, the tasks that were replaced are ignored.
+func (service *DockerSwarmStackService) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	command := service.prepareDockerCommand(service.binaryPath)
+	args := []string{"stack", "ps", "--filter", "desired-state=running", "--no-trunc", "--format", "{{.Name}}\t{{.CurrentState}}\t{{.Error}}", name}
+
+	output, err := runCommandAndCaptureStdErr(command, args, nil)
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	states := agent.ServiceStates{}
+	services := map[string]int{}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+			continue
+		}
+
+		// the tasks are named after their service and their slot, or the node of the global services
+		serviceName := fields[0]
+		if dot := strings.LastIndex(serviceName, "."); dot > 0 {
+			serviceName = serviceName[:dot]
+		}
+
+		index, ok := services[serviceName]
+		if !ok {
+			index = len(states.Services)
+			services[serviceName] = index
+			states.Services = append(states.Services, agent.ServiceState{Name: serviceName})
+		}
+
+		states.Total++
+		states.Services[index].Desired++
+
+		switch strings.ToLower(strings.Fields(fields[1])[0]) {
+		case "running":
+			states.Running++
+			states.Services[index].Running++
+		case "complete", "failed", "shutdown", "rejected", "orphaned":
+			states.Exited++
+		}
+
+		if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+			states.Services[index].Error = strings.TrimSpace(fields[2])
+		}
+	}
+
+	return states, nil
+}
+
+// Validate executes the docker compose config command on the stack files, the docker stack command does not
+// validate the files without deploying them on all the Docker versions.
+func (service *DockerSwarmStackService) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
+	command := path.Join(service.binaryPath, "docker-compose")
+	if runtime.GOOS == "windows" {
+		command = path.Join(service.binaryPath, "docker-compose.exe")
+	}
+
+	args := []string{}
+	for _, filePath := range filePaths {
+		args = append(args, "-f", filePath)
+	}
+	args = append(args, "--project-name", name, "config", "--quiet")
+
+	_, err := runCommandAndCaptureStdErr(command, args, &cmdOpts{WorkingDir: path.Dir(filePaths[0]), Env: envList(options.EnvVars)})
+
+	return err
+}
+
+// Version returns the version of the Docker client binary.
+func (service *DockerSwarmStackService) Version(ctx context.Context) (string, error) {
+	command := service.prepareDockerCommand(service.binaryPath)
+
+	output, err := runCommandAndCaptureStdErr(command, []string{"--version"}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
 func (service *DockerSwarmStackService) prepareDockerCommand(binaryPath string) string {
 	// Assume Linux as a default
 	command := path.Join(binaryPath, "docker")
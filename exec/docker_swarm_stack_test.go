@@ -0,0 +1,197 @@
+package exec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/portainer/agent"
+)
+
+func TestSwarmDeployArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  agent.DeployOptions
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: "stack deploy --with-registry-auth",
+		},
+		{
+			name:     "orphans removed",
+			options:  agent.DeployOptions{RemoveOrphans: true},
+			expected: "stack deploy --prune --with-registry-auth",
+		},
+		{
+			name:     "local images only",
+			options:  agent.DeployOptions{NoPull: true},
+			expected: "stack deploy --resolve-image never --with-registry-auth",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binaryPath, calls := fakeBinary(t, "docker")
+			service := &DockerSwarmStackService{binaryPath: binaryPath}
+
+			stackFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+			if err := os.WriteFile(stackFile, []byte("services:\n  web:\n    image: nginx\n"), 0644); err != nil {
+				t.Fatalf("unable to write the stack file: %s", err)
+			}
+
+			err := service.Deploy(context.Background(), "web", []string{stackFile}, test.options)
+			if err != nil {
+				t.Fatalf("unable to deploy the stack: %s", err)
+			}
+
+			// the deployment is followed by the lookup of the rotated configs and secrets to prune
+			expected := test.expected + " --compose-file " + stackFile + " web"
+			if args := recordedCalls(t, calls); args[0] != expected {
+				t.Errorf("unexpected docker command\n got: %s\nwant: %s", args[0], expected)
+			}
+		})
+	}
+}
+
+func TestRotateObjects(t *testing.T) {
+	folder := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(folder, "nginx.conf"), []byte("server {}\n"), 0644); err != nil {
+		t.Fatalf("unable to write the config file: %s", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(folder, "password"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("unable to write the secret file: %s", err)
+	}
+
+	stackFile := filepath.Join(folder, "docker-compose.yml")
+	content := `version: "3.8"
+services:
+  web:
+    image: nginx
+configs:
+  nginx:
+    file: ./nginx.conf
+  external:
+    external: true
+  named:
+    name: web_named
+    file: ./nginx.conf
+  interpolated:
+    file: ${CONFIG_FILE}
+secrets:
+  password:
+    file: ./password
+`
+	if err := os.WriteFile(stackFile, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write the stack file: %s", err)
+	}
+
+	deployedPath, names, err := rotateObjects("web", stackFile)
+	if err != nil {
+		t.Fatalf("unable to rotate the objects: %s", err)
+	}
+
+	if deployedPath != filepath.Join(folder, rotatedFilePrefix+"docker-compose.yml") {
+		t.Errorf("expected a copy of the stack file to be deployed, got %s", deployedPath)
+	}
+
+	if len(names["configs"]) != 1 || len(names["secrets"]) != 1 {
+		t.Fatalf("expected a rotated config and secret, got %v", names)
+	}
+
+	configName := names["configs"][0]
+	if !strings.HasPrefix(configName, "web_nginx_") || !rotatedNameRegexp.MatchString(configName) {
+		t.Errorf("expected the config to be named after the stack, its key and its content, got %s", configName)
+	}
+
+	rotated, err := os.ReadFile(deployedPath)
+	if err != nil {
+		t.Fatalf("unable to read the rotated stack file: %s", err)
+	}
+
+	if !strings.Contains(string(rotated), "name: "+configName) || !strings.Contains(string(rotated), "name: web_named") {
+		t.Errorf("expected the rotated names to be set in the deployed file, got:\n%s", rotated)
+	}
+
+	// a changed content creates a new object
+	if err := os.WriteFile(filepath.Join(folder, "nginx.conf"), []byte("server { listen 8080; }\n"), 0644); err != nil {
+		t.Fatalf("unable to write the config file: %s", err)
+	}
+
+	_, changed, err := rotateObjects("web", stackFile)
+	if err != nil {
+		t.Fatalf("unable to rotate the objects: %s", err)
+	}
+
+	if changed["configs"][0] == configName || changed["secrets"][0] != names["secrets"][0] {
+		t.Errorf("expected only the changed config to be renamed, got %v after %v", changed, names)
+	}
+}
+
+func TestRotateObjectsUnsupportedVersion(t *testing.T) {
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, "nginx.conf"), []byte("server {}\n"), 0644); err != nil {
+		t.Fatalf("unable to write the config file: %s", err)
+	}
+
+	stackFile := filepath.Join(folder, "docker-compose.yml")
+	if err := os.WriteFile(stackFile, []byte("version: \"3.3\"\nconfigs:\n  nginx:\n    file: ./nginx.conf\n"), 0644); err != nil {
+		t.Fatalf("unable to write the stack file: %s", err)
+	}
+
+	deployedPath, names, err := rotateObjects("web", stackFile)
+	if err != nil || deployedPath != stackFile || names != nil {
+		t.Errorf("expected a compose file that cannot name its objects to be deployed as is, got %s, %v and %v", deployedPath, names, err)
+	}
+}
+
+func TestNamedObjectsSupported(t *testing.T) {
+	tests := map[string]bool{
+		"3.5": true,
+		"3.8": true,
+		"3":   false,
+		"3.4": false,
+		"2.4": false,
+		"4":   true,
+		"":    true,
+	}
+
+	for version, expected := range tests {
+		if supported := namedObjectsSupported(version); supported != expected {
+			t.Errorf("expected the objects of a %q compose file to be named: %t, got %t", version, expected, supported)
+		}
+	}
+}
+
+func TestPruneRotatedObjects(t *testing.T) {
+	binaryPath, calls := fakeBinary(t, "docker")
+
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n" +
+		"if [ \"$2\" = ls ]; then printf 'web_nginx_aaaaaaaaaaaa\\nweb_nginx_bbbbbbbbbbbb\\nweb_manual\\nother_nginx_cccccccccccc\\n'; fi\n"
+	if err := os.WriteFile(filepath.Join(binaryPath, "docker"), []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write the fake binary: %s", err)
+	}
+
+	service := &DockerSwarmStackService{binaryPath: binaryPath}
+	service.pruneRotatedObjects("web", map[string][]string{"configs": {"web_nginx_bbbbbbbbbbbb"}})
+
+	removed := []string{}
+	for _, call := range recordedCalls(t, calls) {
+		if strings.Contains(call, " rm ") {
+			removed = append(removed, call)
+		}
+	}
+	sort.Strings(removed)
+
+	// only the superseded rotated objects of the stack are removed
+	expected := []string{"config rm web_nginx_aaaaaaaaaaaa", "secret rm web_nginx_aaaaaaaaaaaa", "secret rm web_nginx_bbbbbbbbbbbb"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("unexpected removals\n got: %v\nwant: %v", removed, expected)
+	}
+}
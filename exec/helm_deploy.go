@@ -0,0 +1,170 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/portainer/agent"
+)
+
+// HelmDeployer represents a service to install the Helm charts of the stacks inside a Kubernetes environment.
+// The chart is given by the HelmChart deploy option and the stack file holds the values of the release.
+type HelmDeployer struct {
+	command string
+}
+
+// NewHelmDeployer initializes a new HelmDeployer service.
+func NewHelmDeployer(binaryPath string) *HelmDeployer {
+	command := path.Join(binaryPath, "helm")
+	if runtime.GOOS == "windows" {
+		command = path.Join(binaryPath, "helm.exe")
+	}
+
+	return &HelmDeployer{
+		command: command,
+	}
+}
+
+// Deploy installs the chart as a release named after the stack, or upgrades the release when it already exists.
+// The namespace of the release is created when it does not exist. When options.RolloutTimeout is set, it returns
+// once the resources of the release are ready. helm uses the in-cluster config.
+func (deployer *HelmDeployer) Deploy(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	args, err := chartArgs(filePaths, options)
+	if err != nil {
+		return err
+	}
+
+	args = append([]string{"upgrade", "--install", name}, args...)
+	args = append(args, "--create-namespace")
+
+	if options.RolloutTimeout > 0 {
+		args = append(args, "--wait", "--timeout", options.RolloutTimeout.String())
+	}
+
+	_, err = runCommandAndCaptureStdErr(deployer.command, args, &cmdOpts{Output: OutputFrom(ctx)})
+	return err
+}
+
+// Remove uninstalls the release of the stack.
+func (deployer *HelmDeployer) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
+	args, err := buildArgs(&argOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	args = append(args, "uninstall", name)
+
+	_, err = runCommandAndCaptureStdErr(deployer.command, args, nil)
+	return err
+}
+
+// Validate renders the chart with the values of the stack without sending the resources to the cluster.
+func (deployer *HelmDeployer) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	args, err := chartArgs(filePaths, options)
+	if err != nil {
+		return err
+	}
+
+	args = append([]string{"template", name}, args...)
+
+	_, err = runCommandAndCaptureStdErr(deployer.command, args, nil)
+	return err
+}
+
+// Pull is a dummy method for Helm, the chart is downloaded by the deployment
+func (deployer *HelmDeployer) Pull(ctx context.Context, name string, filePaths []string) error {
+	return nil
+}
+
+// Status returns the state of the release of the stack, it is counted as running once deployed and as exited
+// when its last deployment failed. The status of a release that is not deployed is reported as its error.
+func (deployer *HelmDeployer) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	output, err := runCommandAndCaptureStdErr(deployer.command, []string{"list", "--all-namespaces", "--all", "--filter", "^" + regexp.QuoteMeta(name) + "$", "--output", "json"}, nil)
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	var releases []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+
+	err = json.Unmarshal(output, &releases)
+	if err != nil {
+		return agent.ServiceStates{}, errors.Wrap(err, "failed to parse the helm output")
+	}
+
+	if len(releases) == 0 {
+		return agent.ServiceStates{}, fmt.Errorf("release %s not found", name)
+	}
+
+	states := agent.ServiceStates{}
+	for _, release := range releases {
+		service := agent.ServiceState{Name: release.Name, Desired: 1}
+
+		states.Total++
+
+		switch release.Status {
+		case "deployed":
+			states.Running++
+			service.Running = 1
+		case "failed":
+			states.Exited++
+		}
+
+		if release.Status != "deployed" {
+			service.Error = release.Status
+		}
+
+		states.Services = append(states.Services, service)
+	}
+
+	return states, nil
+}
+
+// Version returns the version of the helm client binary.
+func (deployer *HelmDeployer) Version(ctx context.Context) (string, error) {
+	output, err := runCommandAndCaptureStdErr(deployer.command, []string{"version", "--short"}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// chartArgs returns the arguments selecting the chart, the values and the namespace of a release
+func chartArgs(filePaths []string, options agent.DeployOptions) ([]string, error) {
+	if len(filePaths) == 0 {
+		return nil, errors.New("missing file paths")
+	}
+
+	if options.HelmChart == nil || options.HelmChart.Chart == "" {
+		return nil, errors.New("missing Helm chart")
+	}
+
+	args := []string{options.HelmChart.Chart, "--values", filePaths[0]}
+
+	if options.HelmChart.Repository != "" {
+		args = append(args, "--repo", options.HelmChart.Repository)
+	}
+
+	if options.HelmChart.Version != "" {
+		args = append(args, "--version", options.HelmChart.Version)
+	}
+
+	namespaceArgs, err := buildArgs(&argOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(args, namespaceArgs...), nil
+}
@@ -0,0 +1,121 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/portainer/agent"
+)
+
+func TestHelmDeployArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  agent.DeployOptions
+		expected string
+	}{
+		{
+			name:     "chart reference",
+			options:  agent.DeployOptions{HelmChart: &agent.HelmChart{Chart: "oci://registry.example.com/charts/web"}},
+			expected: "upgrade --install web oci://registry.example.com/charts/web --values %s --create-namespace",
+		},
+		{
+			name: "repository chart in a namespace",
+			options: agent.DeployOptions{
+				DeployerBaseOptions: agent.DeployerBaseOptions{Namespace: "team-a"},
+				HelmChart:           &agent.HelmChart{Chart: "nginx", Repository: "https://charts.example.com", Version: "1.2.3"},
+			},
+			expected: "upgrade --install web nginx --values %s --repo https://charts.example.com --version 1.2.3 --namespace team-a --create-namespace",
+		},
+		{
+			name:     "rollout awaited",
+			options:  agent.DeployOptions{HelmChart: &agent.HelmChart{Chart: "nginx"}, RolloutTimeout: 90 * time.Second},
+			expected: "upgrade --install web nginx --values %s --create-namespace --wait --timeout 1m30s",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binaryPath, calls := fakeBinary(t, "helm")
+			deployer := NewHelmDeployer(binaryPath)
+
+			valuesFile := filepath.Join(t.TempDir(), "values.yml")
+
+			err := deployer.Deploy(context.Background(), "web", []string{valuesFile}, test.options)
+			if err != nil {
+				t.Fatalf("unable to deploy the chart: %s", err)
+			}
+
+			expected := []string{fmt.Sprintf(test.expected, valuesFile)}
+			if args := recordedCalls(t, calls); !reflect.DeepEqual(args, expected) {
+				t.Errorf("unexpected helm command\n got: %v\nwant: %v", args, expected)
+			}
+		})
+	}
+}
+
+func TestHelmDeployMissingChart(t *testing.T) {
+	deployer := NewHelmDeployer(t.TempDir())
+
+	if err := deployer.Deploy(context.Background(), "web", []string{"values.yml"}, agent.DeployOptions{HelmChart: &agent.HelmChart{}}); err == nil {
+		t.Error("expected a deployment without a chart to fail")
+	}
+
+	if err := deployer.Deploy(context.Background(), "web", nil, agent.DeployOptions{HelmChart: &agent.HelmChart{Chart: "nginx"}}); err == nil {
+		t.Error("expected a deployment without a values file to fail")
+	}
+}
+
+func TestHelmStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases string
+		expected agent.ServiceStates
+		err      bool
+	}{
+		{
+			name:     "deployed",
+			releases: `[{"name": "web", "status": "deployed"}]`,
+			expected: agent.ServiceStates{Total: 1, Running: 1, Services: []agent.ServiceState{{Name: "web", Desired: 1, Running: 1}}},
+		},
+		{
+			name:     "failed",
+			releases: `[{"name": "web", "status": "failed"}]`,
+			expected: agent.ServiceStates{Total: 1, Exited: 1, Services: []agent.ServiceState{{Name: "web", Desired: 1, Error: "failed"}}},
+		},
+		{
+			name:     "pending upgrade",
+			releases: `[{"name": "web", "status": "pending-upgrade"}]`,
+			expected: agent.ServiceStates{Total: 1, Services: []agent.ServiceState{{Name: "web", Desired: 1, Error: "pending-upgrade"}}},
+		},
+		{
+			name:     "not found",
+			releases: `[]`,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binaryPath, _ := fakeBinary(t, "helm")
+
+			script := "#!/bin/sh\necho '" + test.releases + "'\n"
+			if err := os.WriteFile(filepath.Join(binaryPath, "helm"), []byte(script), 0755); err != nil {
+				t.Fatalf("unable to write the fake binary: %s", err)
+			}
+
+			states, err := NewHelmDeployer(binaryPath).Status(context.Background(), "web", nil, agent.StatusOptions{})
+			if (err != nil) != test.err {
+				t.Fatalf("expected an error to be %t, got %v", test.err, err)
+			}
+
+			if !test.err && !reflect.DeepEqual(states, test.expected) {
+				t.Errorf("unexpected states\n got: %+v\nwant: %+v", states, test.expected)
+			}
+		})
+	}
+}
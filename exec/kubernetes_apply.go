@@ -0,0 +1,361 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// KubernetesFieldManager is the field manager of the fields of the resources applied by the agent
+const KubernetesFieldManager = "portainer-edge-agent"
+
+// legacyFieldManagers are the field managers of the fields set by the kubectl applies of the previous versions of
+// the agent, the agent takes the ownership of these fields over instead of reporting a conflict
+var legacyFieldManagers = map[string]bool{
+	"kubectl-client-side-apply": true,
+	"kubectl":                   true,
+	"before-first-apply":        true,
+}
+
+var conflictManagerRegexp = regexp.MustCompile(`conflict with "([^"]+)"`)
+
+// KubernetesConflictError is returned when the server-side apply of a resource is refused because some of its
+// fields are owned by other field managers, such as controllers or other tools
+type KubernetesConflictError struct {
+	// Resource is the kind and name of the resource, e.g. deployment/nginx
+	Resource string
+	// Conflicts holds the conflicting fields along with their field manager
+	Conflicts []string
+}
+
+func (e *KubernetesConflictError) Error() string {
+	return fmt.Sprintf("conflicting fields on %s: %s", e.Resource, strings.Join(e.Conflicts, "; "))
+}
+
+// rolloutPollInterval is the interval between two checks of the rollout of the applied workloads
+const rolloutPollInterval = 2 * time.Second
+
+// appliedWorkload is a Deployment, StatefulSet or DaemonSet applied by a deployment, whose rollout can be awaited
+type appliedWorkload struct {
+	resource dynamic.ResourceInterface
+	kind     string
+	name     string
+}
+
+// kubernetesApplier applies the resources of the manifests with server-side apply, using the in-cluster config
+type kubernetesApplier struct {
+	client dynamic.Interface
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+}
+
+var (
+	applierMu     sync.Mutex
+	sharedApplier *kubernetesApplier
+)
+
+// getKubernetesApplier returns the applier shared by the deployments, it is created on the first use so that
+// the agent starts outside of a cluster
+func getKubernetesApplier() (*kubernetesApplier, error) {
+	applierMu.Lock()
+	defer applierMu.Unlock()
+
+	if sharedApplier != nil {
+		return sharedApplier, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the in-cluster config")
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedApplier = &kubernetesApplier{
+		client: client,
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+	}
+
+	return sharedApplier, nil
+}
+
+// apply applies the resources of a manifest, namespace overrides the namespace of the namespaced resources
+// when it is set. The applied resources are written to output when it is set. It returns the applied workloads.
+func (applier *kubernetesApplier) apply(ctx context.Context, manifest io.Reader, namespace string, output io.Writer) ([]appliedWorkload, error) {
+	workloads := []appliedWorkload{}
+
+	decoder := yaml.NewYAMLOrJSONDecoder(manifest, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+
+		err := decoder.Decode(&obj.Object)
+		if err == io.EOF {
+			return workloads, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse the manifest")
+		}
+
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		objects := []*unstructured.Unstructured{obj}
+		if obj.IsList() {
+			objects = nil
+
+			err = obj.EachListItem(func(item runtime.Object) error {
+				objects = append(objects, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse the manifest list")
+			}
+		}
+
+		for _, object := range objects {
+			resource, err := applier.applyObject(ctx, object, namespace, output)
+			if err != nil {
+				return nil, err
+			}
+
+			switch object.GetKind() {
+			case "Deployment", "StatefulSet", "DaemonSet":
+				workloads = append(workloads, appliedWorkload{resource: resource, kind: object.GetKind(), name: object.GetName()})
+			}
+		}
+	}
+}
+
+func (applier *kubernetesApplier) applyObject(ctx context.Context, obj *unstructured.Unstructured, namespace string, output io.Writer) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	resourceName := fmt.Sprintf("%s/%s", strings.ToLower(gvk.Kind), obj.GetName())
+
+	mapping, err := applier.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// the kind may be defined by a custom resource definition created since the discovery
+		applier.mapper.Reset()
+		mapping, err = applier.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve the resource type of %s", resourceName)
+	}
+
+	var resource dynamic.ResourceInterface = applier.client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		switch {
+		case namespace != "":
+			obj.SetNamespace(namespace)
+		case obj.GetNamespace() == "":
+			obj.SetNamespace(metav1.NamespaceDefault)
+		}
+
+		resource = applier.client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	}
+
+	options := metav1.ApplyOptions{FieldManager: KubernetesFieldManager}
+
+	_, err = resource.Apply(ctx, obj.GetName(), obj, options)
+	if apierrors.IsConflict(err) && onlyLegacyConflicts(err) {
+		options.Force = true
+		_, err = resource.Apply(ctx, obj.GetName(), obj, options)
+	}
+
+	if err != nil {
+		if conflicts := applyConflicts(err); len(conflicts) > 0 {
+			return nil, &KubernetesConflictError{Resource: resourceName, Conflicts: conflicts}
+		}
+
+		return nil, errors.Wrapf(err, "failed to apply %s", resourceName)
+	}
+
+	if output != nil {
+		fmt.Fprintf(output, "%s serverside-applied\n", resourceName)
+	}
+
+	return resource, nil
+}
+
+// waitForRollout waits for the rollout of the applied workloads to complete within timeout, like kubectl rollout
+// status. A Deployment whose progress deadline is exceeded fails the wait right away.
+func waitForRollout(ctx context.Context, workloads []appliedWorkload, timeout time.Duration, output io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, workload := range workloads {
+		resourceName := fmt.Sprintf("%s/%s", strings.ToLower(workload.kind), workload.name)
+
+		for {
+			obj, err := workload.resource.Get(ctx, workload.name, metav1.GetOptions{})
+			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("the rollout of %s did not complete within %s", resourceName, timeout)
+				}
+
+				return errors.Wrapf(err, "failed to retrieve %s", resourceName)
+			}
+
+			done, err := rolloutComplete(obj)
+			if err != nil {
+				return fmt.Errorf("the rollout of %s failed: %w", resourceName, err)
+			}
+
+			if done {
+				if output != nil {
+					fmt.Fprintf(output, "%s successfully rolled out\n", resourceName)
+				}
+
+				break
+			}
+
+			timer := time.NewTimer(rolloutPollInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+
+				return fmt.Errorf("the rollout of %s did not complete within %s", resourceName, timeout)
+			case <-timer.C:
+			}
+		}
+	}
+
+	return nil
+}
+
+// rolloutComplete returns whether the latest generation of a workload is rolled out, with the same conditions as
+// kubectl rollout status
+func rolloutComplete(obj *unstructured.Unstructured) (bool, error) {
+	generation := obj.GetGeneration()
+	observedGeneration, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if observedGeneration < generation {
+		return false, nil
+	}
+
+	status := func(field string) int64 {
+		value, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return value
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, condition := range conditions {
+			condition, _ := condition.(map[string]interface{})
+			if condition["type"] == "Progressing" && condition["reason"] == "ProgressDeadlineExceeded" {
+				return false, fmt.Errorf("progress deadline exceeded")
+			}
+		}
+
+		replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+
+		updated := status("updatedReplicas")
+
+		return updated >= replicas && status("replicas") <= updated && status("availableReplicas") >= updated, nil
+	case "StatefulSet":
+		replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+
+		if status("readyReplicas") < replicas {
+			return false, nil
+		}
+
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return true, nil
+		}
+
+		partition, _, _ := unstructured.NestedInt64(obj.Object, "spec", "updateStrategy", "rollingUpdate", "partition")
+		if partition > 0 {
+			return status("updatedReplicas") >= replicas-partition, nil
+		}
+
+		updateRevision, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		currentRevision, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+
+		return updateRevision == currentRevision, nil
+	case "DaemonSet":
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return true, nil
+		}
+
+		desired := status("desiredNumberScheduled")
+
+		return status("updatedNumberScheduled") >= desired && status("numberAvailable") >= desired, nil
+	}
+
+	return true, nil
+}
+
+// fieldManagerConflicts returns the causes of an apply error that are field manager conflicts
+func fieldManagerConflicts(err error) []metav1.StatusCause {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return nil
+	}
+
+	causes := []metav1.StatusCause{}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			causes = append(causes, cause)
+		}
+	}
+
+	return causes
+}
+
+// onlyLegacyConflicts returns true when all the conflicts of an apply error are with legacyFieldManagers
+func onlyLegacyConflicts(err error) bool {
+	causes := fieldManagerConflicts(err)
+	if len(causes) == 0 {
+		return false
+	}
+
+	for _, cause := range causes {
+		match := conflictManagerRegexp.FindStringSubmatch(cause.Message)
+		if match == nil || !legacyFieldManagers[match[1]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// applyConflicts describes the conflicting fields of an apply error along with their field manager
+func applyConflicts(err error) []string {
+	conflicts := []string{}
+	for _, cause := range fieldManagerConflicts(err) {
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", cause.Field, cause.Message))
+	}
+
+	return conflicts
+}
@@ -0,0 +1,214 @@
+package exec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func conflictError(causes ...metav1.StatusCause) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    409,
+		Reason:  metav1.StatusReasonConflict,
+		Details: &metav1.StatusDetails{Causes: causes},
+	}}
+}
+
+func conflictCause(field, manager string) metav1.StatusCause {
+	return metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldManagerConflict,
+		Field:   field,
+		Message: `conflict with "` + manager + `" using apps/v1`,
+	}
+}
+
+func TestApplyConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		conflicts []string
+		legacy    bool
+	}{
+		{
+			name:      "not an API error",
+			err:       errors.New("connection refused"),
+			conflicts: []string{},
+		},
+		{
+			name:      "API error without details",
+			err:       &apierrors.StatusError{ErrStatus: metav1.Status{Reason: metav1.StatusReasonConflict}},
+			conflicts: []string{},
+		},
+		{
+			name:      "legacy field managers only",
+			err:       conflictError(conflictCause(".spec.replicas", "kubectl-client-side-apply"), conflictCause(".spec.template", "kubectl")),
+			conflicts: []string{`.spec.replicas (conflict with "kubectl-client-side-apply" using apps/v1)`, `.spec.template (conflict with "kubectl" using apps/v1)`},
+			legacy:    true,
+		},
+		{
+			name:      "legacy and controller field managers",
+			err:       conflictError(conflictCause(".spec.replicas", "before-first-apply"), conflictCause(".spec.replicas", "hpa-controller")),
+			conflicts: []string{`.spec.replicas (conflict with "before-first-apply" using apps/v1)`, `.spec.replicas (conflict with "hpa-controller" using apps/v1)`},
+		},
+		{
+			name: "other causes ignored",
+			err: conflictError(
+				metav1.StatusCause{Type: metav1.CauseTypeFieldValueInvalid, Field: ".spec.replicas", Message: "invalid"},
+				conflictCause(".metadata.labels", "kubectl"),
+			),
+			conflicts: []string{`.metadata.labels (conflict with "kubectl" using apps/v1)`},
+			legacy:    true,
+		},
+		{
+			name:      "unparsable conflict message",
+			err:       conflictError(metav1.StatusCause{Type: metav1.CauseTypeFieldManagerConflict, Field: ".spec", Message: "conflict"}),
+			conflicts: []string{".spec (conflict)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if conflicts := applyConflicts(test.err); !reflect.DeepEqual(conflicts, test.conflicts) {
+				t.Errorf("unexpected conflicts\n got: %v\nwant: %v", conflicts, test.conflicts)
+			}
+
+			if legacy := onlyLegacyConflicts(test.err); legacy != test.legacy {
+				t.Errorf("expected onlyLegacyConflicts to be %t, got %t", test.legacy, legacy)
+			}
+		})
+	}
+}
+
+func workload(kind string, generation int64, spec, status map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": "web", "generation": generation},
+		"spec":       spec,
+		"status":     status,
+	}}
+
+	return obj
+}
+
+func TestRolloutComplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		obj      *unstructured.Unstructured
+		complete bool
+		err      bool
+	}{
+		{
+			name: "deployment rolled out",
+			obj: workload("Deployment", 2, map[string]interface{}{"replicas": int64(3)},
+				map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(3), "availableReplicas": int64(3)}),
+			complete: true,
+		},
+		{
+			name: "deployment with a stale generation",
+			obj: workload("Deployment", 3, map[string]interface{}{"replicas": int64(3)},
+				map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(3), "availableReplicas": int64(3)}),
+		},
+		{
+			name: "deployment with old replicas remaining",
+			obj: workload("Deployment", 2, map[string]interface{}{"replicas": int64(3)},
+				map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(4), "updatedReplicas": int64(3), "availableReplicas": int64(3)}),
+		},
+		{
+			name: "deployment with unavailable replicas",
+			obj: workload("Deployment", 2, map[string]interface{}{"replicas": int64(3)},
+				map[string]interface{}{"observedGeneration": int64(2), "replicas": int64(3), "updatedReplicas": int64(3), "availableReplicas": int64(2)}),
+		},
+		{
+			name: "deployment with the default replicas",
+			obj: workload("Deployment", 1, map[string]interface{}{},
+				map[string]interface{}{"observedGeneration": int64(1), "replicas": int64(1), "updatedReplicas": int64(1), "availableReplicas": int64(1)}),
+			complete: true,
+		},
+		{
+			name: "deployment past its progress deadline",
+			obj: workload("Deployment", 2, map[string]interface{}{"replicas": int64(3)},
+				map[string]interface{}{"observedGeneration": int64(2), "conditions": []interface{}{
+					map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"},
+				}}),
+			err: true,
+		},
+		{
+			name: "statefulset rolled out",
+			obj: workload("StatefulSet", 2, map[string]interface{}{"replicas": int64(2)},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(2), "currentRevision": "web-2", "updateRevision": "web-2"}),
+			complete: true,
+		},
+		{
+			name: "statefulset with a stale generation",
+			obj: workload("StatefulSet", 3, map[string]interface{}{"replicas": int64(2)},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(2), "currentRevision": "web-2", "updateRevision": "web-2"}),
+		},
+		{
+			name: "statefulset updating its revision",
+			obj: workload("StatefulSet", 2, map[string]interface{}{"replicas": int64(2)},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(2), "currentRevision": "web-1", "updateRevision": "web-2"}),
+		},
+		{
+			name: "statefulset with unready replicas",
+			obj: workload("StatefulSet", 2, map[string]interface{}{"replicas": int64(2)},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(1), "currentRevision": "web-2", "updateRevision": "web-2"}),
+		},
+		{
+			name: "statefulset partition rolled out",
+			obj: workload("StatefulSet", 2, map[string]interface{}{"replicas": int64(4), "updateStrategy": map[string]interface{}{"type": "RollingUpdate", "rollingUpdate": map[string]interface{}{"partition": int64(2)}}},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(4), "updatedReplicas": int64(2), "currentRevision": "web-1", "updateRevision": "web-2"}),
+			complete: true,
+		},
+		{
+			name: "statefulset updated on delete",
+			obj: workload("StatefulSet", 2, map[string]interface{}{"replicas": int64(2), "updateStrategy": map[string]interface{}{"type": "OnDelete"}},
+				map[string]interface{}{"observedGeneration": int64(2), "readyReplicas": int64(2), "currentRevision": "web-1", "updateRevision": "web-2"}),
+			complete: true,
+		},
+		{
+			name: "daemonset rolled out",
+			obj: workload("DaemonSet", 2, map[string]interface{}{},
+				map[string]interface{}{"observedGeneration": int64(2), "desiredNumberScheduled": int64(3), "updatedNumberScheduled": int64(3), "numberAvailable": int64(3)}),
+			complete: true,
+		},
+		{
+			name: "daemonset with a stale generation",
+			obj: workload("DaemonSet", 3, map[string]interface{}{},
+				map[string]interface{}{"observedGeneration": int64(2), "desiredNumberScheduled": int64(3), "updatedNumberScheduled": int64(3), "numberAvailable": int64(3)}),
+		},
+		{
+			name: "daemonset updating its pods",
+			obj: workload("DaemonSet", 2, map[string]interface{}{},
+				map[string]interface{}{"observedGeneration": int64(2), "desiredNumberScheduled": int64(3), "updatedNumberScheduled": int64(2), "numberAvailable": int64(3)}),
+		},
+		{
+			name: "daemonset with unavailable pods",
+			obj: workload("DaemonSet", 2, map[string]interface{}{},
+				map[string]interface{}{"observedGeneration": int64(2), "desiredNumberScheduled": int64(3), "updatedNumberScheduled": int64(3), "numberAvailable": int64(1)}),
+		},
+		{
+			name:     "other kind",
+			obj:      workload("ConfigMap", 0, map[string]interface{}{}, map[string]interface{}{}),
+			complete: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			complete, err := rolloutComplete(test.obj)
+			if (err != nil) != test.err {
+				t.Fatalf("expected an error to be %t, got %v", test.err, err)
+			}
+
+			if complete != test.complete {
+				t.Errorf("expected the rollout completion to be %t, got %t", test.complete, complete)
+			}
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package exec
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/portainer/agent"
@@ -29,13 +35,39 @@ func NewKubernetesDeployer(binaryPath string) *KubernetesDeployer {
 }
 
 // Deploy will deploy a Kubernetes manifest inside the default namespace
-// it will use kubectl to deploy the manifest.
-// kubectl uses in-cluster config.
+// it will use server-side apply with the KubernetesFieldManager field manager to deploy the manifest,
+// the conflicts with the fields of other field managers are returned as a KubernetesConflictError.
+// When options.RolloutTimeout is set, it returns once the Deployments, StatefulSets and DaemonSets of the manifest
+// have rolled out. When the stack file is a kustomization, the resources built from the kustomization are applied.
+// It uses the in-cluster config.
 func (deployer *KubernetesDeployer) Deploy(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
 	if len(filePaths) == 0 {
 		return errors.New("missing file paths")
 	}
 
+	manifest, err := deployer.manifest(filePaths[0])
+	if err != nil {
+		return err
+	}
+
+	applier, err := getKubernetesApplier()
+	if err != nil {
+		return err
+	}
+
+	workloads, err := applier.apply(ctx, manifest, options.Namespace, OutputFrom(ctx))
+	if err != nil || options.RolloutTimeout <= 0 {
+		return err
+	}
+
+	return waitForRollout(ctx, workloads, options.RolloutTimeout, OutputFrom(ctx))
+}
+
+func (deployer *KubernetesDeployer) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing file paths")
+	}
+
 	stackFilePath := filePaths[0]
 
 	args, err := buildArgs(&argOptions{
@@ -45,19 +77,21 @@ func (deployer *KubernetesDeployer) Deploy(ctx context.Context, name string, fil
 		return err
 	}
 
-	args = append(args, "apply", "-f", stackFilePath)
+	args = append(args, "delete")
+	args = append(args, manifestArgs(stackFilePath)...)
 
 	_, err = runCommandAndCaptureStdErr(deployer.command, args, nil)
 	return err
+
 }
 
-func (deployer *KubernetesDeployer) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
+// Validate executes the kubectl apply command in client dry-run mode, which validates the manifest
+// without sending it to the cluster.
+func (deployer *KubernetesDeployer) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
 	if len(filePaths) == 0 {
 		return errors.New("missing file paths")
 	}
 
-	stackFilePath := filePaths[0]
-
 	args, err := buildArgs(&argOptions{
 		Namespace: options.Namespace,
 	})
@@ -65,11 +99,31 @@ func (deployer *KubernetesDeployer) Remove(ctx context.Context, name string, fil
 		return err
 	}
 
-	args = append(args, "delete", "-f", stackFilePath)
+	args = append(args, "apply", "--dry-run=client")
+	args = append(args, manifestArgs(filePaths[0])...)
 
 	_, err = runCommandAndCaptureStdErr(deployer.command, args, nil)
 	return err
+}
 
+// Restart executes the kubectl rollout restart command on a workload of the stack, which replaces its pods.
+func (deployer *KubernetesDeployer) Restart(ctx context.Context, name string, filePaths []string, options agent.RestartOptions) error {
+	args, err := buildArgs(&argOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	workload := options.Service
+	if !strings.Contains(workload, "/") {
+		workload = "deployment/" + workload
+	}
+
+	args = append(args, "rollout", "restart", workload)
+
+	_, err = runCommandAndCaptureStdErr(deployer.command, args, nil)
+	return err
 }
 
 // Pull is a dummy method for Kube
@@ -77,6 +131,159 @@ func (deployer *KubernetesDeployer) Pull(ctx context.Context, name string, fileP
 	return nil
 }
 
+// Status executes the kubectl get command on the resources of the manifest and counts their ready and failed pods,
+// in total and per workload. The pods of the workload resources are counted from their replicas, the message of
+// their failed conditions is reported as their error.
+func (deployer *KubernetesDeployer) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	if len(filePaths) == 0 {
+		return agent.ServiceStates{}, errors.New("missing file paths")
+	}
+
+	args, err := buildArgs(&argOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	args = append(args, "get")
+	args = append(args, manifestArgs(filePaths[0])...)
+	args = append(args, "--output", "json")
+
+	output, err := runCommandAndCaptureStdErr(deployer.command, args, nil)
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	var resources struct {
+		Items []struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Replicas               int    `json:"replicas"`
+				ReadyReplicas          int    `json:"readyReplicas"`
+				DesiredNumberScheduled int    `json:"desiredNumberScheduled"`
+				NumberReady            int    `json:"numberReady"`
+				Phase                  string `json:"phase"`
+				Reason                 string `json:"reason"`
+				Message                string `json:"message"`
+				Conditions             []struct {
+					Type    string `json:"type"`
+					Status  string `json:"status"`
+					Message string `json:"message"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+
+	err = json.Unmarshal(output, &resources)
+	if err != nil {
+		return agent.ServiceStates{}, errors.Wrap(err, "failed to parse the kubectl output")
+	}
+
+	states := agent.ServiceStates{}
+	for _, item := range resources.Items {
+		service := agent.ServiceState{Name: fmt.Sprintf("%s/%s", strings.ToLower(item.Kind), item.Metadata.Name)}
+
+		switch item.Kind {
+		case "Deployment", "StatefulSet", "ReplicaSet":
+			service.Desired = item.Status.Replicas
+			service.Running = item.Status.ReadyReplicas
+		case "DaemonSet":
+			service.Desired = item.Status.DesiredNumberScheduled
+			service.Running = item.Status.NumberReady
+		case "Pod":
+			service.Desired = 1
+
+			switch item.Status.Phase {
+			case "Running":
+				service.Running = 1
+			case "Succeeded", "Failed":
+				states.Exited++
+			}
+
+			if item.Status.Phase == "Failed" {
+				service.Error = strings.TrimSpace(item.Status.Reason + " " + item.Status.Message)
+			}
+		default:
+			continue
+		}
+
+		for _, condition := range item.Status.Conditions {
+			failed := (condition.Type == "ReplicaFailure" && condition.Status == "True") ||
+				(condition.Type == "Available" && condition.Status == "False")
+			if failed && condition.Message != "" {
+				service.Error = condition.Message
+			}
+		}
+
+		states.Total += service.Desired
+		states.Running += service.Running
+		states.Services = append(states.Services, service)
+	}
+
+	return states, nil
+}
+
+// Diff executes the kubectl diff command in server-side mode and returns the changes the manifest would apply to the cluster.
+func (deployer *KubernetesDeployer) Diff(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) (string, error) {
+	if len(filePaths) == 0 {
+		return "", errors.New("missing file paths")
+	}
+
+	args, err := buildArgs(&argOptions{
+		Namespace: options.Namespace,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// the conflicts are forced so that the changes are computed even when the deployment reports them
+	args = append(args, "diff", "--server-side", "--field-manager", KubernetesFieldManager, "--force-conflicts")
+	args = append(args, manifestArgs(filePaths[0])...)
+
+	stderr := newLimitedOutput(outputLimit)
+	cmd := exec.CommandContext(ctx, deployer.command, args...)
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+
+	// kubectl diff exits with 1 when the manifest differs from the cluster state
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return string(output), nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, stderr.String())
+	}
+
+	return string(output), nil
+}
+
+// Version returns the version of the kubectl client binary.
+func (deployer *KubernetesDeployer) Version(ctx context.Context) (string, error) {
+	output, err := runCommandAndCaptureStdErr(deployer.command, []string{"version", "--client", "--output", "json"}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var version struct {
+		ClientVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"clientVersion"`
+	}
+
+	err = json.Unmarshal(output, &version)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse kubectl version")
+	}
+
+	return version.ClientVersion.GitVersion, nil
+}
+
 // DeployRawConfig will deploy a Kubernetes manifest inside a specific namespace
 // it will use kubectl to deploy the manifest and receives a raw config.
 // kubectl uses in-cluster config.
@@ -94,6 +301,45 @@ func (deployer *KubernetesDeployer) DeployRawConfig(token, config string, namesp
 	return runCommandAndCaptureStdErr(deployer.command, args, &cmdOpts{Input: config})
 }
 
+// manifest returns the resources of a stack file, the resources of a kustomization are built by kubectl
+func (deployer *KubernetesDeployer) manifest(filePath string) (io.Reader, error) {
+	if !IsKustomization(filePath) {
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(content), nil
+	}
+
+	output, err := runCommandAndCaptureStdErr(deployer.command, []string{"kustomize", filepath.Dir(filePath)}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build the kustomization")
+	}
+
+	return bytes.NewReader(output), nil
+}
+
+// IsKustomization returns true when a stack file is the kustomization of its folder, the folder then holds the
+// resources and the overlays referenced by the kustomization
+func IsKustomization(filePath string) bool {
+	switch filepath.Base(filePath) {
+	case "kustomization.yaml", "kustomization.yml", "Kustomization":
+		return true
+	}
+
+	return false
+}
+
+// manifestArgs returns the kubectl arguments selecting the resources of a stack file
+func manifestArgs(filePath string) []string {
+	if IsKustomization(filePath) {
+		return []string{"-k", filepath.Dir(filePath)}
+	}
+
+	return []string{"-f", filePath}
+}
+
 type argOptions struct {
 	Namespace string
 	Token     string
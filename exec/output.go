@@ -0,0 +1,120 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// outputLimit is the size the output captured from the commands is bounded to, zero leaves it unbounded
+var outputLimit = 64 * 1024
+
+// SetOutputLimit sets the size the output captured from the commands is bounded to, the output beyond it is
+// elided from its middle. A zero limit leaves the output unbounded.
+func SetOutputLimit(limit int) {
+	outputLimit = limit
+}
+
+// limitedOutput captures the output of a command within a limit. It keeps the head and the tail of the output,
+// the useful error being usually at its end, and counts the bytes elided in between.
+type limitedOutput struct {
+	limit  int
+	head   []byte
+	tail   []byte
+	elided int
+}
+
+func newLimitedOutput(limit int) *limitedOutput {
+	return &limitedOutput{limit: limit}
+}
+
+func (output *limitedOutput) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if output.limit <= 0 {
+		output.head = append(output.head, p...)
+
+		return n, nil
+	}
+
+	headSize := output.limit / 4
+	if room := headSize - len(output.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+
+		output.head = append(output.head, p[:room]...)
+		p = p[room:]
+	}
+
+	output.tail = append(output.tail, p...)
+
+	if excess := len(output.tail) - (output.limit - headSize); excess > 0 {
+		output.elided += excess
+		output.tail = append(output.tail[:0], output.tail[excess:]...)
+	}
+
+	return n, nil
+}
+
+func (output *limitedOutput) String() string {
+	if output.elided == 0 {
+		return string(output.head) + string(output.tail)
+	}
+
+	// the cuts may split multi-byte characters, their remaining bytes are elided as well
+	head := output.head
+	if start := lastRuneStart(head); start >= 0 && !utf8.FullRune(head[start:]) {
+		head = head[:start]
+	}
+
+	tail := output.tail
+	for i := 0; i < utf8.UTFMax-1 && len(tail) > 0 && !utf8.RuneStart(tail[0]); i++ {
+		tail = tail[1:]
+	}
+
+	elided := output.elided + len(output.head) - len(head) + len(output.tail) - len(tail)
+
+	return fmt.Sprintf("%s\n[... %d bytes elided ...]\n%s", head, elided, tail)
+}
+
+// lastRuneStart returns the index of the first byte of the last character of p, -1 when it is not found within the
+// size of a character
+func lastRuneStart(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// ElideOutput bounds an output to a limit, keeping its head and its tail and noting how much was elided.
+// A zero limit returns the output unchanged.
+func ElideOutput(output string, limit int) string {
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	limited := newLimitedOutput(limit)
+	limited.Write([]byte(output))
+
+	return limited.String()
+}
+
+type outputKey struct{}
+
+// WithOutput returns a context which makes the deployers also write the output of their commands to w,
+// the writes may come from several goroutines
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+// OutputFrom returns the writer the deployers write the output of their commands to, nil when there is none
+func OutputFrom(ctx context.Context) io.Writer {
+	w, _ := ctx.Value(outputKey{}).(io.Writer)
+
+	return w
+}
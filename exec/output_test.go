@@ -0,0 +1,102 @@
+package exec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimitedOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		writes   []string
+		expected string
+	}{
+		{
+			name:     "under the limit",
+			limit:    8,
+			writes:   []string{"abc"},
+			expected: "abc",
+		},
+		{
+			name:     "at the limit",
+			limit:    8,
+			writes:   []string{"abcd", "efgh"},
+			expected: "abcdefgh",
+		},
+		{
+			name:     "over the limit in a single write",
+			limit:    8,
+			writes:   []string{"abcdefghij"},
+			expected: "ab\n[... 2 bytes elided ...]\nefghij",
+		},
+		{
+			name:     "over the limit across writes",
+			limit:    8,
+			writes:   []string{"a", "bcd", "efg", "hij"},
+			expected: "ab\n[... 2 bytes elided ...]\nefghij",
+		},
+		{
+			name:     "character split by the head cut",
+			limit:    8,
+			writes:   []string{"aé0123456789"},
+			expected: "a\n[... 6 bytes elided ...]\n456789",
+		},
+		{
+			name:     "character split by the tail cut",
+			limit:    8,
+			writes:   []string{"ab0123é56789"},
+			expected: "ab\n[... 6 bytes elided ...]\n56789",
+		},
+		{
+			name:     "three-byte character split by the head cut",
+			limit:    12,
+			writes:   []string{"a€", "0123456789xyz"},
+			expected: "a\n[... 7 bytes elided ...]\n456789xyz",
+		},
+		{
+			name:     "unbounded",
+			limit:    0,
+			writes:   []string{strings.Repeat("a", 100), strings.Repeat("b", 100)},
+			expected: strings.Repeat("a", 100) + strings.Repeat("b", 100),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := newLimitedOutput(test.limit)
+
+			for _, write := range test.writes {
+				n, err := output.Write([]byte(write))
+				if err != nil || n != len(write) {
+					t.Fatalf("expected the whole write to be accepted, got %d bytes and %v", n, err)
+				}
+			}
+
+			if s := output.String(); s != test.expected {
+				t.Errorf("unexpected output\n got: %q\nwant: %q", s, test.expected)
+			}
+		})
+	}
+}
+
+func TestElideOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		limit    int
+		expected string
+	}{
+		{name: "under the limit", output: "abc", limit: 8, expected: "abc"},
+		{name: "over the limit", output: "abcdefghij", limit: 8, expected: "ab\n[... 2 bytes elided ...]\nefghij"},
+		{name: "zero limit", output: "abcdefghij", limit: 0, expected: "abcdefghij"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if elided := ElideOutput(test.output, test.limit); elided != test.expected {
+				t.Errorf("unexpected output\n got: %q\nwant: %q", elided, test.expected)
+			}
+		})
+	}
+}
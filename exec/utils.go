@@ -3,19 +3,28 @@ package exec
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"sort"
 	"strings"
 )
 
 type cmdOpts struct {
 	WorkingDir string
 	Input      string
+	// Output also receives the stdout and stderr of the command, when set
+	Output io.Writer
+	// Env holds the variables added to the environment of the command, in the KEY=VALUE form
+	Env []string
 }
 
 func runCommandAndCaptureStdErr(command string, args []string, opts *cmdOpts) ([]byte, error) {
-	var stderr bytes.Buffer
+	var stdout bytes.Buffer
+	stderr := newLimitedOutput(outputLimit)
 	cmd := exec.Command(command, args...)
-	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
 
 	if opts != nil {
 		if opts.Input != "" {
@@ -24,13 +33,31 @@ func runCommandAndCaptureStdErr(command string, args []string, opts *cmdOpts) ([
 		if opts.WorkingDir != "" {
 			cmd.Dir = opts.WorkingDir
 		}
+		if len(opts.Env) > 0 {
+			cmd.Env = append(os.Environ(), opts.Env...)
+		}
+		if opts.Output != nil {
+			cmd.Stdout = io.MultiWriter(&stdout, opts.Output)
+			cmd.Stderr = io.MultiWriter(stderr, opts.Output)
+		}
 	}
 
-	output, err := cmd.Output()
+	err := cmd.Run()
 
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", err, stderr.String())
 	}
 
-	return output, nil
+	return stdout.Bytes(), nil
+}
+
+// envList returns variables in the KEY=VALUE form, sorted by key
+func envList(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+
+	return env
 }
@@ -0,0 +1,138 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrArchiveTooLarge is returned when the content of an archive exceeds the size it is bounded to
+var ErrArchiveTooLarge = errors.New("the archive content exceeds the maximum size")
+
+// ExtractTarGz extracts the directories and regular files of a tar.gz archive inside a folder, the other entries
+// such as the links are skipped. The entries resolving outside of the folder are refused, including through the
+// symbolic links already present in the folder, and the extraction fails once more than maxSize bytes are extracted,
+// a zero maxSize leaves it unbounded. It returns the paths of the extracted files relative to the folder.
+func ExtractTarGz(r io.Reader, folder string, maxSize int64) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	root, err := resolveExistingPath(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := tar.NewReader(gz)
+	files := []string{}
+	extracted := int64(0)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || !isValidPath(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return files, fmt.Errorf("the archive entry %q is outside of the folder", header.Name)
+		}
+
+		path := filepath.Join(folder, name)
+
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg {
+			resolved, err := resolveExistingPath(path)
+			if err != nil || !isInside(root, resolved) {
+				return files, fmt.Errorf("the archive entry %q resolves outside of the folder", header.Name)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, header.FileInfo().Mode().Perm()|0700)
+		case tar.TypeReg:
+			extracted += header.Size
+			if maxSize > 0 && extracted > maxSize {
+				return files, ErrArchiveTooLarge
+			}
+
+			err = extractFile(archive, path, header.Size, header.FileInfo().Mode().Perm()|0600)
+			if err == nil {
+				files = append(files, filepath.ToSlash(name))
+			}
+		}
+
+		if err != nil {
+			return files, err
+		}
+	}
+}
+
+// resolveExistingPath returns a path with the symbolic links of its existing part resolved, a dangling link is
+// refused since writing through it would create its target
+func resolveExistingPath(path string) (string, error) {
+	existing := filepath.Clean(path)
+	missing := ""
+
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		if _, lstatErr := os.Lstat(existing); lstatErr == nil {
+			return "", fmt.Errorf("the path %q is a dangling symbolic link", existing)
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", err
+		}
+
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+}
+
+// isInside returns whether a path is the folder or inside it
+func isInside(folder, path string) bool {
+	rel, err := filepath.Rel(folder, path)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func extractFile(r io.Reader, path string, size int64, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	// the size of the entry is the one announced by its header
+	_, err = io.CopyN(file, r, size)
+	if err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
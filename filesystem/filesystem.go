@@ -7,6 +7,7 @@ import (
 	"mime/multipart"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -105,6 +106,80 @@ func RenameFile(oldPath, newPath string) error {
 	return os.Rename(oldPath, newPath)
 }
 
+// DirSize returns the total size of the regular files of a directory and its sub-directories
+func DirSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// CopyDir copies the content of a directory to another one, which is created when it does not exist.
+// The symbolic links are copied as links, their target is not followed.
+func CopyDir(source, destination string) error {
+	return filepath.Walk(source, func(sourcePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(source, sourcePath)
+		if err != nil {
+			return err
+		}
+
+		destinationPath := filepath.Join(destination, relativePath)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(destinationPath, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(sourcePath)
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(target, destinationPath)
+		case info.Mode().IsRegular():
+			return copyFile(sourcePath, destinationPath, info.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(sourcePath, destinationPath string, mode os.FileMode) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		destination.Close()
+
+		return err
+	}
+
+	return destination.Close()
+}
+
 // WriteFile takes a path, filename, a file and the mode that should be associated
 // to the file and writes it to disk
 func WriteFile(folder, filename string, file []byte, mode uint32) error {
@@ -118,6 +193,50 @@ func WriteFile(folder, filename string, file []byte, mode uint32) error {
 	return os.WriteFile(filePath, file, os.FileMode(mode))
 }
 
+// WriteFileAtomic takes a path, filename, a file and the mode that should be associated
+// to the file and writes it to disk. The file is written to a temporary file of the same folder
+// which is then renamed, so that a reader never sees a partially written file.
+func WriteFileAtomic(folder, filename string, file []byte, mode uint32) error {
+	return writeFileAtomic(folder, filename, mode, func(w io.Writer) error {
+		_, err := w.Write(file)
+
+		return err
+	})
+}
+
+func writeFileAtomic(folder, filename string, mode uint32, write func(w io.Writer) error) error {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(folder, "."+filename+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	err = write(tmpFile)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, os.FileMode(mode))
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path.Join(folder, filename))
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return err
+}
+
 // WriteFile takes a path, filename, a file and the mode that should be associated
 // to the file and writes it to disk
 func WriteBigFile(folder, filename string, fileheader *multipart.FileHeader, mode uint32) error {
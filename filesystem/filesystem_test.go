@@ -0,0 +1,125 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteFileAtomicInterrupted(t *testing.T) {
+	folder := t.TempDir()
+
+	err := WriteFileAtomic(folder, "docker-compose.yml", []byte("version: '3'\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errInterrupted := errors.New("interrupted")
+
+	err = writeFileAtomic(folder, "docker-compose.yml", 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("services:\n  web:\n    ima"))
+		if err != nil {
+			return err
+		}
+
+		return errInterrupted
+	})
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected the write to be interrupted, got %v", err)
+	}
+
+	content, err := os.ReadFile(path.Join(folder, "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "version: '3'\n" {
+		t.Fatalf("the previous file was altered by the interrupted write: %q", content)
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected the temporary file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestExtractTarGz(t *testing.T) {
+	buildArchive := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+
+		gz := gzip.NewWriter(&buf)
+		archive := tar.NewWriter(gz)
+		for name, content := range files {
+			archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			archive.Write([]byte(content))
+		}
+		archive.Close()
+		gz.Close()
+
+		return &buf
+	}
+
+	folder := t.TempDir()
+
+	files, err := ExtractTarGz(buildArchive(map[string]string{"config/nginx.conf": "server {}"}), folder, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0] != "config/nginx.conf" {
+		t.Fatalf("expected the config file to be extracted, got %v", files)
+	}
+
+	content, err := os.ReadFile(path.Join(folder, "config", "nginx.conf"))
+	if err != nil || string(content) != "server {}" {
+		t.Fatalf("unexpected content of the extracted file: %q, %v", content, err)
+	}
+
+	_, err = ExtractTarGz(buildArchive(map[string]string{"../outside": "x"}), folder, 0)
+	if err == nil {
+		t.Error("expected the entry outside of the folder to be refused")
+	}
+
+	_, err = ExtractTarGz(buildArchive(map[string]string{"large": "0123456789"}), folder, 5)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("expected the archive to be too large, got %v", err)
+	}
+}
+
+func TestExtractTarGzThroughSymlink(t *testing.T) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	archive.WriteHeader(&tar.Header{Name: "shared/config.yml", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	archive.Write([]byte("x"))
+	archive.Close()
+	gz.Close()
+
+	folder := t.TempDir()
+	shared := t.TempDir()
+
+	err := os.Symlink(shared, path.Join(folder, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ExtractTarGz(&buf, folder, 0)
+	if err == nil {
+		t.Error("expected the entry under the symbolic link to be refused")
+	}
+
+	_, err = os.Stat(path.Join(shared, "config.yml"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside of the folder, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package edgestacks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/portainer/agent"
+	"github.com/portainer/agent/edge"
+	"github.com/portainer/agent/edge/stack"
+	"github.com/portainer/agent/http/security"
+	httperror "github.com/portainer/libhttp/error"
+	"github.com/portainer/libhttp/request"
+	"github.com/portainer/libhttp/response"
+)
+
+// Handler is the HTTP handler used to expose the state of the Edge stacks managed by the agent.
+type Handler struct {
+	*mux.Router
+	edgeManager *edge.Manager
+	// stackRouter holds the routes registered by stackManager, the stack manager is only
+	// created once the Edge key is set
+	stackRouter  *mux.Router
+	stackManager *stack.StackManager
+	mu           sync.Mutex
+}
+
+// NewHandler returns a pointer to an Handler
+// It sets the associated handle functions for all the Edge stacks related HTTP endpoints.
+// This handler is meant to be used when the agent is started in Edge mode, all the API endpoints will return
+// a HTTP 503 service not available if edge mode is disabled.
+func NewHandler(notaryService *security.NotaryService, edgeManager *edge.Manager) *Handler {
+	h := &Handler{
+		Router:      mux.NewRouter(),
+		edgeManager: edgeManager,
+	}
+
+	// the webhook is called by third parties such as CI pipelines, which authenticate with the Edge key
+	h.Handle("/edge/stacks/{id}/redeploy", httperror.LoggerHandler(h.redeployStack)).Methods(http.MethodPost)
+	h.PathPrefix("/edge/stacks").Handler(notaryService.DigitalSignatureVerification(httperror.LoggerHandler(h.edgeStacksOperation)))
+
+	return h
+}
+
+// edgeStacksOperation serves the requests with the routes registered by the stack manager
+func (handler *Handler) edgeStacksOperation(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	if handler.edgeManager == nil {
+		return &httperror.HandlerError{StatusCode: http.StatusServiceUnavailable, Message: "Edge stacks are not available on non Edge agent", Err: errors.New("Edge stacks are disabled")}
+	}
+
+	stackManager := handler.edgeManager.GetStackManager()
+	if stackManager == nil {
+		return &httperror.HandlerError{StatusCode: http.StatusServiceUnavailable, Message: "Unable to retrieve stack manager", Err: errors.New("Stack manager is not available")}
+	}
+
+	handler.mu.Lock()
+	if handler.stackManager != stackManager {
+		handler.stackRouter = mux.NewRouter()
+		handler.stackManager = stackManager
+
+		// the signature of the requests is already verified by the handler
+		stackManager.RegisterRoutes(handler.stackRouter, nil)
+	}
+	stackRouter := handler.stackRouter
+	handler.mu.Unlock()
+
+	stackRouter.ServeHTTP(w, r)
+
+	return nil
+}
+
+// redeployStack redeploys an Edge stack with its images pulled again, without waiting for the next poll
+func (handler *Handler) redeployStack(w http.ResponseWriter, r *http.Request) *httperror.HandlerError {
+	if handler.edgeManager == nil {
+		return &httperror.HandlerError{StatusCode: http.StatusServiceUnavailable, Message: "Edge stacks are not available on non Edge agent", Err: errors.New("Edge stacks are disabled")}
+	}
+
+	key := r.Header.Get(agent.HTTPEdgeKeyHeaderName)
+	if !handler.edgeManager.IsKeySet() || subtle.ConstantTimeCompare([]byte(key), []byte(handler.edgeManager.GetKey())) != 1 {
+		return &httperror.HandlerError{StatusCode: http.StatusForbidden, Message: "Invalid Edge key", Err: errors.New("the Edge key does not match")}
+	}
+
+	stackID, err := request.RetrieveNumericRouteVariableValue(r, "id")
+	if err != nil {
+		return &httperror.HandlerError{StatusCode: http.StatusBadRequest, Message: "Invalid stack identifier route variable", Err: err}
+	}
+
+	stackManager := handler.edgeManager.GetStackManager()
+	if stackManager == nil {
+		return &httperror.HandlerError{StatusCode: http.StatusServiceUnavailable, Message: "Unable to retrieve stack manager", Err: errors.New("Stack manager is not available")}
+	}
+
+	err = stackManager.Redeploy(stackID)
+	switch {
+	case errors.Is(err, stack.ErrRedeployDisabled):
+		return &httperror.HandlerError{StatusCode: http.StatusForbidden, Message: "The Edge stack redeployment webhook is disabled", Err: err}
+	case errors.Is(err, stack.ErrUnknownStack):
+		return &httperror.HandlerError{StatusCode: http.StatusNotFound, Message: "Unable to find the Edge stack", Err: err}
+	case err != nil:
+		return &httperror.HandlerError{StatusCode: http.StatusInternalServerError, Message: "Unable to redeploy the Edge stack", Err: err}
+	}
+
+	return response.Empty(w)
+}
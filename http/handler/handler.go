@@ -13,6 +13,7 @@ import (
 	"github.com/portainer/agent/http/handler/browse"
 	"github.com/portainer/agent/http/handler/docker"
 	"github.com/portainer/agent/http/handler/dockerhub"
+	"github.com/portainer/agent/http/handler/edgestacks"
 	"github.com/portainer/agent/http/handler/host"
 	"github.com/portainer/agent/http/handler/key"
 	"github.com/portainer/agent/http/handler/kubernetes"
@@ -33,6 +34,7 @@ type Handler struct {
 	browseHandlerV1        *browse.Handler
 	dockerProxyHandler     *docker.Handler
 	dockerhubHandler       *dockerhub.Handler
+	edgeStacksHandler      *edgestacks.Handler
 	keyHandler             *key.Handler
 	kubernetesHandler      *kubernetes.Handler
 	kubernetesProxyHandler *kubernetesproxy.Handler
@@ -71,6 +73,7 @@ func NewHandler(config *Config) *Handler {
 		browseHandlerV1:        browse.NewHandlerV1(agentProxy, notaryService),
 		dockerProxyHandler:     docker.NewHandler(config.ClusterService, config.RuntimeConfiguration, notaryService, config.UseTLS),
 		dockerhubHandler:       dockerhub.NewHandler(notaryService),
+		edgeStacksHandler:      edgestacks.NewHandler(notaryService, config.EdgeManager),
 		keyHandler:             key.NewHandler(notaryService, config.EdgeManager),
 		kubernetesHandler:      kubernetes.NewHandler(notaryService, config.KubernetesDeployer),
 		kubernetesProxyHandler: kubernetesproxy.NewHandler(notaryService),
@@ -119,6 +122,8 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
 		h.kubernetesProxyHandler.ServeHTTP(rw, request)
 	case strings.HasPrefix(request.URL.Path, "/nomad"):
 		h.nomadProxyHandler.ServeHTTP(rw, request)
+	case strings.HasPrefix(request.URL.Path, "/edge/stacks"):
+		h.edgeStacksHandler.ServeHTTP(rw, request)
 	case strings.HasPrefix(request.URL.Path, "/"):
 		h.dockerProxyHandler.ServeHTTP(rw, request)
 	}
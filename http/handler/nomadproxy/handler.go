@@ -1,8 +1,6 @@
 package nomadproxy
 
 import (
-	"net/http"
-
 	"github.com/portainer/agent"
 
 	"github.com/gorilla/mux"
@@ -14,7 +12,7 @@ import (
 // Handler represents an HTTP API handler for proxying requests to the Nomad API.
 type Handler struct {
 	*mux.Router
-	nomadProxy  http.Handler
+	nomadProxy  *proxy.NomadProxy
 	nomadConfig agent.NomadConfig
 }
 
@@ -9,6 +9,10 @@ import (
 )
 
 func (handler *Handler) nomadOperation(rw http.ResponseWriter, request *http.Request) *httperror.HandlerError {
+	if err := handler.nomadProxy.Unreachable(); err != nil {
+		return &httperror.HandlerError{http.StatusServiceUnavailable, handler.nomadProxy.UnreachableMessage(), err}
+	}
+
 	request.Header.Set(agent.HTTPNomadTokenHeaderName, handler.nomadConfig.NomadToken)
 	http.StripPrefix("/nomad", handler.nomadProxy).ServeHTTP(rw, request)
 
@@ -3,21 +3,47 @@ package proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/portainer/agent"
 	"github.com/portainer/agent/crypto"
+	httperror "github.com/portainer/libhttp/error"
 )
 
-func NewNomadProxy(nomadConfig agent.NomadConfig) http.Handler {
+// NomadProxy forwards the requests to the Nomad API. A connection failure is reported as such,
+// and the Nomad server is then reported unreachable without being dialed again during
+// NomadConfig.NomadUnreachableCache, so that repeated requests do not each wait for the dial timeout.
+type NomadProxy struct {
+	proxy            *httputil.ReverseProxy
+	addr             string
+	unreachableCache time.Duration
+	unreachableUntil time.Time
+	unreachableErr   error
+	mu               sync.Mutex
+}
+
+func NewNomadProxy(nomadConfig agent.NomadConfig) *NomadProxy {
 	remoteURL, _ := url.Parse(nomadConfig.NomadAddr)
 
 	proxy := httputil.NewSingleHostReverseProxy(remoteURL)
 
+	nomadProxy := &NomadProxy{
+		proxy:            proxy,
+		addr:             nomadConfig.NomadAddr,
+		unreachableCache: nomadConfig.NomadUnreachableCache,
+	}
+
+	proxy.ErrorHandler = nomadProxy.handleError
+
 	if nomadConfig.NomadTLSEnabled {
 		tlsClientConfig := &tls.Config{
 			MinVersion:   tls.VersionTLS12,
@@ -49,16 +75,108 @@ func NewNomadProxy(nomadConfig agent.NomadConfig) http.Handler {
 		}
 
 		// Create an HTTPS client and supply the created CA pool and certificate
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: tlsClientConfig,
-		}
+		proxy.Transport = newNomadTransport(nomadConfig, tlsClientConfig)
 	} else {
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+		proxy.Transport = newNomadTransport(nomadConfig, &tls.Config{
+			InsecureSkipVerify: true,
+		})
+	}
+
+	return nomadProxy
+}
+
+func (p *NomadProxy) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
+	p.proxy.ServeHTTP(rw, request)
+}
+
+// Unreachable returns the connection error of the Nomad server while it is reported unreachable, nil otherwise
+func (p *NomadProxy) Unreachable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.unreachableUntil) {
+		return p.unreachableErr
+	}
+
+	return nil
+}
+
+// UnreachableMessage returns the message of the errors of the requests that cannot reach the Nomad server
+func (p *NomadProxy) UnreachableMessage() string {
+	return fmt.Sprintf("Nomad server unreachable at %s", p.addr)
+}
+
+func (p *NomadProxy) handleError(rw http.ResponseWriter, request *http.Request, err error) {
+	if request.Context().Err() != nil {
+		// the request was canceled by the client
+		return
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		httperror.WriteError(rw, http.StatusBadGateway, "Unable to proxy the request to the Nomad API", err)
+
+		return
+	}
+
+	log.Printf("[WARN] [proxy,nomad] [message: Nomad server unreachable] [address: %s] [error: %s]", p.addr, err)
+
+	p.mu.Lock()
+	p.unreachableUntil = time.Now().Add(p.unreachableCache)
+	p.unreachableErr = err
+	p.mu.Unlock()
+
+	httperror.WriteError(rw, http.StatusServiceUnavailable, p.UnreachableMessage(), err)
+}
+
+// newNomadTransport returns the transport used to reach the Nomad API, bounded by the timeouts and
+// the idle connection pool of the Nomad configuration so that a slow or unreachable Nomad server
+// cannot pile up proxied requests
+func newNomadTransport(nomadConfig agent.NomadConfig, tlsClientConfig *tls.Config) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   nomadConfig.NomadDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsClientConfig,
+		TLSHandshakeTimeout:   nomadConfig.NomadTLSHandshakeTimeout,
+		ResponseHeaderTimeout: nomadConfig.NomadResponseHeaderTimeout,
+		IdleConnTimeout:       nomadConfig.NomadIdleConnTimeout,
+		MaxIdleConns:          nomadConfig.NomadMaxIdleConns,
+		MaxIdleConnsPerHost:   nomadConfig.NomadMaxIdleConns,
+	}
+
+	if nomadConfig.NomadRetries <= 0 {
+		return transport
+	}
+
+	return &retryTransport{
+		transport: transport,
+		retries:   nomadConfig.NomadRetries,
+	}
+}
+
+// retryTransport retries the idempotent requests without body whose round trip failed before a response
+// was received, the other requests are sent once
+type retryTransport struct {
+	transport http.RoundTripper
+	retries   int
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if (request.Method != http.MethodGet && request.Method != http.MethodHead) || (request.Body != nil && request.Body != http.NoBody) {
+		return t.transport.RoundTrip(request)
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	for attempt := 1; err != nil && attempt <= t.retries && request.Context().Err() == nil; attempt++ {
+		log.Printf("[WARN] [proxy,nomad] [message: retrying the Nomad API request] [attempt: %d] [error: %s]", attempt, err)
+
+		response, err = t.transport.RoundTrip(request)
 	}
 
-	return proxy
+	return response, err
 }
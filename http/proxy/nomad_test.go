@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/portainer/agent"
+)
+
+// failingTransport fails the first failures round trips, then responds with 200
+type failingTransport struct {
+	failures int
+	attempts int
+}
+
+func (t *failingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.attempts++
+
+	if t.attempts <= t.failures {
+		return nil, errors.New("connection reset by peer")
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: request}, nil
+}
+
+func TestNomadRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		failures int
+		attempts int
+		failed   bool
+	}{
+		{name: "succeeds at once", method: http.MethodGet, failures: 0, attempts: 1},
+		{name: "succeeds once retried", method: http.MethodGet, failures: 2, attempts: 3},
+		{name: "retries exhausted", method: http.MethodHead, failures: 5, attempts: 3, failed: true},
+		{name: "request with a body", method: http.MethodPost, body: "{}", failures: 1, attempts: 1, failed: true},
+		{name: "non-idempotent request", method: http.MethodDelete, failures: 1, attempts: 1, failed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &failingTransport{failures: test.failures}
+			retry := &retryTransport{transport: transport, retries: 2}
+
+			request := httptest.NewRequest(test.method, "http://nomad:4646/v1/jobs", strings.NewReader(test.body))
+			if test.body == "" {
+				request.Body = http.NoBody
+			}
+
+			_, err := retry.RoundTrip(request)
+			if (err != nil) != test.failed {
+				t.Errorf("expected the request to fail to be %t, got %v", test.failed, err)
+			}
+
+			if transport.attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, transport.attempts)
+			}
+		})
+	}
+}
+
+func TestNomadRetryTransportCancelled(t *testing.T) {
+	transport := &failingTransport{failures: 5}
+	retry := &retryTransport{transport: transport, retries: 3}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request := httptest.NewRequest(http.MethodGet, "http://nomad:4646/v1/jobs", nil).WithContext(ctx)
+
+	_, err := retry.RoundTrip(request)
+	if err == nil || transport.attempts != 1 {
+		t.Errorf("expected a cancelled request not to be retried, got %d attempts and %v", transport.attempts, err)
+	}
+}
+
+// closedAddress returns the address of a port nothing listens on
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	return address
+}
+
+func TestNomadProxyUnreachable(t *testing.T) {
+	tests := []struct {
+		name        string
+		cache       time.Duration
+		unreachable bool
+	}{
+		{name: "cached", cache: time.Minute, unreachable: true},
+		{name: "not cached", cache: 0, unreachable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := NewNomadProxy(agent.NomadConfig{NomadAddr: "http://" + closedAddress(t), NomadUnreachableCache: test.cache})
+
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/jobs", nil))
+
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected an unreachable Nomad server to be reported with 503, got %d", recorder.Code)
+			}
+
+			if !strings.Contains(recorder.Body.String(), proxy.UnreachableMessage()) {
+				t.Errorf("expected the response to hold %q, got %s", proxy.UnreachableMessage(), recorder.Body.String())
+			}
+
+			if unreachable := proxy.Unreachable() != nil; unreachable != test.unreachable {
+				t.Errorf("expected the Nomad server to be reported unreachable to be %t, got %t", test.unreachable, unreachable)
+			}
+		})
+	}
+}
+
+func TestNomadProxyUnreachableExpires(t *testing.T) {
+	proxy := NewNomadProxy(agent.NomadConfig{NomadAddr: "http://" + closedAddress(t), NomadUnreachableCache: time.Minute})
+
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/jobs", nil))
+
+	if proxy.Unreachable() == nil {
+		t.Fatal("expected the Nomad server to be reported unreachable")
+	}
+
+	proxy.mu.Lock()
+	proxy.unreachableUntil = time.Now().Add(-time.Second)
+	proxy.mu.Unlock()
+
+	if err := proxy.Unreachable(); err != nil {
+		t.Errorf("expected the Nomad server to be dialed again once the cache expired, got %v", err)
+	}
+}
+
+func TestNomadProxyUpstreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	proxy := NewNomadProxy(agent.NomadConfig{NomadAddr: server.URL, NomadUnreachableCache: time.Minute})
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/jobs", nil))
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("expected a failed request to a reachable Nomad server to be reported with 502, got %d", recorder.Code)
+	}
+
+	if err := proxy.Unreachable(); err != nil {
+		t.Errorf("expected a reachable Nomad server not to be reported unreachable, got %v", err)
+	}
+}
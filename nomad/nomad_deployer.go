@@ -4,15 +4,25 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	nomadapi "github.com/hashicorp/nomad/api"
 	"github.com/pkg/errors"
 	"github.com/portainer/agent"
+	"github.com/portainer/agent/exec"
 	"github.com/portainer/agent/filesystem"
 )
 
+const (
+	// evaluationTimeout bounds the wait for the evaluation of a job deregistration to complete
+	evaluationTimeout = 5 * time.Minute
+	// evaluationPollInterval is the interval between two checks of the state of an evaluation
+	evaluationPollInterval = time.Second
+)
+
 // Deployer represents a service to deploy resources inside a Nomad environment.
 type Deployer struct {
 	client *nomadapi.Client
@@ -43,20 +53,29 @@ func (d *Deployer) Deploy(ctx context.Context, name string, filePaths []string,
 		return errors.Wrap(err, "failed to read Nomad job file")
 	}
 
-	newJob, err := d.client.Jobs().ParseHCL(string(newJobFile), true)
+	newJob, err := d.parseJob(string(newJobFile), options.EnvVars)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse Nomad job file")
 	}
+	setJobNamespace(newJob, options.Namespace)
 
-	// An existing backup file means it is an update action
+	// An existing job reference or backup file means it is an update action
 	// Need to check if the new coming job file has different region, namespace or id settings
 	// If yes, delete the former job
-	if backupFileExists, _ := filesystem.FileExists(backFilePath); backupFileExists {
+	if oldJob, ok := readJobReference(bakFileFolder, name); ok {
+		if diff := compareJobs(newJob, oldJob); diff {
+			err = d.deregisterJob(ctx, oldJob, true)
+			if err != nil {
+				return errors.Wrap(err, "failed to purge former Nomad job")
+			}
+		}
+		filesystem.RemoveFile(backFilePath)
+	} else if backupFileExists, _ := filesystem.FileExists(backFilePath); backupFileExists {
 		oldJobFile, err := filesystem.ReadFromFile(backFilePath)
 		if err != nil {
 			return errors.Wrap(err, "failed to read Nomad job file")
 		}
-		oldJob, err := d.client.Jobs().ParseHCL(string(oldJobFile), true)
+		oldJob, err := d.parseJob(string(oldJobFile), options.EnvVars)
 		if err != nil {
 			return errors.Wrap(err, "failed to parse backup Nomad job file")
 		}
@@ -64,7 +83,7 @@ func (d *Deployer) Deploy(ctx context.Context, name string, filePaths []string,
 		// If new job has critical config changes
 		// Purge the old job before register the new one
 		if diff := compareJobs(newJob, oldJob); diff {
-			err = d.verifyAndPurgeJob(oldJob)
+			err = d.deregisterJob(ctx, oldJob, true)
 			if err != nil {
 				return errors.Wrap(err, "failed to purge former Nomad job")
 			}
@@ -84,11 +103,18 @@ func (d *Deployer) Deploy(ctx context.Context, name string, filePaths []string,
 	}
 
 	// Submit the job
-	_, _, err = d.client.Jobs().RegisterOpts(newJob, runOpts, &nomadapi.WriteOptions{Region: *newJob.Region, Namespace: *newJob.Namespace})
+	resp, _, err := d.client.Jobs().RegisterOpts(newJob, runOpts, &nomadapi.WriteOptions{Region: *newJob.Region, Namespace: *newJob.Namespace})
 	if err != nil {
 		return errors.Wrap(err, "failed to run Nomad job")
 	}
 
+	if output := exec.OutputFrom(ctx); output != nil {
+		fmt.Fprintf(output, "job %s registered, evaluation %s\n", *newJob.ID, resp.EvalID)
+		if resp.Warnings != "" {
+			fmt.Fprintln(output, resp.Warnings)
+		}
+	}
+
 	if periodic || paramjob || multiregion {
 		if periodic && !paramjob {
 			loc, err := newJob.Periodic.GetLocation()
@@ -103,6 +129,40 @@ func (d *Deployer) Deploy(ctx context.Context, name string, filePaths []string,
 
 	filesystem.WriteFile(bakFileFolder, bakFileName, newJobFile, 0640)
 
+	err = writeJobReference(bakFileFolder, name, newJob)
+	if err != nil {
+		return errors.Wrap(err, "failed to write Nomad job reference")
+	}
+
+	return nil
+}
+
+// Validate parses the Nomad job file and validates the job with the Nomad agent
+func (d *Deployer) Validate(ctx context.Context, name string, filePaths []string, options agent.DeployOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing Nomad job file paths")
+	}
+
+	jobFile, err := filesystem.ReadFromFile(filePaths[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to read Nomad job file")
+	}
+
+	job, err := d.parseJob(string(jobFile), options.EnvVars)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse Nomad job file")
+	}
+	setJobNamespace(job, options.Namespace)
+
+	response, _, err := d.client.Jobs().Validate(job, &nomadapi.WriteOptions{Region: *job.Region, Namespace: *job.Namespace})
+	if err != nil {
+		return errors.Wrap(err, "failed to validate Nomad job")
+	}
+
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
 	return nil
 }
 
@@ -111,24 +171,144 @@ func (d *Deployer) Pull(ctx context.Context, name string, filePaths []string) er
 	return nil
 }
 
-// Remove attempts to purge a Nomad job via provided Nomad job file
+// Version returns the version of the Nomad agent
+func (d *Deployer) Version(ctx context.Context) (string, error) {
+	self, err := d.client.Agent().Self()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to retrieve Nomad agent information")
+	}
+
+	return self.Member.Tags["build"], nil
+}
+
+// Status counts the running and terminated allocations of the Nomad job provided via the job file
+func (d *Deployer) Status(ctx context.Context, name string, filePaths []string, options agent.StatusOptions) (agent.ServiceStates, error) {
+	if len(filePaths) == 0 {
+		return agent.ServiceStates{}, errors.New("missing Nomad job file paths")
+	}
+	job, err := d.registeredJob(name, filePaths[0], options.DeployerBaseOptions)
+	if err != nil {
+		return agent.ServiceStates{}, err
+	}
+
+	allocations, _, err := d.client.Jobs().Allocations(*job.ID, false, &nomadapi.QueryOptions{Region: *job.Region, Namespace: *job.Namespace})
+	if err != nil {
+		return agent.ServiceStates{}, errors.Wrap(err, "failed to retrieve Nomad job allocations")
+	}
+
+	states := agent.ServiceStates{}
+	groups := map[string]int{}
+
+	for _, allocation := range allocations {
+		// the allocations replaced by a newer version of the job are ignored
+		if allocation.DesiredStatus != nomadapi.AllocDesiredStatusRun {
+			continue
+		}
+
+		index, ok := groups[allocation.TaskGroup]
+		if !ok {
+			index = len(states.Services)
+			groups[allocation.TaskGroup] = index
+			states.Services = append(states.Services, agent.ServiceState{Name: allocation.TaskGroup})
+		}
+
+		states.Total++
+		states.Services[index].Desired++
+
+		switch allocation.ClientStatus {
+		case nomadapi.AllocClientStatusRunning:
+			states.Running++
+			states.Services[index].Running++
+		case nomadapi.AllocClientStatusComplete, nomadapi.AllocClientStatusFailed, nomadapi.AllocClientStatusLost:
+			states.Exited++
+		}
+
+		if allocation.ClientStatus == nomadapi.AllocClientStatusFailed || allocation.ClientStatus == nomadapi.AllocClientStatusLost {
+			states.Services[index].Error = allocation.ClientDescription
+		}
+	}
+
+	return states, nil
+}
+
+// Restart restarts the tasks of the running allocations of a task group of the job.
+func (d *Deployer) Restart(ctx context.Context, name string, filePaths []string, options agent.RestartOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("missing Nomad job file paths")
+	}
+	job, err := d.registeredJob(name, filePaths[0], options.DeployerBaseOptions)
+	if err != nil {
+		return err
+	}
+
+	queryOptions := &nomadapi.QueryOptions{Region: *job.Region, Namespace: *job.Namespace}
+
+	allocations, _, err := d.client.Jobs().Allocations(*job.ID, false, queryOptions)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve Nomad job allocations")
+	}
+
+	restarted := 0
+	for _, stub := range allocations {
+		if stub.TaskGroup != options.Service || stub.ClientStatus != nomadapi.AllocClientStatusRunning {
+			continue
+		}
+
+		allocation, _, err := d.client.Allocations().Info(stub.ID, queryOptions)
+		if err != nil {
+			return errors.Wrapf(err, "failed to retrieve the Nomad allocation %s", stub.ID)
+		}
+
+		err = d.client.Allocations().Restart(allocation, "", queryOptions)
+		if err != nil {
+			return errors.Wrapf(err, "failed to restart the Nomad allocation %s", stub.ID)
+		}
+
+		restarted++
+	}
+
+	if restarted == 0 {
+		return fmt.Errorf("no running allocation of the task group %s", options.Service)
+	}
+
+	return nil
+}
+
+// Remove attempts to stop a Nomad job via provided Nomad job file, the job is purged when options.Purge is set.
+// It returns once the evaluation of the deregistration has completed.
 func (d *Deployer) Remove(ctx context.Context, name string, filePaths []string, options agent.RemoveOptions) error {
 	if len(filePaths) == 0 {
 		return errors.New("missing Nomad job file paths")
 	}
-	jobFile, err := filesystem.ReadFromFile(filePaths[0])
+	job, err := d.registeredJob(name, filePaths[0], options.DeployerBaseOptions)
 	if err != nil {
-		return errors.Wrap(err, "failed to read Nomad job file")
+		return err
+	}
+
+	return d.deregisterJob(ctx, job, options.Purge)
+}
+
+// registeredJob returns the job registered by the deployment of a job file, from its job reference when the
+// deployment wrote one, otherwise by parsing the job file with the variables of the stack in its namespace
+func (d *Deployer) registeredJob(name, jobFilePath string, options agent.DeployerBaseOptions) (*nomadapi.Job, error) {
+	if job, ok := readJobReference(filepath.Dir(jobFilePath), name); ok {
+		return job, nil
+	}
+
+	jobFile, err := filesystem.ReadFromFile(jobFilePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read Nomad job file")
 	}
-	job, err := d.client.Jobs().ParseHCL(string(jobFile), true)
+	job, err := d.parseJob(string(jobFile), options.EnvVars)
 	if err != nil {
-		return errors.Wrap(err, "failed to parse Nomad job from file")
+		return nil, errors.Wrap(err, "failed to parse Nomad job from file")
 	}
+	setJobNamespace(job, options.Namespace)
 
-	return d.verifyAndPurgeJob(job)
+	return job, nil
 }
 
-func (d *Deployer) verifyAndPurgeJob(job *nomadapi.Job) error {
+func (d *Deployer) deregisterJob(ctx context.Context, job *nomadapi.Job, purge bool) error {
 	// Verify if the job valid, i.e., no error when trying to retrieve job info with the provided job ID
 	_, _, err := d.client.Jobs().Info(*job.ID, &nomadapi.QueryOptions{Region: *job.Region, Namespace: *job.Namespace})
 	if err != nil {
@@ -140,11 +320,47 @@ func (d *Deployer) verifyAndPurgeJob(job *nomadapi.Job) error {
 		return errors.Wrap(err, "failed to retrieve Nomad job info")
 	}
 
-	_, _, err = d.client.Jobs().DeregisterOpts(*job.ID, &nomadapi.DeregisterOptions{Purge: true}, &nomadapi.WriteOptions{Region: *job.Region, Namespace: *job.Namespace})
+	evalID, _, err := d.client.Jobs().DeregisterOpts(*job.ID, &nomadapi.DeregisterOptions{Purge: purge}, &nomadapi.WriteOptions{Region: *job.Region, Namespace: *job.Namespace})
 	if err != nil {
-		return errors.Wrap(err, "failed to purge Nomad job")
+		return errors.Wrap(err, "failed to deregister Nomad job")
+	}
+
+	return d.waitForEvaluation(ctx, evalID, job)
+}
+
+// waitForEvaluation waits for an evaluation to reach a terminal state, within evaluationTimeout. An evaluation
+// that failed or was canceled returns an error.
+func (d *Deployer) waitForEvaluation(ctx context.Context, evalID string, job *nomadapi.Job) error {
+	// the deregistration of the periodic and parameterized jobs creates no evaluation
+	if evalID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, evaluationTimeout)
+	defer cancel()
+
+	for {
+		eval, _, err := d.client.Evaluations().Info(evalID, (&nomadapi.QueryOptions{Region: *job.Region, Namespace: *job.Namespace}).WithContext(ctx))
+		if err != nil {
+			return errors.Wrap(err, "failed to retrieve Nomad evaluation")
+		}
+
+		switch eval.Status {
+		case "complete":
+			return nil
+		case "failed", "canceled":
+			return fmt.Errorf("the Nomad evaluation %s %s: %s", evalID, eval.Status, eval.StatusDescription)
+		}
+
+		timer := time.NewTimer(evaluationPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return errors.Wrapf(ctx.Err(), "the Nomad evaluation %s did not complete", evalID)
+		case <-timer.C:
+		}
 	}
-	return nil
 }
 
 // Check if new planning job have crucial differences
@@ -175,3 +391,72 @@ func compareJobs(old, new *nomadapi.Job) bool {
 
 	return false
 }
+
+// jobsParseRequest is the request of the job parse endpoint including the HCL2 variables,
+// which the version of the api package in use does not support
+type jobsParseRequest struct {
+	JobHCL       string
+	Canonicalize bool
+	// Variables holds the HCL2 variables of the job in the var file format
+	Variables string
+}
+
+// parseJob parses a job file on the Nomad agent, the variables are passed as HCL2 variables to the job
+func (d *Deployer) parseJob(jobHCL string, vars map[string]string) (*nomadapi.Job, error) {
+	if len(vars) == 0 {
+		return d.client.Jobs().ParseHCL(jobHCL, true)
+	}
+
+	var job nomadapi.Job
+	_, err := d.client.Raw().Write("/v1/jobs/parse", &jobsParseRequest{
+		JobHCL:       jobHCL,
+		Canonicalize: true,
+		Variables:    varFile(vars),
+	}, &job, nil)
+
+	return &job, err
+}
+
+// varFile formats variables in the HCL2 var file format, the values are strings
+func varFile(vars map[string]string) string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		// the template sequences are escaped so that the values are taken literally
+		value := strings.NewReplacer("${", "$${", "%{", "%%{").Replace(vars[key])
+
+		fmt.Fprintf(&b, "%s = %s\n", key, hclQuote(value))
+	}
+
+	return b.String()
+}
+
+// hclQuote returns a value as an HCL quoted string. Only the backslashes, the quotes and the control characters
+// are escaped, the escape sequences of Go such as \x or \a are not valid in HCL.
+func hclQuote(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for _, r := range value {
+		switch {
+		case r == '\\' || r == '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	b.WriteByte('"')
+
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+)
+
+func TestVarFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		vars     map[string]string
+		expected string
+	}{
+		{name: "plain values", vars: map[string]string{"b": "2", "a": "1"}, expected: "a = \"1\"\nb = \"2\"\n"},
+		{name: "quotes and backslashes", vars: map[string]string{"a": `say "hi" C:\temp`}, expected: "a = \"say \\\"hi\\\" C:\\\\temp\"\n"},
+		{name: "newline", vars: map[string]string{"a": "line1\nline2"}, expected: "a = \"line1\\nline2\"\n"},
+		{name: "control characters", vars: map[string]string{"a": "bell\a tab\t"}, expected: "a = \"bell\\u0007 tab\\u0009\"\n"},
+		{name: "unicode kept", vars: map[string]string{"a": "café"}, expected: "a = \"café\"\n"},
+		{name: "template sequences", vars: map[string]string{"a": "${var} %{if}"}, expected: "a = \"$${var} %%{if}\"\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if file := varFile(test.vars); file != test.expected {
+				t.Errorf("unexpected var file\n got: %q\nwant: %q", file, test.expected)
+			}
+		})
+	}
+}
+
+// newTestNomad returns a deployer whose Nomad API serves the job web, its deregistration returns evalID and
+// the evaluation reports the evaluations statuses in turn
+func newTestNomad(t *testing.T, evalID string, evaluations ...string) (*Deployer, *url.Values) {
+	deregistration := &url.Values{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/job/web":
+			json.NewEncoder(w).Encode(nomadapi.Job{ID: stringPointer("web")})
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/job/web":
+			*deregistration = r.URL.Query()
+			json.NewEncoder(w).Encode(nomadapi.JobDeregisterResponse{EvalID: evalID})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/evaluation/"+evalID && len(evaluations) > 0:
+			status := evaluations[0]
+			if len(evaluations) > 1 {
+				evaluations = evaluations[1:]
+			}
+
+			json.NewEncoder(w).Encode(nomadapi.Evaluation{ID: evalID, Status: status, StatusDescription: "evaluation " + status})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := nomadapi.NewClient(&nomadapi.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("unable to create the Nomad client: %s", err)
+	}
+
+	return &Deployer{client: client}, deregistration
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func TestDeregisterJob(t *testing.T) {
+	tests := []struct {
+		name        string
+		purge       bool
+		evalID      string
+		evaluations []string
+		failed      bool
+	}{
+		{name: "stopped", evalID: "eval-1", evaluations: []string{"complete"}},
+		{name: "purged", purge: true, evalID: "eval-1", evaluations: []string{"complete"}},
+		{name: "evaluation pending", evalID: "eval-1", evaluations: []string{"pending", "complete"}},
+		{name: "evaluation failed", evalID: "eval-1", evaluations: []string{"failed"}, failed: true},
+		{name: "evaluation canceled", evalID: "eval-1", evaluations: []string{"canceled"}, failed: true},
+		{name: "evaluation not found", evalID: "eval-1", failed: true},
+		{name: "periodic job without evaluation"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployer, deregistration := newTestNomad(t, test.evalID, test.evaluations...)
+
+			job := &nomadapi.Job{ID: stringPointer("web"), Region: stringPointer("global"), Namespace: stringPointer("default")}
+
+			err := deployer.deregisterJob(context.Background(), job, test.purge)
+			if (err != nil) != test.failed {
+				t.Fatalf("expected the deregistration to fail: %t, got %v", test.failed, err)
+			}
+
+			if purge := deregistration.Get("purge") == "true"; purge != test.purge {
+				t.Errorf("expected the job to be purged: %t, got the query %v", test.purge, deregistration)
+			}
+		})
+	}
+}
+
+func TestDeregisterUnknownJob(t *testing.T) {
+	deployer, deregistration := newTestNomad(t, "eval-1", "complete")
+
+	job := &nomadapi.Job{ID: stringPointer("db"), Region: stringPointer("global"), Namespace: stringPointer("default")}
+
+	if err := deployer.deregisterJob(context.Background(), job, true); err != nil {
+		t.Errorf("expected the removal of a job that is not registered to succeed, got %v", err)
+	}
+
+	if len(*deregistration) != 0 {
+		t.Errorf("expected a job that is not registered not to be deregistered, got %v", deregistration)
+	}
+}
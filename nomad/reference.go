@@ -0,0 +1,67 @@
+package nomad
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	nomadapi "github.com/hashicorp/nomad/api"
+	"github.com/portainer/agent/filesystem"
+)
+
+// jobReference identifies a registered job. It is written next to the job file by the deployment so that the job
+// is found again without parsing the job file with the variables and the namespace of that deployment.
+type jobReference struct {
+	ID          string
+	Region      string
+	Namespace   string
+	Datacenters []string
+}
+
+func jobReferenceFileName(name string) string {
+	return fmt.Sprintf("%s_job.json", name)
+}
+
+// writeJobReference writes the reference of a registered job in the folder of its job file
+func writeJobReference(folder, name string, job *nomadapi.Job) error {
+	content, err := json.Marshal(jobReference{
+		ID:          *job.ID,
+		Region:      *job.Region,
+		Namespace:   *job.Namespace,
+		Datacenters: job.Datacenters,
+	})
+	if err != nil {
+		return err
+	}
+
+	return filesystem.WriteFile(folder, jobReferenceFileName(name), content, 0640)
+}
+
+// readJobReference returns the job registered by the last deployment of a job file, it returns false when
+// the deployment wrote no reference
+func readJobReference(folder, name string) (*nomadapi.Job, bool) {
+	content, err := os.ReadFile(filepath.Join(folder, jobReferenceFileName(name)))
+	if err != nil {
+		return nil, false
+	}
+
+	var reference jobReference
+	if json.Unmarshal(content, &reference) != nil || reference.ID == "" {
+		return nil, false
+	}
+
+	return &nomadapi.Job{
+		ID:          &reference.ID,
+		Region:      &reference.Region,
+		Namespace:   &reference.Namespace,
+		Datacenters: reference.Datacenters,
+	}, true
+}
+
+// setJobNamespace places a job in the namespace of its stack, the namespace of the job file is kept when it is empty
+func setJobNamespace(job *nomadapi.Job, namespace string) {
+	if namespace != "" {
+		job.Namespace = &namespace
+	}
+}
@@ -1,7 +1,11 @@
 package os
 
 import (
+	"fmt"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/portainer/agent"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -26,6 +30,8 @@ const (
 	EnvKeyEdgeInactivityTimeout = "EDGE_INACTIVITY_TIMEOUT"
 	EnvKeyEdgeInsecurePoll      = "EDGE_INSECURE_POLL"
 	EnvKeyEdgeTunnel            = "EDGE_TUNNEL"
+	EnvKeyEdgeClientConcurrency = "EDGE_CLIENT_CONCURRENCY"
+	EnvKeyEdgeRegistrySocket    = "EDGE_REGISTRY_SOCKET"
 	EnvKeyHealthCheck           = "HEALTH_CHECK"
 	EnvKeyLogLevel              = "LOG_LEVEL"
 	EnvKeyLogMode               = "LOG_MODE"
@@ -34,6 +40,95 @@ const (
 	EnvKeySSLCACert             = "MTLS_SSL_CA"
 	EnvKeyCertRetryInterval     = "MTLS_CERT_RETRY_INTERVAL"
 	EnvKeyUpdateID              = "UPDATE_ID"
+
+	EnvKeyEdgeStackImageMirrors             = "EDGE_STACK_IMAGE_MIRRORS"
+	EnvKeyEdgeStackImageMirrorFallback      = "EDGE_STACK_IMAGE_MIRROR_FALLBACK"
+	EnvKeyEdgeStackMQTTBrokerURL            = "EDGE_STACK_MQTT_BROKER_URL"
+	EnvKeyEdgeStackMQTTTopic                = "EDGE_STACK_MQTT_TOPIC"
+	EnvKeyEdgeStackFolderCleanup            = "EDGE_STACK_FOLDER_CLEANUP"
+	EnvKeyEdgeStackFolderCleanupAllow       = "EDGE_STACK_FOLDER_CLEANUP_ALLOW"
+	EnvKeyEdgeStackFolderCleanupDeny        = "EDGE_STACK_FOLDER_CLEANUP_DENY"
+	EnvKeyEdgeStackSharedFilesPath          = "EDGE_STACK_SHARED_FILES_PATH"
+	EnvKeyEdgeStackMinDeployerVersions      = "EDGE_STACK_MIN_DEPLOYER_VERSIONS"
+	EnvKeyEdgeStackOTLPEndpoint             = "EDGE_STACK_OTLP_ENDPOINT"
+	EnvKeyEdgeStackDeleteConcurrency        = "EDGE_STACK_DELETE_CONCURRENCY"
+	EnvKeyEdgeStackStripComposeVersion      = "EDGE_STACK_STRIP_COMPOSE_VERSION"
+	EnvKeyEdgeStackHealthMonitorInterval    = "EDGE_STACK_HEALTH_MONITOR_INTERVAL"
+	EnvKeyEdgeStackPostReconcileHook        = "EDGE_STACK_POST_RECONCILE_HOOK"
+	EnvKeyEdgeStackPostReconcileHookTimeout = "EDGE_STACK_POST_RECONCILE_HOOK_TIMEOUT"
+	EnvKeyEdgeStackCheckImageDiskSpace      = "EDGE_STACK_CHECK_IMAGE_DISK_SPACE"
+	EnvKeyEdgeStackImageStorePath           = "EDGE_STACK_IMAGE_STORE_PATH"
+	EnvKeyEdgeStackEventHistoryPerStack     = "EDGE_STACK_EVENT_HISTORY_PER_STACK"
+	EnvKeyEdgeStackEventHistoryTotal        = "EDGE_STACK_EVENT_HISTORY_TOTAL"
+	EnvKeyEdgeStackEventHistoryFile         = "EDGE_STACK_EVENT_HISTORY_FILE"
+	EnvKeyEdgeStackEventHistoryFileMaxSize  = "EDGE_STACK_EVENT_HISTORY_FILE_MAX_SIZE"
+	EnvKeyEdgeStackAdmissionEndpoint        = "EDGE_STACK_ADMISSION_ENDPOINT"
+	EnvKeyEdgeStackAdmissionTimeout         = "EDGE_STACK_ADMISSION_TIMEOUT"
+	EnvKeyEdgeStackAdmissionFailOpen        = "EDGE_STACK_ADMISSION_FAIL_OPEN"
+	EnvKeyEdgeStackNormalizeLineEndings     = "EDGE_STACK_NORMALIZE_LINE_ENDINGS"
+	EnvKeyEdgeStackNetworkDriver            = "EDGE_STACK_NETWORK_DRIVER"
+	EnvKeyEdgeStackNetworkDriverOpts        = "EDGE_STACK_NETWORK_DRIVER_OPTS"
+	EnvKeyEdgeStackDeployAfterDelete        = "EDGE_STACK_DEPLOY_AFTER_DELETE"
+	EnvKeyEdgeStackKubernetesResourcePrefix = "EDGE_STACK_KUBERNETES_RESOURCE_PREFIX"
+	EnvKeyEdgeStackKubernetesResourceLabels = "EDGE_STACK_KUBERNETES_RESOURCE_LABELS"
+	EnvKeyEdgeStackLazyPull                 = "EDGE_STACK_LAZY_PULL"
+	EnvKeyEdgeStackRemoveUnknownStacks      = "EDGE_STACK_REMOVE_UNKNOWN"
+	EnvKeyEdgeStackOperationConcurrency     = "EDGE_STACK_OPERATION_CONCURRENCY"
+	EnvKeyEdgeStackFilesPath                = "EDGE_STACK_FILES_PATH"
+	EnvKeyEdgeStackCoalesceVersions         = "EDGE_STACK_COALESCE_VERSIONS"
+	EnvKeyEdgeStackMapResourceLimits        = "EDGE_STACK_MAP_RESOURCE_LIMITS"
+	EnvKeyEdgeStackDeployDiff               = "EDGE_STACK_DEPLOY_DIFF"
+	EnvKeyEdgeStackImagePrune               = "EDGE_STACK_IMAGE_PRUNE"
+	EnvKeyEdgeStackRemoveRenamedStacks      = "EDGE_STACK_REMOVE_RENAMED"
+	EnvKeyEdgeStackTransformConcurrency     = "EDGE_STACK_TRANSFORM_CONCURRENCY"
+	EnvKeyEdgeStackCredentialHelperFallback = "EDGE_STACK_CREDENTIAL_HELPER_FALLBACK"
+	EnvKeyEdgeStackAtomicWrites             = "EDGE_STACK_ATOMIC_WRITES"
+	EnvKeyEdgeStackCheckBindMounts          = "EDGE_STACK_CHECK_BIND_MOUNTS"
+	EnvKeyEdgeStackRetryStatusInterval      = "EDGE_STACK_RETRY_STATUS_INTERVAL"
+	EnvKeyEdgeStackEnvFiles                 = "EDGE_STACK_ENV_FILES"
+	EnvKeyEdgeStackEmptyStack               = "EDGE_STACK_EMPTY_STACK"
+	EnvKeyEdgeStackEngineAssetsPaths        = "EDGE_STACK_ENGINE_ASSETS_PATHS"
+	EnvKeyEdgeStackNodeLabels               = "EDGE_STACK_NODE_LABELS"
+	EnvKeyEdgeStackReconcileTimeout         = "EDGE_STACK_RECONCILE_TIMEOUT"
+	EnvKeyEdgeStackAnonymousPullFirst       = "EDGE_STACK_ANONYMOUS_PULL_FIRST"
+	EnvKeyEdgeStackRemovePreviousNamespace  = "EDGE_STACK_REMOVE_PREVIOUS_NAMESPACE"
+	EnvKeyEdgeStackWarmupImages             = "EDGE_STACK_WARMUP_IMAGES"
+	EnvKeyEdgeStackWarmupKnownStacks        = "EDGE_STACK_WARMUP_KNOWN_STACKS"
+	EnvKeyEdgeStackQueuePositionInterval    = "EDGE_STACK_QUEUE_POSITION_INTERVAL"
+	EnvKeyEdgeStackSecretFiles              = "EDGE_STACK_SECRET_FILES"
+	EnvKeyEdgeStackEngineWorkers            = "EDGE_STACK_ENGINE_WORKERS"
+	EnvKeyEdgeStackVersionMismatch          = "EDGE_STACK_VERSION_MISMATCH"
+	EnvKeyEdgeStackNoEngine                 = "EDGE_STACK_NO_ENGINE"
+	EnvKeyEdgeStackIndex                    = "EDGE_STACK_INDEX"
+	EnvKeyEdgeStackOutputLimit              = "EDGE_STACK_OUTPUT_LIMIT"
+	EnvKeyEdgeStackPartialPoll              = "EDGE_STACK_PARTIAL_POLL_THRESHOLD"
+	EnvKeyEdgeStackWorkers                  = "EDGE_STACK_WORKERS"
+	EnvKeyEdgeStackRetryBackoff             = "EDGE_STACK_RETRY_BACKOFF"
+	EnvKeyEdgeStackRetryBackoffMax          = "EDGE_STACK_RETRY_BACKOFF_MAX"
+	EnvKeyEdgeStackRetryMaxRetries          = "EDGE_STACK_RETRY_MAX_RETRIES"
+	EnvKeyEdgeStackValidate                 = "EDGE_STACK_VALIDATE"
+	EnvKeyEdgeStackRollback                 = "EDGE_STACK_ROLLBACK"
+	EnvKeyEdgeStackHealthCheckTimeout       = "EDGE_STACK_HEALTH_CHECK_TIMEOUT"
+	EnvKeyEdgeStackDeployLogs               = "EDGE_STACK_DEPLOY_LOGS"
+	EnvKeyEdgeStackArchiveMaxSize           = "EDGE_STACK_ARCHIVE_MAX_SIZE"
+	EnvKeyEdgeStackRedeployWebhook          = "EDGE_STACK_REDEPLOY_WEBHOOK"
+	EnvKeyEdgeStackWindowBypass             = "EDGE_STACK_WINDOW_BYPASS"
+	EnvKeyEdgeStackProgress                 = "EDGE_STACK_PROGRESS"
+	EnvKeyEdgeStackDiskQuota                = "EDGE_STACK_DISK_QUOTA"
+	EnvKeyEdgeStackPullBandwidthLimit       = "EDGE_STACK_PULL_BANDWIDTH_LIMIT"
+	EnvKeyEdgeStackPrePullWorkers           = "EDGE_STACK_PRE_PULL_WORKERS"
+	EnvKeyEdgeStackDriftCheckInterval       = "EDGE_STACK_DRIFT_CHECK_INTERVAL"
+	EnvKeyEdgeStackRemovePurge              = "EDGE_STACK_REMOVE_PURGE"
+	EnvKeyEdgeStackRolloutTimeout           = "EDGE_STACK_ROLLOUT_TIMEOUT"
+	EnvKeyEdgeStackRegistryCredentialsTTL   = "EDGE_STACK_REGISTRY_CREDENTIALS_TTL"
+	EnvKeyEdgeStackImageVerifyKeys          = "EDGE_STACK_IMAGE_VERIFY_KEYS"
+	EnvKeyNomadProxyDialTimeout             = "NOMAD_PROXY_DIAL_TIMEOUT"
+	EnvKeyNomadProxyTLSHandshakeTimeout     = "NOMAD_PROXY_TLS_HANDSHAKE_TIMEOUT"
+	EnvKeyNomadProxyResponseHeaderTimeout   = "NOMAD_PROXY_RESPONSE_HEADER_TIMEOUT"
+	EnvKeyNomadProxyIdleConnTimeout         = "NOMAD_PROXY_IDLE_CONN_TIMEOUT"
+	EnvKeyNomadProxyMaxIdleConns            = "NOMAD_PROXY_MAX_IDLE_CONNS"
+	EnvKeyNomadProxyRetries                 = "NOMAD_PROXY_RETRIES"
+	EnvKeyNomadProxyUnreachableCache        = "NOMAD_PROXY_UNREACHABLE_CACHE"
 )
 
 type EnvOptionParser struct{}
@@ -67,6 +162,100 @@ var (
 	fEdgeInactivityTimeout = kingpin.Flag("edge-inactivity", EnvKeyEdgeInactivityTimeout+" timeout used by the agent to close the reverse tunnel after inactivity (default to 5m)").Envar(EnvKeyEdgeInactivityTimeout).Default(agent.DefaultEdgeSleepInterval).String()
 	fEdgeInsecurePoll      = kingpin.Flag("edge-insecurepoll", EnvKeyEdgeInsecurePoll+" enable this option if you need the agent to poll a HTTPS Portainer instance with self-signed certificates. Disabled by default, set to 1 to enable it").Envar(EnvKeyEdgeInsecurePoll).Bool()
 	fEdgeTunnel            = kingpin.Flag("edge-tunnel", EnvKeyEdgeTunnel+" disable this option if you wish to prevent the agent from opening tunnels over websockets").Envar(EnvKeyEdgeTunnel).Default("true").Bool()
+	fEdgeClientConcurrency = kingpin.Flag("edge-client-concurrency", EnvKeyEdgeClientConcurrency+" maximum number of Portainer API calls running at the same time, 0 does not limit them").Envar(EnvKeyEdgeClientConcurrency).Default("0").Int()
+	fEdgeRegistrySocket    = kingpin.Flag("edge-registry-socket", EnvKeyEdgeRegistrySocket+" path of the Unix socket the registry credential server listens on instead of 127.0.0.1:9005, only the user running the agent can access it").Envar(EnvKeyEdgeRegistrySocket).String()
+
+	// Edge stacks
+	fEdgeStackImageMirrors             = kingpin.Flag("edge-stack-image-mirrors", EnvKeyEdgeStackImageMirrors+" comma separated list of registry=mirror mappings used to rewrite the image references of Edge stacks (e.g. docker.io=mirror.local:5000)").Envar(EnvKeyEdgeStackImageMirrors).String()
+	fEdgeStackImageMirrorFallback      = kingpin.Flag("edge-stack-image-mirror-fallback", EnvKeyEdgeStackImageMirrorFallback+" pull from the original registry when an image cannot be pulled from its mirror (defaults to true)").Envar(EnvKeyEdgeStackImageMirrorFallback).Default("true").Bool()
+	fEdgeStackMQTTBrokerURL            = kingpin.Flag("edge-stack-mqtt-broker-url", EnvKeyEdgeStackMQTTBrokerURL+" URL of an MQTT broker (tcp://, mqtt://, ssl:// or mqtts://) the Edge stack status transitions are published to").Envar(EnvKeyEdgeStackMQTTBrokerURL).String()
+	fEdgeStackMQTTTopic                = kingpin.Flag("edge-stack-mqtt-topic", EnvKeyEdgeStackMQTTTopic+" topic the Edge stack status transitions are published to, {device}, {id} and {name} are replaced by the Edge ID, the stack identifier and the stack name").Envar(EnvKeyEdgeStackMQTTTopic).Default(agent.DefaultEdgeStackMQTTTopic).String()
+	fEdgeStackFolderCleanup            = kingpin.Flag("edge-stack-folder-cleanup", EnvKeyEdgeStackFolderCleanup+" defines how the folders of stacks no longer managed by the agent are handled at startup (defaults to disabled)").Envar(EnvKeyEdgeStackFolderCleanup).Default("disabled").Enum("disabled", "dry-run", "enabled")
+	fEdgeStackFolderCleanupAllow       = kingpin.Flag("edge-stack-folder-cleanup-allow", EnvKeyEdgeStackFolderCleanupAllow+" comma separated list of patterns restricting the stack folders that can be cleaned up").Envar(EnvKeyEdgeStackFolderCleanupAllow).String()
+	fEdgeStackFolderCleanupDeny        = kingpin.Flag("edge-stack-folder-cleanup-deny", EnvKeyEdgeStackFolderCleanupDeny+" comma separated list of patterns excluding stack folders from the cleanup").Envar(EnvKeyEdgeStackFolderCleanupDeny).String()
+	fEdgeStackSharedFilesPath          = kingpin.Flag("edge-stack-shared-files-path", EnvKeyEdgeStackSharedFilesPath+" directory of compose files shared by the Edge stacks, available as ./shared inside each stack folder").Envar(EnvKeyEdgeStackSharedFilesPath).String()
+	fEdgeStackMinDeployerVersions      = kingpin.Flag("edge-stack-min-deployer-versions", EnvKeyEdgeStackMinDeployerVersions+" comma separated list of tool=version pairs overriding the minimum supported deployer versions (e.g. docker-compose=2.0.0)").Envar(EnvKeyEdgeStackMinDeployerVersions).String()
+	fEdgeStackOTLPEndpoint             = kingpin.Flag("edge-stack-otlp-endpoint", EnvKeyEdgeStackOTLPEndpoint+" OpenTelemetry collector endpoint (OTLP/HTTP) used to export the Edge stack deployment traces").Envar(EnvKeyEdgeStackOTLPEndpoint).String()
+	fEdgeStackDeleteConcurrency        = kingpin.Flag("edge-stack-delete-concurrency", EnvKeyEdgeStackDeleteConcurrency+" maximum number of Edge stacks removed at the same time, 0 removes them one at a time along with the deployments").Envar(EnvKeyEdgeStackDeleteConcurrency).Default("0").Int()
+	fEdgeStackStripComposeVersion      = kingpin.Flag("edge-stack-strip-compose-version", EnvKeyEdgeStackStripComposeVersion+" remove the obsolete top-level version key of the Edge stack compose files before deploying them").Envar(EnvKeyEdgeStackStripComposeVersion).Default("false").Bool()
+	fEdgeStackHealthMonitorInterval    = kingpin.Flag("edge-stack-health-monitor-interval", EnvKeyEdgeStackHealthMonitorInterval+" interval used to check the health of the deployed Edge stacks, 0 disables the health monitor").Envar(EnvKeyEdgeStackHealthMonitorInterval).Default("0s").Duration()
+	fEdgeStackPostReconcileHook        = kingpin.Flag("edge-stack-post-reconcile-hook", EnvKeyEdgeStackPostReconcileHook+" command executed once the pending Edge stacks have been processed, with its arguments separated by white spaces (no shell quoting); it receives the JSON encoded stack inventory on its standard input").Envar(EnvKeyEdgeStackPostReconcileHook).String()
+	fEdgeStackPostReconcileHookTimeout = kingpin.Flag("edge-stack-post-reconcile-hook-timeout", EnvKeyEdgeStackPostReconcileHookTimeout+" maximum duration of the Edge stack post-reconcile hook").Envar(EnvKeyEdgeStackPostReconcileHookTimeout).Default(agent.DefaultEdgeStackPostReconcileHookTimeout).Duration()
+	fEdgeStackCheckImageDiskSpace      = kingpin.Flag("edge-stack-check-image-disk-space", EnvKeyEdgeStackCheckImageDiskSpace+" verify that the image store has enough space before pulling the Edge stack images").Envar(EnvKeyEdgeStackCheckImageDiskSpace).Default("false").Bool()
+	fEdgeStackImageStorePath           = kingpin.Flag("edge-stack-image-store-path", EnvKeyEdgeStackImageStorePath+" path of the image store used to check the available space (defaults to the Docker root directory)").Envar(EnvKeyEdgeStackImageStorePath).String()
+	fEdgeStackEventHistoryPerStack     = kingpin.Flag("edge-stack-event-history-per-stack", EnvKeyEdgeStackEventHistoryPerStack+" number of status transitions retained for each Edge stack, the oldest are evicted first").Envar(EnvKeyEdgeStackEventHistoryPerStack).Default(agent.DefaultEdgeStackEventHistoryPerStack).Int()
+	fEdgeStackEventHistoryTotal        = kingpin.Flag("edge-stack-event-history-total", EnvKeyEdgeStackEventHistoryTotal+" number of status transitions retained across all the Edge stacks, the oldest are evicted first").Envar(EnvKeyEdgeStackEventHistoryTotal).Default(agent.DefaultEdgeStackEventHistoryTotal).Int()
+	fEdgeStackEventHistoryFile         = kingpin.Flag("edge-stack-event-history-file", EnvKeyEdgeStackEventHistoryFile+" path of the log used to persist the Edge stack status transitions across restarts, keep empty to only retain them in memory").Envar(EnvKeyEdgeStackEventHistoryFile).String()
+	fEdgeStackEventHistoryFileMaxSize  = kingpin.Flag("edge-stack-event-history-file-max-size", EnvKeyEdgeStackEventHistoryFileMaxSize+" size in bytes after which the Edge stack events log is rotated, a single rotated log is kept").Envar(EnvKeyEdgeStackEventHistoryFileMaxSize).Default(agent.DefaultEdgeStackEventHistoryFileMaxSize).Int64()
+	fEdgeStackAdmissionEndpoint        = kingpin.Flag("edge-stack-admission-endpoint", EnvKeyEdgeStackAdmissionEndpoint+" URL of the policy endpoint approving each Edge stack deployment").Envar(EnvKeyEdgeStackAdmissionEndpoint).String()
+	fEdgeStackAdmissionTimeout         = kingpin.Flag("edge-stack-admission-timeout", EnvKeyEdgeStackAdmissionTimeout+" maximum duration of an Edge stack admission check").Envar(EnvKeyEdgeStackAdmissionTimeout).Default(agent.DefaultEdgeStackAdmissionTimeout).Duration()
+	fEdgeStackAdmissionFailOpen        = kingpin.Flag("edge-stack-admission-fail-open", EnvKeyEdgeStackAdmissionFailOpen+" deploy the Edge stacks whose admission cannot be checked instead of denying them").Envar(EnvKeyEdgeStackAdmissionFailOpen).Default("false").Bool()
+	fEdgeStackNormalizeLineEndings     = kingpin.Flag("edge-stack-normalize-line-endings", EnvKeyEdgeStackNormalizeLineEndings+" convert the CRLF line endings of the Edge stack files to LF before writing them").Envar(EnvKeyEdgeStackNormalizeLineEndings).Default("false").Bool()
+	fEdgeStackNetworkDriver            = kingpin.Flag("edge-stack-network-driver", EnvKeyEdgeStackNetworkDriver+" driver of the default network injected in the Edge stack compose files that do not define it (e.g. macvlan)").Envar(EnvKeyEdgeStackNetworkDriver).String()
+	fEdgeStackNetworkDriverOpts        = kingpin.Flag("edge-stack-network-driver-opts", EnvKeyEdgeStackNetworkDriverOpts+" comma separated list of key=value driver options of the injected default network (e.g. parent=eth0)").Envar(EnvKeyEdgeStackNetworkDriverOpts).String()
+	fEdgeStackDeployAfterDelete        = kingpin.Flag("edge-stack-deploy-after-delete", EnvKeyEdgeStackDeployAfterDelete+" defines whether a new deployment of an Edge stack whose deletion is pending supersedes the deletion or waits for it to complete, a deletion in progress is always completed first (defaults to supersede)").Envar(EnvKeyEdgeStackDeployAfterDelete).Default("supersede").Enum("supersede", "wait")
+	fEdgeStackKubernetesResourcePrefix = kingpin.Flag("edge-stack-kubernetes-resource-prefix", EnvKeyEdgeStackKubernetesResourcePrefix+" prefix of the name of the Kubernetes resources created by the agent, such as the image pull secrets").Envar(EnvKeyEdgeStackKubernetesResourcePrefix).String()
+	fEdgeStackKubernetesResourceLabels = kingpin.Flag("edge-stack-kubernetes-resource-labels", EnvKeyEdgeStackKubernetesResourceLabels+" comma separated list of key=value labels set on the Kubernetes resources created by the agent").Envar(EnvKeyEdgeStackKubernetesResourceLabels).String()
+	fEdgeStackLazyPull                 = kingpin.Flag("edge-stack-lazy-pull", EnvKeyEdgeStackLazyPull+" skip pulling the Edge stack images before their deployment when the Docker engine uses the containerd image store with a lazy pulling snapshotter (stargz, soci or nydus)").Envar(EnvKeyEdgeStackLazyPull).Default("false").Bool()
+	fEdgeStackRemoveUnknownStacks      = kingpin.Flag("edge-stack-remove-unknown", EnvKeyEdgeStackRemoveUnknownStacks+" remove the Edge stacks whose status update is rejected because they no longer exist on the Portainer server").Envar(EnvKeyEdgeStackRemoveUnknownStacks).Default("true").Bool()
+	fEdgeStackOperationConcurrency     = kingpin.Flag("edge-stack-operation-concurrency", EnvKeyEdgeStackOperationConcurrency+" maximum number of Edge stack pulls, deployments and removals running at the same time, 0 does not limit them").Envar(EnvKeyEdgeStackOperationConcurrency).Default("0").Int()
+	fEdgeStackFilesPath                = kingpin.Flag("edge-stack-files-path", EnvKeyEdgeStackFilesPath+" directory the Edge stack files are written to, it must be writable (e.g. a tmpfs mount on read-only systems)").Envar(EnvKeyEdgeStackFilesPath).Default(agent.EdgeStackFilesPath).String()
+	fEdgeStackCoalesceVersions         = kingpin.Flag("edge-stack-coalesce-versions", EnvKeyEdgeStackCoalesceVersions+" skip the deployment of an Edge stack version that was superseded by a newer version before being deployed").Envar(EnvKeyEdgeStackCoalesceVersions).Default("true").Bool()
+	fEdgeStackMapResourceLimits        = kingpin.Flag("edge-stack-map-resource-limits", EnvKeyEdgeStackMapResourceLimits+" translate the deploy.resources limits and reservations of the Edge stack services to container settings on Docker standalone, so that they are enforced").Envar(EnvKeyEdgeStackMapResourceLimits).Default("false").Bool()
+	fEdgeStackDeployDiff               = kingpin.Flag("edge-stack-deploy-diff", EnvKeyEdgeStackDeployDiff+" report the changes the Edge stack deployments apply (report), or only report them without deploying the stacks (only)").Envar(EnvKeyEdgeStackDeployDiff).Default("disabled").Enum("disabled", "report", "only")
+	fEdgeStackImagePrune               = kingpin.Flag("edge-stack-image-prune", EnvKeyEdgeStackImagePrune+" images removed after a successful Edge stack deployment: disabled, dangling, unused (pulled for an Edge stack, not used by any container nor referenced by an Edge stack) or dry-run (reports the unused images to Portainer in the stack status without removing them)").Envar(EnvKeyEdgeStackImagePrune).Default("disabled").Enum("disabled", "dangling", "unused", "dry-run")
+	fEdgeStackRemoveRenamedStacks      = kingpin.Flag("edge-stack-remove-renamed", EnvKeyEdgeStackRemoveRenamedStacks+" remove the deployment of a renamed Edge stack under its previous name before deploying it under the new name").Envar(EnvKeyEdgeStackRemoveRenamedStacks).Default("true").Bool()
+	fEdgeStackTransformConcurrency     = kingpin.Flag("edge-stack-transform-concurrency", EnvKeyEdgeStackTransformConcurrency+" number of documents of a Kubernetes Edge stack manifest transformed at the same time when adding the image pull secrets").Envar(EnvKeyEdgeStackTransformConcurrency).Default("1").Int()
+	fEdgeStackCredentialHelperFallback = kingpin.Flag("edge-stack-credential-helper-fallback", EnvKeyEdgeStackCredentialHelperFallback+" pass the registry credentials directly to the Docker engine when pulling the Edge stack images through the credential helper fails").Envar(EnvKeyEdgeStackCredentialHelperFallback).Default("true").Bool()
+	fEdgeStackAtomicWrites             = kingpin.Flag("edge-stack-atomic-writes", EnvKeyEdgeStackAtomicWrites+" write the Edge stack files to a temporary file renamed into place, so that a deployment never reads a partially written file").Envar(EnvKeyEdgeStackAtomicWrites).Default("true").Bool()
+	fEdgeStackCheckBindMounts          = kingpin.Flag("edge-stack-check-bind-mounts", EnvKeyEdgeStackCheckBindMounts+" refuse to deploy an Edge stack when a host path bind mounted by its services does not exist, instead of letting Docker create an empty directory").Envar(EnvKeyEdgeStackCheckBindMounts).Default("false").Bool()
+	fEdgeStackRetryStatusInterval      = kingpin.Flag("edge-stack-retry-status-interval", EnvKeyEdgeStackRetryStatusInterval+" minimum interval between two reports of the retries of an Edge stack to Portainer, 0 does not report them").Envar(EnvKeyEdgeStackRetryStatusInterval).Default("1m").Duration()
+	fEdgeStackEnvFiles                 = kingpin.Flag("edge-stack-env-files", EnvKeyEdgeStackEnvFiles+" handling of the env files provided with the Edge stacks: disabled ignores them, write writes them next to the compose file, strict also refuses to deploy a stack referencing a missing env file").Envar(EnvKeyEdgeStackEnvFiles).Default("strict").Enum("disabled", "write", "strict")
+	fEdgeStackEmptyStack               = kingpin.Flag("edge-stack-empty-stack", EnvKeyEdgeStackEmptyStack+" handling of the Edge stacks defining no services (no workloads for Kubernetes, no task groups for Nomad): ignore, warn or error").Envar(EnvKeyEdgeStackEmptyStack).Default("warn").Enum("ignore", "warn", "error")
+	fEdgeStackEngineAssetsPaths        = kingpin.Flag("edge-stack-engine-assets-paths", EnvKeyEdgeStackEngineAssetsPaths+" comma separated list of engine=path pairs overriding the assets path holding the deployment binaries of an engine (e.g. kubernetes=/opt/kubectl/bin), the engines are docker-standalone, docker-swarm, kubernetes and nomad").Envar(EnvKeyEdgeStackEngineAssetsPaths).String()
+	fEdgeStackNodeLabels               = kingpin.Flag("edge-stack-node-labels", EnvKeyEdgeStackNodeLabels+" comma separated list of key=value labels describing the device, an Edge stack with a node selector is only deployed when the device has all of its labels (e.g. zone=eu,gpu=true)").Envar(EnvKeyEdgeStackNodeLabels).String()
+	fEdgeStackReconcileTimeout         = kingpin.Flag("edge-stack-reconcile-timeout", EnvKeyEdgeStackReconcileTimeout+" maximum duration of the reconciliation of the Edge stacks returned by a poll, the stacks not processed in time are processed by the next poll, 0 does not limit it").Envar(EnvKeyEdgeStackReconcileTimeout).Default("0s").Duration()
+	fEdgeStackAnonymousPullFirst       = kingpin.Flag("edge-stack-anonymous-pull-first", EnvKeyEdgeStackAnonymousPullFirst+" try to access the registries anonymously before using the registry credentials when the agent pulls the Edge stack images or their manifests itself, for the registries serving public and private images from the same host").Envar(EnvKeyEdgeStackAnonymousPullFirst).Default("false").Bool()
+	fEdgeStackRemovePreviousNamespace  = kingpin.Flag("edge-stack-remove-previous-namespace", EnvKeyEdgeStackRemovePreviousNamespace+" remove the resources of a Kubernetes Edge stack from its previous namespace when its namespace changes").Envar(EnvKeyEdgeStackRemovePreviousNamespace).Default("true").Bool()
+	fEdgeStackWarmupImages             = kingpin.Flag("edge-stack-warmup-images", EnvKeyEdgeStackWarmupImages+" comma separated list of images pulled when the agent starts, before any Edge stack deployment").Envar(EnvKeyEdgeStackWarmupImages).String()
+	fEdgeStackWarmupKnownStacks        = kingpin.Flag("edge-stack-warmup-known-stacks", EnvKeyEdgeStackWarmupKnownStacks+" pull the images of the Edge stack files found in the stack files path when the agent starts").Envar(EnvKeyEdgeStackWarmupKnownStacks).Default("false").Bool()
+	fEdgeStackQueuePositionInterval    = kingpin.Flag("edge-stack-queue-position-interval", EnvKeyEdgeStackQueuePositionInterval+" minimum interval between two reports of the position of a pending Edge stack in the deployment queue, 0 does not report it").Envar(EnvKeyEdgeStackQueuePositionInterval).Default("30s").Duration()
+	fEdgeStackSecretFiles              = kingpin.Flag("edge-stack-secret-files", EnvKeyEdgeStackSecretFiles+" handling of the secret files provided with the Edge stacks: disabled ignores them, write writes them next to the compose file, strict also refuses to deploy a stack whose file secrets are missing").Envar(EnvKeyEdgeStackSecretFiles).Default("strict").Enum("disabled", "write", "strict")
+	fEdgeStackEngineWorkers            = kingpin.Flag("edge-stack-engine-workers", EnvKeyEdgeStackEngineWorkers+" run the deployments of each engine on a dedicated worker, so that a slow engine does not hold back the deployments to the other engines").Envar(EnvKeyEdgeStackEngineWorkers).Default("false").Bool()
+	fEdgeStackVersionMismatch          = kingpin.Flag("edge-stack-version-mismatch", EnvKeyEdgeStackVersionMismatch+" handling of an Edge stack configuration whose version differs from the version being processed: defer waits for the next poll, deploy deploys it anyway").Envar(EnvKeyEdgeStackVersionMismatch).Default("defer").Enum("defer", "deploy")
+	fEdgeStackNoEngine                 = kingpin.Flag("edge-stack-no-engine", EnvKeyEdgeStackNoEngine+" handling of the Edge stacks received before the engine of the agent is set: wait holds them back until it is set, fail processes them and they fail to deploy").Envar(EnvKeyEdgeStackNoEngine).Default("wait").Enum("wait", "fail")
+	fEdgeStackIndex                    = kingpin.Flag("edge-stack-index", EnvKeyEdgeStackIndex+" index the pending and deploying Edge stacks, so that the deployment loop does not iterate over all the stacks on agents managing many stacks").Envar(EnvKeyEdgeStackIndex).Default("false").Bool()
+	fEdgeStackOutputLimit              = kingpin.Flag("edge-stack-output-limit", EnvKeyEdgeStackOutputLimit+" maximum size in bytes of the deployer output captured and reported with the Edge stack statuses, the output beyond it is elided from its middle, 0 leaves it unbounded").Envar(EnvKeyEdgeStackOutputLimit).Default("65536").Int()
+	fEdgeStackPartialPoll              = kingpin.Flag("edge-stack-partial-poll-threshold", EnvKeyEdgeStackPartialPoll+" percentage of the managed Edge stacks missing from a poll response from which the response is deemed partial and the removals wait for the next poll to confirm them, 0 disables the check").Envar(EnvKeyEdgeStackPartialPoll).Default("50").Int()
+	fEdgeStackWorkers                  = kingpin.Flag("edge-stack-workers", EnvKeyEdgeStackWorkers+" number of Edge stacks pulled and deployed in parallel, per engine when the engine workers are enabled").Envar(EnvKeyEdgeStackWorkers).Default("1").Int()
+	fEdgeStackRetryBackoff             = kingpin.Flag("edge-stack-retry-backoff", EnvKeyEdgeStackRetryBackoff+" delay before the first retry of a failed Edge stack images pull, doubling with each retry, 0 retries on the next iterations instead").Envar(EnvKeyEdgeStackRetryBackoff).Default("10s").Duration()
+	fEdgeStackRetryBackoffMax          = kingpin.Flag("edge-stack-retry-backoff-max", EnvKeyEdgeStackRetryBackoffMax+" maximum delay between two retries of a failed Edge stack images pull").Envar(EnvKeyEdgeStackRetryBackoffMax).Default("10m").Duration()
+	fEdgeStackRetryMaxRetries          = kingpin.Flag("edge-stack-retry-max-retries", EnvKeyEdgeStackRetryMaxRetries+" number of retries of a failed Edge stack images pull after which the stack is reported in error, when the backoff is enabled").Envar(EnvKeyEdgeStackRetryMaxRetries).Default("1000").Int()
+	fEdgeStackValidate                 = kingpin.Flag("edge-stack-validate", EnvKeyEdgeStackValidate+" validate the files of the Edge stacks with their deployer before deploying them, the stacks rejected by the validation are not deployed").Envar(EnvKeyEdgeStackValidate).Default("false").Bool()
+	fEdgeStackRollback                 = kingpin.Flag("edge-stack-rollback", EnvKeyEdgeStackRollback+" keep the files of the last Edge stack version deployed successfully and deploy it again when the deployment of a newer version fails").Envar(EnvKeyEdgeStackRollback).Default("false").Bool()
+	fEdgeStackHealthCheckTimeout       = kingpin.Flag("edge-stack-health-check-timeout", EnvKeyEdgeStackHealthCheckTimeout+" maximum duration to wait for the workloads of a deployed Edge stack to be healthy before reporting it, 0 reports the stack as deployed once the deployer succeeded").Envar(EnvKeyEdgeStackHealthCheckTimeout).Default("0s").Duration()
+	fEdgeStackDeployLogs               = kingpin.Flag("edge-stack-deploy-logs", EnvKeyEdgeStackDeployLogs+" maximum size in bytes of the tail of the deployer output sent to Portainer with the status of each Edge stack deployment, 0 disables it").Envar(EnvKeyEdgeStackDeployLogs).Default("4096").Int()
+	fEdgeStackArchiveMaxSize           = kingpin.Flag("edge-stack-archive-max-size", EnvKeyEdgeStackArchiveMaxSize+" maximum size in bytes of the content extracted from the archive of an Edge stack folder, 0 leaves it unbounded").Envar(EnvKeyEdgeStackArchiveMaxSize).Default("104857600").Int64()
+	fEdgeStackRedeployWebhook          = kingpin.Flag("edge-stack-redeploy-webhook", EnvKeyEdgeStackRedeployWebhook+" enable the /edge/stacks/{id}/redeploy endpoint, authenticated with the Edge key, redeploying an Edge stack with its images pulled again without waiting for the next poll").Envar(EnvKeyEdgeStackRedeployWebhook).Default("false").Bool()
+	fEdgeStackWindowBypass             = kingpin.Flag("edge-stack-window-bypass", EnvKeyEdgeStackWindowBypass+" deploy the new Edge stacks outside of their deployment windows, which then only apply to their updates").Envar(EnvKeyEdgeStackWindowBypass).Default("false").Bool()
+	fEdgeStackProgress                 = kingpin.Flag("edge-stack-progress", EnvKeyEdgeStackProgress+" report the phases of the Edge stack deployments to Portainer, from the files written to the health check").Envar(EnvKeyEdgeStackProgress).Default("false").Bool()
+	fEdgeStackDiskQuota                = kingpin.Flag("edge-stack-disk-quota", EnvKeyEdgeStackDiskQuota+" maximum size in bytes of the Edge stack files path, the orphaned and versioned stack folders are pruned to stay below it, 0 disables the quota").Envar(EnvKeyEdgeStackDiskQuota).Default("0").Int64()
+	fEdgeStackPullBandwidthLimit       = kingpin.Flag("edge-stack-pull-bandwidth-limit", EnvKeyEdgeStackPullBandwidthLimit+" approximate maximum rate in bytes per second of the image pulls of the Edge stacks deployed to a Docker engine, 0 leaves them unbounded").Envar(EnvKeyEdgeStackPullBandwidthLimit).Default("0").Int64()
+	fEdgeStackPrePullWorkers           = kingpin.Flag("edge-stack-pre-pull-workers", EnvKeyEdgeStackPrePullWorkers+" number of Edge stacks whose images are pre-pulled at the same time ahead of their deployment, 0 pre-pulls them during the deployment").Envar(EnvKeyEdgeStackPrePullWorkers).Default("0").Int()
+	fEdgeStackDriftCheckInterval       = kingpin.Flag("edge-stack-drift-check-interval", EnvKeyEdgeStackDriftCheckInterval+" interval used to check that the resources of the deployed Edge stacks still exist, 0 disables the drift monitor").Envar(EnvKeyEdgeStackDriftCheckInterval).Default("0s").Duration()
+	fEdgeStackRemovePurge              = kingpin.Flag("edge-stack-remove-purge", EnvKeyEdgeStackRemovePurge+" purge the Nomad jobs of the removed Edge stacks instead of only stopping them").Envar(EnvKeyEdgeStackRemovePurge).Default("true").Bool()
+	fEdgeStackRolloutTimeout           = kingpin.Flag("edge-stack-rollout-timeout", EnvKeyEdgeStackRolloutTimeout+" maximum duration to wait for the workloads of the Kubernetes Edge stacks to roll out, 0 does not wait").Envar(EnvKeyEdgeStackRolloutTimeout).Default("0s").Duration()
+	fEdgeStackRegistryCredentialsTTL   = kingpin.Flag("edge-stack-registry-credentials-ttl", EnvKeyEdgeStackRegistryCredentialsTTL+" duration after which the registry credentials of the Edge stacks are fetched again from Portainer before use, 0 never refreshes them").Envar(EnvKeyEdgeStackRegistryCredentialsTTL).Default("0s").Duration()
+	fEdgeStackImageVerifyKeys          = kingpin.Flag("edge-stack-image-verify-keys", EnvKeyEdgeStackImageVerifyKeys+" comma separated list of cosign public keys (paths or KMS references) the images of the Edge stacks must be signed with, the signatures are verified before the pull when it is set").Envar(EnvKeyEdgeStackImageVerifyKeys).String()
+
+	// Nomad proxy
+	fNomadProxyDialTimeout           = kingpin.Flag("nomad-proxy-dial-timeout", EnvKeyNomadProxyDialTimeout+" maximum duration of the connection to the Nomad API").Envar(EnvKeyNomadProxyDialTimeout).Default(agent.DefaultNomadProxyDialTimeout).Duration()
+	fNomadProxyTLSHandshakeTimeout   = kingpin.Flag("nomad-proxy-tls-handshake-timeout", EnvKeyNomadProxyTLSHandshakeTimeout+" maximum duration of the TLS handshake with the Nomad API").Envar(EnvKeyNomadProxyTLSHandshakeTimeout).Default(agent.DefaultNomadProxyTLSHandshakeTimeout).Duration()
+	fNomadProxyResponseHeaderTimeout = kingpin.Flag("nomad-proxy-response-header-timeout", EnvKeyNomadProxyResponseHeaderTimeout+" maximum duration to wait for the response headers of the Nomad API").Envar(EnvKeyNomadProxyResponseHeaderTimeout).Default(agent.DefaultNomadProxyResponseHeaderTimeout).Duration()
+	fNomadProxyIdleConnTimeout       = kingpin.Flag("nomad-proxy-idle-conn-timeout", EnvKeyNomadProxyIdleConnTimeout+" duration after which an idle connection to the Nomad API is closed").Envar(EnvKeyNomadProxyIdleConnTimeout).Default(agent.DefaultNomadProxyIdleConnTimeout).Duration()
+	fNomadProxyMaxIdleConns          = kingpin.Flag("nomad-proxy-max-idle-conns", EnvKeyNomadProxyMaxIdleConns+" maximum number of idle connections kept to the Nomad API").Envar(EnvKeyNomadProxyMaxIdleConns).Default(agent.DefaultNomadProxyMaxIdleConns).Int()
+	fNomadProxyRetries               = kingpin.Flag("nomad-proxy-retries", EnvKeyNomadProxyRetries+" number of times an idempotent request is retried when the Nomad API cannot be reached").Envar(EnvKeyNomadProxyRetries).Default(agent.DefaultNomadProxyRetries).Int()
+	fNomadProxyUnreachableCache      = kingpin.Flag("nomad-proxy-unreachable-cache", EnvKeyNomadProxyUnreachableCache+" duration the Nomad server is reported unreachable without being dialed again after a connection failure, 0 dials it for every request").Envar(EnvKeyNomadProxyUnreachableCache).Default(agent.DefaultNomadProxyUnreachableCache).Duration()
 
 	// mTLS edge agent certs
 	fSSLCert           = kingpin.Flag("sslcert", "Path to the SSL certificate used to identify the agent to Portainer").Envar(EnvKeySSLCert).String()
@@ -78,6 +267,44 @@ var (
 func (parser *EnvOptionParser) Options() (*agent.Options, error) {
 	kingpin.Parse()
 
+	imageMirrors, err := parseKeyValueList(*fEdgeStackImageMirrors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackImageMirrors, err)
+	}
+
+	minDeployerVersions, err := parseKeyValueList(*fEdgeStackMinDeployerVersions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackMinDeployerVersions, err)
+	}
+
+	if *fEdgeStackNetworkDriver != "" && !networkDriverRegexp.MatchString(*fEdgeStackNetworkDriver) {
+		return nil, fmt.Errorf("invalid %s value: %q is not a valid network driver", EnvKeyEdgeStackNetworkDriver, *fEdgeStackNetworkDriver)
+	}
+
+	networkDriverOpts, err := parseKeyValueList(*fEdgeStackNetworkDriverOpts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackNetworkDriverOpts, err)
+	}
+
+	if !kubernetesNamePrefixRegexp.MatchString(*fEdgeStackKubernetesResourcePrefix) {
+		return nil, fmt.Errorf("invalid %s value: %q is not a valid Kubernetes name prefix", EnvKeyEdgeStackKubernetesResourcePrefix, *fEdgeStackKubernetesResourcePrefix)
+	}
+
+	kubernetesResourceLabels, err := parseKeyValueList(*fEdgeStackKubernetesResourceLabels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackKubernetesResourceLabels, err)
+	}
+
+	engineAssetsPaths, err := parseKeyValueList(*fEdgeStackEngineAssetsPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackEngineAssetsPaths, err)
+	}
+
+	nodeLabels, err := parseKeyValueList(*fEdgeStackNodeLabels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", EnvKeyEdgeStackNodeLabels, err)
+	}
+
 	return &agent.Options{
 		AssetsPath:            *fAssetsPath,
 		AgentServerAddr:       fAgentServerAddr.String(),
@@ -96,6 +323,8 @@ func (parser *EnvOptionParser) Options() (*agent.Options, error) {
 		EdgeInactivityTimeout: *fEdgeInactivityTimeout,
 		EdgeInsecurePoll:      *fEdgeInsecurePoll,
 		EdgeTunnel:            *fEdgeTunnel,
+		EdgeClientConcurrency: *fEdgeClientConcurrency,
+		EdgeRegistrySocket:    *fEdgeRegistrySocket,
 		HealthCheck:           *fHealthCheck,
 		LogLevel:              *fLogLevel,
 		LogMode:               *fLogMode,
@@ -105,5 +334,168 @@ func (parser *EnvOptionParser) Options() (*agent.Options, error) {
 		SSLCACert:             *fSSLCACert,
 		UpdateID:              *fUpdateID,
 		CertRetryInterval:     *fCertRetryInterval,
+
+		EdgeStackImageMirrors:             imageMirrors,
+		EdgeStackImageMirrorFallback:      *fEdgeStackImageMirrorFallback,
+		EdgeStackMQTTBrokerURL:            *fEdgeStackMQTTBrokerURL,
+		EdgeStackMQTTTopic:                *fEdgeStackMQTTTopic,
+		EdgeStackFolderCleanup:            *fEdgeStackFolderCleanup,
+		EdgeStackFolderCleanupAllow:       parseList(*fEdgeStackFolderCleanupAllow),
+		EdgeStackFolderCleanupDeny:        parseList(*fEdgeStackFolderCleanupDeny),
+		EdgeStackSharedFilesPath:          *fEdgeStackSharedFilesPath,
+		EdgeStackMinDeployerVersions:      minDeployerVersions,
+		EdgeStackOTLPEndpoint:             *fEdgeStackOTLPEndpoint,
+		EdgeStackDeleteConcurrency:        *fEdgeStackDeleteConcurrency,
+		EdgeStackStripComposeVersion:      *fEdgeStackStripComposeVersion,
+		EdgeStackHealthMonitorInterval:    *fEdgeStackHealthMonitorInterval,
+		EdgeStackPostReconcileHook:        *fEdgeStackPostReconcileHook,
+		EdgeStackPostReconcileHookTimeout: *fEdgeStackPostReconcileHookTimeout,
+		EdgeStackCheckImageDiskSpace:      *fEdgeStackCheckImageDiskSpace,
+		EdgeStackImageStorePath:           *fEdgeStackImageStorePath,
+		EdgeStackEventHistoryPerStack:     *fEdgeStackEventHistoryPerStack,
+		EdgeStackEventHistoryTotal:        *fEdgeStackEventHistoryTotal,
+		EdgeStackEventHistoryFile:         *fEdgeStackEventHistoryFile,
+		EdgeStackEventHistoryFileMaxSize:  *fEdgeStackEventHistoryFileMaxSize,
+		EdgeStackAdmissionEndpoint:        *fEdgeStackAdmissionEndpoint,
+		EdgeStackAdmissionTimeout:         *fEdgeStackAdmissionTimeout,
+		EdgeStackAdmissionFailOpen:        *fEdgeStackAdmissionFailOpen,
+		EdgeStackNormalizeLineEndings:     *fEdgeStackNormalizeLineEndings,
+		EdgeStackNetworkDriver:            *fEdgeStackNetworkDriver,
+		EdgeStackNetworkDriverOpts:        networkDriverOpts,
+		EdgeStackDeployAfterDelete:        *fEdgeStackDeployAfterDelete,
+		EdgeStackKubernetesResourcePrefix: *fEdgeStackKubernetesResourcePrefix,
+		EdgeStackKubernetesResourceLabels: kubernetesResourceLabels,
+		EdgeStackLazyPull:                 *fEdgeStackLazyPull,
+		EdgeStackRemoveUnknownStacks:      *fEdgeStackRemoveUnknownStacks,
+		EdgeStackOperationConcurrency:     *fEdgeStackOperationConcurrency,
+		EdgeStackFilesPath:                *fEdgeStackFilesPath,
+		EdgeStackCoalesceVersions:         *fEdgeStackCoalesceVersions,
+		EdgeStackMapResourceLimits:        *fEdgeStackMapResourceLimits,
+		EdgeStackDeployDiff:               *fEdgeStackDeployDiff,
+		EdgeStackImagePrune:               *fEdgeStackImagePrune,
+		EdgeStackRemoveRenamedStacks:      *fEdgeStackRemoveRenamedStacks,
+		EdgeStackTransformConcurrency:     *fEdgeStackTransformConcurrency,
+		EdgeStackCredentialHelperFallback: *fEdgeStackCredentialHelperFallback,
+		EdgeStackAtomicWrites:             *fEdgeStackAtomicWrites,
+		EdgeStackCheckBindMounts:          *fEdgeStackCheckBindMounts,
+		EdgeStackRetryStatusInterval:      *fEdgeStackRetryStatusInterval,
+		EdgeStackEnvFiles:                 *fEdgeStackEnvFiles,
+		EdgeStackEmptyStack:               *fEdgeStackEmptyStack,
+		EdgeStackEngineAssetsPaths:        engineAssetsPaths,
+		EdgeStackNodeLabels:               nodeLabels,
+		EdgeStackReconcileTimeout:         *fEdgeStackReconcileTimeout,
+		EdgeStackAnonymousPullFirst:       *fEdgeStackAnonymousPullFirst,
+		EdgeStackRemovePreviousNamespace:  *fEdgeStackRemovePreviousNamespace,
+		EdgeStackWarmupImages:             parseList(*fEdgeStackWarmupImages),
+		EdgeStackWarmupKnownStacks:        *fEdgeStackWarmupKnownStacks,
+		EdgeStackQueuePositionInterval:    *fEdgeStackQueuePositionInterval,
+		EdgeStackSecretFiles:              *fEdgeStackSecretFiles,
+		EdgeStackEngineWorkers:            *fEdgeStackEngineWorkers,
+		EdgeStackVersionMismatch:          *fEdgeStackVersionMismatch,
+		EdgeStackNoEngine:                 *fEdgeStackNoEngine,
+		EdgeStackIndex:                    *fEdgeStackIndex,
+		EdgeStackOutputLimit:              *fEdgeStackOutputLimit,
+		EdgeStackPartialPoll:              *fEdgeStackPartialPoll,
+		EdgeStackWorkers:                  *fEdgeStackWorkers,
+		EdgeStackRetryBackoff:             *fEdgeStackRetryBackoff,
+		EdgeStackRetryBackoffMax:          *fEdgeStackRetryBackoffMax,
+		EdgeStackRetryMaxRetries:          *fEdgeStackRetryMaxRetries,
+		EdgeStackValidate:                 *fEdgeStackValidate,
+		EdgeStackRollback:                 *fEdgeStackRollback,
+		EdgeStackHealthCheckTimeout:       *fEdgeStackHealthCheckTimeout,
+		EdgeStackDeployLogs:               *fEdgeStackDeployLogs,
+		EdgeStackArchiveMaxSize:           *fEdgeStackArchiveMaxSize,
+		EdgeStackRedeployWebhook:          *fEdgeStackRedeployWebhook,
+		EdgeStackWindowBypass:             *fEdgeStackWindowBypass,
+		EdgeStackProgress:                 *fEdgeStackProgress,
+		EdgeStackDiskQuota:                *fEdgeStackDiskQuota,
+		EdgeStackPullBandwidthLimit:       *fEdgeStackPullBandwidthLimit,
+		EdgeStackPrePullWorkers:           *fEdgeStackPrePullWorkers,
+		EdgeStackDriftCheckInterval:       *fEdgeStackDriftCheckInterval,
+		EdgeStackRemovePurge:              *fEdgeStackRemovePurge,
+		EdgeStackRolloutTimeout:           *fEdgeStackRolloutTimeout,
+		EdgeStackRegistryCredentialsTTL:   *fEdgeStackRegistryCredentialsTTL,
+		EdgeStackImageVerifyKeys:          parseList(*fEdgeStackImageVerifyKeys),
+		NomadProxyDialTimeout:             *fNomadProxyDialTimeout,
+		NomadProxyTLSHandshakeTimeout:     *fNomadProxyTLSHandshakeTimeout,
+		NomadProxyResponseHeaderTimeout:   *fNomadProxyResponseHeaderTimeout,
+		NomadProxyIdleConnTimeout:         *fNomadProxyIdleConnTimeout,
+		NomadProxyMaxIdleConns:            *fNomadProxyMaxIdleConns,
+		NomadProxyRetries:                 *fNomadProxyRetries,
+		NomadProxyUnreachableCache:        *fNomadProxyUnreachableCache,
+
+		OptionSources: optionSources(),
 	}, nil
 }
+
+// optionSources returns the source of each option (default, env or flag), indexed by environment variable
+func optionSources() map[string]string {
+	sources := map[string]string{}
+
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		if flag.Envar == "" {
+			continue
+		}
+
+		sources[flag.Envar] = optionSource(flag.Name, flag.Envar)
+	}
+
+	return sources
+}
+
+func optionSource(flagName, envKey string) string {
+	for _, arg := range os.Args[1:] {
+		if arg == "--"+flagName || arg == "--no-"+flagName || strings.HasPrefix(arg, "--"+flagName+"=") {
+			return "flag"
+		}
+	}
+
+	if _, ok := os.LookupEnv(envKey); ok {
+		return "env"
+	}
+
+	return "default"
+}
+
+// parseList parses a comma separated list of values
+func parseList(value string) []string {
+	values := []string{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
+
+// networkDriverRegexp matches the name of a Docker network driver, including the plugin drivers
+var networkDriverRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-/:]*$`)
+
+// kubernetesNamePrefixRegexp matches a prefix that keeps the resource names valid DNS subdomains
+var kubernetesNamePrefixRegexp = regexp.MustCompile(`^([a-z0-9][a-z0-9.\-]*)?$`)
+
+// parseKeyValueList parses a comma separated list of key=value pairs
+func parseKeyValueList(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, val, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+		if !ok || key == "" || val == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", item)
+		}
+
+		pairs[key] = val
+	}
+
+	return pairs, nil
+}